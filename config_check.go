@@ -0,0 +1,136 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// checkConfiguration loads the policies and the OAS, validates the policies referenced by the OAS
+// and builds the evaluators, without starting the server. A summary of the routes and policies
+// is written to w, while the returned error names the first item failing the check.
+func checkConfiguration(env config.EnvironmentVariables, log *logrus.Logger, w io.Writer) error {
+	opaModuleConfig, err := loadConfiguredPolicies(env)
+	if err != nil {
+		return err
+	}
+
+	oas, err := loadOASFromFileOrNetwork(log, env)
+	if err != nil {
+		return fmt.Errorf("failed OAS load: %s", err.Error())
+	}
+	if err := requireNonEmptyOAS(oas, env); err != nil {
+		return err
+	}
+	if err := applySecuritySchemePolicies(oas, env); err != nil {
+		return err
+	}
+
+	if err := validatePolicies(oas, opaModuleConfig); err != nil {
+		return err
+	}
+
+	mongoClient, err := mongoclient.NewMongoClient(env, log)
+	if err != nil {
+		return fmt.Errorf("failed MongoDB setup: %s", err.Error())
+	}
+	if mongoClient != nil {
+		defer mongoClient.Disconnect()
+	}
+
+	ctx := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoClient), logrus.NewEntry(log))
+	evaluators, err := setupEvaluators(ctx, mongoClient, oas, opaModuleConfig, env)
+	if err != nil {
+		return fmt.Errorf("failed evaluators setup: %s", err.Error())
+	}
+
+	writeConfigurationSummary(w, oas, opaModuleConfig, evaluators)
+	return nil
+}
+
+func loadConfiguredPolicies(env config.EnvironmentVariables) (*OPAModuleConfig, error) {
+	if env.OPABundleURL == "" {
+		opaModuleConfig, err := loadPoliciesFromDirectory(env.OPAModulesDirectory, env.OPADataFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file read from %s: %s", env.OPAModulesDirectory, err.Error())
+		}
+		return opaModuleConfig, nil
+	}
+
+	bundleLoader, err := newPoliciesBundleLoader(env)
+	if err != nil {
+		return nil, err
+	}
+	opaModuleConfig, err := bundleLoader.load(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed policies bundle load from %s: %s", env.OPABundleURL, err.Error())
+	}
+	return opaModuleConfig, nil
+}
+
+func writeConfigurationSummary(w io.Writer, oas *OpenAPISpec, opaModuleConfig *OPAModuleConfig, evaluators PartialResultsEvaluators) {
+	paths := make([]string, 0, len(oas.Paths))
+	for path := range oas.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Fprintln(w, "Routes:")
+	for _, path := range paths {
+		verbs := make([]string, 0, len(oas.Paths[path]))
+		for verb := range oas.Paths[path] {
+			verbs = append(verbs, verb)
+		}
+		sort.Strings(verbs)
+		for _, verb := range verbs {
+			permission := oas.Paths[path][verb].PermissionV2
+			policies := "no policy"
+			if permission != nil {
+				policies = fmt.Sprintf("request policy: %s", strings.Join(permission.RequestFlow.allowPolicies(), ","))
+				if permission.RequestFlow.Combinator != "" {
+					policies = fmt.Sprintf("%s (%s)", policies, permission.RequestFlow.Combinator)
+				}
+				if permission.ResponseFlow.PolicyName != "" {
+					policies = fmt.Sprintf("%s, response policy: %s", policies, permission.ResponseFlow.PolicyName)
+				}
+			}
+			fmt.Fprintf(w, "  %s %s -> %s\n", strings.ToUpper(verb), path, policies)
+		}
+	}
+
+	modules := []string{opaModuleConfig.Name}
+	for _, module := range opaModuleConfig.AdditionalModules {
+		modules = append(modules, module.Name)
+	}
+	fmt.Fprintf(w, "Rego modules: %s\n", strings.Join(modules, ", "))
+
+	policyNames := make([]string, 0, len(evaluators))
+	for policyName := range evaluators {
+		policyNames = append(policyNames, policyName)
+	}
+	sort.Strings(policyNames)
+	fmt.Fprintf(w, "Policies: %s\n", strings.Join(policyNames, ", "))
+	fmt.Fprintln(w, "Configuration is valid")
+}
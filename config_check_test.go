@@ -0,0 +1,125 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfiguration(t *testing.T) {
+	log, _ := test.NewNullLogger()
+
+	writeConfiguration := func(t *testing.T, oas, policies string) config.EnvironmentVariables {
+		t.Helper()
+		directory := t.TempDir()
+		oasPath := filepath.Join(directory, "oas.json")
+		require.NoError(t, os.WriteFile(oasPath, []byte(oas), 0600))
+		policiesDirectory := filepath.Join(directory, "policies")
+		require.NoError(t, os.Mkdir(policiesDirectory, 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(policiesDirectory, "policies.rego"), []byte(policies), 0600))
+		return config.EnvironmentVariables{
+			APIPermissionsFilePath: oasPath,
+			OPAModulesDirectory:    policiesDirectory,
+		}
+	}
+
+	oas := `{"paths":{
+		"/users":{
+			"get":{"x-rond":{"requestFlow":{"policyName":"allow"},"responseFlow":{"policyName":"filter_response"}}},
+			"post":{"x-rond":{"requestFlow":{"policyName":"allow"}}}
+		},
+		"/health":{"get":{}}
+	}}`
+
+	t.Run("writes summary of valid configuration", func(t *testing.T) {
+		env := writeConfiguration(t, oas, "package policies\nallow { true }\nfilter_response [body] { body := input.response.body }\n")
+		var summary bytes.Buffer
+
+		require.NoError(t, checkConfiguration(env, log, &summary))
+		require.Equal(t, `Routes:
+  GET /health -> no policy
+  GET /users -> request policy: allow, response policy: filter_response
+  POST /users -> request policy: allow
+Rego modules: policies.rego
+Policies: allow, filter_response
+Configuration is valid
+`, summary.String())
+	})
+
+	t.Run("fails naming the missing policy", func(t *testing.T) {
+		env := writeConfiguration(t, oas, "package policies\nallow { true }\n")
+
+		err := checkConfiguration(env, log, &bytes.Buffer{})
+		require.ErrorIs(t, err, ErrMissingPolicies)
+		require.EqualError(t, err, "missing policies: filter_response (GET /users)")
+	})
+
+	t.Run("fails naming the invalid rego directory", func(t *testing.T) {
+		env := writeConfiguration(t, oas, "package policies\nallow { \n")
+
+		err := checkConfiguration(env, log, &bytes.Buffer{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed rego file read from "+env.OPAModulesDirectory)
+	})
+
+	t.Run("fails on invalid OAS", func(t *testing.T) {
+		env := writeConfiguration(t, "{not a json", "package policies\nallow { true }\n")
+
+		err := checkConfiguration(env, log, &bytes.Buffer{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed OAS load")
+	})
+
+	t.Run("empty OAS", func(t *testing.T) {
+		env := writeConfiguration(t, `{"paths":{}}`, "package policies\nallow { true }\n")
+
+		require.NoError(t, checkConfiguration(env, log, &bytes.Buffer{}), "empty OAS allowed by default")
+
+		env.RequireNonEmptyOAS = true
+		require.ErrorIs(t, checkConfiguration(env, log, &bytes.Buffer{}), ErrEmptyOAS)
+	})
+
+	t.Run("security scheme policies", func(t *testing.T) {
+		env := writeConfiguration(t, `{"paths":{"/orders":{"get":{"security":[{"bearerAuth":[]}]}}}}`, "package policies\nallow { true }\n")
+
+		env.SecuritySchemePolicies = "bearerAuth=allow"
+		require.NoError(t, checkConfiguration(env, log, &bytes.Buffer{}))
+
+		env.SecuritySchemePolicies = "bearerAuth=allow_bearer"
+		require.EqualError(t, checkConfiguration(env, log, &bytes.Buffer{}), "missing policies: allow_bearer (GET /orders)")
+	})
+
+	t.Run("returns exit code", func(t *testing.T) {
+		validEnv := writeConfiguration(t, oas, "package policies\nallow { true }\nfilter_response { true }\n")
+		validEnv.LogLevel = "fatal"
+		var output bytes.Buffer
+		require.Equal(t, 0, runConfigurationCheck(validEnv, &output))
+		require.Contains(t, output.String(), "Configuration is valid")
+
+		invalidEnv := writeConfiguration(t, oas, "package policies\nallow { true }\n")
+		invalidEnv.LogLevel = "fatal"
+		output.Reset()
+		require.Equal(t, 1, runConfigurationCheck(invalidEnv, &output))
+		require.Equal(t, "Configuration is not valid: missing policies: filter_response (GET /users)\n", output.String())
+	})
+}
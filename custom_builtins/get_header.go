@@ -52,3 +52,39 @@ var GetHeaderFunction = rego.Function2(
 		return ast.StringTerm(headers.Get(headerKey)), nil
 	},
 )
+
+// GetHeaderAll returns all the values corresponding (in case-insensitive mode) to the headerKey
+// in the headers of the request, otherwise return an empty array if does not exist.
+var GetHeaderAllDecl = &ast.Builtin{
+	Name: "get_header_all",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, //headerKey: string
+			types.A, //input.request.headers: http.Header (map[string][]string)
+		),
+		types.NewArray(nil, types.S), // All the values in the header or [] if does not exist
+	),
+}
+
+var GetHeaderAllFunction = rego.Function2(
+	&rego.Function{
+		Name: GetHeaderAllDecl.Name,
+		Decl: GetHeaderAllDecl.Decl,
+	},
+	func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+		var headerKey string
+		var headers http.Header
+		if err := ast.As(a.Value, &headerKey); err != nil {
+			return nil, err
+		}
+		if err := ast.As(b.Value, &headers); err != nil {
+			return nil, err
+		}
+		values := headers.Values(headerKey)
+		terms := make([]*ast.Term, 0, len(values))
+		for _, value := range values {
+			terms = append(terms, ast.StringTerm(value))
+		}
+		return ast.ArrayTerm(terms...), nil
+	},
+)
@@ -0,0 +1,83 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// GetQuery returns the first value corresponding (in case-insensitive mode) to the queryKey
+// in the query parameters of the request, otherwise return an empty string if does not exist.
+var GetQueryDecl = &ast.Builtin{
+	Name: "get_query",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, //queryKey: string
+			types.A, //input.request.query: url.Values (map[string][]string)
+		),
+		types.S, // First value in the query parameter or "" if does not exist
+	),
+}
+
+var GetQueryFunction = rego.Function2(
+	&rego.Function{
+		Name: GetQueryDecl.Name,
+		Decl: GetQueryDecl.Decl,
+	},
+	func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+		var queryKey string
+		var query url.Values
+		if err := ast.As(a.Value, &queryKey); err != nil {
+			return nil, err
+		}
+		if err := ast.As(b.Value, &query); err != nil {
+			return nil, err
+		}
+		return ast.StringTerm(getQueryValue(query, queryKey)), nil
+	},
+)
+
+// getQueryValue looks for the exact key first; otherwise keys are compared case-insensitively,
+// in lexicographic order so that the result does not depend on the map iteration order.
+func getQueryValue(query url.Values, queryKey string) string {
+	if values, ok := query[queryKey]; ok {
+		return firstValue(values)
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.EqualFold(key, queryKey) {
+			return firstValue(query[key])
+		}
+	}
+	return ""
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// DefaultGroupLevelsDelimiter divides the levels of hierarchical groups, such as org/team/subteam.
+const DefaultGroupLevelsDelimiter = "/"
+
+// GroupDescendsFrom returns whether the user group is the required group or one of its descendants
+// in the groups hierarchy.
+var GroupDescendsFromDecl = &ast.Builtin{
+	Name: "group_descends_from",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // userGroup: string
+			types.S, // requiredGroup: string
+		),
+		types.B, // true if userGroup is requiredGroup or one of its descendants
+	),
+}
+
+// GroupDescendsFromFunction returns the group_descends_from builtin splitting the group levels
+// with the provided delimiter, or with DefaultGroupLevelsDelimiter when empty.
+func GroupDescendsFromFunction(delimiter string) func(*rego.Rego) {
+	if delimiter == "" {
+		delimiter = DefaultGroupLevelsDelimiter
+	}
+	return rego.Function2(
+		&rego.Function{
+			Name: GroupDescendsFromDecl.Name,
+			Decl: GroupDescendsFromDecl.Decl,
+		},
+		func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+			var userGroup, requiredGroup string
+			if err := ast.As(a.Value, &userGroup); err != nil {
+				return nil, err
+			}
+			if err := ast.As(b.Value, &requiredGroup); err != nil {
+				return nil, err
+			}
+			return ast.BooleanTerm(groupDescendsFrom(userGroup, requiredGroup, delimiter)), nil
+		},
+	)
+}
+
+// groupDescendsFrom matches whole levels, so that org/team-a does not descend from org/team.
+func groupDescendsFrom(userGroup, requiredGroup, delimiter string) bool {
+	userGroup = strings.TrimSuffix(userGroup, delimiter)
+	requiredGroup = strings.TrimSuffix(requiredGroup, delimiter)
+	if userGroup == "" || requiredGroup == "" {
+		return false
+	}
+	return userGroup == requiredGroup || strings.HasPrefix(userGroup, requiredGroup+delimiter)
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const (
+	defaultHTTPFetchTimeout     = 2 * time.Second
+	defaultHTTPFetchCacheTTL    = time.Minute
+	httpFetchMaxBodySize        = 1 << 20
+	httpFetchMaxCachedResponses = 1000
+	httpFetchMaxRedirects       = 10
+)
+
+// HTTPGetJSON returns the JSON document served by the url, whose host must be allowlisted;
+// failed fetches are undefined, so that the policy can fall back on a default.
+var HTTPGetJSONDecl = &ast.Builtin{
+	Name: "http_get_json",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // url: string
+		),
+		types.A, // fetched JSON document
+	),
+	Nondeterministic: true,
+}
+
+// http_get_json is registered globally, like now, so that partial evaluation does not freeze
+// the document fetched while building the partial results: it is fetched on each evaluation.
+func init() {
+	rego.RegisterBuiltinDyn(
+		&rego.Function{
+			Name:             HTTPGetJSONDecl.Name,
+			Decl:             HTTPGetJSONDecl.Decl,
+			Nondeterministic: HTTPGetJSONDecl.Nondeterministic,
+		},
+		func(bctx rego.BuiltinContext, terms []*ast.Term) (*ast.Term, error) {
+			var resourceURL string
+			if err := ast.As(terms[0].Value, &resourceURL); err != nil {
+				return nil, err
+			}
+
+			fetcher := GetHTTPResourceFetcherFromContext(bctx.Context)
+			if fetcher == nil {
+				return nil, fmt.Errorf("no http resource fetcher found in context")
+			}
+			document, err := fetcher.Fetch(bctx.Context, resourceURL)
+			if err != nil {
+				return nil, err
+			}
+			value, err := ast.InterfaceToValue(document)
+			if err != nil {
+				return nil, err
+			}
+			return ast.NewTerm(value), nil
+		},
+	)
+}
+
+type httpResourceFetcherKey struct{}
+
+type httpResource struct {
+	document  interface{}
+	expiresAt time.Time
+}
+
+// HTTPResourceFetcher fetches the JSON resources of the allowlisted hosts, caching the responses
+// for a TTL up to httpFetchMaxCachedResponses, so that user-influenced urls cannot grow it unbounded.
+type HTTPResourceFetcher struct {
+	allowedHosts map[string]bool
+	client       *http.Client
+	ttl          time.Duration
+
+	mtx       sync.Mutex
+	resources map[string]httpResource
+	now       func() time.Time
+}
+
+// NewHTTPResourceFetcher returns a fetcher allowing only the given hosts, matched with their port
+// when present; non positive timeout and ttl fall back on their defaults.
+func NewHTTPResourceFetcher(allowedHosts []string, timeout, ttl time.Duration) *HTTPResourceFetcher {
+	if timeout <= 0 {
+		timeout = defaultHTTPFetchTimeout
+	}
+	if ttl <= 0 {
+		ttl = defaultHTTPFetchCacheTTL
+	}
+	hosts := make(map[string]bool, len(allowedHosts))
+	for _, host := range allowedHosts {
+		hosts[strings.ToLower(host)] = true
+	}
+	fetcher := &HTTPResourceFetcher{
+		allowedHosts: hosts,
+		ttl:          ttl,
+		resources:    make(map[string]httpResource),
+		now:          time.Now,
+	}
+	fetcher.client = &http.Client{
+		Timeout: timeout,
+		// redirects are followed only towards allowed hosts, which would be bypassed otherwise
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= httpFetchMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", httpFetchMaxRedirects)
+			}
+			return fetcher.checkURL(req.URL)
+		},
+	}
+	return fetcher
+}
+
+// checkURL refuses the urls which are not http, or whose host is not allowed.
+func (fetcher *HTTPResourceFetcher) checkURL(resourceURL *url.URL) error {
+	if resourceURL.Scheme != "http" && resourceURL.Scheme != "https" {
+		return fmt.Errorf("url %s is not an http url", resourceURL)
+	}
+	if !fetcher.isAllowed(resourceURL) {
+		return fmt.Errorf("host %s is not allowed", resourceURL.Host)
+	}
+	return nil
+}
+
+func (fetcher *HTTPResourceFetcher) isAllowed(resourceURL *url.URL) bool {
+	host := strings.ToLower(resourceURL.Host)
+	return fetcher.allowedHosts[host] || fetcher.allowedHosts[strings.ToLower(resourceURL.Hostname())]
+}
+
+// Fetch returns the JSON document served by the url, from the cache if it has not expired yet.
+func (fetcher *HTTPResourceFetcher) Fetch(ctx context.Context, resourceURL string) (interface{}, error) {
+	parsedURL, err := url.Parse(resourceURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := fetcher.checkURL(parsedURL); err != nil {
+		return nil, err
+	}
+
+	if document, ok := fetcher.cached(resourceURL); ok {
+		return document, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch of %s failed with status code %d", resourceURL, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpFetchMaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > httpFetchMaxBodySize {
+		return nil, fmt.Errorf("fetch of %s returned a body larger than %d bytes", resourceURL, httpFetchMaxBodySize)
+	}
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("fetch of %s returned an invalid JSON: %s", resourceURL, err.Error())
+	}
+
+	fetcher.store(resourceURL, document)
+	return document, nil
+}
+
+func (fetcher *HTTPResourceFetcher) cached(resourceURL string) (interface{}, bool) {
+	fetcher.mtx.Lock()
+	defer fetcher.mtx.Unlock()
+	resource, ok := fetcher.resources[resourceURL]
+	if !ok {
+		return nil, false
+	}
+	if !fetcher.now().Before(resource.expiresAt) {
+		delete(fetcher.resources, resourceURL)
+		return nil, false
+	}
+	return resource.document, true
+}
+
+// store caches the document, evicting the expired responses when the cache is full;
+// the document is not cached if the cache is still full.
+func (fetcher *HTTPResourceFetcher) store(resourceURL string, document interface{}) {
+	fetcher.mtx.Lock()
+	defer fetcher.mtx.Unlock()
+	now := fetcher.now()
+	if _, ok := fetcher.resources[resourceURL]; !ok && len(fetcher.resources) >= httpFetchMaxCachedResponses {
+		for cachedURL, resource := range fetcher.resources {
+			if !now.Before(resource.expiresAt) {
+				delete(fetcher.resources, cachedURL)
+			}
+		}
+		if len(fetcher.resources) >= httpFetchMaxCachedResponses {
+			return
+		}
+	}
+	fetcher.resources[resourceURL] = httpResource{document: document, expiresAt: now.Add(fetcher.ttl)}
+}
+
+// HTTPResourceFetcherInjectorMiddleware injects into the request context the fetcher used by http_get_json.
+func HTTPResourceFetcherInjectorMiddleware(fetcher *HTTPResourceFetcher) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithHTTPResourceFetcher(r.Context(), fetcher)))
+		})
+	}
+}
+
+func WithHTTPResourceFetcher(ctx context.Context, fetcher *HTTPResourceFetcher) context.Context {
+	return context.WithValue(ctx, httpResourceFetcherKey{}, fetcher)
+}
+
+// GetHTTPResourceFetcherFromContext returns the fetcher injected into the context, if any.
+func GetHTTPResourceFetcherFromContext(ctx context.Context) *HTTPResourceFetcher {
+	fetcher, _ := ctx.Value(httpResourceFetcherKey{}).(*HTTPResourceFetcher)
+	return fetcher
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"net"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// IPInCIDR returns whether the IPv4 or IPv6 address belongs to the CIDR range;
+// malformed addresses or ranges do not match instead of failing the evaluation.
+var IPInCIDRDecl = &ast.Builtin{
+	Name: "ip_in_cidr",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // ip: string
+			types.S, // cidr: string
+		),
+		types.B, // true if both are valid and the ip is in the cidr range
+	),
+}
+
+var IPInCIDRFunction = rego.Function2(
+	&rego.Function{
+		Name: IPInCIDRDecl.Name,
+		Decl: IPInCIDRDecl.Decl,
+	},
+	func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+		var ipValue, cidrValue string
+		if err := ast.As(a.Value, &ipValue); err != nil {
+			return nil, err
+		}
+		if err := ast.As(b.Value, &cidrValue); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(ipValue)
+		_, ipNet, err := net.ParseCIDR(cidrValue)
+		return ast.BooleanTerm(ip != nil && err == nil && ipNet.Contains(ip)), nil
+	},
+)
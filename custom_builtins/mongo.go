@@ -15,11 +15,19 @@
 package custom_builtins
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rond-authz/rond/internal/metrics"
 	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/tracing"
 
+	"github.com/mia-platform/glogger/v2"
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/types"
+	"github.com/sirupsen/logrus"
 )
 
 var MongoFindOneDecl = &ast.Builtin{
@@ -39,6 +47,179 @@ var MongoFindOne = rego.Function2(
 		Decl: MongoFindOneDecl.Decl,
 	},
 	func(ctx rego.BuiltinContext, collectionNameTerm, queryTerm *ast.Term) (*ast.Term, error) {
+		return findOne(ctx, collectionNameTerm, queryTerm, nil)
+	},
+)
+
+var MongoFindOneWithProjectionDecl = &ast.Builtin{
+	Name: "find_one_with_projection",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // collectionName
+			types.A, // query
+			types.A, // projection, e.g. {"tenantId": 1}
+		),
+		types.A, // found document
+	),
+}
+
+var MongoFindOneWithProjection = rego.Function3(
+	&rego.Function{
+		Name: MongoFindOneWithProjectionDecl.Name,
+		Decl: MongoFindOneWithProjectionDecl.Decl,
+	},
+	findOne,
+)
+
+func findOne(ctx rego.BuiltinContext, collectionNameTerm, queryTerm, projectionTerm *ast.Term) (term *ast.Term, err error) {
+	spanCtx, span := tracing.StartSpan(ctx.Context, "MongoFindOne")
+	defer func() { tracing.EndSpan(span, err) }()
+
+	mongoClient, err := mongoclient.GetMongoClientFromContext(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	var collectionName string
+	if err := ast.As(collectionNameTerm.Value, &collectionName); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.CollectionNameAttributeKey.String(collectionName))
+
+	query := make(map[string]interface{})
+	if err := ast.As(queryTerm.Value, &query); err != nil {
+		return nil, err
+	}
+
+	projection, err := projectionFromTerm(projectionTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	result, err := mongoClient.FindOne(spanCtx, collectionName, query, projection)
+	if err != nil {
+		return nil, err
+	}
+	observeMongoQuery(ctx.Context, MongoFindOneDecl.Name, collectionName, query, startTime, documentsCount(result))
+	span.SetAttributes(tracing.DocumentCountAttributeKey.Int(documentsCount(result)))
+
+	t, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.NewTerm(t), nil
+}
+
+var MongoFindManyDecl = &ast.Builtin{
+	Name: "find_many",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // collectionName
+			types.A, // query
+		),
+		types.A, // found document
+	),
+}
+
+var MongoFindMany = rego.Function2(
+	&rego.Function{
+		Name: MongoFindManyDecl.Name,
+		Decl: MongoFindManyDecl.Decl,
+	},
+	func(ctx rego.BuiltinContext, collectionNameTerm, queryTerm *ast.Term) (*ast.Term, error) {
+		return findMany(ctx, collectionNameTerm, queryTerm, nil)
+	},
+)
+
+var MongoFindManyWithProjectionDecl = &ast.Builtin{
+	Name: "find_many_with_projection",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // collectionName
+			types.A, // query
+			types.A, // projection, e.g. {"tenantId": 1}
+		),
+		types.A, // found documents
+	),
+}
+
+var MongoFindManyWithProjection = rego.Function3(
+	&rego.Function{
+		Name: MongoFindManyWithProjectionDecl.Name,
+		Decl: MongoFindManyWithProjectionDecl.Decl,
+	},
+	findMany,
+)
+
+func findMany(ctx rego.BuiltinContext, collectionNameTerm, queryTerm, projectionTerm *ast.Term) (term *ast.Term, err error) {
+	spanCtx, span := tracing.StartSpan(ctx.Context, "MongoFindMany")
+	defer func() { tracing.EndSpan(span, err) }()
+
+	mongoClient, err := mongoclient.GetMongoClientFromContext(ctx.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	var collectionName string
+	if err := ast.As(collectionNameTerm.Value, &collectionName); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.CollectionNameAttributeKey.String(collectionName))
+
+	query := make(map[string]interface{})
+	if err := ast.As(queryTerm.Value, &query); err != nil {
+		return nil, err
+	}
+
+	projection, err := projectionFromTerm(projectionTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime := time.Now()
+	result, err := mongoClient.FindMany(spanCtx, collectionName, query, projection)
+	if err != nil {
+		return nil, err
+	}
+	observeMongoQuery(ctx.Context, MongoFindManyDecl.Name, collectionName, query, startTime, len(result))
+	span.SetAttributes(tracing.DocumentCountAttributeKey.Int(len(result)))
+
+	t, err := ast.InterfaceToValue(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.NewTerm(t), nil
+}
+
+var MongoFindManyPaginatedDecl = &ast.Builtin{
+	Name: "find_many_paginated",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // collectionName
+			types.A, // query
+			types.A, // pagination options, e.g. {"skip": 0, "limit": 50}
+		),
+		types.A, // found documents page
+	),
+}
+
+type paginationOptions struct {
+	Skip  int64 `json:"skip"`
+	Limit int64 `json:"limit"`
+}
+
+var MongoFindManyPaginated = rego.Function3(
+	&rego.Function{
+		Name: MongoFindManyPaginatedDecl.Name,
+		Decl: MongoFindManyPaginatedDecl.Decl,
+	},
+	func(ctx rego.BuiltinContext, collectionNameTerm, queryTerm, paginationTerm *ast.Term) (term *ast.Term, err error) {
+		spanCtx, span := tracing.StartSpan(ctx.Context, "MongoFindManyPaginated")
+		defer func() { tracing.EndSpan(span, err) }()
+
 		mongoClient, err := mongoclient.GetMongoClientFromContext(ctx.Context)
 		if err != nil {
 			return nil, err
@@ -48,16 +229,28 @@ var MongoFindOne = rego.Function2(
 		if err := ast.As(collectionNameTerm.Value, &collectionName); err != nil {
 			return nil, err
 		}
+		span.SetAttributes(tracing.CollectionNameAttributeKey.String(collectionName))
 
 		query := make(map[string]interface{})
 		if err := ast.As(queryTerm.Value, &query); err != nil {
 			return nil, err
 		}
 
-		result, err := mongoClient.FindOne(ctx.Context, collectionName, query)
+		var pagination paginationOptions
+		if err := ast.As(paginationTerm.Value, &pagination); err != nil {
+			return nil, err
+		}
+		if pagination.Skip < 0 || pagination.Limit < 0 {
+			return nil, fmt.Errorf("invalid pagination options: skip and limit must not be negative")
+		}
+
+		startTime := time.Now()
+		result, err := mongoClient.FindManyPaginated(spanCtx, collectionName, query, pagination.Skip, pagination.Limit)
 		if err != nil {
 			return nil, err
 		}
+		observeMongoQuery(ctx.Context, MongoFindManyPaginatedDecl.Name, collectionName, query, startTime, len(result))
+		span.SetAttributes(tracing.DocumentCountAttributeKey.Int(len(result)))
 
 		t, err := ast.InterfaceToValue(result)
 		if err != nil {
@@ -68,23 +261,26 @@ var MongoFindOne = rego.Function2(
 	},
 )
 
-var MongoFindManyDecl = &ast.Builtin{
-	Name: "find_many",
+var MongoCountDecl = &ast.Builtin{
+	Name: "count_documents",
 	Decl: types.NewFunction(
 		types.Args(
 			types.S, // collectionName
 			types.A, // query
 		),
-		types.A, // found document
+		types.N, // number of documents matching the query
 	),
 }
 
-var MongoFindMany = rego.Function2(
+var MongoCount = rego.Function2(
 	&rego.Function{
-		Name: MongoFindManyDecl.Name,
-		Decl: MongoFindManyDecl.Decl,
+		Name: MongoCountDecl.Name,
+		Decl: MongoCountDecl.Decl,
 	},
-	func(ctx rego.BuiltinContext, collectionNameTerm, queryTerm *ast.Term) (*ast.Term, error) {
+	func(ctx rego.BuiltinContext, collectionNameTerm, queryTerm *ast.Term) (term *ast.Term, err error) {
+		spanCtx, span := tracing.StartSpan(ctx.Context, "MongoCount")
+		defer func() { tracing.EndSpan(span, err) }()
+
 		mongoClient, err := mongoclient.GetMongoClientFromContext(ctx.Context)
 		if err != nil {
 			return nil, err
@@ -94,22 +290,58 @@ var MongoFindMany = rego.Function2(
 		if err := ast.As(collectionNameTerm.Value, &collectionName); err != nil {
 			return nil, err
 		}
+		span.SetAttributes(tracing.CollectionNameAttributeKey.String(collectionName))
 
 		query := make(map[string]interface{})
 		if err := ast.As(queryTerm.Value, &query); err != nil {
 			return nil, err
 		}
 
-		result, err := mongoClient.FindMany(ctx.Context, collectionName, query)
+		startTime := time.Now()
+		count, err := mongoClient.CountDocuments(spanCtx, collectionName, query)
 		if err != nil {
 			return nil, err
 		}
+		observeMongoQuery(ctx.Context, MongoCountDecl.Name, collectionName, query, startTime, int(count))
+		span.SetAttributes(tracing.DocumentCountAttributeKey.Int(int(count)))
 
-		t, err := ast.InterfaceToValue(result)
-		if err != nil {
-			return nil, err
-		}
-
-		return ast.NewTerm(t), nil
+		return ast.IntNumberTerm(int(count)), nil
 	},
 )
+
+// observeMongoQuery trace-logs the query performed by a builtin and, when metrics are enabled,
+// records its duration and the number of found documents.
+func observeMongoQuery(ctx context.Context, operation, collectionName string, query map[string]interface{}, startTime time.Time, documents int) {
+	elapsed := time.Since(startTime)
+	if m := metrics.GetMetricsFromContext(ctx); m != nil {
+		m.ObserveMongoQuery(collectionName, operation, elapsed, documents)
+	}
+	if logger := glogger.Get(ctx); logger.Logger.IsLevelEnabled(logrus.TraceLevel) {
+		logger.WithFields(logrus.Fields{
+			"operation":  operation,
+			"collection": collectionName,
+			"query":      query,
+			"elapsed":    elapsed.String(),
+			"documents":  documents,
+		}).Trace("policy MongoDB query completed")
+	}
+}
+
+// projectionFromTerm returns the projection passed to the find builtins, if any.
+func projectionFromTerm(projectionTerm *ast.Term) (map[string]interface{}, error) {
+	if projectionTerm == nil {
+		return nil, nil
+	}
+	projection := make(map[string]interface{})
+	if err := ast.As(projectionTerm.Value, &projection); err != nil {
+		return nil, err
+	}
+	return projection, nil
+}
+
+func documentsCount(document interface{}) int {
+	if document == nil {
+		return 0
+	}
+	return 1
+}
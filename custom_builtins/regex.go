@@ -0,0 +1,113 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+const (
+	safeRegexMaxPatternLength  = 1024
+	safeRegexMaxProgramSize    = 4096
+	safeRegexMaxCachedPatterns = 1000
+)
+
+// SafeRegexMatch returns whether the value matches the pattern, like regex.match, but invalid
+// or oversized patterns do not match instead of failing the whole evaluation.
+var SafeRegexMatchDecl = &ast.Builtin{
+	Name: "safe_regex_match",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // pattern: string
+			types.S, // value: string
+		),
+		types.B, // true if the pattern is accepted and matches the value
+	),
+}
+
+var SafeRegexMatchFunction = rego.Function2(
+	&rego.Function{
+		Name: SafeRegexMatchDecl.Name,
+		Decl: SafeRegexMatchDecl.Decl,
+	},
+	func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+		var pattern, value string
+		if err := ast.As(a.Value, &pattern); err != nil {
+			return nil, err
+		}
+		if err := ast.As(b.Value, &value); err != nil {
+			return nil, err
+		}
+		re := safeRegexes.get(pattern)
+		return ast.BooleanTerm(re != nil && re.MatchString(value)), nil
+	},
+)
+
+var safeRegexes = &regexCache{patterns: map[string]*regexp.Regexp{}}
+
+// regexCache holds the compiled patterns, nil for the rejected ones, up to safeRegexMaxCachedPatterns
+// so that user-influenced patterns cannot grow it unbounded.
+type regexCache struct {
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+}
+
+func (c *regexCache) get(pattern string) *regexp.Regexp {
+	c.mu.Lock()
+	re, ok := c.patterns[pattern]
+	c.mu.Unlock()
+	if ok {
+		return re
+	}
+
+	re, err := compileSafeRegex(pattern)
+	if err != nil {
+		re = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.patterns) < safeRegexMaxCachedPatterns {
+		c.patterns[pattern] = re
+	}
+	return re
+}
+
+// compileSafeRegex rejects the patterns whose length or compiled program size exceed the limits,
+// such as nested repetitions which expand into huge programs, before compiling them.
+func compileSafeRegex(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > safeRegexMaxPatternLength {
+		return nil, fmt.Errorf("pattern longer than %d characters", safeRegexMaxPatternLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > safeRegexMaxProgramSize {
+		return nil, fmt.Errorf("pattern program larger than %d instructions", safeRegexMaxProgramSize)
+	}
+	return regexp.Compile(pattern)
+}
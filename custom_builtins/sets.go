@@ -0,0 +1,84 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// InAllowedSet returns whether the value belongs to the set with the given name in the data
+// document, where the name is the dot separated path of an array or of an object, whose keys
+// are the members of the set.
+var InAllowedSetDecl = &ast.Builtin{
+	Name: "in_allowed_set",
+	Decl: types.NewFunction(
+		types.Args(
+			types.A, // value: any
+			types.S, // setName: string
+		),
+		types.B, // true if value is a member of the set
+	),
+}
+
+// InAllowedSetFunction returns the in_allowed_set builtin looking up the sets in the provided data;
+// a missing set halts the evaluation instead of being silently treated as undefined.
+func InAllowedSetFunction(data map[string]interface{}) func(*rego.Rego) {
+	return rego.Function2(
+		&rego.Function{
+			Name: InAllowedSetDecl.Name,
+			Decl: InAllowedSetDecl.Decl,
+		},
+		func(_ rego.BuiltinContext, a, b *ast.Term) (*ast.Term, error) {
+			var setName string
+			if err := ast.As(b.Value, &setName); err != nil {
+				return nil, err
+			}
+			set, err := allowedSet(data, setName)
+			if err != nil {
+				return nil, rego.NewHaltError(err)
+			}
+
+			switch typedSet := set.(type) {
+			case *ast.Array:
+				member := typedSet.Until(func(element *ast.Term) bool {
+					return element.Value.Compare(a.Value) == 0
+				})
+				return ast.BooleanTerm(member), nil
+			case ast.Object:
+				return ast.BooleanTerm(typedSet.Get(a) != nil), nil
+			}
+			return nil, rego.NewHaltError(fmt.Errorf("allowed set %s is neither an array nor an object", setName))
+		},
+	)
+}
+
+func allowedSet(data map[string]interface{}, setName string) (ast.Value, error) {
+	var document interface{} = data
+	for _, key := range strings.Split(setName, ".") {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("allowed set %s not found in data", setName)
+		}
+		if document, ok = object[key]; !ok {
+			return nil, fmt.Errorf("allowed set %s not found in data", setName)
+		}
+	}
+	return ast.InterfaceToValue(document)
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_builtins
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// Now returns the evaluation time as nanoseconds since the Unix epoch.
+var NowDecl = &ast.Builtin{
+	Name:             "now",
+	Decl:             types.NewFunction(types.Args(), types.N),
+	Nondeterministic: true,
+}
+
+// ParseTime returns the nanoseconds since the Unix epoch of the provided RFC3339 timestamp.
+var ParseTimeDecl = &ast.Builtin{
+	Name: "parse_time",
+	Decl: types.NewFunction(
+		types.Args(
+			types.S, // timestamp: string in RFC3339 format
+		),
+		types.N, // nanoseconds since the Unix epoch
+	),
+}
+
+// now is registered globally rather than as a rego option: partial evaluation skips only the
+// non-deterministic builtins known to the OPA runtime, so a per-instance builtin would be evaluated
+// once while building the partial results and its value would be frozen in the policies.
+func init() {
+	rego.RegisterBuiltinDyn(
+		&rego.Function{
+			Name:             NowDecl.Name,
+			Decl:             NowDecl.Decl,
+			Nondeterministic: NowDecl.Nondeterministic,
+		},
+		func(bctx rego.BuiltinContext, _ []*ast.Term) (*ast.Term, error) {
+			if bctx.Time != nil {
+				return bctx.Time, nil
+			}
+			return unixNanoTerm(time.Now()), nil
+		},
+	)
+}
+
+var ParseTimeFunction = rego.Function1(
+	&rego.Function{
+		Name: ParseTimeDecl.Name,
+		Decl: ParseTimeDecl.Decl,
+	},
+	func(_ rego.BuiltinContext, a *ast.Term) (*ast.Term, error) {
+		var timestamp string
+		if err := ast.As(a.Value, &timestamp); err != nil {
+			return nil, err
+		}
+		parsedTime, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		return unixNanoTerm(parsedTime), nil
+	},
+)
+
+func unixNanoTerm(t time.Time) *ast.Term {
+	return ast.NumberTerm(json.Number(strconv.FormatInt(t.UnixNano(), 10)))
+}
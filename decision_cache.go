@@ -0,0 +1,193 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/types"
+)
+
+const defaultDecisionCacheSize = 1000
+
+// defaultDecisionCacheKeys are the input fields identifying a cached decision, together with
+// the user identity, unless the route configures its own.
+var defaultDecisionCacheKeys = []string{"request.method", "request.path"}
+
+type decisionCacheContextKey struct{}
+
+// cachedDecision is the outcome of the allow policies evaluation: the policies results when
+// allowed, or the deny error otherwise.
+type cachedDecision struct {
+	policyName    string
+	policyResults []interface{}
+	err           error
+}
+
+type decisionCacheEntry struct {
+	key       string
+	decision  cachedDecision
+	expiresAt time.Time
+}
+
+// DecisionCache is an in-memory LRU cache holding the allow policies decisions of the routes
+// configuring a cache TTL, with entries expiring after the TTL of their route.
+type DecisionCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// NewDecisionCache returns a DecisionCache holding up to size entries, or defaultDecisionCacheSize
+// if size is not positive.
+func NewDecisionCache(size int) *DecisionCache {
+	if size <= 0 {
+		size = defaultDecisionCacheSize
+	}
+	return &DecisionCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// decisionCacheKey identifies the decision by the evaluated policies, the user identity and the
+// values of the given input fields, expressed as dot separated paths such as request.path.
+func decisionCacheKey(requestFlow RequestFlow, user types.User, input []byte) (string, error) {
+	var decodedInput map[string]interface{}
+	if err := json.Unmarshal(input, &decodedInput); err != nil {
+		return "", err
+	}
+	cacheKeys := requestFlow.CacheKeys
+	if len(cacheKeys) == 0 {
+		cacheKeys = defaultDecisionCacheKeys
+	}
+
+	groups := append([]string{}, user.UserGroups...)
+	sort.Strings(groups)
+	keyParts := []string{
+		strings.Join(requestFlow.allowPolicies(), ","),
+		requestFlow.Combinator,
+		user.Tenant,
+		user.UserID,
+		strings.Join(groups, ","),
+	}
+	for _, cacheKey := range cacheKeys {
+		var value interface{} = decodedInput
+		for _, field := range strings.Split(cacheKey, ".") {
+			object, _ := value.(map[string]interface{})
+			value = object[field]
+		}
+		encodedValue, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		keyParts = append(keyParts, string(encodedValue))
+	}
+	return strings.Join(keyParts, "|"), nil
+}
+
+// Get returns the cached decision for the given key, if present and not expired.
+func (cache *DecisionCache) Get(key string) (cachedDecision, bool) {
+	if cache == nil {
+		return cachedDecision{}, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return cachedDecision{}, false
+	}
+	entry := element.Value.(*decisionCacheEntry)
+	if cache.now().After(entry.expiresAt) {
+		cache.removeElement(element)
+		return cachedDecision{}, false
+	}
+	cache.lru.MoveToFront(element)
+	return entry.decision, true
+}
+
+// Set stores the decision for the given ttl, evicting the least recently used entry when full.
+func (cache *DecisionCache) Set(key string, decision cachedDecision, ttl time.Duration) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	expiresAt := cache.now().Add(ttl)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*decisionCacheEntry)
+		entry.decision = decision
+		entry.expiresAt = expiresAt
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&decisionCacheEntry{key: key, decision: decision, expiresAt: expiresAt})
+	if cache.lru.Len() > cache.size {
+		cache.removeElement(cache.lru.Back())
+	}
+}
+
+// Invalidate removes every entry, since a change of the bindings may affect any decision.
+func (cache *DecisionCache) Invalidate() {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+}
+
+func (cache *DecisionCache) removeElement(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*decisionCacheEntry).key)
+}
+
+// DecisionCacheInjectorMiddleware will inject into request context the decision cache.
+func DecisionCacheInjectorMiddleware(cache *DecisionCache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithDecisionCache(r.Context(), cache)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithDecisionCache(ctx context.Context, cache *DecisionCache) context.Context {
+	return context.WithValue(ctx, decisionCacheContextKey{}, cache)
+}
+
+// GetDecisionCacheFromContext extracts the decision cache from provided context,
+// returning `nil` if none has been injected.
+func GetDecisionCacheFromContext(ctx context.Context) *DecisionCache {
+	cache, _ := ctx.Value(decisionCacheContextKey{}).(*DecisionCache)
+	return cache
+}
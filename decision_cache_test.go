@@ -0,0 +1,93 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionCache(t *testing.T) {
+	allowed := cachedDecision{policyName: "allow"}
+
+	t.Run("returns entries until they expire", func(t *testing.T) {
+		cache := NewDecisionCache(10)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+
+		cache.Set("key", allowed, time.Minute)
+		decision, ok := cache.Get("key")
+		require.True(t, ok)
+		require.Equal(t, allowed, decision)
+
+		now = now.Add(2 * time.Minute)
+		_, ok = cache.Get("key")
+		require.False(t, ok)
+	})
+
+	t.Run("evicts the least recently used entry", func(t *testing.T) {
+		cache := NewDecisionCache(2)
+		cache.Set("first", allowed, time.Minute)
+		cache.Set("second", allowed, time.Minute)
+		_, ok := cache.Get("first")
+		require.True(t, ok)
+
+		cache.Set("third", allowed, time.Minute)
+		_, ok = cache.Get("second")
+		require.False(t, ok)
+		_, ok = cache.Get("first")
+		require.True(t, ok)
+	})
+
+	t.Run("invalidate removes every entry", func(t *testing.T) {
+		cache := NewDecisionCache(10)
+		cache.Set("first", allowed, time.Minute)
+		cache.Set("second", allowed, time.Minute)
+
+		cache.Invalidate()
+		_, ok := cache.Get("first")
+		require.False(t, ok)
+		_, ok = cache.Get("second")
+		require.False(t, ok)
+	})
+
+	t.Run("nil cache is disabled", func(t *testing.T) {
+		var cache *DecisionCache
+		cache.Set("key", allowed, time.Minute)
+		_, ok := cache.Get("key")
+		require.False(t, ok)
+		cache.Invalidate()
+	})
+}
+
+func TestDecisionCacheKey(t *testing.T) {
+	user := types.User{UserID: "user1", UserGroups: []string{"group2", "group1"}}
+	input := []byte(`{"request":{"method":"GET","path":"/api","query":{"tenant":["t1"]}},"user":{}}`)
+
+	t.Run("uses method and path by default", func(t *testing.T) {
+		key, err := decisionCacheKey(RequestFlow{PolicyName: "allow"}, user, input)
+		require.NoError(t, err)
+		require.Equal(t, `allow|||user1|group1,group2|"GET"|"/api"`, key)
+	})
+
+	t.Run("uses the configured input fields", func(t *testing.T) {
+		key, err := decisionCacheKey(RequestFlow{PolicyName: "allow", CacheKeys: []string{"request.query.tenant", "request.missing"}}, user, input)
+		require.NoError(t, err)
+		require.Equal(t, `allow|||user1|group1,group2|["t1"]|null`, key)
+	})
+}
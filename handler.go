@@ -15,16 +15,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 
+	"github.com/rond-authz/rond/internal/authtoken"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/decisionlog"
 	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/internal/opatranslator"
+	"github.com/rond-authz/rond/internal/utils"
 
 	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/profiler"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 )
 
@@ -32,6 +41,15 @@ const URL_SCHEME = "http"
 const BASE_ROW_FILTER_HEADER_KEY = "acl_rows"
 const GENERIC_BUSINESS_ERROR_MESSAGE = "Internal server error, please try again later"
 const NO_PERMISSIONS_ERROR_MESSAGE = "You do not have permissions to access this feature, contact the administrator for more information."
+const TIMEOUT_ERROR_MESSAGE = "The request took too long to be processed, please try again later"
+const INVALID_TOKEN_ERROR_MESSAGE = "The provided authorization token is not valid"
+const UNAUTHENTICATED_ERROR_MESSAGE = "You must be authenticated to access this feature"
+const REQUEST_BODY_TOO_LARGE_ERROR_MESSAGE = "The request body is too large"
+const POLICY_MISCONFIGURED_ERROR_MESSAGE = "The policy of the requested API is misconfigured, contact the administrator for more information."
+const INVALID_REQUEST_BODY_ERROR_MESSAGE = "The request body is not valid"
+const RATE_LIMIT_ERROR_MESSAGE = "Too many requests, please try again later"
+const METHOD_NOT_ALLOWED_ERROR_MESSAGE = "The request method is not allowed"
+const QUERY_TOO_COMPLEX_ERROR_MESSAGE = "The permissions on the requested resources are too complex to be evaluated, contact the administrator for more information."
 
 func ReverseProxyOrResponse(
 	logger *logrus.Entry,
@@ -63,6 +81,10 @@ func rbacHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if rejectNotAllowedMethod(w, req, env) {
+		return
+	}
+
 	permission, err := GetXPermission(requestContext)
 	if err != nil {
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("no policy permission found in context")
@@ -76,49 +98,293 @@ func rbacHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	stripInboundHeaders(req.Header, env)
+	if !isTrustedIdentitySource(req, env) {
+		logger.Debug("request not sent by the trusted identity source, identity headers ignored")
+		clearIdentityHeaders(req.Header, env)
+	}
+
+	if env.RequestTimeout > 0 {
+		// policy evaluation, row filter header injection and proxying share the same deadline
+		timeoutContext, cancel := context.WithTimeout(requestContext, env.RequestTimeout)
+		defer cancel()
+		req = req.WithContext(timeoutContext)
+	}
+
+	if env.DebugInputEnabled && req.Header.Get(DebugInputHeaderKey) == "true" {
+		respondWithRegoInput(w, req, env, permission)
+		return
+	}
+	if env.DebugProfileEnabled && req.Header.Get(DebugProfileHeaderKey) == "true" {
+		respondWithRegoProfile(w, req, env, permission)
+		return
+	}
+
+	req = req.WithContext(withPolicyHeaders(req.Context()))
 	if err := EvaluateRequest(req, env, w, partialResultEvaluators, permission); err != nil {
 		return
 	}
 	ReverseProxyOrResponse(logger, env, w, req, permission, partialResultEvaluators)
 }
 
+// defaultAllowedMethods are the HTTP methods proxied to the target service, unless configured otherwise.
+var defaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// allowedMethods returns the HTTP methods proxied to the target service, whatever the OAS declares.
+func allowedMethods(env config.EnvironmentVariables) []string {
+	methods := utils.SplitHeaderValues(strings.ToUpper(env.AllowedMethods), ",")
+	if len(methods) == 0 {
+		return defaultAllowedMethods
+	}
+	return methods
+}
+
+// rejectNotAllowedMethod responds 405, listing the allowed methods in the Allow header,
+// when the request method is not allowed, reporting whether the request has been rejected.
+func rejectNotAllowedMethod(w http.ResponseWriter, req *http.Request, env config.EnvironmentVariables) bool {
+	methods := allowedMethods(env)
+	if lo.Contains(methods, req.Method) {
+		return false
+	}
+	glogger.Get(req.Context()).WithField("method", utils.SanitizeString(req.Method)).Warn("request method not allowed")
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	failResponseWithCode(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", req.Method), METHOD_NOT_ALLOWED_ERROR_MESSAGE)
+	return true
+}
+
+// respondWithRegoInput writes the policy input built for the request, without evaluating nor proxying it.
+func respondWithRegoInput(w http.ResponseWriter, req *http.Request, env config.EnvironmentVariables, permission *RondConfig) {
+	logger := glogger.Get(req.Context())
+
+	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, req, env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
+		failResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	input, err := createRegoQueryInput(req, env, permission.Options, userInfo, nil)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
+		failResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	logger.Info("responding with the policy input for debugging")
+	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(input); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
+
+// PolicyProfile is the profile of an allow policy evaluation, reporting the evaluations count and
+// time of each expression of the rego modules, sorted by time.
+type PolicyProfile struct {
+	PolicyName string               `json:"policyName"`
+	Allowed    bool                 `json:"allowed"`
+	Error      string               `json:"error,omitempty"`
+	Profile    []profiler.ExprStats `json:"profile"`
+}
+
+type ProfileResponseBody struct {
+	Policies []PolicyProfile `json:"policies"`
+}
+
+// respondWithRegoProfile evaluates every allow policy of the request with a fresh evaluator, tracing it
+// with the OPA profiler, and writes the profiles in place of proxying the request.
+func respondWithRegoProfile(w http.ResponseWriter, req *http.Request, env config.EnvironmentVariables, permission *RondConfig) {
+	logger := glogger.Get(req.Context())
+
+	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, req, env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
+		failResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	input, err := createRegoQueryInput(req, env, permission.Options, userInfo, nil)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
+		failResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	response := ProfileResponseBody{Policies: []PolicyProfile{}}
+	for _, policyName := range permission.RequestFlow.allowPolicies() {
+		policyProfiler := profiler.New()
+		ctx := WithEvaluationProfiler(req.Context(), policyProfiler)
+		evaluator, err := createQueryEvaluator(ctx, logger, req, env, policyName, input, nil)
+		if err != nil {
+			failResponseWithCode(w, http.StatusInternalServerError, "RBAC policy evaluator creation failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		policyProfile := PolicyProfile{PolicyName: policyName}
+		if _, _, err := evaluator.PolicyEvaluation(logger, permission); err != nil {
+			policyProfile.Error = err.Error()
+		} else {
+			policyProfile.Allowed = true
+		}
+		policyProfile.Profile = policyProfiler.ReportTopNResults(0, []string{"total_time_ns", "num_eval", "line"})
+		response.Policies = append(response.Policies, policyProfile)
+	}
+
+	content, err := json.Marshal(response)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed profile marshaling")
+		failResponseWithCode(w, http.StatusInternalServerError, "profile marshaling failed", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	logger.Info("responding with the policies profile for debugging")
+	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(content); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
+
 func EvaluateRequest(req *http.Request, env config.EnvironmentVariables, w http.ResponseWriter, partialResultsEvaluators PartialResultsEvaluators, permission *RondConfig) error {
 	requestContext := req.Context()
 	logger := glogger.Get(requestContext)
 
+	// the row filter kill switch evaluates the query generating policies as plain allow policies
+	if env.DisableRowFilter && permission.RequestFlow.GenerateQuery {
+		allowPermission := *permission
+		allowPermission.RequestFlow.GenerateQuery = false
+		permission = &allowPermission
+	}
+
 	userInfo, err := mongoclient.RetrieveUserBindingsAndRoles(logger, req, env)
 	if err != nil {
+		if errors.Is(err, mongoclient.ErrInvalidTenant) {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("tenant resolution failed")
+			failResponseWithCode(w, http.StatusBadRequest, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return err
+		}
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed user bindings and roles retrieving")
 		failResponseWithCode(w, http.StatusInternalServerError, "user bindings retrieval failed", GENERIC_BUSINESS_ERROR_MESSAGE)
 		return err
 	}
 
-	input, err := createRegoQueryInput(req, env, permission.Options.EnableResourcePermissionsMapOptimization, userInfo, nil)
+	if schema := permission.RequestFlow.BodySchema; schema != nil && hasApplicationJSONContentType(req.Header) {
+		if err := validateRequestBody(req, env.RequestMaxBodySize, schema); err != nil {
+			if errors.Is(err, ErrRequestBodyTooLarge) {
+				logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("request body exceeds the maximum size")
+				failResponseWithCode(w, http.StatusRequestEntityTooLarge, err.Error(), REQUEST_BODY_TOO_LARGE_ERROR_MESSAGE)
+				return err
+			}
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("request body validation failed")
+			failResponseWithCode(w, http.StatusBadRequest, err.Error(), INVALID_REQUEST_BODY_ERROR_MESSAGE)
+			return err
+		}
+	}
+
+	input, err := createRegoQueryInput(req, env, permission.Options, userInfo, nil)
 	if err != nil {
+		if errors.Is(err, authtoken.ErrInvalidToken) {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("bearer token verification failed")
+			failResponseWithCode(w, http.StatusUnauthorized, err.Error(), INVALID_TOKEN_ERROR_MESSAGE)
+			return err
+		}
+		if errors.Is(err, ErrRequestBodyTooLarge) {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("request body exceeds the maximum size")
+			failResponseWithCode(w, http.StatusRequestEntityTooLarge, err.Error(), REQUEST_BODY_TOO_LARGE_ERROR_MESSAGE)
+			return err
+		}
 		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed rego query input creation")
 		failResponseWithCode(w, http.StatusInternalServerError, "RBAC input creation failed", GENERIC_BUSINESS_ERROR_MESSAGE)
 		return err
 	}
 
-	var evaluatorAllowPolicy *OPAEvaluator
-	if !permission.RequestFlow.GenerateQuery {
-		evaluatorAllowPolicy, err = partialResultsEvaluators.GetEvaluatorFromPolicy(requestContext, permission.RequestFlow.PolicyName, input, env)
-		if err != nil {
-			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot find policy evaluator")
-			failResponseWithCode(w, http.StatusInternalServerError, "failed partial evaluator retrieval", GENERIC_BUSINESS_ERROR_MESSAGE)
-			return err
+	allowPolicies := permission.RequestFlow.allowPolicies()
+	if len(allowPolicies) == 0 {
+		err := fmt.Errorf("no allow policy configured")
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot find policy evaluator")
+		failResponseWithCode(w, http.StatusInternalServerError, "failed partial evaluator retrieval", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return err
+	}
+
+	decisionCache := GetDecisionCacheFromContext(requestContext)
+	// the cache TTL is validated at startup
+	cacheTTL, _ := permission.RequestFlow.cacheTTL()
+	var decisionKey string
+	if decisionCache != nil && cacheTTL > 0 && !permission.RequestFlow.GenerateQuery {
+		var keyErr error
+		if decisionKey, keyErr = decisionCacheKey(permission.RequestFlow, userInfo, input); keyErr != nil {
+			logger.WithField("error", logrus.Fields{"message": keyErr.Error()}).Warn("failed decision cache key creation")
 		}
+	}
+
+	// with the all combinator the evaluation stops at the first denying policy,
+	// with the any combinator at the first allowing one.
+	anyPolicy := permission.RequestFlow.Combinator == PoliciesCombinatorAny
+	var policyName string
+	var policyResults []interface{}
+	var query interface{}
+	if decision, ok := decisionCache.Get(decisionKey); ok {
+		logger.WithField("policyName", decision.policyName).Debug("policy decision found in cache")
+		policyName, policyResults, err = decision.policyName, decision.policyResults, decision.err
+		logDecision(logger, req, policyName, userInfo.UserID, input, err, true)
 	} else {
-		evaluatorAllowPolicy, err = createQueryEvaluator(requestContext, logger, req, env, permission.RequestFlow.PolicyName, input, nil)
-		if err != nil {
-			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot create evaluator")
-			failResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluator creation failed", NO_PERMISSIONS_ERROR_MESSAGE)
-			return err
+		for _, policyName = range allowPolicies {
+			var evaluatorAllowPolicy *OPAEvaluator
+			if !permission.RequestFlow.GenerateQuery && !permission.RequestFlow.DisablePartialCache {
+				evaluatorAllowPolicy, err = partialResultsEvaluators.GetEvaluatorFromPolicy(requestContext, policyName, input, env)
+				if errors.Is(err, ErrPolicyNotFound) {
+					logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("policy misconfigured")
+					failResponseWithCode(w, http.StatusInternalServerError, err.Error(), POLICY_MISCONFIGURED_ERROR_MESSAGE)
+					return err
+				}
+				if err != nil {
+					logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot find policy evaluator")
+					failResponseWithCode(w, http.StatusInternalServerError, "failed partial evaluator retrieval", GENERIC_BUSINESS_ERROR_MESSAGE)
+					return err
+				}
+			} else {
+				evaluatorAllowPolicy, err = createQueryEvaluator(requestContext, logger, req, env, policyName, input, nil)
+				if err != nil {
+					logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("cannot create evaluator")
+					failResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluator creation failed", NO_PERMISSIONS_ERROR_MESSAGE)
+					return err
+				}
+			}
+
+			var policyResult interface{}
+			policyResult, query, err = evaluatorAllowPolicy.PolicyEvaluation(logger, permission)
+			logDecision(logger, req, policyName, userInfo.UserID, input, err, false)
+			if err == nil {
+				policyResults = append(policyResults, policyResult)
+			}
+			if (err == nil) == anyPolicy || errors.Is(err, ErrPolicyEvaluationTimeout) || errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+		}
+		// only the allow and deny decisions are cached, the evaluation errors are not
+		var denyErr *PolicyDenyError
+		if decisionKey != "" && (err == nil || errors.As(err, &denyErr)) {
+			decisionCache.Set(decisionKey, cachedDecision{policyName: policyName, policyResults: policyResults, err: err}, cacheTTL)
 		}
 	}
-
-	_, query, err := evaluatorAllowPolicy.PolicyEvaluation(logger, permission)
 	if err != nil {
+		if env.PolicyAuditMode && !errors.Is(err, context.DeadlineExceeded) {
+			logger.WithFields(logrus.Fields{
+				"policyName": policyName,
+				"input":      string(input),
+				"wouldBlock": true,
+				"error":      logrus.Fields{"message": err.Error()},
+			}).Warn("RBAC policy evaluation failed, request allowed by audit mode")
+			return nil
+		}
 		if errors.Is(err, opatranslator.ErrEmptyQuery) && hasApplicationJSONContentType(req.Header) {
 			w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
 			w.WriteHeader(http.StatusOK)
@@ -130,10 +396,31 @@ func EvaluateRequest(req *http.Request, env config.EnvironmentVariables, w http.
 		}
 
 		logger.WithField("error", logrus.Fields{
-			"policyName": permission.RequestFlow.PolicyName,
+			"policyName": policyName,
 			"message":    err.Error(),
 		}).Error("RBAC policy evaluation failed")
-		failResponseWithCode(w, http.StatusForbidden, "RBAC policy evaluation failed", NO_PERMISSIONS_ERROR_MESSAGE)
+		if errors.Is(err, ErrPolicyEvaluationTimeout) {
+			failResponseWithCode(w, http.StatusInternalServerError, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			failResponseWithCode(w, http.StatusGatewayTimeout, "RBAC policy evaluation timed out", TIMEOUT_ERROR_MESSAGE)
+			return err
+		}
+		if errors.Is(err, opatranslator.ErrQueryTooComplex) {
+			failResponseWithCode(w, http.StatusForbidden, err.Error(), QUERY_TOO_COMPLEX_ERROR_MESSAGE)
+			return err
+		}
+		if env.Distinguish401And403 && permission.RequestFlow.OnDeny.StatusCode == 0 && !hasUserIdentity(req.Header, env) {
+			failResponseWithCode(w, http.StatusUnauthorized, "RBAC policy evaluation failed", UNAUTHENTICATED_ERROR_MESSAGE)
+			return err
+		}
+		var denyErr *PolicyDenyError
+		var reason string
+		if errors.As(err, &denyErr) {
+			reason = denyErr.Reason
+		}
+		failResponseOnDeny(w, permission.RequestFlow.OnDeny, reason)
 		return err
 	}
 	var queryToProxy = []byte{}
@@ -144,40 +431,277 @@ func EvaluateRequest(req *http.Request, env config.EnvironmentVariables, w http.
 			failResponseWithCode(w, http.StatusForbidden, "Error while marshaling row filter query", GENERIC_BUSINESS_ERROR_MESSAGE)
 			return err
 		}
+		if env.LogRowFilterQuery {
+			logRowFilterQuery(logger, queryToProxy, env)
+		}
 	}
 
 	queryHeaderKey := BASE_ROW_FILTER_HEADER_KEY
+	if env.RowFilterHeaderKey != "" {
+		queryHeaderKey = env.RowFilterHeaderKey
+	}
 	if permission.RequestFlow.QueryOptions.HeaderName != "" {
 		queryHeaderKey = permission.RequestFlow.QueryOptions.HeaderName
 	}
 	if query != nil {
-		req.Header.Set(queryHeaderKey, string(queryToProxy))
+		if permission.RequestFlow.QueryOptions.Target == RowFilterTargetQuery {
+			setRowFilterQueryParam(req, permission.RequestFlow.QueryOptions.QueryParamName, string(queryToProxy))
+		} else {
+			req.Header.Set(queryHeaderKey, string(queryToProxy))
+		}
+	}
+
+	policyHeaders := getPolicyHeadersFromContext(requestContext)
+	for _, policyResult := range policyResults {
+		if err := setPolicyResultHeaders(req.Header, policyHeaders, policyResult); err != nil {
+			logger.WithField("error", logrus.Fields{
+				"policyName": policyName,
+				"message":    err.Error(),
+			}).Error("invalid policy result")
+			failResponseWithCode(w, http.StatusInternalServerError, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return err
+		}
+	}
+	return nil
+}
+
+// setRowFilterQueryParam sets the row filter query as the paramName query parameter, BASE_ROW_FILTER_HEADER_KEY
+// by default, replacing any value sent by the client.
+func setRowFilterQueryParam(req *http.Request, paramName, query string) {
+	if paramName == "" {
+		paramName = BASE_ROW_FILTER_HEADER_KEY
+	}
+	queryParams := req.URL.Query()
+	queryParams.Set(paramName, query)
+	req.URL.RawQuery = queryParams.Encode()
+}
+
+type policyHeadersContextKey struct{}
+
+// withPolicyHeaders returns a context collecting the keys of the headers set by the allow
+// policies, which take precedence over the PROXY_ADD_HEADERS ones.
+func withPolicyHeaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, policyHeadersContextKey{}, map[string]bool{})
+}
+
+func getPolicyHeadersFromContext(ctx context.Context) map[string]bool {
+	policyHeaders, _ := ctx.Value(policyHeadersContextKey{}).(map[string]bool)
+	return policyHeaders
+}
+
+// setPolicyResultHeaders sets on the request the headers listed in the setHeaders
+// field of an object policy result, recording their keys in policyHeaders when not nil;
+// other results set no header.
+func setPolicyResultHeaders(headers http.Header, policyHeaders map[string]bool, policyResult interface{}) error {
+	result, ok := policyResult.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	setHeaders, ok := result[setHeadersResultKey]
+	if !ok {
+		return nil
+	}
+	headersToSet, ok := setHeaders.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("policy result %s field must be an object", setHeadersResultKey)
+	}
+	for key, value := range headersToSet {
+		headerValue, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("policy result header %s must be a string", key)
+		}
+		headers.Set(key, headerValue)
+		if policyHeaders != nil {
+			policyHeaders[http.CanonicalHeaderKey(key)] = true
+		}
 	}
 	return nil
 }
 
+// logDecision writes the policy decision to the decision log, when enabled,
+// marking the ones taken from the decision cache.
+func logDecision(logger *logrus.Entry, req *http.Request, policyName, userID string, input []byte, evaluationErr error, cached bool) {
+	decision := decisionlog.Decision{
+		RequestID:  GetRequestIDFromContext(req.Context()),
+		PolicyName: policyName,
+		Allowed:    evaluationErr == nil,
+		Cached:     cached,
+		UserID:     userID,
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		Input:      input,
+	}
+	if evaluationErr != nil {
+		decision.Error = evaluationErr.Error()
+	}
+	if err := decisionlog.GetLoggerFromContext(req.Context()).Log(decision); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed decision log write")
+	}
+}
+
+func failResponseOnDeny(w http.ResponseWriter, onDeny OnDenyOptions, reason string) {
+	statusCode := http.StatusForbidden
+	if onDeny.StatusCode >= http.StatusBadRequest && onDeny.StatusCode < 600 {
+		statusCode = onDeny.StatusCode
+	}
+	message := NO_PERMISSIONS_ERROR_MESSAGE
+	if onDeny.Message != "" {
+		message = onDeny.Message
+	}
+	failResponseWithReason(w, statusCode, "RBAC policy evaluation failed", message, reason)
+}
+
+// hasUserIdentity reports whether the request carries any of the configured identity headers
+// or a bearer token, telling apart anonymous requests from the authenticated ones.
+func hasUserIdentity(headers http.Header, env config.EnvironmentVariables) bool {
+	for _, headerKey := range []string{env.UserIdHeader, env.UserGroupsHeader, env.UserPropertiesHeader} {
+		if headerKey != "" && headers.Get(headerKey) != "" {
+			return true
+		}
+	}
+	_, hasToken := authtoken.BearerTokenFromHeader(headers)
+	return hasToken
+}
+
+// defaultRowFilterQueryLogSize is the maximum size of the logged row filter query, unless configured otherwise.
+const defaultRowFilterQueryLogSize = 1024
+
+const redactedValue = "[REDACTED]"
+
+// logRowFilterQuery logs at debug level the row filter query, truncated to the configured size.
+// With redaction enabled, the values of the query are replaced keeping its structure and fields.
+func logRowFilterQuery(logger *logrus.Entry, query []byte, env config.EnvironmentVariables) {
+	if !logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	if env.RedactRowFilterQuery {
+		var decodedQuery interface{}
+		if err := json.Unmarshal(query, &decodedQuery); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed row filter query redaction")
+			return
+		}
+		redactedQuery, err := json.Marshal(redactQueryValues(decodedQuery))
+		if err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed row filter query redaction")
+			return
+		}
+		query = redactedQuery
+	}
+
+	maxSize := env.RowFilterQueryLogSize
+	if maxSize <= 0 {
+		maxSize = defaultRowFilterQueryLogSize
+	}
+	fields := logrus.Fields{"querySize": len(query)}
+	if len(query) > maxSize {
+		fields["query"] = string(query[:maxSize])
+		fields["queryTruncated"] = true
+	} else {
+		fields["query"] = string(query)
+	}
+	logger.WithFields(fields).Debug("row filter query generated")
+}
+
+// redactQueryValues replaces the values of the query, keeping the field names and the operators.
+func redactQueryValues(query interface{}) interface{} {
+	switch typedQuery := query.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(typedQuery))
+		for key, value := range typedQuery {
+			redacted[key] = redactQueryValues(value)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(typedQuery))
+		for i, value := range typedQuery {
+			redacted[i] = redactQueryValues(value)
+		}
+		return redacted
+	}
+	return redactedValue
+}
+
+// isTrustedIdentitySource reports whether the identity headers of the request can be trusted,
+// that is when no trusted source is configured or the request peer address belongs to one of them.
+// The X-Forwarded-For header is not taken into account, since it can be set by the client.
+func isTrustedIdentitySource(req *http.Request, env config.EnvironmentVariables) bool {
+	sources := utils.SplitHeaderValues(env.TrustedIdentitySource, ",")
+	if len(sources) == 0 {
+		return true
+	}
+	peerIP := net.ParseIP(requestClientIP(req, false))
+	if peerIP == nil {
+		return false
+	}
+	for _, source := range sources {
+		if _, sourceNet, err := net.ParseCIDR(source); err == nil {
+			if sourceNet.Contains(peerIP) {
+				return true
+			}
+			continue
+		}
+		if sourceIP := net.ParseIP(source); sourceIP != nil && sourceIP.Equal(peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// clearIdentityHeaders removes the configured identity headers, so that they are neither used to
+// build the policy input nor proxied to the target service.
+func clearIdentityHeaders(headers http.Header, env config.EnvironmentVariables) {
+	for _, headerKey := range []string{env.UserIdHeader, env.UserGroupsHeader, env.UserPropertiesHeader} {
+		if headerKey != "" {
+			headers.Del(headerKey)
+		}
+	}
+}
+
 func ReverseProxy(logger *logrus.Entry, env config.EnvironmentVariables, w http.ResponseWriter, req *http.Request, permission *RondConfig, partialResultsEvaluators PartialResultsEvaluators) {
-	targetHostFromEnv := env.TargetServiceHost
+	targetHostFromEnv := targetServiceURLHost(env.TargetServiceHost)
+	targetSchemeFromEnv := env.TargetServiceScheme
+	if targetSchemeFromEnv == "" {
+		targetSchemeFromEnv = URL_SCHEME
+	}
+	transport := newRetryTransport(getTargetServiceTransport(req.Context()), env, isRetryOptedIn(req))
 	proxy := httputil.ReverseProxy{
 		FlushInterval: -1,
+		Transport:     transport,
 		Director: func(req *http.Request) {
 			req.URL.Host = targetHostFromEnv
-			req.URL.Scheme = URL_SCHEME
+			req.URL.Scheme = targetSchemeFromEnv
 			if _, ok := req.Header["User-Agent"]; !ok {
-				// explicitly disable User-Agent so it's not set to default value
-				req.Header.Set("User-Agent", "")
+				req.Header.Set("User-Agent", missingUserAgent(env))
+			}
+			// the retries opt in is meant for rond only
+			req.Header.Del(ProxyRetryHeaderKey)
+			setForwardedHeaders(req, env.TrustInboundForwarded)
+			setProxyHeaders(req, env)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("target service request timed out")
+				failResponseWithCode(w, http.StatusGatewayTimeout, "target service request timed out", TIMEOUT_ERROR_MESSAGE)
+				return
 			}
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("target service request failed")
+			w.WriteHeader(http.StatusBadGateway)
 		},
 	}
 
+	// the upgraded connection is tunneled as it is by the proxy, without any response filtering
+	if isUpgradeRequest(req) {
+		proxy.ServeHTTP(upgradableResponseWriter(w, req), req)
+		return
+	}
+
 	// Check on nil is performed to proxy the oas documentation path
 	if permission == nil || permission.ResponseFlow.PolicyName == "" {
 		proxy.ServeHTTP(w, req)
 		return
 	}
 	proxy.Transport = &OPATransport{
-		http.DefaultTransport,
-		req.Context(),
+		transport,
 		logger,
 		req,
 		permission,
@@ -187,6 +711,62 @@ func ReverseProxy(logger *logrus.Entry, env config.EnvironmentVariables, w http.
 	proxy.ServeHTTP(w, req)
 }
 
+// missingUserAgent returns the User-Agent sent to the target service for requests without one.
+// By default it is empty, which explicitly disables the Go default User-Agent so that none is sent;
+// with PreserveUserAgent it is DefaultUserAgent, or rond/<version> if not configured.
+func missingUserAgent(env config.EnvironmentVariables) string {
+	if !env.PreserveUserAgent {
+		return ""
+	}
+	if env.DefaultUserAgent != "" {
+		return env.DefaultUserAgent
+	}
+	return "rond/" + env.ServiceVersion
+}
+
+// setForwardedHeaders sets the X-Forwarded-Host and X-Forwarded-Proto headers from the
+// incoming request, keeping the inbound ones only if trusted. The client IP is appended to
+// X-Forwarded-For by the reverse proxy itself, so an untrusted inbound chain is just dropped.
+func setForwardedHeaders(req *http.Request, trustInbound bool) {
+	if !trustInbound {
+		req.Header.Del(XForwardedForHeaderKey)
+		req.Header.Del(XForwardedHostHeaderKey)
+		req.Header.Del(XForwardedProtoHeaderKey)
+	}
+
+	if req.Header.Get(XForwardedHostHeaderKey) == "" {
+		req.Header.Set(XForwardedHostHeaderKey, req.Host)
+	}
+	if req.Header.Get(XForwardedProtoHeaderKey) == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set(XForwardedProtoHeaderKey, proto)
+	}
+}
+
+// stripInboundHeaders removes the configured headers sent by the client, before they are
+// used to build the policy input, so that the ones set by rond later on are proxied.
+func stripInboundHeaders(headers http.Header, env config.EnvironmentVariables) {
+	for _, headerKey := range utils.SplitHeaderValues(env.ProxyStripHeaders, ",") {
+		headers.Del(headerKey)
+	}
+}
+
+// setProxyHeaders adds the configured headers to the proxied request.
+// The added headers override the ones sent by the client, but not the ones set by the allow policies.
+func setProxyHeaders(req *http.Request, env config.EnvironmentVariables) {
+	// PROXY_ADD_HEADERS is validated at startup
+	addHeaders, _ := config.ParseHeaderPairs(env.ProxyAddHeaders)
+	policyHeaders := getPolicyHeadersFromContext(req.Context())
+	for headerKey, values := range addHeaders {
+		if !policyHeaders[headerKey] {
+			req.Header[headerKey] = values
+		}
+	}
+}
+
 func alwaysProxyHandler(w http.ResponseWriter, req *http.Request) {
 	requestContext := req.Context()
 	logger := glogger.Get(req.Context())
@@ -196,5 +776,6 @@ func alwaysProxyHandler(w http.ResponseWriter, req *http.Request) {
 		failResponse(w, "no environment found in context", GENERIC_BUSINESS_ERROR_MESSAGE)
 		return
 	}
+	stripInboundHeaders(req.Header, env)
 	ReverseProxyOrResponse(logger, env, w, req, nil, nil)
 }
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -27,11 +28,15 @@ import (
 	"strings"
 
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/custom_builtins"
+	"github.com/rond-authz/rond/internal/authtoken"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/decisionlog"
 	"github.com/rond-authz/rond/internal/mocks"
 	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/opatranslator"
 	"github.com/rond-authz/rond/internal/testutils"
 	"github.com/rond-authz/rond/types"
 
@@ -113,6 +118,151 @@ func TestDirectProxyHandler(t *testing.T) {
 		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
 	})
 
+	t.Run("forwards client information with X-Forwarded headers", func(t *testing.T) {
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		testCases := []struct {
+			name                  string
+			trustInboundForwarded bool
+			expectedForwardedFor  string
+			expectedForwardedHost string
+		}{
+			{
+				name:                  "appends client IP to trusted inbound chain",
+				trustInboundForwarded: true,
+				expectedForwardedFor:  "10.0.0.1, 192.168.1.10",
+				expectedForwardedHost: "public.example.com",
+			},
+			{
+				name:                  "resets untrusted inbound chain",
+				trustInboundForwarded: false,
+				expectedForwardedFor:  "192.168.1.10",
+				expectedForwardedHost: "www.example.com:8080",
+			},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.name, func(t *testing.T) {
+				invoked := false
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					invoked = true
+					assert.Equal(t, r.Header.Get("X-Forwarded-For"), testCase.expectedForwardedFor)
+					assert.Equal(t, r.Header.Get("X-Forwarded-Host"), testCase.expectedForwardedHost)
+					assert.Equal(t, r.Header.Get("X-Forwarded-Proto"), "http")
+					w.WriteHeader(http.StatusOK)
+				}))
+				defer server.Close()
+
+				serverURL, _ := url.Parse(server.URL)
+				ctx := createContext(t,
+					ctx,
+					config.EnvironmentVariables{TargetServiceHost: serverURL.Host, TrustInboundForwarded: testCase.trustInboundForwarded},
+					nil,
+					mockXPermission,
+					mockOPAModule,
+					partialEvaluators,
+				)
+
+				r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+				assert.Equal(t, err, nil, "Unexpected error")
+				r.RemoteAddr = "192.168.1.10:54321"
+				r.Header.Set("X-Forwarded-For", "10.0.0.1")
+				r.Header.Set("X-Forwarded-Host", "public.example.com")
+				r.Header.Set("X-Forwarded-Proto", "http")
+
+				w := httptest.NewRecorder()
+				rbacHandler(w, r)
+
+				assert.Assert(t, invoked, "Handler was not invoked.")
+				assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+			})
+		}
+	})
+
+	t.Run("sends User-Agent to the target service", func(t *testing.T) {
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		testCases := []struct {
+			name              string
+			env               config.EnvironmentVariables
+			requestUserAgent  string
+			expectedUserAgent string
+			expectedPresent   bool
+		}{
+			{
+				name:            "does not send missing User-Agent by default",
+				env:             config.EnvironmentVariables{ServiceVersion: "1.2.3"},
+				expectedPresent: false,
+			},
+			{
+				name:              "forwards the client User-Agent",
+				env:               config.EnvironmentVariables{ServiceVersion: "1.2.3"},
+				requestUserAgent:  "client/1.0",
+				expectedUserAgent: "client/1.0",
+				expectedPresent:   true,
+			},
+			{
+				name:              "sends rond version when preserving User-Agent",
+				env:               config.EnvironmentVariables{ServiceVersion: "1.2.3", PreserveUserAgent: true},
+				expectedUserAgent: "rond/1.2.3",
+				expectedPresent:   true,
+			},
+			{
+				name:              "sends configured default User-Agent when preserving User-Agent",
+				env:               config.EnvironmentVariables{ServiceVersion: "1.2.3", PreserveUserAgent: true, DefaultUserAgent: "my-gateway"},
+				expectedUserAgent: "my-gateway",
+				expectedPresent:   true,
+			},
+			{
+				name:              "forwards the client User-Agent when preserving User-Agent",
+				env:               config.EnvironmentVariables{ServiceVersion: "1.2.3", PreserveUserAgent: true, DefaultUserAgent: "my-gateway"},
+				requestUserAgent:  "client/1.0",
+				expectedUserAgent: "client/1.0",
+				expectedPresent:   true,
+			},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.name, func(t *testing.T) {
+				invoked := false
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					invoked = true
+					_, present := r.Header["User-Agent"]
+					assert.Equal(t, present, testCase.expectedPresent, "Mocked Backend: Unexpected User-Agent presence")
+					assert.Equal(t, r.Header.Get("User-Agent"), testCase.expectedUserAgent, "Mocked Backend: Unexpected User-Agent")
+					w.WriteHeader(http.StatusOK)
+				}))
+				defer server.Close()
+
+				serverURL, _ := url.Parse(server.URL)
+				env := testCase.env
+				env.TargetServiceHost = serverURL.Host
+				ctx := createContext(t,
+					ctx,
+					env,
+					nil,
+					mockXPermission,
+					mockOPAModule,
+					partialEvaluators,
+				)
+
+				r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+				assert.Equal(t, err, nil, "Unexpected error")
+				if testCase.requestUserAgent != "" {
+					r.Header.Set("User-Agent", testCase.requestUserAgent)
+				}
+
+				w := httptest.NewRecorder()
+				rbacHandler(w, r)
+
+				assert.Assert(t, invoked, "Handler was not invoked.")
+				assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+			})
+		}
+	})
+
 	t.Run("sends request with custom headers", func(t *testing.T) {
 		invoked := false
 		mockHeader := "CustomHeader"
@@ -149,6 +299,49 @@ func TestDirectProxyHandler(t *testing.T) {
 		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
 	})
 
+	t.Run("adds and strips the configured headers", func(t *testing.T) {
+		invoked := false
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			assert.Equal(t, r.Header.Get("X-Gateway"), "rond")
+			assert.Equal(t, r.Header.Get("X-Env"), "prod", "configured headers must override the client ones")
+			assert.Equal(t, r.Header.Get("miauserid"), "", "stripped header must not be proxied")
+			assert.Equal(t, r.Header.Get("CustomHeader"), "kept")
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{
+				TargetServiceHost: serverURL.Host,
+				ProxyAddHeaders:   "X-Gateway=rond, X-Env=prod",
+				ProxyStripHeaders: "miauserid",
+			},
+			nil,
+			mockXPermission,
+			mockOPAModule,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		r.Header.Set("X-Env", "from-client")
+		r.Header.Set("miauserid", "spoofed")
+		r.Header.Set("CustomHeader", "kept")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+	})
+
 	t.Run("sends request with body", func(t *testing.T) {
 		invoked := false
 		mockBodySting := "I am a body"
@@ -315,6 +508,73 @@ allow {
 		assert.Equal(t, string(buf), "Mocked Backend Body Example", "Unexpected body response")
 	})
 
+	t.Run("sends sql filter query", func(t *testing.T) {
+		policy := `package policies
+allow {
+	input.request.method == "GET"
+
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+	employee.salary > 0
+}
+
+allow {
+	input.request.method == "GET"
+
+	employee := data.resources[_]
+	employee.salary <= 10
+}
+`
+
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			var filterQuery map[string]interface{}
+			err := json.Unmarshal([]byte(r.Header.Get("rowfilterquery")), &filterQuery)
+			assert.Equal(t, err, nil, "Mocked backend: Unexpected error")
+			assert.DeepEqual(t, map[string]interface{}{
+				"where": `("manager" = $1 AND "salary" > $2) OR ("salary" <= $3)`,
+				"args":  []interface{}{"manager_test", float64(0), float64(10)},
+			}, filterQuery)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
+		rondConfigWithSQLQueryGen := &RondConfig{
+			RequestFlow: RequestFlow{
+				PolicyName:    "allow",
+				GenerateQuery: true,
+				QueryOptions: QueryOptions{
+					HeaderName: "rowfilterquery",
+					Dialect:    "sql",
+				},
+			},
+		}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oasWithFilter, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			nil,
+			rondConfigWithSQLQueryGen,
+			opaModuleConfig,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+	})
+
 	t.Run("sends empty filter query", func(t *testing.T) {
 		policy := `package policies
 allow {
@@ -455,98 +715,1677 @@ allow {
 
 		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
 
-		partialEvaluators, err := setupEvaluators(ctx, nil, &oasWithFilter, opaModuleConfig, envs)
-		assert.Equal(t, err, nil, "Unexpected error")
-		ctx := createContext(t,
-			context.Background(),
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
-			nil,
-			mockRondConfigWithQueryGen,
-			opaModuleConfig,
-			partialEvaluators,
-		)
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oasWithFilter, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			nil,
+			mockRondConfigWithQueryGen,
+			opaModuleConfig,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", body)
+		assert.Equal(t, err, nil, "Unexpected error")
+		r.Header.Set(ContentTypeHeaderKey, "text/plain")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, !invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
+	})
+
+	t.Run("filter query return not allow", func(t *testing.T) {
+		policy := `package policies
+allow {
+	get_header("examplekey", input.headers) == "test"
+	input.request.method == "DELETE"
+	employee := data.resources[_]
+	employee.name == "name_test"
+}
+
+allow {
+	input.request.method == "GET111"
+
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+}
+
+allow {
+	input.request.method == "GETAAA"
+	input.request.path == "/api"
+	employee := data.resources[_]
+	employee.salary < 0
+}
+`
+
+		invoked := false
+		mockBodySting := "I am a body"
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			defer r.Body.Close()
+			buf, err := io.ReadAll(r.Body)
+			assert.Equal(t, err, nil, "Mocked backend: Unexpected error")
+			assert.Equal(t, string(buf), mockBodySting, "Mocked backend: Unexpected Body received")
+			filterQuery := r.Header.Get("rowfilterquery")
+			expectedQuery := ``
+			assert.Equal(t, expectedQuery, filterQuery)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("Mocked Backend Body Example"))
+		}))
+		defer server.Close()
+
+		body := strings.NewReader(mockBodySting)
+
+		serverURL, _ := url.Parse(server.URL)
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oasWithFilter, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			nil,
+			mockRondConfigWithQueryGen,
+			opaModuleConfig,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", body)
+		assert.Equal(t, err, nil, "Unexpected error")
+		r.Header.Set("miauserproperties", `{"name":"gianni"}`)
+		r.Header.Set("examplekey", "value")
+		r.Header.Set(ContentTypeHeaderKey, "text/plain")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, !invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader, "Unexpected content type.")
+	})
+
+	t.Run("returns 504 when target service does not respond within request timeout", func(t *testing.T) {
+		unblockServer := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-unblockServer
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+		defer close(unblockServer)
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			ctx,
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, RequestTimeout: 50 * time.Millisecond},
+			nil,
+			mockXPermission,
+			mockOPAModule,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusGatewayTimeout, "Unexpected status code.")
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader, "Unexpected content type.")
+	})
+
+	t.Run("proxies request completed within request timeout", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			ctx,
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, RequestTimeout: time.Minute},
+			nil,
+			mockXPermission,
+			mockOPAModule,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+	})
+
+	t.Run("proxies denied request in policy audit mode", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { false }`}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		auditLog, hook := test.NewNullLogger()
+		serverURL, _ := url.Parse(server.URL)
+		ctx := glogger.WithLogger(createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PolicyAuditMode: true},
+			nil,
+			mockXPermission,
+			opaModuleConfig,
+			partialEvaluators,
+		), logrus.NewEntry(auditLog))
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+
+		var auditEntry *logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				auditEntry = entry
+			}
+		}
+		assert.Assert(t, auditEntry != nil, "audit log not found")
+		assert.Equal(t, auditEntry.Data["wouldBlock"], true)
+		assert.Equal(t, auditEntry.Data["policyName"], "todo")
+		assert.Assert(t, auditEntry.Data["input"] != "", "missing policy input")
+	})
+
+	t.Run("returns 401 on invalid bearer token when verification is enabled", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { true }`}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := authtoken.WithVerifier(createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			nil,
+			mockXPermission,
+			opaModuleConfig,
+			partialEvaluators,
+		), authtoken.NewVerifier("http://jwks.example.com", "", "", 0))
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		r.Header.Set("Authorization", "Bearer not-a-token")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusUnauthorized, "Unexpected status code.")
+		var requestError types.RequestError
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&requestError))
+		assert.Equal(t, requestError.Message, INVALID_TOKEN_ERROR_MESSAGE)
+	})
+
+	t.Run("request body size limit", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { input.request.body.hello == "world" }`}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		body := `{"hello":"world"}`
+
+		t.Run("returns 413 when exceeded", func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			serverURL, _ := url.Parse(server.URL)
+			ctx := createContext(t,
+				context.Background(),
+				config.EnvironmentVariables{TargetServiceHost: serverURL.Host, RequestMaxBodySize: int64(len(body) - 1)},
+				nil,
+				mockXPermission,
+				opaModuleConfig,
+				partialEvaluators,
+			)
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api", strings.NewReader(body))
+			assert.Equal(t, err, nil, "Unexpected error")
+			r.Header.Set(ContentTypeHeaderKey, "application/json")
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Assert(t, !invoked, "Handler was invoked.")
+			assert.Equal(t, w.Result().StatusCode, http.StatusRequestEntityTooLarge, "Unexpected status code.")
+			var requestError types.RequestError
+			assert.NilError(t, json.NewDecoder(w.Body).Decode(&requestError))
+			assert.Equal(t, requestError.Message, REQUEST_BODY_TOO_LARGE_ERROR_MESSAGE)
+		})
+
+		t.Run("proxies the whole body when within the limit", func(t *testing.T) {
+			var proxiedBody []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxiedBody, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			serverURL, _ := url.Parse(server.URL)
+			ctx := createContext(t,
+				context.Background(),
+				config.EnvironmentVariables{TargetServiceHost: serverURL.Host, RequestMaxBodySize: int64(len(body))},
+				nil,
+				mockXPermission,
+				opaModuleConfig,
+				partialEvaluators,
+			)
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api", strings.NewReader(body))
+			assert.Equal(t, err, nil, "Unexpected error")
+			r.Header.Set(ContentTypeHeaderKey, "application/json")
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+			assert.Equal(t, string(proxiedBody), body)
+		})
+	})
+
+	t.Run("writes decision log with redacted headers", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { true }`}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		decisionLog := &bytes.Buffer{}
+		serverURL, _ := url.Parse(server.URL)
+		ctx := decisionlog.WithLogger(createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host, UserIdHeader: "miauserid"},
+			nil,
+			mockXPermission,
+			opaModuleConfig,
+			partialEvaluators,
+		), decisionlog.NewLogger(decisionLog, []string{"X-Api-Key"}))
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		r.Header.Set("miauserid", "user1")
+		r.Header.Set("Authorization", "Bearer secret-token")
+		r.Header.Set("X-Api-Key", "secret-key")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+		var decision map[string]interface{}
+		assert.NilError(t, json.Unmarshal(decisionLog.Bytes(), &decision))
+		assert.Equal(t, decision["policyName"], "todo")
+		assert.Equal(t, decision["allowed"], true)
+		assert.Equal(t, decision["userId"], "user1")
+		assert.Equal(t, decision["method"], http.MethodGet)
+		assert.Equal(t, decision["path"], "/api")
+		assert.Assert(t, decision["input"] != nil, "missing policy input")
+		assert.Assert(t, !strings.Contains(decisionLog.String(), "secret"), "sensitive header logged")
+	})
+
+	t.Run("returns custom status code and message configured on deny", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { false }`}
+		permission := &RondConfig{
+			RequestFlow: RequestFlow{
+				PolicyName: "todo",
+				OnDeny:     OnDenyOptions{StatusCode: http.StatusNotFound, Message: "resource not found"},
+			},
+		}
+
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			ctx,
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			nil,
+			permission,
+			opaModuleConfig,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		testutils.AssertResponseFullErrorMessages(t, w, http.StatusNotFound, "RBAC policy evaluation failed", "resource not found")
+	})
+
+	t.Run("distinguishes anonymous and authenticated denials", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+todo { false }`}
+		partialEvaluators, err := setupEvaluators(ctx, nil, &oas, opaModuleConfig, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		testCases := []struct {
+			name               string
+			distinguish        bool
+			headers            map[string]string
+			onDeny             OnDenyOptions
+			expectedStatusCode int
+			expectedMessage    string
+		}{
+			{
+				name:               "anonymous request with flag disabled",
+				expectedStatusCode: http.StatusForbidden,
+				expectedMessage:    NO_PERMISSIONS_ERROR_MESSAGE,
+			},
+			{
+				name:               "anonymous request",
+				distinguish:        true,
+				expectedStatusCode: http.StatusUnauthorized,
+				expectedMessage:    UNAUTHENTICATED_ERROR_MESSAGE,
+			},
+			{
+				name:               "anonymous request with status code configured on deny",
+				distinguish:        true,
+				onDeny:             OnDenyOptions{StatusCode: http.StatusNotFound},
+				expectedStatusCode: http.StatusNotFound,
+				expectedMessage:    NO_PERMISSIONS_ERROR_MESSAGE,
+			},
+			{
+				name:               "request with user id",
+				distinguish:        true,
+				headers:            map[string]string{"miauserid": "user1"},
+				expectedStatusCode: http.StatusForbidden,
+				expectedMessage:    NO_PERMISSIONS_ERROR_MESSAGE,
+			},
+			{
+				name:               "request with user groups",
+				distinguish:        true,
+				headers:            map[string]string{"miausergroups": "group1"},
+				expectedStatusCode: http.StatusForbidden,
+				expectedMessage:    NO_PERMISSIONS_ERROR_MESSAGE,
+			},
+			{
+				name:               "request with bearer token",
+				distinguish:        true,
+				headers:            map[string]string{"Authorization": "Bearer some-token"},
+				expectedStatusCode: http.StatusForbidden,
+				expectedMessage:    NO_PERMISSIONS_ERROR_MESSAGE,
+			},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.name, func(t *testing.T) {
+				permission := &RondConfig{
+					RequestFlow: RequestFlow{PolicyName: "todo", OnDeny: testCase.onDeny},
+				}
+				ctx := createContext(t,
+					ctx,
+					config.EnvironmentVariables{
+						TargetServiceHost:    "targetservice.test",
+						UserIdHeader:         "miauserid",
+						UserGroupsHeader:     "miausergroups",
+						Distinguish401And403: testCase.distinguish,
+					},
+					nil,
+					permission,
+					opaModuleConfig,
+					partialEvaluators,
+				)
+
+				r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+				assert.Equal(t, err, nil, "Unexpected error")
+				for key, value := range testCase.headers {
+					r.Header.Set(key, value)
+				}
+				w := httptest.NewRecorder()
+
+				rbacHandler(w, r)
+
+				testutils.AssertResponseFullErrorMessages(t, w, testCase.expectedStatusCode, "RBAC policy evaluation failed", testCase.expectedMessage)
+			})
+		}
+	})
+}
+
+func TestEvaluateRequestRowFilterHeaderKey(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow {
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+}`}
+	expectedQuery := `{"$or":[{"$and":[{"manager":{"$eq":"manager_test"}}]}]}`
+
+	testCases := []struct {
+		name              string
+		globalHeaderKey   string
+		routeHeaderKey    string
+		expectedHeaderKey string
+	}{
+		{name: "defaults to acl_rows", expectedHeaderKey: BASE_ROW_FILTER_HEADER_KEY},
+		{name: "uses the global header key without per-route configuration", globalHeaderKey: "x-global-filter", expectedHeaderKey: "x-global-filter"},
+		{name: "per-route header key takes precedence", globalHeaderKey: "x-global-filter", routeHeaderKey: "x-route-filter", expectedHeaderKey: "x-route-filter"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			env := config.EnvironmentVariables{RowFilterHeaderKey: testCase.globalHeaderKey}
+			permission := &RondConfig{
+				RequestFlow: RequestFlow{
+					PolicyName:    "allow",
+					GenerateQuery: true,
+					QueryOptions:  QueryOptions{HeaderName: testCase.routeHeaderKey},
+				},
+			}
+			ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, nil)
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			w := httptest.NewRecorder()
+
+			err = EvaluateRequest(r, env, w, nil, permission)
+			assert.NilError(t, err)
+			assert.Equal(t, r.Header.Get(testCase.expectedHeaderKey), expectedQuery)
+			for _, headerKey := range []string{BASE_ROW_FILTER_HEADER_KEY, "x-global-filter", "x-route-filter"} {
+				if headerKey != testCase.expectedHeaderKey {
+					assert.Equal(t, r.Header.Get(headerKey), "", "unexpected filter query in %s header", headerKey)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateRequestLogRowFilterQuery(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow {
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+}`}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", GenerateQuery: true}}
+
+	evaluateRequest := func(t *testing.T, env config.EnvironmentVariables) []*logrus.Entry {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+		ctx := glogger.WithLogger(createContext(t, context.Background(), env, nil, permission, opaModuleConfig, nil), logrus.NewEntry(log))
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		err = EvaluateRequest(r, env, httptest.NewRecorder(), nil, permission)
+		assert.NilError(t, err)
+
+		entries := []*logrus.Entry{}
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "row filter query generated" {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	t.Run("does not log the query by default", func(t *testing.T) {
+		assert.Equal(t, len(evaluateRequest(t, config.EnvironmentVariables{})), 0)
+	})
+
+	t.Run("logs the query", func(t *testing.T) {
+		entries := evaluateRequest(t, config.EnvironmentVariables{LogRowFilterQuery: true})
+		assert.Equal(t, len(entries), 1)
+		assert.Equal(t, entries[0].Level, logrus.DebugLevel)
+		assert.Equal(t, entries[0].Data["query"], `{"$or":[{"$and":[{"manager":{"$eq":"manager_test"}}]}]}`)
+		assert.Equal(t, entries[0].Data["querySize"], 55)
+	})
+
+	t.Run("logs the redacted query", func(t *testing.T) {
+		entries := evaluateRequest(t, config.EnvironmentVariables{LogRowFilterQuery: true, RedactRowFilterQuery: true})
+		assert.Equal(t, len(entries), 1)
+		assert.Equal(t, entries[0].Data["query"], `{"$or":[{"$and":[{"manager":{"$eq":"[REDACTED]"}}]}]}`)
+	})
+
+	t.Run("truncates the query exceeding the size", func(t *testing.T) {
+		entries := evaluateRequest(t, config.EnvironmentVariables{LogRowFilterQuery: true, RowFilterQueryLogSize: 10})
+		assert.Equal(t, len(entries), 1)
+		assert.Equal(t, entries[0].Data["query"], `{"$or":[{"`)
+		assert.Equal(t, entries[0].Data["queryTruncated"], true)
+	})
+}
+
+func TestEvaluateRequestQueryMaxClauses(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+managers := ["m1", "m2", "m3", "m4"]
+teams := ["t1", "t2", "t3", "t4"]
+allow {
+	resource := data.resources[_]
+	resource.manager == managers[_]
+	resource.team == teams[_]
+}`}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", GenerateQuery: true}}
+
+	t.Run("forwards the query within the limit", func(t *testing.T) {
+		env := config.EnvironmentVariables{QueryMaxClauses: 32}
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, nil)
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, nil, permission)
+		assert.NilError(t, err)
+		assert.Assert(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY) != "")
+	})
+
+	t.Run("responds 403 when the query exceeds the limit", func(t *testing.T) {
+		env := config.EnvironmentVariables{QueryMaxClauses: 31}
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, nil)
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, nil, permission)
+		assert.Assert(t, errors.Is(err, opatranslator.ErrQueryTooComplex))
+		assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), "")
+		testutils.AssertResponseFullErrorMessages(t, w, http.StatusForbidden, "query too complex: more than 31 clauses", QUERY_TOO_COMPLEX_ERROR_MESSAGE)
+	})
+}
+
+func TestEvaluateRequestDisableRowFilter(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+filter_projects {
+	input.request.method == "GET"
+}
+filter_projects {
+	resource := data.resources[_]
+	resource.public == true
+}`}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "filter_projects", GenerateQuery: true}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"all": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+
+	evaluateRequest := func(t *testing.T, env config.EnvironmentVariables, method string) (*http.Request, *httptest.ResponseRecorder, error) {
+		t.Helper()
+		partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModuleConfig, env)
+		assert.NilError(t, err)
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModuleConfig, partialEvaluators)
+		r, err := http.NewRequestWithContext(ctx, method, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, partialEvaluators, permission)
+		return r, w, err
+	}
+
+	t.Run("generates the row filter query by default", func(t *testing.T) {
+		r, _, err := evaluateRequest(t, config.EnvironmentVariables{}, http.MethodPost)
+		assert.NilError(t, err)
+		assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), `{"$or":[{"$and":[{"public":{"$eq":true}}]}]}`)
+	})
+
+	t.Run("allows as a plain allow policy with the row filter disabled", func(t *testing.T) {
+		r, _, err := evaluateRequest(t, config.EnvironmentVariables{DisableRowFilter: true}, http.MethodGet)
+		assert.NilError(t, err)
+		assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), "")
+		assert.Assert(t, permission.RequestFlow.GenerateQuery, "route permission must not be modified")
+	})
+
+	t.Run("denies as a plain allow policy with the row filter disabled", func(t *testing.T) {
+		r, w, err := evaluateRequest(t, config.EnvironmentVariables{DisableRowFilter: true}, http.MethodPost)
+		assert.Assert(t, err != nil)
+		assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), "")
+		testutils.AssertResponseFullErrorMessages(t, w, http.StatusForbidden, "RBAC policy evaluation failed", NO_PERMISSIONS_ERROR_MESSAGE)
+	})
+}
+
+func TestEvaluateRequestBodySchema(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow { true }`}
+	oas, err := deserializeSpec([]byte(`{
+		"paths":{"/users":{"post":{"x-rond":{"requestFlow":{"policyName":"allow","bodySchemaRef":"#/components/schemas/User"}}}}},
+		"components":{"schemas":{"User":{
+			"type":"object",
+			"required":["name"],
+			"properties":{"name":{"type":"string"},"age":{"type":"integer","minimum":0}}
+		}}}
+	}`), ErrFileLoadFailed)
+	assert.NilError(t, err)
+	permission, err := oas.FindPermission(oas.PrepareOASRouter(), "/users", http.MethodPost)
+	assert.NilError(t, err)
+	assert.Assert(t, permission.RequestFlow.BodySchema != nil)
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModuleConfig, envs)
+	assert.NilError(t, err)
+
+	evaluateRequest := func(t *testing.T, contentType, body string) (*http.Request, *httptest.ResponseRecorder, error) {
+		t.Helper()
+		ctx := createContext(t, context.Background(), envs, nil, &permission, opaModuleConfig, partialEvaluators)
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/users", strings.NewReader(body))
+		assert.NilError(t, err)
+		r.Header.Set(ContentTypeHeaderKey, contentType)
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, envs, w, partialEvaluators, &permission)
+		return r, w, err
+	}
+
+	t.Run("accepts a valid body", func(t *testing.T) {
+		r, _, err := evaluateRequest(t, JSONContentTypeHeader, `{"name":"john","age":42}`)
+		assert.NilError(t, err)
+		bodyBytes, err := io.ReadAll(r.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, string(bodyBytes), `{"name":"john","age":42}`)
+	})
+
+	t.Run("rejects an invalid body", func(t *testing.T) {
+		_, w, err := evaluateRequest(t, JSONContentTypeHeader, `{"age":-1}`)
+		assert.Assert(t, errors.Is(err, ErrInvalidRequestBody))
+		assert.Equal(t, w.Result().StatusCode, http.StatusBadRequest)
+		responseBody := getJSONResponseBody[types.RequestError](t, w)
+		assert.Equal(t, responseBody.Message, INVALID_REQUEST_BODY_ERROR_MESSAGE)
+		assert.ErrorContains(t, err, `property "name" is missing`)
+	})
+
+	t.Run("rejects a malformed body", func(t *testing.T) {
+		_, w, err := evaluateRequest(t, JSONContentTypeHeader, `{"name":`)
+		assert.Assert(t, errors.Is(err, ErrInvalidRequestBody))
+		assert.Equal(t, w.Result().StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("skips validation of non JSON body", func(t *testing.T) {
+		_, _, err := evaluateRequest(t, "text/plain", `not json`)
+		assert.NilError(t, err)
+	})
+}
+
+func TestEvaluateRequestDisablePartialCache(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow {
+	project := find_one("projects", {"projectId": "p1"})
+	project.enabled == true
+}`}
+
+	evaluateRequests := func(t *testing.T, permission *RondConfig) int {
+		t.Helper()
+		findOneCalls := 0
+		mongoMock := &mocks.MongoClientMock{
+			FindOneExpectation: func(collectionName string, query interface{}) { findOneCalls++ },
+			FindOneResult:      map[string]interface{}{"enabled": true},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{"get": VerbConfig{PermissionV2: permission}},
+			},
+		}
+		setupCtx := mongoclient.WithMongoClient(context.Background(), mongoMock)
+		partialEvaluators, err := setupEvaluators(setupCtx, mongoMock, oas, opaModuleConfig, envs)
+		assert.NilError(t, err)
+		findOneCalls = 0
+
+		for i := 0; i < 3; i++ {
+			ctx := createContext(t, context.Background(), envs, mongoMock, permission, opaModuleConfig, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			err = EvaluateRequest(r, envs, httptest.NewRecorder(), partialEvaluators, permission)
+			assert.NilError(t, err)
+		}
+		return findOneCalls
+	}
+
+	t.Run("precomputed evaluator reuses the query result frozen at startup", func(t *testing.T) {
+		findOneCalls := evaluateRequests(t, &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}})
+		assert.Equal(t, findOneCalls, 0)
+	})
+
+	t.Run("fresh evaluator queries on each request", func(t *testing.T) {
+		findOneCalls := evaluateRequests(t, &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true}})
+		assert.Equal(t, findOneCalls, 3)
+	})
+}
+
+func TestEvaluateRequestDecisionCache(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow {
+	project := find_one("projects", {"projectId": "p1"})
+	project.enabled == true
+}`}
+	env := config.EnvironmentVariables{UserIdHeader: "miauserid"}
+
+	evaluateRequests := func(t *testing.T, permission *RondConfig, enabled bool, userIDs ...string) (int, []int, *bytes.Buffer) {
+		t.Helper()
+		findOneCalls := 0
+		mongoMock := &mocks.MongoClientMock{
+			FindOneExpectation: func(collectionName string, query interface{}) { findOneCalls++ },
+			FindOneResult:      map[string]interface{}{"enabled": enabled},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{"get": VerbConfig{PermissionV2: permission}},
+			},
+		}
+		setupCtx := mongoclient.WithMongoClient(context.Background(), mongoMock)
+		partialEvaluators, err := setupEvaluators(setupCtx, mongoMock, oas, opaModuleConfig, env)
+		assert.NilError(t, err)
+		findOneCalls = 0
+
+		decisionCache := NewDecisionCache(10)
+		decisionLog := &bytes.Buffer{}
+		decisionLogger := decisionlog.NewLogger(decisionLog, nil)
+		statusCodes := []int{}
+		for _, userID := range userIDs {
+			ctx := createContext(t, context.Background(), env, mongoMock, permission, opaModuleConfig, partialEvaluators)
+			ctx = decisionlog.WithLogger(WithDecisionCache(ctx, decisionCache), decisionLogger)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			r.Header.Set("miauserid", userID)
+			w := httptest.NewRecorder()
+			if err := EvaluateRequest(r, env, w, partialEvaluators, permission); err != nil {
+				statusCodes = append(statusCodes, w.Result().StatusCode)
+				continue
+			}
+			statusCodes = append(statusCodes, http.StatusOK)
+		}
+		return findOneCalls, statusCodes, decisionLog
+	}
+
+	t.Run("identical request within the TTL skips policy evaluation", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true, CacheTTL: "1m"}}
+		findOneCalls, statusCodes, _ := evaluateRequests(t, permission, true, "user1", "user1")
+		assert.Equal(t, findOneCalls, 1)
+		assert.DeepEqual(t, statusCodes, []int{http.StatusOK, http.StatusOK})
+	})
+
+	t.Run("logs the cached decisions", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true, CacheTTL: "1m"}}
+		_, _, decisionLog := evaluateRequests(t, permission, false, "user1", "user1")
+
+		decoder := json.NewDecoder(decisionLog)
+		for _, cached := range []bool{false, true} {
+			var decision map[string]interface{}
+			assert.NilError(t, decoder.Decode(&decision))
+			assert.Equal(t, decision["policyName"], "allow")
+			assert.Equal(t, decision["allowed"], false)
+			assert.Equal(t, decision["userId"], "user1")
+			assert.Equal(t, decision["cached"] == true, cached)
+		}
+		assert.Assert(t, !decoder.More(), "unexpected decision logged")
+	})
+
+	t.Run("caches deny decisions", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true, CacheTTL: "1m"}}
+		findOneCalls, statusCodes, _ := evaluateRequests(t, permission, false, "user1", "user1")
+		assert.Equal(t, findOneCalls, 1)
+		assert.DeepEqual(t, statusCodes, []int{http.StatusForbidden, http.StatusForbidden})
+	})
+
+	t.Run("evaluates the requests of other users", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true, CacheTTL: "1m"}}
+		findOneCalls, _, _ := evaluateRequests(t, permission, true, "user1", "user2")
+		assert.Equal(t, findOneCalls, 2)
+	})
+
+	t.Run("evaluates every request without TTL", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", DisablePartialCache: true}}
+		findOneCalls, _, _ := evaluateRequests(t, permission, true, "user1", "user1")
+		assert.Equal(t, findOneCalls, 2)
+	})
+}
+
+func TestEvaluateRequestTenantHeader(t *testing.T) {
+	env := config.EnvironmentVariables{
+		UserIdHeader:    "userid",
+		TenantHeaderKey: "x-tenant",
+	}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	mongoClient := &mocks.MongoClientMock{
+		UserBindings: []types.Binding{},
+		UserRoles:    []types.Role{},
+	}
+
+	t.Run("responds 400 without tenant header", func(t *testing.T) {
+		ctx := createContext(t, context.Background(), env, mongoClient, permission, mockOPAModule, nil)
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		r.Header.Set("userid", "user1")
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, nil, permission)
+		assert.Assert(t, errors.Is(err, mongoclient.ErrInvalidTenant))
+		assert.Equal(t, w.Result().StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("evaluates the request with tenant header", func(t *testing.T) {
+		oas := OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"get": VerbConfig{PermissionV2: permission},
+				},
+			},
+		}
+		partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, mockOPAModule, env)
+		assert.NilError(t, err)
+
+		ctx := createContext(t, context.Background(), env, mongoClient, permission, mockOPAModule, partialEvaluators)
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		r.Header.Set("userid", "user1")
+		r.Header.Set("x-tenant", "tenant1")
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, partialEvaluators, permission)
+		assert.NilError(t, err)
+	})
+}
+
+func TestDirectProxyHandlerPolicyResultHeaders(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+set_tenant = {"setHeaders": {"x-tenant": "abc", "x-scope": input.request.method}} { true }
+invalid_header = {"setHeaders": {"x-tenant": 1}} { true }
+other_object = {"tenant": "abc"} { true }
+allow_all { true }`,
+	}
+
+	testCases := []struct {
+		name            string
+		policyName      string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}{
+		{
+			name:            "sets policy headers on proxied request",
+			policyName:      "set_tenant",
+			expectedStatus:  http.StatusOK,
+			expectedHeaders: map[string]string{"x-tenant": "abc", "x-scope": http.MethodGet},
+		},
+		{
+			name:            "boolean policy sets no header",
+			policyName:      "allow_all",
+			expectedStatus:  http.StatusOK,
+			expectedHeaders: map[string]string{"x-tenant": "", "x-scope": ""},
+		},
+		{
+			name:           "object result without headers is not allowed",
+			policyName:     "other_object",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "fails on invalid header value",
+			policyName:     "invalid_header",
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				for key, value := range testCase.expectedHeaders {
+					assert.Equal(t, r.Header.Get(key), value, "Mocked Backend: Unexpected %s header", key)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: testCase.policyName}}
+			oas := OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{
+						"get": VerbConfig{PermissionV2: permission},
+					},
+				},
+			}
+			serverURL, _ := url.Parse(server.URL)
+			env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+			partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+			assert.NilError(t, err)
+
+			ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, testCase.expectedStatus)
+			assert.Equal(t, invoked, testCase.expectedStatus == http.StatusOK)
+		})
+	}
+}
+
+func TestDirectProxyHandlerPolicyHeadersOverrideProxyAddHeaders(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+set_tenant = {"setHeaders": {"x-tenant": "from-policy"}} { true }`,
+	}
+
+	invoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked = true
+		assert.Equal(t, r.Header.Get("X-Tenant"), "from-policy", "policy headers must override the configured ones")
+		assert.Equal(t, r.Header.Get("X-Gateway"), "rond", "configured headers must override the client ones")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "set_tenant"}}
+	oas := OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	serverURL, _ := url.Parse(server.URL)
+	env := config.EnvironmentVariables{
+		TargetServiceHost: serverURL.Host,
+		ProxyAddHeaders:   "X-Gateway=rond, X-Tenant=from-config",
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+	assert.NilError(t, err)
+
+	ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+	assert.NilError(t, err)
+	r.Header.Set("X-Gateway", "spoofed")
+	r.Header.Set("X-Tenant", "spoofed")
+	w := httptest.NewRecorder()
+
+	rbacHandler(w, r)
+
+	assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	assert.Assert(t, invoked, "Handler was not invoked.")
+}
+
+func TestDirectProxyHandlerStripHeaders(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+admin_only { input.request.headers["X-Role"][0] == "admin" }
+set_role = {"setHeaders": {"x-role": "user"}} { true }
+allow {
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+}`,
+	}
+
+	serveRequest := func(t *testing.T, permission *RondConfig, assertHeaders func(r *http.Request)) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			assertHeaders(r)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		oas := OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"get": VerbConfig{PermissionV2: permission},
+				},
+			},
+		}
+		serverURL, _ := url.Parse(server.URL)
+		env := config.EnvironmentVariables{
+			TargetServiceHost: serverURL.Host,
+			ProxyStripHeaders: "X-Role, acl_rows",
+		}
+		partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+		assert.NilError(t, err)
+
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		r.Header.Set("X-Role", "admin")
+		r.Header.Set(BASE_ROW_FILTER_HEADER_KEY, "{}")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		return w, invoked
+	}
+
+	t.Run("strips the headers before the policy evaluation", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "admin_only"}}
+		w, invoked := serveRequest(t, permission, func(r *http.Request) {})
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
+	})
+
+	t.Run("proxies the headers set by the policy", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "set_role"}}
+		w, invoked := serveRequest(t, permission, func(r *http.Request) {
+			assert.Equal(t, r.Header.Get("X-Role"), "user")
+			assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), "")
+		})
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
+
+	t.Run("proxies the row filter header", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow", GenerateQuery: true}}
+		w, invoked := serveRequest(t, permission, func(r *http.Request) {
+			assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), `{"$or":[{"$and":[{"manager":{"$eq":"manager_test"}}]}]}`)
+		})
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
+}
+
+func TestDirectProxyHandlerCombinedPolicies(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+tenant_check { input.request.headers["X-Tenant"][0] == "t1" }
+feature_flag { input.request.headers["X-Feature"][0] == "on" }
+set_tenant = {"setHeaders": {"x-tenant-checked": "true"}} { true }
+set_feature = {"setHeaders": {"x-feature-checked": "true"}} { true }
+deny_all { false }
+allow_all { true }
+not_evaluated { true }`,
+	}
+
+	testCases := []struct {
+		name            string
+		requestFlow     RequestFlow
+		headers         map[string]string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "all allows when every policy passes",
+			requestFlow:    RequestFlow{Policies: []string{"tenant_check", "feature_flag"}, Combinator: PoliciesCombinatorAll},
+			headers:        map[string]string{"X-Tenant": "t1", "X-Feature": "on"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "all is the default combinator",
+			requestFlow:    RequestFlow{Policies: []string{"tenant_check", "feature_flag"}},
+			headers:        map[string]string{"X-Tenant": "t1", "X-Feature": "off"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "all denies when a policy fails",
+			requestFlow:    RequestFlow{Policies: []string{"tenant_check", "feature_flag"}, Combinator: PoliciesCombinatorAll},
+			headers:        map[string]string{"X-Tenant": "t2", "X-Feature": "on"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "all stops at the first denying policy",
+			requestFlow:    RequestFlow{Policies: []string{"deny_all", "not_evaluated"}, Combinator: PoliciesCombinatorAll},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:            "all sets the headers of every policy",
+			requestFlow:     RequestFlow{Policies: []string{"set_tenant", "set_feature"}, Combinator: PoliciesCombinatorAll},
+			expectedStatus:  http.StatusOK,
+			expectedHeaders: map[string]string{"x-tenant-checked": "true", "x-feature-checked": "true"},
+		},
+		{
+			name:           "any allows when a policy passes",
+			requestFlow:    RequestFlow{Policies: []string{"tenant_check", "feature_flag"}, Combinator: PoliciesCombinatorAny},
+			headers:        map[string]string{"X-Tenant": "t2", "X-Feature": "on"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "any denies when every policy fails",
+			requestFlow:    RequestFlow{Policies: []string{"tenant_check", "feature_flag"}, Combinator: PoliciesCombinatorAny},
+			headers:        map[string]string{"X-Tenant": "t2", "X-Feature": "off"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "any stops at the first allowing policy",
+			requestFlow:    RequestFlow{Policies: []string{"allow_all", "not_evaluated"}, Combinator: PoliciesCombinatorAny},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "single policy name is still supported",
+			requestFlow:    RequestFlow{PolicyName: "tenant_check"},
+			headers:        map[string]string{"X-Tenant": "t1"},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				for key, value := range testCase.expectedHeaders {
+					assert.Equal(t, r.Header.Get(key), value, "Mocked Backend: Unexpected %s header", key)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			permission := &RondConfig{RequestFlow: testCase.requestFlow}
+			oas := OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{
+						"get": VerbConfig{PermissionV2: permission},
+					},
+				},
+			}
+			serverURL, _ := url.Parse(server.URL)
+			env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+			partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+			assert.NilError(t, err)
+			// evaluating a policy without evaluator fails with 500, revealing a missing short circuit
+			delete(partialEvaluators, "not_evaluated")
+
+			ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			for key, value := range testCase.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, testCase.expectedStatus)
+			assert.Equal(t, invoked, testCase.expectedStatus == http.StatusOK)
+		})
+	}
+}
+
+func TestDirectProxyHandlerRowFilterQueryParam(t *testing.T) {
+	opaModule := &OPAModuleConfig{Name: "mypolicy.rego", Content: `package policies
+allow {
+	employee := data.resources[_]
+	employee.manager == "manager_test"
+}`}
+	expectedQuery := `{"$or":[{"$and":[{"manager":{"$eq":"manager_test"}}]}]}`
+
+	testCases := []struct {
+		name              string
+		queryParamName    string
+		requestQuery      string
+		expectedParamName string
+	}{
+		{name: "defaults to acl_rows", expectedParamName: BASE_ROW_FILTER_HEADER_KEY},
+		{name: "uses the configured query param name", queryParamName: "_q", expectedParamName: "_q"},
+		{name: "overrides the query param sent by the client", queryParamName: "_q", requestQuery: "_q=%7B%7D", expectedParamName: "_q"},
+		{name: "keeps the other query params", requestQuery: "limit=10", expectedParamName: BASE_ROW_FILTER_HEADER_KEY},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				queryParams := r.URL.Query()
+				assert.DeepEqual(t, queryParams[testCase.expectedParamName], []string{expectedQuery})
+				if testCase.requestQuery == "limit=10" {
+					assert.Equal(t, queryParams.Get("limit"), "10", "Mocked Backend: Unexpected limit query param")
+				}
+				assert.Equal(t, r.Header.Get(BASE_ROW_FILTER_HEADER_KEY), "", "Mocked Backend: Unexpected row filter header")
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			permission := &RondConfig{
+				RequestFlow: RequestFlow{
+					PolicyName:    "allow",
+					GenerateQuery: true,
+					QueryOptions: QueryOptions{
+						Target:         RowFilterTargetQuery,
+						QueryParamName: testCase.queryParamName,
+					},
+				},
+			}
+			serverURL, _ := url.Parse(server.URL)
+			env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+			ctx := createContext(t, context.Background(), env, nil, permission, opaModule, nil)
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api?"+testCase.requestQuery, nil)
+			assert.NilError(t, err)
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+			assert.Assert(t, invoked, "Handler was not invoked.")
+		})
+	}
+}
+
+func TestDirectProxyHandlerPolicyDenyReason(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+tenant_check = {"allow": true} { input.request.headers["X-Tenant"][0] == "t1" }
+tenant_check = {"allow": false, "reason": "tenant_mismatch"} { input.request.headers["X-Tenant"][0] != "t1" }
+boolean_check { input.request.headers["X-Tenant"][0] == "t1" }`,
+	}
+
+	testCases := []struct {
+		name           string
+		policyName     string
+		tenant         string
+		expectedStatus int
+		expectedReason string
+	}{
+		{name: "structured decision allows", policyName: "tenant_check", tenant: "t1", expectedStatus: http.StatusOK},
+		{name: "structured decision denies with reason", policyName: "tenant_check", tenant: "t2", expectedStatus: http.StatusForbidden, expectedReason: "tenant_mismatch"},
+		{name: "boolean policy allows", policyName: "boolean_check", tenant: "t1", expectedStatus: http.StatusOK},
+		{name: "boolean policy denies without reason", policyName: "boolean_check", tenant: "t2", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: testCase.policyName}}
+			oas := OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{
+						"get": VerbConfig{PermissionV2: permission},
+					},
+				},
+			}
+			serverURL, _ := url.Parse(server.URL)
+			env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host}
+			partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+			assert.NilError(t, err)
+
+			ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+			assert.NilError(t, err)
+			r.Header.Set("X-Tenant", testCase.tenant)
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, testCase.expectedStatus)
+			assert.Equal(t, invoked, testCase.expectedStatus == http.StatusOK)
+			if testCase.expectedStatus == http.StatusOK {
+				return
+			}
+			var responseBody map[string]interface{}
+			assert.NilError(t, json.NewDecoder(w.Result().Body).Decode(&responseBody))
+			assert.Equal(t, responseBody["message"], NO_PERMISSIONS_ERROR_MESSAGE)
+			reason, hasReason := responseBody["reason"]
+			assert.Equal(t, hasReason, testCase.expectedReason != "", "unexpected reason field: %v", reason)
+			if testCase.expectedReason != "" {
+				assert.Equal(t, reason, testCase.expectedReason)
+			}
+		})
+	}
+}
+
+func TestDirectProxyHandlerPolicyNotFound(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { true }`,
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, &OpenAPISpec{}, opaModule, envs)
+	assert.NilError(t, err)
+
+	invoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked = true
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	ctx := createContext(t,
+		context.Background(),
+		config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+		nil,
+		&RondConfig{RequestFlow: RequestFlow{PolicyName: "missing_policy"}},
+		opaModule,
+		partialEvaluators,
+	)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+	assert.NilError(t, err)
+	w := httptest.NewRecorder()
+
+	rbacHandler(w, r)
+
+	assert.Assert(t, !invoked, "Handler was invoked.")
+	testutils.AssertResponseFullErrorMessages(t, w, http.StatusInternalServerError, "policy evaluator not found: missing_policy", POLICY_MISCONFIGURED_ERROR_MESSAGE)
+}
+
+func TestDirectProxyHandlerAllowedMethods(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { true }`,
+	}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"all": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	assert.NilError(t, err)
+
+	serveRequest := func(t *testing.T, env config.EnvironmentVariables, method string) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env.TargetServiceHost = serverURL.Host
+		ctx := createContext(t,
+			context.Background(),
+			env,
+			nil,
+			permission,
+			opaModule,
+			partialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, method, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		return w, invoked
+	}
+
+	t.Run("proxies an allowed method", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{}, http.MethodPatch)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
+
+	t.Run("responds 405 on a method not allowed by default", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{}, http.MethodTrace)
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		testutils.AssertResponseFullErrorMessages(t, w, http.StatusMethodNotAllowed, "method TRACE not allowed", METHOD_NOT_ALLOWED_ERROR_MESSAGE)
+		assert.Equal(t, w.Result().Header.Get("Allow"), "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+	})
+
+	t.Run("responds 405 on a method not configured", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{AllowedMethods: "get, head"}, http.MethodPost)
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		testutils.AssertResponseFullErrorMessages(t, w, http.StatusMethodNotAllowed, "method POST not allowed", METHOD_NOT_ALLOWED_ERROR_MESSAGE)
+		assert.Equal(t, w.Result().Header.Get("Allow"), "GET, HEAD")
+	})
+}
+
+func TestDirectProxyHandlerDebugInput(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { false }`,
+	}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"all": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	assert.NilError(t, err)
+
+	serveRequest := func(t *testing.T, env config.EnvironmentVariables) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env.TargetServiceHost = serverURL.Host
+		env.UserIdHeader = "userid"
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api?q=1", bytes.NewBufferString(`{"name":"rond"}`))
+		assert.NilError(t, err)
+		r.Header.Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+		r.Header.Set("userid", "user1")
+		r.Header.Set(DebugInputHeaderKey, "true")
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+		return w, invoked
+	}
+
+	t.Run("returns the policy input without evaluating nor proxying", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{DebugInputEnabled: true})
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
+
+		var input Input
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &input))
+		assert.Equal(t, input.Request.Method, http.MethodPost)
+		assert.Equal(t, input.Request.Path, "/api")
+		assert.DeepEqual(t, input.Request.Query, url.Values{"q": []string{"1"}})
+		assert.DeepEqual(t, input.Request.Body, map[string]interface{}{"name": "rond"})
+		assert.Equal(t, input.Request.Headers.Get("userid"), "user1")
+	})
+
+	t.Run("evaluates the request when debug input is disabled", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{})
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
+	})
+}
+
+func TestDirectProxyHandlerDebugProfile(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo {
+	input.request.method == "POST"
+	input.request.path == "/api"
+}`,
+	}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"all": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	assert.NilError(t, err)
+
+	serveRequest := func(t *testing.T, env config.EnvironmentVariables) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env.TargetServiceHost = serverURL.Host
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
 
-		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", body)
-		assert.Equal(t, err, nil, "Unexpected error")
-		r.Header.Set(ContentTypeHeaderKey, "text/plain")
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		r.Header.Set(DebugProfileHeaderKey, "true")
 		w := httptest.NewRecorder()
 
 		rbacHandler(w, r)
+		return w, invoked
+	}
 
-		assert.Assert(t, !invoked, "Handler was not invoked.")
-		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
-	})
+	t.Run("returns the policy profile without proxying", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{DebugProfileEnabled: true})
 
-	t.Run("filter query return not allow", func(t *testing.T) {
-		policy := `package policies
-allow {
-	get_header("examplekey", input.headers) == "test"
-	input.request.method == "DELETE"
-	employee := data.resources[_]
-	employee.name == "name_test"
-}
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
+
+		var response ProfileResponseBody
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, len(response.Policies), 1)
+		policyProfile := response.Policies[0]
+		assert.Equal(t, policyProfile.PolicyName, "todo")
+		assert.Assert(t, policyProfile.Allowed)
+
+		profiledRows := map[int]int{}
+		for _, stats := range policyProfile.Profile {
+			if stats.Location.File == "example.rego" {
+				profiledRows[stats.Location.Row] = stats.NumEval
+			}
+		}
+		assert.Equal(t, profiledRows[3], 1, "missing method expression profile")
+		assert.Equal(t, profiledRows[4], 1, "missing path expression profile")
+	})
 
-allow {
-	input.request.method == "GET111"
+	t.Run("proxies the request when debug profile is disabled", func(t *testing.T) {
+		w, invoked := serveRequest(t, config.EnvironmentVariables{})
 
-	employee := data.resources[_]
-	employee.manager == "manager_test"
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
 }
 
-allow {
-	input.request.method == "GETAAA"
-	input.request.path == "/api"
-	employee := data.resources[_]
-	employee.salary < 0
-}
-`
+func TestDirectProxyHandlerTrustedIdentitySource(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { input.request.headers["Userid"][0] == "admin" }`,
+	}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"all": VerbConfig{PermissionV2: permission},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	assert.NilError(t, err)
 
+	serveRequest := func(t *testing.T, remoteAddr string) (*httptest.ResponseRecorder, bool) {
+		t.Helper()
 		invoked := false
-		mockBodySting := "I am a body"
-
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			invoked = true
-			defer r.Body.Close()
-			buf, err := io.ReadAll(r.Body)
-			assert.Equal(t, err, nil, "Mocked backend: Unexpected error")
-			assert.Equal(t, string(buf), mockBodySting, "Mocked backend: Unexpected Body received")
-			filterQuery := r.Header.Get("rowfilterquery")
-			expectedQuery := ``
-			assert.Equal(t, expectedQuery, filterQuery)
+			assert.Equal(t, r.Header.Get("userid"), "admin")
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Mocked Backend Body Example"))
 		}))
 		defer server.Close()
 
-		body := strings.NewReader(mockBodySting)
-
 		serverURL, _ := url.Parse(server.URL)
+		env := config.EnvironmentVariables{
+			TargetServiceHost:     serverURL.Host,
+			UserIdHeader:          "userid",
+			TrustedIdentitySource: "10.0.0.0/8, 192.168.1.10",
+		}
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
 
-		opaModuleConfig := &OPAModuleConfig{Name: "mypolicy.rego", Content: policy}
-
-		partialEvaluators, err := setupEvaluators(ctx, nil, &oasWithFilter, opaModuleConfig, envs)
-		assert.Equal(t, err, nil, "Unexpected error")
-		ctx := createContext(t,
-			context.Background(),
-			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
-			nil,
-			mockRondConfigWithQueryGen,
-			opaModuleConfig,
-			partialEvaluators,
-		)
-
-		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", body)
-		assert.Equal(t, err, nil, "Unexpected error")
-		r.Header.Set("miauserproperties", `{"name":"gianni"}`)
-		r.Header.Set("examplekey", "value")
-		r.Header.Set(ContentTypeHeaderKey, "text/plain")
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://www.example.com:8080/api", nil)
+		assert.NilError(t, err)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("userid", "admin")
+		r.Header.Set(XForwardedForHeaderKey, "10.0.0.1")
 		w := httptest.NewRecorder()
 
 		rbacHandler(w, r)
+		return w, invoked
+	}
 
-		assert.Assert(t, !invoked, "Handler was not invoked.")
-		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
-		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader, "Unexpected content type.")
+	t.Run("trusts identity headers sent by a trusted range", func(t *testing.T) {
+		w, invoked := serveRequest(t, "10.1.2.3:41000")
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
+
+	t.Run("trusts identity headers sent by a trusted address", func(t *testing.T) {
+		w, invoked := serveRequest(t, "192.168.1.10:41000")
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+	})
+
+	t.Run("ignores spoofed identity headers", func(t *testing.T) {
+		w, invoked := serveRequest(t, "203.0.113.7:41000")
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
 	})
 }
 
@@ -1787,6 +3626,203 @@ project.tenantId == "1234"
 	})
 }
 
+func TestPolicyWithMongoPaginatedBuiltinIntegration(t *testing.T) {
+	var mockOPAModule = &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `
+package policies
+todo {
+projects := find_many_paginated("projects", {"tenantId": "1234"}, {"skip": 10, "limit": 2})
+count(projects) == 2
+}`,
+	}
+	var mockXPermission = &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "todo"},
+					},
+				},
+			},
+		},
+	}
+
+	t.Run("invokes target service", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		mongoMock := &mocks.MongoClientMock{
+			FindManyPaginatedExpectation: func(collectionName string, query interface{}, skip, limit int64) {
+				assert.Equal(t, collectionName, "projects")
+				assert.DeepEqual(t, query, map[string]interface{}{
+					"tenantId": "1234",
+				})
+				assert.Equal(t, skip, int64(10))
+				assert.Equal(t, limit, int64(2))
+			},
+			FindManyResult: []interface{}{
+				map[string]interface{}{"projectId": "p1"},
+				map[string]interface{}{"projectId": "p2"},
+			},
+		}
+
+		log, _ := test.NewNullLogger()
+		ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
+
+		mockPartialEvaluators, err := setupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			mongoMock,
+			mockXPermission,
+			mockOPAModule,
+			mockPartialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, invoked, "Handler was not invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+	})
+
+	t.Run("blocks for mongo error", func(t *testing.T) {
+		invoked := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		mongoMock := &mocks.MongoClientMock{
+			FindManyPaginatedExpectation: func(collectionName string, query interface{}, skip, limit int64) {},
+			FindManyError:                fmt.Errorf("FAILED MONGO QUERY"),
+		}
+
+		log, _ := test.NewNullLogger()
+		ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
+
+		mockPartialEvaluators, err := setupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		serverURL, _ := url.Parse(server.URL)
+		ctx := createContext(t,
+			context.Background(),
+			config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+			mongoMock,
+			mockXPermission,
+			mockOPAModule,
+			mockPartialEvaluators,
+		)
+
+		r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+		assert.Equal(t, err, nil, "Unexpected error")
+
+		w := httptest.NewRecorder()
+
+		rbacHandler(w, r)
+
+		assert.Assert(t, !invoked, "Handler was invoked.")
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
+	})
+}
+
+func TestPolicyWithMongoCountBuiltinIntegration(t *testing.T) {
+	var mockOPAModule = &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `
+package policies
+todo {
+count_documents("projects", {"tenantId": "1234"}) >= 3
+}`,
+	}
+	var mockXPermission = &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "todo"},
+					},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		countResult    int64
+		countError     error
+		expectInvoked  bool
+		expectedStatus int
+	}{
+		{name: "invokes target service when count is above threshold", countResult: 3, expectInvoked: true, expectedStatus: http.StatusOK},
+		{name: "blocks when count is below threshold", countResult: 0, expectedStatus: http.StatusForbidden},
+		{name: "blocks for mongo error", countError: fmt.Errorf("FAILED MONGO QUERY"), expectedStatus: http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			invoked := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				invoked = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			mongoMock := &mocks.MongoClientMock{
+				CountDocumentsExpectation: func(collectionName string, query interface{}) {
+					assert.Equal(t, collectionName, "projects")
+					assert.DeepEqual(t, query, map[string]interface{}{
+						"tenantId": "1234",
+					})
+				},
+				CountDocumentsResult: testCase.countResult,
+				CountDocumentsError:  testCase.countError,
+			}
+
+			log, _ := test.NewNullLogger()
+			ctxForPartial := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
+
+			mockPartialEvaluators, err := setupEvaluators(ctxForPartial, mongoMock, oas, mockOPAModule, envs)
+			assert.Equal(t, err, nil, "Unexpected error")
+
+			serverURL, _ := url.Parse(server.URL)
+			ctx := createContext(t,
+				context.Background(),
+				config.EnvironmentVariables{TargetServiceHost: serverURL.Host},
+				mongoMock,
+				mockXPermission,
+				mockOPAModule,
+				mockPartialEvaluators,
+			)
+
+			r, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com:8080/api", nil)
+			assert.Equal(t, err, nil, "Unexpected error")
+
+			w := httptest.NewRecorder()
+
+			rbacHandler(w, r)
+
+			assert.Equal(t, invoked, testCase.expectInvoked, "Unexpected handler invocation.")
+			assert.Equal(t, w.Result().StatusCode, testCase.expectedStatus, "Unexpected status code.")
+		})
+	}
+}
+
 func TestCreateQueryEvaluator(t *testing.T) {
 	policy := `package policies
 allow {
@@ -0,0 +1,46 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtoken
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	AuthorizationHeaderKey = "Authorization"
+	bearerPrefix           = "Bearer "
+)
+
+// BearerTokenFromHeader returns the token carried by the `Authorization: Bearer` header, if any.
+func BearerTokenFromHeader(headers http.Header) (string, bool) {
+	authorization := headers.Get(AuthorizationHeaderKey)
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[len(bearerPrefix):]), true
+}
+
+// ParseUnverifiedClaims decodes the claims of a JWT without verifying its signature.
+func ParseUnverifiedClaims(token string) (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return nil, fmt.Errorf("failed token parse: %s", err.Error())
+	}
+	return claims, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtoken
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBearerTokenFromHeader(t *testing.T) {
+	testCases := []struct {
+		name          string
+		authorization string
+		expectedToken string
+		expectedFound bool
+	}{
+		{name: "missing header"},
+		{name: "other scheme", authorization: "Basic dXNlcjpwYXNz"},
+		{name: "empty bearer", authorization: "Bearer "},
+		{name: "bearer token", authorization: "Bearer my-token", expectedToken: "my-token", expectedFound: true},
+		{name: "case insensitive scheme", authorization: "bearer my-token", expectedToken: "my-token", expectedFound: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			headers := http.Header{}
+			if testCase.authorization != "" {
+				headers.Set(AuthorizationHeaderKey, testCase.authorization)
+			}
+
+			token, found := BearerTokenFromHeader(headers)
+			require.Equal(t, testCase.expectedFound, found)
+			require.Equal(t, testCase.expectedToken, token)
+		})
+	}
+}
+
+func TestParseUnverifiedClaims(t *testing.T) {
+	t.Run("returns token claims", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub":    "user-id",
+			"groups": []string{"admin"},
+		}).SignedString([]byte("secret"))
+		require.NoError(t, err)
+
+		claims, err := ParseUnverifiedClaims(token)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"sub":    "user-id",
+			"groups": []interface{}{"admin"},
+		}, claims)
+	})
+
+	t.Run("fails on malformed token", func(t *testing.T) {
+		claims, err := ParseUnverifiedClaims("not-a-token")
+		require.Error(t, err)
+		require.Nil(t, claims)
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtoken
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultJWKSRefreshInterval = 15 * time.Minute
+	// minJWKSRefetchInterval limits the JWKS requests triggered by tokens signed with unknown keys.
+	minJWKSRefetchInterval = 10 * time.Second
+)
+
+// ErrInvalidToken is returned when a bearer token fails verification.
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+type verifierContextKey struct{}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Verifier validates JWT signatures against the keys exposed by a JWKS endpoint,
+// checking the issuer and audience claims when configured.
+type Verifier struct {
+	jwksURL         string
+	issuer          string
+	audience        string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	now       func() time.Time
+}
+
+// NewVerifier returns a Verifier using the JWKS exposed at jwksURL; keys are
+// fetched lazily and refreshed every refreshInterval.
+func NewVerifier(jwksURL, issuer, audience string, refreshInterval time.Duration) *Verifier {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJWKSRefreshInterval
+	}
+	return &Verifier{
+		jwksURL:         jwksURL,
+		issuer:          issuer,
+		audience:        audience,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		keys:            make(map[string]interface{}),
+		now:             time.Now,
+	}
+}
+
+// Verify checks the token signature, expiration, issuer and audience, returning its claims.
+// Every verification failure wraps ErrInvalidToken.
+func (verifier *Verifier) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}))
+	_, err := parser.ParseWithClaims(token, claims, func(parsedToken *jwt.Token) (interface{}, error) {
+		kid, _ := parsedToken.Header["kid"].(string)
+		return verifier.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+
+	if verifier.issuer != "" && !claims.VerifyIssuer(verifier.issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if verifier.audience != "" && !claims.VerifyAudience(verifier.audience, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// key returns the verification key identified by kid, fetching the JWKS again
+// when the cached one is stale or does not contain kid, to handle key rotation.
+func (verifier *Verifier) key(ctx context.Context, kid string) (interface{}, error) {
+	verifier.mu.RLock()
+	key, found := verifier.keys[kid]
+	sinceFetch := verifier.now().Sub(verifier.fetchedAt)
+	verifier.mu.RUnlock()
+
+	if found && sinceFetch < verifier.refreshInterval {
+		return key, nil
+	}
+	if !found && sinceFetch < minJWKSRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	if err := verifier.refresh(ctx); err != nil {
+		if found {
+			// keep trusting the cached key when the JWKS endpoint is temporarily unavailable
+			return key, nil
+		}
+		return nil, err
+	}
+
+	verifier.mu.RLock()
+	defer verifier.mu.RUnlock()
+	if key, found := verifier.keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+func (verifier *Verifier) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, verifier.jwksURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed JWKS request creation: %s", err.Error())
+	}
+	resp, err := verifier.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed JWKS fetch: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed JWKS fetch: unexpected status code %d", resp.StatusCode)
+	}
+
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return fmt.Errorf("failed JWKS decode: %s", err.Error())
+	}
+
+	keys := make(map[string]interface{}, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	verifier.mu.Lock()
+	defer verifier.mu.Unlock()
+	verifier.keys = keys
+	verifier.fetchedAt = verifier.now()
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// VerifierInjectorMiddleware will inject into request context the token verifier.
+func VerifierInjectorMiddleware(verifier *Verifier) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithVerifier(r.Context(), verifier)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithVerifier(ctx context.Context, verifier *Verifier) context.Context {
+	return context.WithValue(ctx, verifierContextKey{}, verifier)
+}
+
+// GetVerifierFromContext extracts the token verifier from provided context,
+// returning `nil` if token verification is not enabled.
+func GetVerifierFromContext(ctx context.Context) *Verifier {
+	verifier, _ := ctx.Value(verifierContextKey{}).(*Verifier)
+	return verifier
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authtoken
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rotatedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	var jwksRequests int32
+	jwks := []map[string]string{rsaJWK("rsa-key", &rsaKey.PublicKey), ecJWK("ec-key", &ecKey.PublicKey)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&jwksRequests, 1)
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks}))
+	}))
+	defer server.Close()
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"sub": "user-id",
+			"iss": "https://issuer.example.com",
+			"aud": "rond",
+			"exp": float64(time.Now().Add(time.Hour).Unix()),
+		}
+	}
+	sign := func(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+
+	verifier := NewVerifier(server.URL, "https://issuer.example.com", "rond", time.Hour)
+
+	t.Run("verifies RSA signed token", func(t *testing.T) {
+		claims, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rsaKey, validClaims()))
+		require.NoError(t, err)
+		require.Equal(t, "user-id", claims["sub"])
+	})
+
+	t.Run("verifies EC signed token with cached keys", func(t *testing.T) {
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodES256, "ec-key", ecKey, validClaims()))
+		require.NoError(t, err)
+		require.Equal(t, int32(1), atomic.LoadInt32(&jwksRequests))
+	})
+
+	t.Run("rejects expired token", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rsaKey, claims))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("rejects unexpected issuer", func(t *testing.T) {
+		claims := validClaims()
+		claims["iss"] = "https://other.example.com"
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rsaKey, claims))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("rejects unexpected audience", func(t *testing.T) {
+		claims := validClaims()
+		claims["aud"] = "other"
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rsaKey, claims))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("rejects token signed with another key", func(t *testing.T) {
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rotatedKey, validClaims()))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("rejects symmetric algorithms", func(t *testing.T) {
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodHS256, "rsa-key", []byte("secret"), validClaims()))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("fetches keys again on unknown kid", func(t *testing.T) {
+		jwks = append(jwks, rsaJWK("rotated-key", &rotatedKey.PublicKey))
+		verifier.fetchedAt = verifier.fetchedAt.Add(-minJWKSRefetchInterval)
+		requestsBefore := atomic.LoadInt32(&jwksRequests)
+
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rotated-key", rotatedKey, validClaims()))
+		require.NoError(t, err)
+		require.Equal(t, requestsBefore+1, atomic.LoadInt32(&jwksRequests))
+	})
+
+	t.Run("does not fetch keys again on unknown kid right after a refresh", func(t *testing.T) {
+		requestsBefore := atomic.LoadInt32(&jwksRequests)
+
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "missing-key", rotatedKey, validClaims()))
+		require.ErrorIs(t, err, ErrInvalidToken)
+		require.Equal(t, requestsBefore, atomic.LoadInt32(&jwksRequests))
+	})
+
+	t.Run("refreshes stale keys", func(t *testing.T) {
+		verifier.fetchedAt = verifier.fetchedAt.Add(-time.Hour)
+		requestsBefore := atomic.LoadInt32(&jwksRequests)
+
+		_, err := verifier.Verify(context.Background(), sign(t, jwt.SigningMethodRS256, "rsa-key", rsaKey, validClaims()))
+		require.NoError(t, err)
+		require.Equal(t, requestsBefore+1, atomic.LoadInt32(&jwksRequests))
+	})
+}
+
+func TestGetVerifierFromContext(t *testing.T) {
+	t.Run("verifier not found in context", func(t *testing.T) {
+		require.Nil(t, GetVerifierFromContext(context.Background()))
+	})
+
+	t.Run("verifier injected by middleware", func(t *testing.T) {
+		verifier := NewVerifier("http://jwks", "", "", 0)
+		invoked := false
+		handler := VerifierInjectorMiddleware(verifier)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			require.Equal(t, verifier, GetVerifierFromContext(r.Context()))
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.True(t, invoked)
+	})
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
@@ -17,7 +17,13 @@ package config
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rond-authz/rond/internal/utils"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/configlib"
@@ -25,14 +31,39 @@ import (
 
 const (
 	APIPermissionsFilePathEnvKey = "API_PERMISSIONS_FILE_PATH"
+	OASInlineEnvKey              = "OAS_INLINE"
 	TargetServiceOASPathEnvKey   = "TARGET_SERVICE_OAS_PATH"
 	StandaloneEnvKey             = "STANDALONE"
 	TargetServiceHostEnvKey      = "TARGET_SERVICE_HOST"
 	BindingsCrudServiceURL       = "BINDINGS_CRUD_SERVICE_URL"
+	OPAModulesDirectoryEnvKey    = "OPA_MODULES_DIRECTORY"
+	OPABundleURLEnvKey           = "OPA_BUNDLE_URL"
+	PublicPathsEnvKey            = "PUBLIC_PATHS"
+	ResponseContentTypesEnvKey   = "RESPONSE_FILTER_CONTENT_TYPES"
+	ProxyAddHeadersEnvKey        = "PROXY_ADD_HEADERS"
+	TrustedIdentitySourceEnvKey  = "TRUSTED_IDENTITY_SOURCE"
+	PermissionsFilePathsEnvKey   = "API_PERMISSIONS_FILE_PATHS"
+	OASMergeStrategyEnvKey       = "OAS_MERGE_STRATEGY"
+	ErrorResponseFormatEnvKey    = "ERROR_RESPONSE_FORMAT"
+	SecuritySchemePoliciesEnvKey = "SECURITY_SCHEME_POLICIES"
 
 	TraceLogLevel = "trace"
 )
 
+const (
+	// OASMergeStrategyError fails when more than one OAS source declares the same operation.
+	OASMergeStrategyError = "error"
+	// OASMergeStrategyLastWins keeps the operation declared by the last OAS source.
+	OASMergeStrategyLastWins = "last-wins"
+)
+
+const (
+	// ErrorResponseFormatJSON writes the error responses as a JSON object.
+	ErrorResponseFormatJSON = "json"
+	// ErrorResponseFormatText writes only the business message of the error responses as plain text.
+	ErrorResponseFormatText = "text"
+)
+
 // EnvironmentVariables struct with the mapping of desired
 // environment variables.
 type EnvironmentVariables struct {
@@ -41,19 +72,98 @@ type EnvironmentVariables struct {
 	ServiceVersion         string
 	TargetServiceHost      string
 	TargetServiceOASPath   string
+	TargetServiceScheme    string
+	TargetServiceCACert    string
+	TargetServiceInsecure  bool
+	TargetMaxIdleConns     int
+	TargetIdleConnTimeout  time.Duration
+	TargetDialTimeout      time.Duration
 	OPAModulesDirectory    string
+	OPABundleURL           string
+	OPABundlePollInterval  time.Duration
+	OPABundlePublicKeyFile string
 	APIPermissionsFilePath string
 	UserPropertiesHeader   string
 	UserGroupsHeader       string
+	UserGroupsDelimiter    string
 	UserIdHeader           string
 	ClientTypeHeader       string
 	BindingsCrudServiceURL string
 	MongoDBUrl             string
+	MongoDatabaseName      string
 	RolesCollectionName    string
 	BindingsCollectionName string
 	PathPrefixStandalone   string
 	DelayShutdownSeconds   int
 	Standalone             bool
+	OASFetchCacheTTL       time.Duration
+	OASFetchMaxRetries     int
+	OASFetchBackoff        time.Duration
+	RequestTimeout         time.Duration
+	ResponseMaxBodySize    int64
+	PolicyAuditMode        bool
+	PolicyHotReload        bool
+	PolicyStrictStartup    bool
+	DecisionLogEnabled     bool
+	DecisionLogFile        string
+	RedactedHeaders        string
+	BindingsCacheTTL       time.Duration
+	BindingsCacheSize      int
+	ParseBearerToken       bool
+	JWKSURL                string
+	JWTIssuer              string
+	JWTAudience            string
+	JWKSRefreshInterval    time.Duration
+	TrustInboundForwarded  bool
+	Distinguish401And403   bool
+	RowFilterHeaderKey     string
+	ValidateOnly           bool
+	TenantHeaderKey        string
+	TenantCollectionFormat string
+	OPADataFilePath        string
+	RequestIDHeaderKey     string
+	PolicyEvalTimeout      time.Duration
+	OASInline              string
+	GroupLevelsDelimiter   string
+	RequestMaxBodySize     int64
+	PublicPaths            string
+	IncludeStates          string
+	CaseInsensitivePaths   bool
+	PreserveUserAgent      bool
+	DefaultUserAgent       string
+	ExposePolicies         bool
+	ProxyRetries           int
+	ProxyRetryBackoff      time.Duration
+	AllowGetBody           bool
+	IdentityExtractor      string
+	MongoQueryMetrics      bool
+	QueryMaxClauses        int
+	ResponseContentTypes   string
+	DisableRowFilter       bool
+	DefaultPolicyName      string
+	AllowedMethods         string
+	DebugInputEnabled      bool
+	MongoReadPreference    string
+	MongoReadConcern       string
+	UserPropertiesBase64   bool
+	ProxyAddHeaders        string
+	ProxyStripHeaders      string
+	TrustedIdentitySource  string
+	RateLimitRPS           float64
+	RateLimitBurst         int
+	PermissionsFilePaths   string
+	OASMergeStrategy       string
+	DebugEvalEnabled       bool
+	LogRowFilterQuery      bool
+	RowFilterQueryLogSize  int
+	RedactRowFilterQuery   bool
+	RequireNonEmptyOAS     bool
+	ErrorResponseFormat    string
+	DebugProfileEnabled    bool
+	SecuritySchemePolicies string
+	PolicyHTTPAllowedHosts string
+	PolicyHTTPTimeout      time.Duration
+	PolicyHTTPCacheTTL     time.Duration
 }
 
 var EnvVariablesConfig = []configlib.EnvConfig{
@@ -76,14 +186,50 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Key:      TargetServiceHostEnvKey,
 		Variable: "TargetServiceHost",
 	},
+	{
+		Key:          "TARGET_SERVICE_SCHEME",
+		Variable:     "TargetServiceScheme",
+		DefaultValue: "http",
+	},
+	{
+		Key:      "TARGET_SERVICE_CA_CERT",
+		Variable: "TargetServiceCACert",
+	},
+	{
+		Key:      "TARGET_SERVICE_INSECURE_SKIP_VERIFY",
+		Variable: "TargetServiceInsecure",
+	},
+	{
+		Key:      "TARGET_MAX_IDLE_CONNS",
+		Variable: "TargetMaxIdleConns",
+	},
+	{
+		Key:      "TARGET_IDLE_CONN_TIMEOUT",
+		Variable: "TargetIdleConnTimeout",
+	},
+	{
+		Key:      "TARGET_DIAL_TIMEOUT",
+		Variable: "TargetDialTimeout",
+	},
 	{
 		Key:      TargetServiceOASPathEnvKey,
 		Variable: "TargetServiceOASPath",
 	},
 	{
-		Key:      "OPA_MODULES_DIRECTORY",
+		Key:      OPAModulesDirectoryEnvKey,
 		Variable: "OPAModulesDirectory",
-		Required: true,
+	},
+	{
+		Key:      OPABundleURLEnvKey,
+		Variable: "OPABundleURL",
+	},
+	{
+		Key:      "OPA_BUNDLE_POLLING_INTERVAL",
+		Variable: "OPABundlePollInterval",
+	},
+	{
+		Key:      "OPA_BUNDLE_PUBLIC_KEY_FILE",
+		Variable: "OPABundlePublicKeyFile",
 	},
 	{
 		Key:      APIPermissionsFilePathEnvKey,
@@ -99,6 +245,11 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Variable:     "UserGroupsHeader",
 		DefaultValue: "miausergroups",
 	},
+	{
+		Key:          "USER_GROUPS_HEADER_DELIMITER",
+		Variable:     "UserGroupsDelimiter",
+		DefaultValue: ",",
+	},
 	{
 		Key:          "USER_ID_HEADER_KEY",
 		Variable:     "UserIdHeader",
@@ -118,6 +269,10 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Key:      "MONGODB_URL",
 		Variable: "MongoDBUrl",
 	},
+	{
+		Key:      "MONGODB_DATABASE_NAME",
+		Variable: "MongoDatabaseName",
+	},
 	{
 		Key:      "BINDINGS_COLLECTION_NAME",
 		Variable: "BindingsCollectionName",
@@ -139,6 +294,280 @@ var EnvVariablesConfig = []configlib.EnvConfig{
 		Key:      BindingsCrudServiceURL,
 		Variable: "BindingsCrudServiceURL",
 	},
+	{
+		Key:      "OAS_FETCH_CACHE_TTL",
+		Variable: "OASFetchCacheTTL",
+	},
+	{
+		Key:      "OAS_FETCH_MAX_RETRIES",
+		Variable: "OASFetchMaxRetries",
+	},
+	{
+		Key:      "OAS_FETCH_BACKOFF",
+		Variable: "OASFetchBackoff",
+	},
+	{
+		Key:      "REQUEST_TIMEOUT",
+		Variable: "RequestTimeout",
+	},
+	{
+		Key:      "RESPONSE_FILTER_MAX_BODY_SIZE",
+		Variable: "ResponseMaxBodySize",
+	},
+	{
+		Key:      "POLICY_AUDIT_MODE",
+		Variable: "PolicyAuditMode",
+	},
+	{
+		Key:      "POLICY_HOT_RELOAD",
+		Variable: "PolicyHotReload",
+	},
+	{
+		Key:      "POLICY_STRICT_STARTUP",
+		Variable: "PolicyStrictStartup",
+	},
+	{
+		Key:      "DECISION_LOG_ENABLED",
+		Variable: "DecisionLogEnabled",
+	},
+	{
+		Key:      "DECISION_LOG_FILE",
+		Variable: "DecisionLogFile",
+	},
+	{
+		Key:      "DECISION_LOG_REDACTED_HEADERS",
+		Variable: "RedactedHeaders",
+	},
+	{
+		Key:      "BINDINGS_CACHE_TTL",
+		Variable: "BindingsCacheTTL",
+	},
+	{
+		Key:      "BINDINGS_CACHE_SIZE",
+		Variable: "BindingsCacheSize",
+	},
+	{
+		Key:      "PARSE_BEARER_TOKEN",
+		Variable: "ParseBearerToken",
+	},
+	{
+		Key:      "JWT_JWKS_URL",
+		Variable: "JWKSURL",
+	},
+	{
+		Key:      "JWT_ISSUER",
+		Variable: "JWTIssuer",
+	},
+	{
+		Key:      "JWT_AUDIENCE",
+		Variable: "JWTAudience",
+	},
+	{
+		Key:      "JWT_JWKS_REFRESH_INTERVAL",
+		Variable: "JWKSRefreshInterval",
+	},
+	{
+		Key:      "TRUST_INBOUND_FORWARDED",
+		Variable: "TrustInboundForwarded",
+	},
+	{
+		Key:      "DISTINGUISH_401_403",
+		Variable: "Distinguish401And403",
+	},
+	{
+		Key:      "ROW_FILTER_HEADER_KEY",
+		Variable: "RowFilterHeaderKey",
+	},
+	{
+		Key:      "VALIDATE_ONLY",
+		Variable: "ValidateOnly",
+	},
+	{
+		Key:      "TENANT_HEADER_KEY",
+		Variable: "TenantHeaderKey",
+	},
+	{
+		Key:      "TENANT_COLLECTION_NAME_TEMPLATE",
+		Variable: "TenantCollectionFormat",
+	},
+	{
+		Key:      "OPA_DATA_FILE_PATH",
+		Variable: "OPADataFilePath",
+	},
+	{
+		Key:      "REQUEST_ID_HEADER_KEY",
+		Variable: "RequestIDHeaderKey",
+	},
+	{
+		Key:      "POLICY_EVAL_TIMEOUT",
+		Variable: "PolicyEvalTimeout",
+	},
+	{
+		Key:      OASInlineEnvKey,
+		Variable: "OASInline",
+	},
+	{
+		Key:      "GROUP_HIERARCHY_SEPARATOR",
+		Variable: "GroupLevelsDelimiter",
+	},
+	{
+		Key:      "MAX_REQUEST_BODY_BYTES",
+		Variable: "RequestMaxBodySize",
+	},
+	{
+		Key:      PublicPathsEnvKey,
+		Variable: "PublicPaths",
+	},
+	{
+		Key:      "INCLUDE_STATES",
+		Variable: "IncludeStates",
+	},
+	{
+		Key:      "CASE_INSENSITIVE_PATHS",
+		Variable: "CaseInsensitivePaths",
+	},
+	{
+		Key:      "PRESERVE_USER_AGENT",
+		Variable: "PreserveUserAgent",
+	},
+	{
+		Key:      "DEFAULT_USER_AGENT",
+		Variable: "DefaultUserAgent",
+	},
+	{
+		Key:      "EXPOSE_POLICIES_ROUTE",
+		Variable: "ExposePolicies",
+	},
+	{
+		Key:      "PROXY_RETRIES",
+		Variable: "ProxyRetries",
+	},
+	{
+		Key:      "PROXY_RETRY_BACKOFF",
+		Variable: "ProxyRetryBackoff",
+	},
+	{
+		Key:      "ALLOW_GET_BODY",
+		Variable: "AllowGetBody",
+	},
+	{
+		Key:      "IDENTITY_EXTRACTOR",
+		Variable: "IdentityExtractor",
+	},
+	{
+		Key:      "MONGO_QUERY_METRICS",
+		Variable: "MongoQueryMetrics",
+	},
+	{
+		Key:      "QUERY_MAX_CLAUSES",
+		Variable: "QueryMaxClauses",
+	},
+	{
+		Key:      ResponseContentTypesEnvKey,
+		Variable: "ResponseContentTypes",
+	},
+	{
+		Key:      "DISABLE_ROW_FILTER",
+		Variable: "DisableRowFilter",
+	},
+	{
+		Key:      "DEFAULT_POLICY_NAME",
+		Variable: "DefaultPolicyName",
+	},
+	{
+		Key:      "ALLOWED_METHODS",
+		Variable: "AllowedMethods",
+	},
+	{
+		Key:      "DEBUG_INPUT_ENABLED",
+		Variable: "DebugInputEnabled",
+	},
+	{
+		Key:      "MONGODB_READ_PREFERENCE",
+		Variable: "MongoReadPreference",
+	},
+	{
+		Key:      "MONGODB_READ_CONCERN",
+		Variable: "MongoReadConcern",
+	},
+	{
+		Key:      "USER_PROPERTIES_BASE64",
+		Variable: "UserPropertiesBase64",
+	},
+	{
+		Key:      ProxyAddHeadersEnvKey,
+		Variable: "ProxyAddHeaders",
+	},
+	{
+		Key:      "PROXY_STRIP_HEADERS",
+		Variable: "ProxyStripHeaders",
+	},
+	{
+		Key:      TrustedIdentitySourceEnvKey,
+		Variable: "TrustedIdentitySource",
+	},
+	{
+		Key:      "RATE_LIMIT_RPS",
+		Variable: "RateLimitRPS",
+	},
+	{
+		Key:      "RATE_LIMIT_BURST",
+		Variable: "RateLimitBurst",
+	},
+	{
+		Key:      PermissionsFilePathsEnvKey,
+		Variable: "PermissionsFilePaths",
+	},
+	{
+		Key:          OASMergeStrategyEnvKey,
+		Variable:     "OASMergeStrategy",
+		DefaultValue: OASMergeStrategyError,
+	},
+	{
+		Key:      "DEBUG_EVAL_ENABLED",
+		Variable: "DebugEvalEnabled",
+	},
+	{
+		Key:      "LOG_ROW_FILTER_QUERY",
+		Variable: "LogRowFilterQuery",
+	},
+	{
+		Key:      "ROW_FILTER_QUERY_LOG_SIZE",
+		Variable: "RowFilterQueryLogSize",
+	},
+	{
+		Key:      "REDACT_ROW_FILTER_QUERY",
+		Variable: "RedactRowFilterQuery",
+	},
+	{
+		Key:      "REQUIRE_NONEMPTY_OAS",
+		Variable: "RequireNonEmptyOAS",
+	},
+	{
+		Key:          ErrorResponseFormatEnvKey,
+		Variable:     "ErrorResponseFormat",
+		DefaultValue: ErrorResponseFormatJSON,
+	},
+	{
+		Key:      "DEBUG_PROFILE_ENABLED",
+		Variable: "DebugProfileEnabled",
+	},
+	{
+		Key:      SecuritySchemePoliciesEnvKey,
+		Variable: "SecuritySchemePolicies",
+	},
+	{
+		Key:      "POLICY_HTTP_ALLOWED_HOSTS",
+		Variable: "PolicyHTTPAllowedHosts",
+	},
+	{
+		Key:      "POLICY_HTTP_TIMEOUT",
+		Variable: "PolicyHTTPTimeout",
+	},
+	{
+		Key:      "POLICY_HTTP_CACHE_TTL",
+		Variable: "PolicyHTTPCacheTTL",
+	},
 }
 
 type EnvKey struct{}
@@ -174,9 +603,76 @@ func GetEnvOrDie() EnvironmentVariables {
 		panic(fmt.Errorf("missing environment variables, one of %s or %s set to true is required", TargetServiceHostEnvKey, StandaloneEnvKey))
 	}
 
+	if env.OPAModulesDirectory == "" && env.OPABundleURL == "" {
+		panic(fmt.Errorf("missing environment variables, one of %s or %s is required", OPAModulesDirectoryEnvKey, OPABundleURLEnvKey))
+	}
+
 	if env.Standalone && env.BindingsCrudServiceURL == "" {
 		panic(fmt.Errorf("missing environment variables, %s must be set if mode is standalone", BindingsCrudServiceURL))
 	}
 
+	for _, publicPath := range utils.SplitHeaderValues(env.PublicPaths, ",") {
+		if _, err := path.Match(publicPath, ""); err != nil {
+			panic(fmt.Errorf("invalid %s pattern %s: %s", PublicPathsEnvKey, publicPath, err.Error()))
+		}
+	}
+
+	for _, contentType := range utils.SplitHeaderValues(env.ResponseContentTypes, ",") {
+		if _, err := path.Match(contentType, ""); err != nil {
+			panic(fmt.Errorf("invalid %s pattern %s: %s", ResponseContentTypesEnvKey, contentType, err.Error()))
+		}
+	}
+
+	if _, err := ParseHeaderPairs(env.ProxyAddHeaders); err != nil {
+		panic(fmt.Errorf("invalid %s: %s", ProxyAddHeadersEnvKey, err.Error()))
+	}
+
+	if _, err := ParseSecuritySchemePolicies(env.SecuritySchemePolicies); err != nil {
+		panic(fmt.Errorf("invalid %s: %s", SecuritySchemePoliciesEnvKey, err.Error()))
+	}
+
+	if env.OASMergeStrategy != OASMergeStrategyError && env.OASMergeStrategy != OASMergeStrategyLastWins {
+		panic(fmt.Errorf("invalid %s %s: must be one of %s, %s", OASMergeStrategyEnvKey, env.OASMergeStrategy, OASMergeStrategyError, OASMergeStrategyLastWins))
+	}
+
+	if env.ErrorResponseFormat != ErrorResponseFormatJSON && env.ErrorResponseFormat != ErrorResponseFormatText {
+		panic(fmt.Errorf("invalid %s %s: must be one of %s, %s", ErrorResponseFormatEnvKey, env.ErrorResponseFormat, ErrorResponseFormatJSON, ErrorResponseFormatText))
+	}
+
+	for _, source := range utils.SplitHeaderValues(env.TrustedIdentitySource, ",") {
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			panic(fmt.Errorf("invalid %s %s: must be an IP address or a CIDR range", TrustedIdentitySourceEnvKey, source))
+		}
+	}
+
 	return env
 }
+
+// ParseHeaderPairs parses comma separated key=value pairs into headers.
+func ParseHeaderPairs(value string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range utils.SplitHeaderValues(value, ",") {
+		key, headerValue, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("header %s is not in the key=value form", pair)
+		}
+		headers.Add(key, strings.TrimSpace(headerValue))
+	}
+	return headers, nil
+}
+
+// ParseSecuritySchemePolicies parses comma separated scheme=policyName pairs, mapping the OAS
+// security schemes to the policies evaluated for the operations requiring them.
+func ParseSecuritySchemePolicies(value string) (map[string]string, error) {
+	schemePolicies := map[string]string{}
+	for _, pair := range utils.SplitHeaderValues(value, ",") {
+		scheme, policyName, found := strings.Cut(pair, "=")
+		scheme, policyName = strings.TrimSpace(scheme), strings.TrimSpace(policyName)
+		if !found || scheme == "" || policyName == "" {
+			return nil, fmt.Errorf("security scheme %s is not in the scheme=policyName form", pair)
+		}
+		schemePolicies[scheme] = policyName
+	}
+	return schemePolicies, nil
+}
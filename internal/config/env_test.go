@@ -21,6 +21,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gotest.tools/v3/assert"
@@ -74,11 +75,15 @@ func TestGetEnvOrDie(t *testing.T) {
 		HTTPPort:             "8080",
 		UserPropertiesHeader: "miauserproperties",
 		UserGroupsHeader:     "miausergroups",
+		UserGroupsDelimiter:  ",",
 		UserIdHeader:         "miauserid",
 		ClientTypeHeader:     "Client-Type",
 		DelayShutdownSeconds: 10,
 		PathPrefixStandalone: "/eval",
 		ServiceVersion:       "latest",
+		TargetServiceScheme:  "http",
+		OASMergeStrategy:     OASMergeStrategyError,
+		ErrorResponseFormat:  ErrorResponseFormatJSON,
 
 		OPAModulesDirectory: "/modules",
 	}
@@ -115,6 +120,23 @@ func TestGetEnvOrDie(t *testing.T) {
 		require.Equal(t, expectedEnvs, actualEnvs, "Unexpected envs variables.")
 	})
 
+	t.Run(`returns correctly - with OASFetchCacheTTL`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "OAS_FETCH_CACHE_TTL", value: "30s"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		actualEnvs := GetEnvOrDie()
+		expectedEnvs := defaultAndRequiredEnvironmentVariables
+		expectedEnvs.TargetServiceHost = "http://localhost:3000"
+		expectedEnvs.OASFetchCacheTTL = 30 * time.Second
+
+		require.Equal(t, expectedEnvs, actualEnvs, "Unexpected envs variables.")
+	})
+
 	t.Run(`returns error - with Standalone and not BindingsCrudServiceURL`, func(t *testing.T) {
 		otherEnvs := []env{
 			{name: "STANDALONE", value: "true"},
@@ -146,6 +168,132 @@ func TestGetEnvOrDie(t *testing.T) {
 		}, "Unexpected envs variables.")
 	})
 
+	t.Run(`returns correctly - with OPABundleURL and without OPAModulesDirectory`, func(t *testing.T) {
+		envs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "OPA_BUNDLE_URL", value: "http://bundle-server/bundle.tar.gz"},
+		}
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		actualEnvs := GetEnvOrDie()
+		expectedEnvs := defaultAndRequiredEnvironmentVariables
+		expectedEnvs.TargetServiceHost = "http://localhost:3000"
+		expectedEnvs.OPAModulesDirectory = ""
+		expectedEnvs.OPABundleURL = "http://bundle-server/bundle.tar.gz"
+
+		require.Equal(t, expectedEnvs, actualEnvs, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - no OPAModulesDirectory or OPABundleURL`, func(t *testing.T) {
+		unsetEnvs := setEnvs([]env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+		})
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("missing environment variables, one of %s or %s is required", OPAModulesDirectoryEnvKey, OPABundleURLEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid PublicPaths pattern`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "PUBLIC_PATHS", value: "/public/*,/assets/[a-"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s pattern /assets/[a-: syntax error in pattern", PublicPathsEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid ResponseContentTypes pattern`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "RESPONSE_FILTER_CONTENT_TYPES", value: "application/json,text/[a-"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s pattern text/[a-: syntax error in pattern", ResponseContentTypesEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid ProxyAddHeaders pair`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "PROXY_ADD_HEADERS", value: "X-Gateway=rond,X-Invalid"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s: header X-Invalid is not in the key=value form", ProxyAddHeadersEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid SecuritySchemePolicies pair`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "SECURITY_SCHEME_POLICIES", value: "bearerAuth=allow_bearer,apiKey="},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s: security scheme apiKey= is not in the scheme=policyName form", SecuritySchemePoliciesEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid TrustedIdentitySource`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "TRUSTED_IDENTITY_SOURCE", value: "10.0.0.0/8,gateway"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s gateway: must be an IP address or a CIDR range", TrustedIdentitySourceEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid OASMergeStrategy`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "OAS_MERGE_STRATEGY", value: "first-wins"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s first-wins: must be one of error, last-wins", OASMergeStrategyEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
+	t.Run(`throws - invalid ErrorResponseFormat`, func(t *testing.T) {
+		otherEnvs := []env{
+			{name: "TARGET_SERVICE_HOST", value: "http://localhost:3000"},
+			{name: "ERROR_RESPONSE_FORMAT", value: "xml"},
+		}
+		envs := append(requiredEnvs, otherEnvs...)
+		unsetEnvs := setEnvs(envs)
+		defer unsetEnvs()
+
+		require.PanicsWithError(t, fmt.Sprintf("invalid %s xml: must be one of json, text", ErrorResponseFormatEnvKey), func() {
+			GetEnvOrDie()
+		}, "Unexpected envs variables.")
+	})
+
 	t.Run(`throws - no Standalone or TargetServiceHost`, func(t *testing.T) {
 		otherEnvs := []env{}
 		envs := append(requiredEnvs, otherEnvs...)
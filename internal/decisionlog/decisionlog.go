@@ -0,0 +1,176 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decisionlog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const cookieHeaderKey = "Cookie"
+
+// defaultRedactedHeaders are always redacted, since they hold user credentials.
+var defaultRedactedHeaders = []string{"Authorization", cookieHeaderKey}
+
+type loggerContextKey struct{}
+
+// Decision describes a single authorization decision taken evaluating a policy.
+type Decision struct {
+	Time       time.Time       `json:"time"`
+	RequestID  string          `json:"requestId,omitempty"`
+	PolicyName string          `json:"policyName"`
+	Allowed    bool            `json:"allowed"`
+	Cached     bool            `json:"cached,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	UserID     string          `json:"userId,omitempty"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Input      json.RawMessage `json:"input,omitempty"`
+}
+
+// Logger writes the authorization decisions as JSON lines, replacing the values of the
+// redacted headers in the policy input with their SHA-256 hash.
+type Logger struct {
+	mu              sync.Mutex
+	writer          io.Writer
+	redactedHeaders map[string]struct{}
+}
+
+// NewLogger creates a decision logger writing to the provided writer. The Authorization
+// and Cookie headers are always redacted, in addition to the provided ones.
+func NewLogger(writer io.Writer, redactedHeaders []string) *Logger {
+	headers := make(map[string]struct{}, len(defaultRedactedHeaders)+len(redactedHeaders))
+	for _, header := range append(defaultRedactedHeaders, redactedHeaders...) {
+		headers[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+	return &Logger{
+		writer:          writer,
+		redactedHeaders: headers,
+	}
+}
+
+// NewFileLogger creates a decision logger appending to the file at the provided path,
+// or writing to the standard output if the path is empty.
+func NewFileLogger(path string, redactedHeaders []string) (*Logger, error) {
+	if path == "" {
+		return NewLogger(os.Stdout, redactedHeaders), nil
+	}
+	//#nosec G304 -- the path is provided by the service configuration
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed decision log file open: %s", err.Error())
+	}
+	return NewLogger(file, redactedHeaders), nil
+}
+
+// Log writes the decision as a single JSON line. A nil Logger does nothing.
+func (logger *Logger) Log(decision Decision) error {
+	if logger == nil {
+		return nil
+	}
+	if decision.Time.IsZero() {
+		decision.Time = time.Now()
+	}
+	decision.Input = logger.redactInput(decision.Input)
+
+	line, err := json.Marshal(decision)
+	if err != nil {
+		return fmt.Errorf("failed decision marshal: %s", err.Error())
+	}
+	line = append(line, '\n')
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if _, err := logger.writer.Write(line); err != nil {
+		return fmt.Errorf("failed decision write: %s", err.Error())
+	}
+	return nil
+}
+
+// redactInput hashes the redacted headers, and the cookies if the Cookie header is redacted.
+// If the input cannot be decoded, it is dropped so that no sensitive value is logged.
+func (logger *Logger) redactInput(input json.RawMessage) json.RawMessage {
+	if len(input) == 0 {
+		return nil
+	}
+	var decodedInput map[string]interface{}
+	if err := json.Unmarshal(input, &decodedInput); err != nil {
+		return nil
+	}
+
+	if request, ok := decodedInput["request"].(map[string]interface{}); ok {
+		if headers, ok := request["headers"].(map[string]interface{}); ok {
+			for key, values := range headers {
+				if _, redacted := logger.redactedHeaders[http.CanonicalHeaderKey(key)]; !redacted {
+					continue
+				}
+				if valuesList, ok := values.([]interface{}); ok {
+					for i, value := range valuesList {
+						valuesList[i] = hashValue(fmt.Sprint(value))
+					}
+				}
+			}
+		}
+		if cookies, ok := request["cookies"].(map[string]interface{}); ok {
+			if _, redacted := logger.redactedHeaders[cookieHeaderKey]; redacted {
+				for name, value := range cookies {
+					cookies[name] = hashValue(fmt.Sprint(value))
+				}
+			}
+		}
+	}
+
+	redactedInput, err := json.Marshal(decodedInput)
+	if err != nil {
+		return nil
+	}
+	return redactedInput
+}
+
+func hashValue(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// LoggerInjectorMiddleware will inject into request context the decision logger.
+func LoggerInjectorMiddleware(logger *Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithLogger(r.Context(), logger)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// GetLoggerFromContext extracts the decision logger from provided context,
+// returning `nil` if decision logging is not enabled.
+func GetLoggerFromContext(ctx context.Context) *Logger {
+	logger, _ := ctx.Value(loggerContextKey{}).(*Logger)
+	return logger
+}
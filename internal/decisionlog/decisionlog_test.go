@@ -0,0 +1,150 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decisionlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestLogger(t *testing.T) {
+	input := json.RawMessage(`{"request":{"method":"GET","headers":{"Authorization":["Bearer token"],"X-Api-Key":["secret"],"Accept":["application/json"]},"cookies":{"session":"secret-session"}},"user":{}}`)
+
+	t.Run("writes one JSON line per decision", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := NewLogger(buf, nil)
+
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow", Allowed: true, UserID: "user1", Method: http.MethodGet, Path: "/api"}))
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow", Error: "policy evaluation failed", Method: http.MethodPost, Path: "/api"}))
+
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		require.Len(t, lines, 2)
+
+		var decision Decision
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &decision))
+		require.Equal(t, "allow", decision.PolicyName)
+		require.True(t, decision.Allowed)
+		require.Equal(t, "user1", decision.UserID)
+		require.WithinDuration(t, time.Now(), decision.Time, time.Minute)
+
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &decision))
+		require.False(t, decision.Allowed)
+		require.Equal(t, "policy evaluation failed", decision.Error)
+	})
+
+	t.Run("hashes default and configured redacted headers", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := NewLogger(buf, []string{"x-api-key"})
+
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow", Input: input}))
+
+		require.NotContains(t, buf.String(), "secret")
+		require.NotContains(t, buf.String(), "Bearer token")
+
+		var decision struct {
+			Input struct {
+				Request struct {
+					Headers map[string][]string `json:"headers"`
+					Cookies map[string]string   `json:"cookies"`
+				} `json:"request"`
+			} `json:"input"`
+		}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decision))
+		require.Equal(t, []string{hashValue("Bearer token")}, decision.Input.Request.Headers["Authorization"])
+		require.Equal(t, []string{hashValue("secret")}, decision.Input.Request.Headers["X-Api-Key"])
+		require.Equal(t, []string{"application/json"}, decision.Input.Request.Headers["Accept"])
+		require.Equal(t, hashValue("secret-session"), decision.Input.Request.Cookies["session"])
+	})
+
+	t.Run("drops input that cannot be decoded", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		logger := NewLogger(buf, nil)
+
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow", Input: json.RawMessage(`not-json`)}))
+		require.NotContains(t, buf.String(), `"input"`)
+	})
+
+	t.Run("returns writer errors", func(t *testing.T) {
+		logger := NewLogger(failingWriter{}, nil)
+		err := logger.Log(Decision{PolicyName: "allow"})
+		require.EqualError(t, err, "failed decision write: write failed")
+	})
+
+	t.Run("nil logger does nothing", func(t *testing.T) {
+		var logger *Logger
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow"}))
+	})
+}
+
+func TestNewFileLogger(t *testing.T) {
+	t.Run("appends decisions to file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "decisions.log")
+		logger, err := NewFileLogger(path, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, logger.Log(Decision{PolicyName: "allow", Allowed: true}))
+
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(content), `"policyName":"allow"`)
+	})
+
+	t.Run("writes to standard output without path", func(t *testing.T) {
+		logger, err := NewFileLogger("", nil)
+		require.NoError(t, err)
+		require.Equal(t, os.Stdout, logger.writer)
+	})
+
+	t.Run("fails on invalid path", func(t *testing.T) {
+		_, err := NewFileLogger(filepath.Join(t.TempDir(), "missing", "decisions.log"), nil)
+		require.Error(t, err)
+	})
+}
+
+func TestLoggerInjectorMiddleware(t *testing.T) {
+	logger := NewLogger(&bytes.Buffer{}, nil)
+
+	t.Run("injects logger in request context", func(t *testing.T) {
+		invoked := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			require.Equal(t, logger, GetLoggerFromContext(r.Context()))
+		})
+
+		LoggerInjectorMiddleware(logger)(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.True(t, invoked, "next handler not invoked")
+	})
+
+	t.Run("returns nil without logger", func(t *testing.T) {
+		require.Nil(t, GetLoggerFromContext(context.Background()))
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
+)
+
+// HeaderExtractorName selects the HeaderExtractor, which is the default one.
+const HeaderExtractorName = "header"
+
+type extractorContextKey struct{}
+
+// Identity is the user performing the request.
+type Identity struct {
+	ID         string
+	Groups     []string
+	Properties map[string]interface{}
+}
+
+// Extractor retrieves the identity of the user performing the request.
+type Extractor interface {
+	Extract(req *http.Request) (Identity, error)
+}
+
+// HeaderExtractor reads the identity from the request headers set by the upstream authentication.
+type HeaderExtractor struct {
+	IDHeader         string
+	GroupsHeader     string
+	GroupsDelimiter  string
+	PropertiesHeader string
+	// PropertiesBase64 is set when the upstream base64 encodes the JSON properties header.
+	PropertiesBase64 bool
+}
+
+func NewHeaderExtractor(env config.EnvironmentVariables) HeaderExtractor {
+	return HeaderExtractor{
+		IDHeader:         env.UserIdHeader,
+		GroupsHeader:     env.UserGroupsHeader,
+		GroupsDelimiter:  env.UserGroupsDelimiter,
+		PropertiesHeader: env.UserPropertiesHeader,
+		PropertiesBase64: env.UserPropertiesBase64,
+	}
+}
+
+func (e HeaderExtractor) Extract(req *http.Request) (Identity, error) {
+	properties := make(map[string]interface{})
+	if value := req.Header.Get(e.PropertiesHeader); value != "" {
+		propertiesJSON := []byte(value)
+		if e.PropertiesBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return Identity{}, fmt.Errorf("user properties header is not valid base64: %s", err.Error())
+			}
+			propertiesJSON = decoded
+		}
+		if err := json.Unmarshal(propertiesJSON, &properties); err != nil {
+			return Identity{}, fmt.Errorf("user properties header is not valid: %s", err.Error())
+		}
+	}
+	return Identity{
+		ID:         req.Header.Get(e.IDHeader),
+		Groups:     utils.SplitHeaderValues(req.Header.Get(e.GroupsHeader), e.GroupsDelimiter),
+		Properties: properties,
+	}, nil
+}
+
+// NewExtractor returns the extractor with the given name, defaulting to the HeaderExtractor.
+func NewExtractor(name string, env config.EnvironmentVariables) (Extractor, error) {
+	switch name {
+	case "", HeaderExtractorName:
+		return NewHeaderExtractor(env), nil
+	}
+	return nil, fmt.Errorf("unknown identity extractor %s", name)
+}
+
+// ExtractorInjectorMiddleware will inject into request context the identity extractor.
+func ExtractorInjectorMiddleware(extractor Extractor) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithExtractor(r.Context(), extractor)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithExtractor(ctx context.Context, extractor Extractor) context.Context {
+	return context.WithValue(ctx, extractorContextKey{}, extractor)
+}
+
+// GetExtractorFromContext extracts the identity extractor from provided context,
+// returning the HeaderExtractor configured by env if none has been injected.
+func GetExtractorFromContext(ctx context.Context, env config.EnvironmentVariables) Extractor {
+	if extractor, ok := ctx.Value(extractorContextKey{}).(Extractor); ok {
+		return extractor
+	}
+	return NewHeaderExtractor(env)
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package identity
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderExtractor(t *testing.T) {
+	env := config.EnvironmentVariables{
+		UserIdHeader:         "userid",
+		UserGroupsHeader:     "usergroups",
+		UserPropertiesHeader: "userproperties",
+	}
+	extractor := NewHeaderExtractor(env)
+
+	t.Run("extracts the identity from headers", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("userid", "user1")
+		req.Header.Set("usergroups", "admin, users")
+		req.Header.Set("userproperties", `{"my":"other","key":["is","not"]}`)
+
+		userIdentity, err := extractor.Extract(req)
+		require.NoError(t, err)
+		require.Equal(t, Identity{
+			ID:         "user1",
+			Groups:     []string{"admin", "users"},
+			Properties: map[string]interface{}{"my": "other", "key": []interface{}{"is", "not"}},
+		}, userIdentity)
+	})
+
+	t.Run("empty identity without headers", func(t *testing.T) {
+		userIdentity, err := extractor.Extract(httptest.NewRequest(http.MethodGet, "/", nil))
+		require.NoError(t, err)
+		require.Equal(t, Identity{Groups: []string{}, Properties: map[string]interface{}{}}, userIdentity)
+	})
+
+	t.Run("fails on invalid properties header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("userproperties", `"not an object"`)
+
+		_, err := extractor.Extract(req)
+		require.ErrorContains(t, err, "user properties header is not valid")
+	})
+
+	t.Run("base64 encoded properties header", func(t *testing.T) {
+		env := env
+		env.UserPropertiesBase64 = true
+		extractor := NewHeaderExtractor(env)
+
+		t.Run("decodes the properties", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("userproperties", base64.StdEncoding.EncodeToString([]byte(`{"my":"other"}`)))
+
+			userIdentity, err := extractor.Extract(req)
+			require.NoError(t, err)
+			require.Equal(t, map[string]interface{}{"my": "other"}, userIdentity.Properties)
+		})
+
+		t.Run("fails on invalid base64", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("userproperties", `{"my":"other"}`)
+
+			_, err := extractor.Extract(req)
+			require.ErrorContains(t, err, "user properties header is not valid base64")
+		})
+	})
+}
+
+func TestNewExtractor(t *testing.T) {
+	env := config.EnvironmentVariables{UserIdHeader: "userid"}
+
+	for _, name := range []string{"", HeaderExtractorName} {
+		extractor, err := NewExtractor(name, env)
+		require.NoError(t, err)
+		require.Equal(t, NewHeaderExtractor(env), extractor)
+	}
+
+	_, err := NewExtractor("mtls", env)
+	require.EqualError(t, err, "unknown identity extractor mtls")
+}
+
+type staticExtractor struct{}
+
+func (staticExtractor) Extract(req *http.Request) (Identity, error) {
+	return Identity{ID: "static"}, nil
+}
+
+func TestGetExtractorFromContext(t *testing.T) {
+	env := config.EnvironmentVariables{UserIdHeader: "userid"}
+
+	t.Run("defaults to the header extractor", func(t *testing.T) {
+		require.Equal(t, NewHeaderExtractor(env), GetExtractorFromContext(context.Background(), env))
+	})
+
+	t.Run("returns the injected extractor", func(t *testing.T) {
+		ctx := WithExtractor(context.Background(), staticExtractor{})
+		require.Equal(t, staticExtractor{}, GetExtractorFromContext(ctx, env))
+	})
+
+	t.Run("injected by middleware", func(t *testing.T) {
+		var extractor Extractor
+		handler := ExtractorInjectorMiddleware(staticExtractor{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			extractor = GetExtractorFromContext(r.Context(), env)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, staticExtractor{}, extractor)
+	})
+}
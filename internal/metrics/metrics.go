@@ -0,0 +1,97 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metricsContextKey struct{}
+
+// Metrics collects the rönd metrics in its own registry.
+type Metrics struct {
+	registry            *prometheus.Registry
+	mongoQueryDuration  *prometheus.HistogramVec
+	mongoQueryDocuments *prometheus.HistogramVec
+	policyUndefined     *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		mongoQueryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rond",
+			Name:      "mongo_query_duration_seconds",
+			Help:      "Duration of the MongoDB queries performed by the policies builtins.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"collection", "operation"}),
+		mongoQueryDocuments: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rond",
+			Name:      "mongo_query_documents",
+			Help:      "Number of documents found by the MongoDB queries performed by the policies builtins.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"collection", "operation"}),
+		policyUndefined: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rond",
+			Name:      "policy_undefined_results_total",
+			Help:      "Number of policy evaluations with an undefined result, denied as not allowed.",
+		}, []string{"policy"}),
+	}
+	m.registry.MustRegister(m.mongoQueryDuration, m.mongoQueryDocuments, m.policyUndefined)
+	return m
+}
+
+// ObserveMongoQuery records the duration and the number of found documents of a MongoDB query.
+func (m *Metrics) ObserveMongoQuery(collectionName, operation string, duration time.Duration, documents int) {
+	m.mongoQueryDuration.WithLabelValues(collectionName, operation).Observe(duration.Seconds())
+	m.mongoQueryDocuments.WithLabelValues(collectionName, operation).Observe(float64(documents))
+}
+
+// ObservePolicyUndefined counts an evaluation of the policy with an undefined result.
+func (m *Metrics) ObservePolicyUndefined(policyName string) {
+	m.policyUndefined.WithLabelValues(policyName).Inc()
+}
+
+// Handler exposes the collected metrics in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// MetricsInjectorMiddleware will inject into request context the metrics.
+func MetricsInjectorMiddleware(m *Metrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithMetrics(r.Context(), m)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey{}, m)
+}
+
+// GetMetricsFromContext extracts the metrics from provided context,
+// returning `nil` if metrics are not enabled.
+func GetMetricsFromContext(ctx context.Context) *Metrics {
+	m, _ := ctx.Value(metricsContextKey{}).(*Metrics)
+	return m
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveMongoQuery(t *testing.T) {
+	m := New()
+	m.ObserveMongoQuery("projects", "find_many", 20*time.Millisecond, 3)
+	m.ObserveMongoQuery("projects", "find_many", 30*time.Millisecond, 5)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Contains(t, w.Body.String(), `rond_mongo_query_duration_seconds_count{collection="projects",operation="find_many"} 2`)
+	require.Contains(t, w.Body.String(), `rond_mongo_query_duration_seconds_sum{collection="projects",operation="find_many"} 0.05`)
+	require.Contains(t, w.Body.String(), `rond_mongo_query_documents_sum{collection="projects",operation="find_many"} 8`)
+}
+
+func TestObservePolicyUndefined(t *testing.T) {
+	m := New()
+	m.ObservePolicyUndefined("allow")
+	m.ObservePolicyUndefined("allow")
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Contains(t, w.Body.String(), `rond_policy_undefined_results_total{policy="allow"} 2`)
+}
+
+func TestGetMetricsFromContext(t *testing.T) {
+	t.Run("nil when not enabled", func(t *testing.T) {
+		require.Nil(t, GetMetricsFromContext(context.Background()))
+	})
+
+	t.Run("injected by middleware", func(t *testing.T) {
+		m := New()
+		var found *Metrics
+		handler := MetricsInjectorMiddleware(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			found = GetMetricsFromContext(r.Context())
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Same(t, m, found)
+	})
+}
@@ -26,22 +26,32 @@ type FindOneExpectation struct {
 }
 
 type MongoClientMock struct {
-	FindOneError        error
-	UserBindingsError   error
-	UserRolesError      error
-	FindOneResult       interface{}
-	FindManyError       error
-	FindOneExpectation  func(collectionName string, query interface{})
-	FindManyExpectation func(collectionName string, query interface{})
-	UserRoles           []types.Role
-	UserBindings        []types.Binding
-	FindManyResult      []interface{}
+	FindOneError                 error
+	UserBindingsError            error
+	UserRolesError               error
+	FindOneResult                interface{}
+	FindManyError                error
+	FindOneExpectation           func(collectionName string, query interface{})
+	FindManyExpectation          func(collectionName string, query interface{})
+	FindManyPaginatedExpectation func(collectionName string, query interface{}, skip, limit int64)
+	UserRoles                    []types.Role
+	UserBindings                 []types.Binding
+	FindManyResult               []interface{}
+	CountDocumentsError          error
+	CountDocumentsExpectation    func(collectionName string, query interface{})
+	CountDocumentsResult         int64
+	ProjectionExpectation        func(projection interface{})
+	HealthCheckError             error
 }
 
 func (mongoClient MongoClientMock) Disconnect() error {
 	return nil
 }
 
+func (mongoClient MongoClientMock) HealthCheck(ctx context.Context) error {
+	return mongoClient.HealthCheckError
+}
+
 func (mongoClient MongoClientMock) RetrieveRoles(ctx context.Context) ([]types.Role, error) {
 	return nil, nil
 }
@@ -60,8 +70,11 @@ func (mongoClient MongoClientMock) RetrieveUserRolesByRolesID(ctx context.Contex
 	return nil, mongoClient.UserRolesError
 }
 
-func (mongoClient MongoClientMock) FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error) {
+func (mongoClient MongoClientMock) FindOne(ctx context.Context, collectionName string, query, projection map[string]interface{}) (interface{}, error) {
 	mongoClient.FindOneExpectation(collectionName, query)
+	if mongoClient.ProjectionExpectation != nil {
+		mongoClient.ProjectionExpectation(projection)
+	}
 	if mongoClient.FindOneError != nil {
 		return nil, mongoClient.FindOneError
 	}
@@ -69,11 +82,32 @@ func (mongoClient MongoClientMock) FindOne(ctx context.Context, collectionName s
 	return mongoClient.FindOneResult, nil
 }
 
-func (mongoClient MongoClientMock) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+func (mongoClient MongoClientMock) FindMany(ctx context.Context, collectionName string, query, projection map[string]interface{}) ([]interface{}, error) {
 	mongoClient.FindManyExpectation(collectionName, query)
+	if mongoClient.ProjectionExpectation != nil {
+		mongoClient.ProjectionExpectation(projection)
+	}
 	if mongoClient.FindManyError != nil {
 		return nil, mongoClient.FindManyError
 	}
 
 	return mongoClient.FindManyResult, nil
 }
+
+func (mongoClient MongoClientMock) FindManyPaginated(ctx context.Context, collectionName string, query map[string]interface{}, skip, limit int64) ([]interface{}, error) {
+	mongoClient.FindManyPaginatedExpectation(collectionName, query, skip, limit)
+	if mongoClient.FindManyError != nil {
+		return nil, mongoClient.FindManyError
+	}
+
+	return mongoClient.FindManyResult, nil
+}
+
+func (mongoClient MongoClientMock) CountDocuments(ctx context.Context, collectionName string, query map[string]interface{}) (int64, error) {
+	mongoClient.CountDocumentsExpectation(collectionName, query)
+	if mongoClient.CountDocumentsError != nil {
+		return 0, mongoClient.CountDocumentsError
+	}
+
+	return mongoClient.CountDocumentsResult, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/internal/utils"
+	"github.com/rond-authz/rond/types"
+	"github.com/samber/lo"
+)
+
+const defaultBindingsCacheSize = 1000
+
+type bindingsCacheContextKey struct{}
+
+type bindingsCacheEntry struct {
+	key       string
+	user      types.User
+	expiresAt time.Time
+}
+
+// BindingsCache is an in-memory LRU cache, with entries expiring after a fixed TTL,
+// holding the bindings and roles retrieved for a user identity.
+type BindingsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// NewBindingsCache returns a BindingsCache holding up to size entries for the given ttl.
+// The function returns a `nil` cache if ttl is not positive, meaning caching is disabled.
+func NewBindingsCache(size int, ttl time.Duration) *BindingsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultBindingsCacheSize
+	}
+	return &BindingsCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func bindingsCacheKey(tenant, userID string, userGroups []string) string {
+	groups := append([]string{}, userGroups...)
+	sort.Strings(groups)
+	return tenant + "|" + userID + "|" + strings.Join(groups, ",")
+}
+
+// Get returns the cached bindings and roles for the given tenant and identity, if present and not expired.
+func (cache *BindingsCache) Get(tenant, userID string, userGroups []string) (types.User, bool) {
+	if cache == nil {
+		return types.User{}, false
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[bindingsCacheKey(tenant, userID, userGroups)]
+	if !ok {
+		return types.User{}, false
+	}
+	entry := element.Value.(*bindingsCacheEntry)
+	if cache.now().After(entry.expiresAt) {
+		cache.removeElement(element)
+		return types.User{}, false
+	}
+	cache.lru.MoveToFront(element)
+	return entry.user, true
+}
+
+// Set stores the user bindings and roles, evicting the least recently used entry when full.
+func (cache *BindingsCache) Set(user types.User) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := bindingsCacheKey(user.Tenant, user.UserID, user.UserGroups)
+	expiresAt := cache.now().Add(cache.ttl)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*bindingsCacheEntry)
+		entry.user = user
+		entry.expiresAt = expiresAt
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(&bindingsCacheEntry{key: key, user: user, expiresAt: expiresAt})
+	if cache.lru.Len() > cache.size {
+		cache.removeElement(cache.lru.Back())
+	}
+}
+
+// Invalidate removes every entry whose identity matches one of the given subjects or groups.
+func (cache *BindingsCache) Invalidate(subjects []string, groups []string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, element := range cache.entries {
+		user := element.Value.(*bindingsCacheEntry).user
+		if utils.Contains(subjects, user.UserID) || lo.Some(groups, user.UserGroups) {
+			cache.removeElement(element)
+		}
+	}
+}
+
+func (cache *BindingsCache) removeElement(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*bindingsCacheEntry).key)
+}
+
+// BindingsCacheInjectorMiddleware will inject into request context the bindings cache.
+func BindingsCacheInjectorMiddleware(cache *BindingsCache) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithBindingsCache(r.Context(), cache)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func WithBindingsCache(ctx context.Context, cache *BindingsCache) context.Context {
+	return context.WithValue(ctx, bindingsCacheContextKey{}, cache)
+}
+
+// GetBindingsCacheFromContext extracts the bindings cache from provided context,
+// returning `nil` if none has been injected.
+func GetBindingsCacheFromContext(ctx context.Context) *BindingsCache {
+	cache, _ := ctx.Value(bindingsCacheContextKey{}).(*BindingsCache)
+	return cache
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongoclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/types"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"gotest.tools/v3/assert"
+)
+
+func TestBindingsCache(t *testing.T) {
+	user := types.User{
+		UserID:       "userId",
+		UserGroups:   []string{"group1", "group2"},
+		UserBindings: []types.Binding{{BindingID: "b1", Roles: []string{"r1"}}},
+		UserRoles:    []types.Role{{RoleID: "r1", Permissions: []string{"p1"}}},
+	}
+
+	t.Run("is disabled without ttl", func(t *testing.T) {
+		cache := NewBindingsCache(10, 0)
+		assert.Assert(t, cache == nil)
+
+		cache.Set(user)
+		_, ok := cache.Get("", user.UserID, user.UserGroups)
+		assert.Assert(t, !ok)
+		cache.Invalidate([]string{user.UserID}, nil)
+	})
+
+	t.Run("returns entries regardless of groups order", func(t *testing.T) {
+		cache := NewBindingsCache(10, time.Minute)
+		cache.Set(user)
+
+		cachedUser, ok := cache.Get("", "userId", []string{"group2", "group1"})
+		assert.Assert(t, ok)
+		assert.DeepEqual(t, cachedUser, user)
+
+		_, ok = cache.Get("", "userId", []string{"group1"})
+		assert.Assert(t, !ok)
+	})
+
+	t.Run("expires entries after ttl", func(t *testing.T) {
+		now := time.Now()
+		cache := NewBindingsCache(10, time.Minute)
+		cache.now = func() time.Time { return now }
+		cache.Set(user)
+
+		now = now.Add(30 * time.Second)
+		_, ok := cache.Get("", user.UserID, user.UserGroups)
+		assert.Assert(t, ok)
+
+		now = now.Add(time.Minute)
+		_, ok = cache.Get("", user.UserID, user.UserGroups)
+		assert.Assert(t, !ok)
+		assert.Equal(t, cache.lru.Len(), 0)
+	})
+
+	t.Run("evicts least recently used entry", func(t *testing.T) {
+		cache := NewBindingsCache(2, time.Minute)
+		cache.Set(types.User{UserID: "u1"})
+		cache.Set(types.User{UserID: "u2"})
+		_, ok := cache.Get("", "u1", nil)
+		assert.Assert(t, ok)
+
+		cache.Set(types.User{UserID: "u3"})
+		_, ok = cache.Get("", "u2", nil)
+		assert.Assert(t, !ok)
+		_, ok = cache.Get("", "u1", nil)
+		assert.Assert(t, ok)
+		_, ok = cache.Get("", "u3", nil)
+		assert.Assert(t, ok)
+	})
+
+	t.Run("invalidates entries by subject or group", func(t *testing.T) {
+		cache := NewBindingsCache(10, time.Minute)
+		cache.Set(types.User{UserID: "u1", UserGroups: []string{"g1"}})
+		cache.Set(types.User{UserID: "u2", UserGroups: []string{"g2"}})
+		cache.Set(types.User{UserID: "u3", UserGroups: []string{"g3"}})
+
+		cache.Invalidate([]string{"u1"}, []string{"g2"})
+
+		_, ok := cache.Get("", "u1", []string{"g1"})
+		assert.Assert(t, !ok)
+		_, ok = cache.Get("", "u2", []string{"g2"})
+		assert.Assert(t, !ok)
+		_, ok = cache.Get("", "u3", []string{"g3"})
+		assert.Assert(t, ok)
+	})
+}
+
+func TestGetBindingsCacheFromContext(t *testing.T) {
+	t.Run("cache not found in context", func(t *testing.T) {
+		assert.Assert(t, GetBindingsCacheFromContext(context.Background()) == nil)
+	})
+
+	t.Run("cache injected by middleware", func(t *testing.T) {
+		cache := NewBindingsCache(10, time.Minute)
+		invoked := false
+		handler := BindingsCacheInjectorMiddleware(cache)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			assert.Equal(t, GetBindingsCacheFromContext(r.Context()), cache)
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Assert(t, invoked)
+	})
+}
+
+// slowMongoClientMock simulates the round-trip latency of the bindings and roles queries.
+type slowMongoClientMock struct {
+	mocks.MongoClientMock
+}
+
+func (mongoClient slowMongoClientMock) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	time.Sleep(100 * time.Microsecond)
+	return mongoClient.MongoClientMock.RetrieveUserBindings(ctx, user)
+}
+
+func (mongoClient slowMongoClientMock) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	time.Sleep(100 * time.Microsecond)
+	return mongoClient.MongoClientMock.RetrieveUserRolesByRolesID(ctx, userRolesId)
+}
+
+func BenchmarkRetrieveUserBindingsAndRoles(b *testing.B) {
+	logger, _ := test.NewNullLogger()
+	env := config.EnvironmentVariables{
+		UserGroupsHeader: "thegroupsheader",
+		UserIdHeader:     "theuserheader",
+	}
+	mock := slowMongoClientMock{
+		MongoClientMock: mocks.MongoClientMock{
+			UserBindings: []types.Binding{{Roles: []string{"r1", "r2"}}},
+			UserRoles: []types.Role{
+				{RoleID: "r1", Permissions: []string{"p1"}},
+				{RoleID: "r2", Permissions: []string{"p2"}},
+			},
+		},
+	}
+
+	run := func(b *testing.B, bindingsCache *BindingsCache) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), mock), bindingsCache))
+		req.Header.Set("thegroupsheader", "group1,group2")
+		req.Header.Set("theuserheader", "userId")
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, env); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		run(b, nil)
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		run(b, NewBindingsCache(100, time.Minute))
+	})
+}
@@ -20,18 +20,21 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/identity"
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 )
@@ -41,11 +44,47 @@ type MongoClient struct {
 	bindings     *mongo.Collection
 	roles        *mongo.Collection
 	databaseName string
+
+	bindingsCollectionName string
+	rolesCollectionName    string
+	tenantCollectionFormat string
+	documentStates         []string
 }
 
 const STATE string = "__STATE__"
 const PUBLIC string = "PUBLIC"
 
+const defaultTenantCollectionFormat = "{collection}_{tenant}"
+
+// ErrInvalidTenant is returned when tenant resolution is enabled and the request
+// carries a missing or malformed tenant.
+var ErrInvalidTenant = errors.New("invalid tenant")
+
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type tenantContextKey struct{}
+
+// WithTenant stores in the context the tenant used to select the bindings
+// and roles collections.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// GetTenantFromContext returns the tenant stored in the context, if any.
+func GetTenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// TenantCollectionName builds the collection name for the tenant replacing the
+// {collection} and {tenant} placeholders of format.
+func TenantCollectionName(format, collectionName, tenant string) string {
+	if format == "" {
+		format = defaultTenantCollectionFormat
+	}
+	return strings.NewReplacer("{collection}", collectionName, "{tenant}", tenant).Replace(format)
+}
+
 // MongoClientInjectorMiddleware will inject into request context the
 // mongo collections.
 func MongoClientInjectorMiddleware(collections types.IMongoClient) mux.MiddlewareFunc {
@@ -83,6 +122,14 @@ func (mongoClient *MongoClient) Disconnect() error {
 	return nil
 }
 
+// HealthCheck verifies the connection to MongoDB pinging the primary node.
+func (mongoClient *MongoClient) HealthCheck(ctx context.Context) error {
+	if mongoClient == nil {
+		return nil
+	}
+	return mongoClient.client.Ping(ctx, readpref.Primary())
+}
+
 // NewMongoClient tries to setup a new MongoClient instance.
 // The function returns a `nil` client if the environment variable `MongoDBUrl` is not specified.
 func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*MongoClient, error) {
@@ -105,7 +152,10 @@ func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*Mo
 		return nil, fmt.Errorf("failed MongoDB connection string validation: %s", err.Error())
 	}
 
-	clientOpts := options.Client().ApplyURI(env.MongoDBUrl)
+	clientOpts, err := clientOptions(env)
+	if err != nil {
+		return nil, err
+	}
 	client, err := mongo.Connect(context.Background(), clientOpts)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to MongoDB: %s", err.Error())
@@ -117,17 +167,110 @@ func NewMongoClient(env config.EnvironmentVariables, logger *logrus.Logger) (*Mo
 		return nil, fmt.Errorf("error verifying MongoDB connection: %s", err.Error())
 	}
 
+	databaseName := resolveDatabaseName(env, parsedConnectionString)
 	mongoClient := MongoClient{
 		client:       client,
-		databaseName: parsedConnectionString.Database,
-		roles:        client.Database(parsedConnectionString.Database).Collection(env.RolesCollectionName),
-		bindings:     client.Database(parsedConnectionString.Database).Collection(env.BindingsCollectionName),
+		databaseName: databaseName,
+		roles:        client.Database(databaseName).Collection(env.RolesCollectionName),
+		bindings:     client.Database(databaseName).Collection(env.BindingsCollectionName),
+
+		bindingsCollectionName: env.BindingsCollectionName,
+		rolesCollectionName:    env.RolesCollectionName,
+		tenantCollectionFormat: env.TenantCollectionFormat,
+		documentStates:         documentStates(env.IncludeStates),
 	}
 
 	logger.Info("MongoDB client set up completed")
 	return &mongoClient, nil
 }
 
+// clientOptions returns the MongoDB client options for the connection string,
+// applying the configured read preference and read concern, if any.
+func clientOptions(env config.EnvironmentVariables) (*options.ClientOptions, error) {
+	clientOpts := options.Client().ApplyURI(env.MongoDBUrl)
+
+	if env.MongoReadPreference != "" {
+		mode, err := readpref.ModeFromString(env.MongoReadPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MongoDB read preference %s: %s", env.MongoReadPreference, err.Error())
+		}
+		readPreference, err := readpref.New(mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MongoDB read preference %s: %s", env.MongoReadPreference, err.Error())
+		}
+		clientOpts.SetReadPreference(readPreference)
+	}
+
+	if env.MongoReadConcern != "" {
+		readConcern, ok := readConcerns[env.MongoReadConcern]
+		if !ok {
+			return nil, fmt.Errorf("invalid MongoDB read concern %s: must be one of local, available, majority, linearizable, snapshot", env.MongoReadConcern)
+		}
+		clientOpts.SetReadConcern(readConcern())
+	}
+	return clientOpts, nil
+}
+
+var readConcerns = map[string]func() *readconcern.ReadConcern{
+	"local":        readconcern.Local,
+	"available":    readconcern.Available,
+	"majority":     readconcern.Majority,
+	"linearizable": readconcern.Linearizable,
+	"snapshot":     readconcern.Snapshot,
+}
+
+// resolveDatabaseName returns the database configured with MongoDatabaseName, if any,
+// otherwise the one specified in the connection string.
+func resolveDatabaseName(env config.EnvironmentVariables, connectionString connstring.ConnString) string {
+	if env.MongoDatabaseName != "" {
+		return env.MongoDatabaseName
+	}
+	return connectionString.Database
+}
+
+// documentStates returns the CRUD states of the bindings and roles to retrieve,
+// PUBLIC followed by the comma separated includeStates.
+func documentStates(includeStates string) []string {
+	states := []string{PUBLIC}
+	for _, state := range utils.SplitHeaderValues(includeStates, ",") {
+		if !utils.Contains(states, state) {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// stateFilter matches the bindings and roles in the retrieved CRUD states, only PUBLIC by default.
+func (mongoClient *MongoClient) stateFilter() bson.M {
+	if len(mongoClient.documentStates) <= 1 {
+		return bson.M{STATE: PUBLIC}
+	}
+	return bson.M{STATE: bson.M{"$in": mongoClient.documentStates}}
+}
+
+// bindingsCollection returns the bindings collection of the tenant in context,
+// falling back to the configured one when no tenant is set.
+func (mongoClient *MongoClient) bindingsCollection(ctx context.Context) *mongo.Collection {
+	if tenant := GetTenantFromContext(ctx); tenant != "" {
+		return mongoClient.tenantCollection(mongoClient.bindingsCollectionName, tenant)
+	}
+	return mongoClient.bindings
+}
+
+// rolesCollection returns the roles collection of the tenant in context,
+// falling back to the configured one when no tenant is set.
+func (mongoClient *MongoClient) rolesCollection(ctx context.Context) *mongo.Collection {
+	if tenant := GetTenantFromContext(ctx); tenant != "" {
+		return mongoClient.tenantCollection(mongoClient.rolesCollectionName, tenant)
+	}
+	return mongoClient.roles
+}
+
+func (mongoClient *MongoClient) tenantCollection(collectionName, tenant string) *mongo.Collection {
+	name := TenantCollectionName(mongoClient.tenantCollectionFormat, collectionName, tenant)
+	return mongoClient.client.Database(mongoClient.databaseName).Collection(name)
+}
+
 func (mongoClient *MongoClient) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
 	filter := bson.M{
 		"$and": []bson.M{
@@ -137,10 +280,10 @@ func (mongoClient *MongoClient) RetrieveUserBindings(ctx context.Context, user *
 					{"groups": bson.M{"$elemMatch": bson.M{"$in": user.UserGroups}}},
 				},
 			},
-			{STATE: PUBLIC},
+			mongoClient.stateFilter(),
 		},
 	}
-	cursor, err := mongoClient.bindings.Find(
+	cursor, err := mongoClient.bindingsCollection(ctx).Find(
 		ctx,
 		filter,
 	)
@@ -155,10 +298,8 @@ func (mongoClient *MongoClient) RetrieveUserBindings(ctx context.Context, user *
 }
 
 func (mongoClient *MongoClient) RetrieveRoles(ctx context.Context) ([]types.Role, error) {
-	filter := bson.M{
-		STATE: PUBLIC,
-	}
-	cursor, err := mongoClient.roles.Find(
+	filter := mongoClient.stateFilter()
+	cursor, err := mongoClient.rolesCollection(ctx).Find(
 		ctx,
 		filter,
 	)
@@ -178,10 +319,10 @@ func (mongoClient *MongoClient) RetrieveUserRolesByRolesID(ctx context.Context,
 			{
 				"roleId": bson.M{"$in": userRolesId},
 			},
-			{STATE: PUBLIC},
+			mongoClient.stateFilter(),
 		},
 	}
-	cursor, err := mongoClient.roles.Find(
+	cursor, err := mongoClient.rolesCollection(ctx).Find(
 		ctx,
 		filter,
 	)
@@ -195,7 +336,9 @@ func (mongoClient *MongoClient) RetrieveUserRolesByRolesID(ctx context.Context,
 	return rolesResult, nil
 }
 
-func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error) {
+// FindOne returns the first document matching query; when projection is not empty,
+// only the projected fields are returned.
+func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName string, query, projection map[string]interface{}) (interface{}, error) {
 	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
 	glogger.Get(ctx).WithFields(logrus.Fields{
 		"mongoQuery":     query,
@@ -203,7 +346,11 @@ func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName stri
 		"collectionName": collectionName,
 	}).Debug("performing query")
 
-	result := collection.FindOne(ctx, query)
+	findOneOptions := options.FindOne()
+	if len(projection) > 0 {
+		findOneOptions.SetProjection(projection)
+	}
+	result := collection.FindOne(ctx, query, findOneOptions)
 
 	var bsonDocument bson.D
 	err := result.Decode(&bsonDocument)
@@ -230,7 +377,22 @@ func (mongoClient *MongoClient) FindOne(ctx context.Context, collectionName stri
 	return res, nil
 }
 
-func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error) {
+// FindMany returns all the documents matching query; when projection is not empty,
+// only the projected fields are returned.
+func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName string, query, projection map[string]interface{}) ([]interface{}, error) {
+	findOptions := options.Find()
+	if len(projection) > 0 {
+		findOptions.SetProjection(projection)
+	}
+	return mongoClient.findMany(ctx, collectionName, query, findOptions)
+}
+
+// FindManyPaginated works as FindMany, returning only the page of documents identified by skip and limit.
+func (mongoClient *MongoClient) FindManyPaginated(ctx context.Context, collectionName string, query map[string]interface{}, skip, limit int64) ([]interface{}, error) {
+	return mongoClient.findMany(ctx, collectionName, query, options.Find().SetSkip(skip).SetLimit(limit))
+}
+
+func (mongoClient *MongoClient) findMany(ctx context.Context, collectionName string, query map[string]interface{}, findOptions *options.FindOptions) ([]interface{}, error) {
 	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
 	glogger.Get(ctx).WithFields(logrus.Fields{
 		"mongoQuery":     query,
@@ -238,7 +400,7 @@ func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName str
 		"collectionName": collectionName,
 	}).Debug("performing query")
 
-	resultCursor, err := collection.Find(ctx, query)
+	resultCursor, err := collection.Find(ctx, query, findOptions)
 	if err != nil {
 		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Error("failed query execution")
 		return nil, err
@@ -270,13 +432,73 @@ func (mongoClient *MongoClient) FindMany(ctx context.Context, collectionName str
 	return results, nil
 }
 
+func (mongoClient *MongoClient) CountDocuments(ctx context.Context, collectionName string, query map[string]interface{}) (int64, error) {
+	collection := mongoClient.client.Database(mongoClient.databaseName).Collection(collectionName)
+	glogger.Get(ctx).WithFields(logrus.Fields{
+		"mongoQuery":     query,
+		"dbName":         mongoClient.databaseName,
+		"collectionName": collectionName,
+	}).Debug("performing count query")
+
+	count, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		glogger.Get(ctx).WithField("error", logrus.Fields{"message": err.Error()}).Error("failed count query execution")
+		return 0, err
+	}
+	return count, nil
+}
+
+// ActiveBindings returns the bindings valid at the given time, that are the ones whose validity
+// has started and not yet ended: ValidFrom is inclusive, while ValidUntil is exclusive.
+func ActiveBindings(bindings []types.Binding, at time.Time) []types.Binding {
+	activeBindings := make([]types.Binding, 0, len(bindings))
+	for _, binding := range bindings {
+		if binding.ValidFrom != nil && at.Before(*binding.ValidFrom) {
+			continue
+		}
+		if binding.ValidUntil != nil && !at.Before(*binding.ValidUntil) {
+			continue
+		}
+		activeBindings = append(activeBindings, binding)
+	}
+	return activeBindings
+}
+
+// activeUser returns the user with only the bindings active at the given time, and the roles
+// referenced by them; the bindings and roles are cached unfiltered, since they may become
+// active, or expire, while cached.
+func activeUser(user types.User, at time.Time) types.User {
+	activeBindings := ActiveBindings(user.UserBindings, at)
+	if len(activeBindings) == len(user.UserBindings) {
+		return user
+	}
+	activeRolesIds := make(map[string]struct{})
+	for _, roleID := range RolesIDsFromBindings(activeBindings) {
+		activeRolesIds[roleID] = struct{}{}
+	}
+	activeRoles := make([]types.Role, 0, len(user.UserRoles))
+	for _, role := range user.UserRoles {
+		if _, ok := activeRolesIds[role.RoleID]; ok {
+			activeRoles = append(activeRoles, role)
+		}
+	}
+	user.UserBindings = activeBindings
+	user.UserRoles = activeRoles
+	return user
+}
+
+// RolesIDsFromBindings returns the role ids referenced by the bindings without duplicates,
+// in the order they are first found.
 func RolesIDsFromBindings(bindings []types.Binding) []string {
 	rolesIds := []string{}
+	seenRolesIds := make(map[string]struct{})
 	for _, binding := range bindings {
 		for _, role := range binding.Roles {
-			if !utils.Contains(rolesIds, role) {
-				rolesIds = append(rolesIds, role)
+			if _, ok := seenRolesIds[role]; ok {
+				continue
 			}
+			seenRolesIds[role] = struct{}{}
+			rolesIds = append(rolesIds, role)
 		}
 	}
 	return rolesIds
@@ -289,12 +511,31 @@ func RetrieveUserBindingsAndRoles(logger *logrus.Entry, req *http.Request, env c
 		return types.User{}, fmt.Errorf("Unexpected error retrieving MongoDB Client from request context")
 	}
 
+	userIdentity, err := identity.GetExtractorFromContext(requestContext, env).Extract(req)
+	if err != nil {
+		return types.User{}, err
+	}
+
 	var user types.User
 
-	user.UserGroups = strings.Split(req.Header.Get(env.UserGroupsHeader), ",")
-	user.UserID = req.Header.Get(env.UserIdHeader)
+	user.UserGroups = userIdentity.Groups
+	user.UserID = userIdentity.ID
 
 	if mongoClient != nil && user.UserID != "" {
+		if env.TenantHeaderKey != "" {
+			user.Tenant = req.Header.Get(env.TenantHeaderKey)
+			if !validTenant.MatchString(user.Tenant) {
+				return types.User{}, fmt.Errorf("%w: header %s has value %q", ErrInvalidTenant, env.TenantHeaderKey, user.Tenant)
+			}
+			requestContext = WithTenant(requestContext, user.Tenant)
+		}
+
+		bindingsCache := GetBindingsCacheFromContext(requestContext)
+		if cachedUser, ok := bindingsCache.Get(user.Tenant, user.UserID, user.UserGroups); ok {
+			logger.Trace("found bindings and roles in cache")
+			return activeUser(cachedUser, time.Now()), nil
+		}
+
 		user.UserBindings, err = mongoClient.RetrieveUserBindings(requestContext, &user)
 		if err != nil {
 			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("something went wrong while retrieving user bindings")
@@ -312,6 +553,8 @@ func RetrieveUserBindingsAndRoles(logger *logrus.Entry, req *http.Request, env c
 			"foundBindingsLength": len(user.UserBindings),
 			"foundRolesLength":    len(user.UserRoles),
 		}).Trace("found bindings and roles")
+		bindingsCache.Set(user)
+		return activeUser(user, time.Now()), nil
 	}
 	return user, nil
 }
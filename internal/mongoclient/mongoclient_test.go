@@ -16,12 +16,14 @@ package mongoclient
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/mocks"
@@ -29,6 +31,9 @@ import (
 	"github.com/rond-authz/rond/types"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
 	"gotest.tools/v3/assert"
 )
 
@@ -129,6 +134,65 @@ func TestSetupMongoCollection(t *testing.T) {
 		defer mongoClient.Disconnect()
 		assert.Assert(t, err == nil, "setup mongo returns error")
 		assert.Assert(t, mongoClient != nil)
+		assert.NilError(t, mongoClient.HealthCheck(context.Background()), "unexpected health check error")
+	})
+}
+
+func TestClientOptions(t *testing.T) {
+	mongoURL := "mongodb://localhost:27017/test"
+
+	t.Run("uses driver defaults without configuration", func(t *testing.T) {
+		clientOpts, err := clientOptions(config.EnvironmentVariables{MongoDBUrl: mongoURL})
+		assert.NilError(t, err)
+		assert.Assert(t, clientOpts.ReadPreference == nil)
+		assert.Assert(t, clientOpts.ReadConcern == nil)
+	})
+
+	t.Run("applies the configured read preference and read concern", func(t *testing.T) {
+		clientOpts, err := clientOptions(config.EnvironmentVariables{
+			MongoDBUrl:          mongoURL,
+			MongoReadPreference: "secondaryPreferred",
+			MongoReadConcern:    "majority",
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, clientOpts.ReadPreference.Mode(), readpref.SecondaryPreferredMode)
+		assert.Equal(t, clientOpts.ReadConcern.GetLevel(), "majority")
+	})
+
+	t.Run("fails on unknown read preference", func(t *testing.T) {
+		_, err := clientOptions(config.EnvironmentVariables{MongoDBUrl: mongoURL, MongoReadPreference: "closest"})
+		assert.ErrorContains(t, err, "invalid MongoDB read preference closest")
+	})
+
+	t.Run("fails on unknown read concern", func(t *testing.T) {
+		_, err := clientOptions(config.EnvironmentVariables{MongoDBUrl: mongoURL, MongoReadConcern: "strong"})
+		assert.ErrorContains(t, err, "invalid MongoDB read concern strong")
+	})
+}
+
+func TestResolveDatabaseName(t *testing.T) {
+	t.Run("uses database from connection string", func(t *testing.T) {
+		connectionString, err := connstring.ParseAndValidate("mongodb://localhost:27017/fromurl")
+		assert.NilError(t, err)
+
+		databaseName := resolveDatabaseName(config.EnvironmentVariables{}, connectionString)
+		assert.Equal(t, databaseName, "fromurl")
+	})
+
+	t.Run("explicit database name overrides connection string", func(t *testing.T) {
+		connectionString, err := connstring.ParseAndValidate("mongodb://localhost:27017/fromurl")
+		assert.NilError(t, err)
+
+		databaseName := resolveDatabaseName(config.EnvironmentVariables{MongoDatabaseName: "explicit"}, connectionString)
+		assert.Equal(t, databaseName, "explicit")
+	})
+
+	t.Run("explicit database name is used with connection string without database", func(t *testing.T) {
+		connectionString, err := connstring.ParseAndValidate("mongodb://localhost:27017")
+		assert.NilError(t, err)
+
+		databaseName := resolveDatabaseName(config.EnvironmentVariables{MongoDatabaseName: "explicit"}, connectionString)
+		assert.Equal(t, databaseName, "explicit")
 	})
 }
 
@@ -313,6 +377,111 @@ func TestMongoCollections(t *testing.T) {
 	})
 }
 
+func TestMongoCollectionsDocumentStates(t *testing.T) {
+	mongoHost := os.Getenv("MONGO_HOST_CI")
+	if mongoHost == "" {
+		mongoHost = testutils.LocalhostMongoDB
+		t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+	}
+
+	setupMongoClient := func(t *testing.T, includeStates string) *MongoClient {
+		t.Helper()
+		env := config.EnvironmentVariables{
+			MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+			RolesCollectionName:    "roles",
+			BindingsCollectionName: "bindings",
+			IncludeStates:          includeStates,
+		}
+
+		log, _ := test.NewNullLogger()
+		mongoClient, err := NewMongoClient(env, log)
+		assert.Assert(t, err == nil, "setup mongo returns error")
+		t.Cleanup(func() { mongoClient.Disconnect() })
+		client, _, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+		mongoClient.client = client
+		mongoClient.roles = rolesCollection
+		mongoClient.bindings = bindingsCollection
+
+		testutils.PopulateDBForTesting(t, context.Background(), rolesCollection, bindingsCollection)
+		return mongoClient
+	}
+
+	bindingIDs := func(bindings []types.Binding) []string {
+		ids := []string{}
+		for _, binding := range bindings {
+			ids = append(ids, binding.BindingID)
+		}
+		return ids
+	}
+	roleIDs := func(roles []types.Role) []string {
+		ids := []string{}
+		for _, role := range roles {
+			ids = append(ids, role.RoleID)
+		}
+		return ids
+	}
+
+	t.Run("excludes PRIVATE bindings and roles by default", func(t *testing.T) {
+		mongoClient := setupMongoClient(t, "")
+		ctx := context.Background()
+
+		bindings, err := mongoClient.RetrieveUserBindings(ctx, &types.User{UserID: "user1", UserGroups: []string{}})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, bindingIDs(bindings), []string{"binding1", "binding2", "binding5"})
+
+		roles, err := mongoClient.RetrieveRoles(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, roleIDs(roles), []string{"role1", "role3", "notUsedByAnyone"})
+
+		roles, err = mongoClient.RetrieveUserRolesByRolesID(ctx, []string{"role3", "role6"})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, roleIDs(roles), []string{"role3"})
+	})
+
+	t.Run("includes the opted in states", func(t *testing.T) {
+		mongoClient := setupMongoClient(t, "PRIVATE")
+		ctx := context.Background()
+
+		bindings, err := mongoClient.RetrieveUserBindings(ctx, &types.User{UserID: "user1", UserGroups: []string{}})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, bindingIDs(bindings), []string{"binding1", "binding2", "binding5", "notUsedByAnyone2"})
+
+		roles, err := mongoClient.RetrieveUserRolesByRolesID(ctx, []string{"role3", "role6"})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, roleIDs(roles), []string{"role3", "role6"})
+	})
+
+	t.Run("retrieves bindings out of their validity", func(t *testing.T) {
+		mongoClient := setupMongoClient(t, "")
+		ctx := context.Background()
+		past := time.Now().Add(-time.Hour)
+		future := time.Now().Add(time.Hour)
+		_, err := mongoClient.bindings.InsertMany(ctx, []interface{}{
+			types.Binding{BindingID: "expired", Subjects: []string{"user1"}, CRUDDocumentState: "PUBLIC", ValidUntil: &past},
+			types.Binding{BindingID: "future", Subjects: []string{"user1"}, CRUDDocumentState: "PUBLIC", ValidFrom: &future},
+			types.Binding{BindingID: "active", Subjects: []string{"user1"}, CRUDDocumentState: "PUBLIC", ValidFrom: &past, ValidUntil: &future},
+		})
+		assert.NilError(t, err)
+
+		bindings, err := mongoClient.RetrieveUserBindings(ctx, &types.User{UserID: "user1", UserGroups: []string{}})
+		assert.NilError(t, err)
+		// the validity is checked when the bindings are used, since they are cached
+		assert.DeepEqual(t, bindingIDs(bindings), []string{"binding1", "binding2", "binding5", "expired", "future", "active"})
+	})
+}
+
+func TestStateFilter(t *testing.T) {
+	t.Run("only PUBLIC by default", func(t *testing.T) {
+		assert.DeepEqual(t, (&MongoClient{}).stateFilter(), bson.M{STATE: PUBLIC})
+		assert.DeepEqual(t, (&MongoClient{documentStates: documentStates("")}).stateFilter(), bson.M{STATE: PUBLIC})
+	})
+
+	t.Run("with included states", func(t *testing.T) {
+		mongoClient := &MongoClient{documentStates: documentStates("DRAFT, PRIVATE,PUBLIC,DRAFT")}
+		assert.DeepEqual(t, mongoClient.stateFilter(), bson.M{STATE: bson.M{"$in": []string{PUBLIC, "DRAFT", "PRIVATE"}}})
+	})
+}
+
 func TestMongoFindOne(t *testing.T) {
 	mongoHost := os.Getenv("MONGO_HOST_CI")
 	if mongoHost == "" {
@@ -343,7 +512,7 @@ func TestMongoFindOne(t *testing.T) {
 	t.Run("finds a document", func(t *testing.T) {
 		result, err := mongoClient.FindOne(context.Background(), "roles", map[string]interface{}{
 			"roleId": "role3",
-		})
+		}, nil)
 		assert.NilError(t, err)
 		resultMap := result.(map[string]interface{})
 		assert.Assert(t, resultMap["_id"] != nil)
@@ -360,10 +529,20 @@ func TestMongoFindOne(t *testing.T) {
 		})
 	})
 
+	t.Run("finds a document with projection", func(t *testing.T) {
+		result, err := mongoClient.FindOne(context.Background(), "roles", map[string]interface{}{
+			"roleId": "role3",
+		}, map[string]interface{}{"roleId": 1, "_id": 0})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, result, map[string]interface{}{
+			"roleId": "role3",
+		})
+	})
+
 	t.Run("does not find a document", func(t *testing.T) {
 		result, err := mongoClient.FindOne(context.Background(), "roles", map[string]interface{}{
 			"key": 42,
-		})
+		}, nil)
 		assert.NilError(t, err)
 		assert.Assert(t, result == nil)
 	})
@@ -403,7 +582,7 @@ func TestMongoFindMany(t *testing.T) {
 				{"roleId": "role9999"},
 				{"roleId": "role6"},
 			},
-		})
+		}, nil)
 		assert.NilError(t, err)
 
 		assert.Equal(t, len(result), 2)
@@ -435,10 +614,21 @@ func TestMongoFindMany(t *testing.T) {
 		})
 	})
 
+	t.Run("finds multiple documents with projection", func(t *testing.T) {
+		result, err := mongoClient.FindMany(context.Background(), "roles", map[string]interface{}{
+			"roleId": map[string]interface{}{"$in": []string{"role3", "role6"}},
+		}, map[string]interface{}{"roleId": 1, "_id": 0})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, result, []interface{}{
+			map[string]interface{}{"roleId": "role3"},
+			map[string]interface{}{"roleId": "role6"},
+		})
+	})
+
 	t.Run("does not find any document", func(t *testing.T) {
 		result, err := mongoClient.FindMany(context.Background(), "roles", map[string]interface{}{
 			"roleId": "role9999",
-		})
+		}, nil)
 		assert.NilError(t, err)
 		assert.Equal(t, len(result), 0)
 	})
@@ -446,12 +636,130 @@ func TestMongoFindMany(t *testing.T) {
 	t.Run("returns error on invalid query", func(t *testing.T) {
 		result, err := mongoClient.FindMany(context.Background(), "roles", map[string]interface{}{
 			"$UNKWNONW": "role9999",
-		})
+		}, nil)
 		assert.ErrorContains(t, err, "unknown top level operator")
 		assert.Equal(t, len(result), 0)
 	})
 }
 
+func TestMongoFindManyPaginated(t *testing.T) {
+	mongoHost := os.Getenv("MONGO_HOST_CI")
+	if mongoHost == "" {
+		mongoHost = testutils.LocalhostMongoDB
+		t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+	}
+
+	env := config.EnvironmentVariables{
+		MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+		RolesCollectionName:    "roles",
+		BindingsCollectionName: "bindings",
+	}
+	log, _ := test.NewNullLogger()
+	mongoClient, err := NewMongoClient(env, log)
+	defer mongoClient.Disconnect()
+	assert.Assert(t, err == nil, "setup mongo returns error")
+
+	client, dbName, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+	mongoClient.client = client
+	mongoClient.databaseName = dbName
+	mongoClient.roles = rolesCollection
+	mongoClient.bindings = bindingsCollection
+
+	ctx := context.Background()
+
+	testutils.PopulateDBForTesting(t, ctx, rolesCollection, bindingsCollection)
+
+	query := map[string]interface{}{
+		"$or": []map[string]interface{}{
+			{"roleId": "role3"},
+			{"roleId": "role9999"},
+			{"roleId": "role6"},
+		},
+	}
+
+	t.Run("returns the first page", func(t *testing.T) {
+		result, err := mongoClient.FindManyPaginated(context.Background(), "roles", query, 0, 1)
+		assert.NilError(t, err)
+
+		assert.Equal(t, len(result), 1)
+		resultMap := result[0].(map[string]interface{})
+		assert.Equal(t, resultMap["roleId"], "role3")
+	})
+
+	t.Run("skips documents", func(t *testing.T) {
+		result, err := mongoClient.FindManyPaginated(context.Background(), "roles", query, 1, 10)
+		assert.NilError(t, err)
+
+		assert.Equal(t, len(result), 1)
+		resultMap := result[0].(map[string]interface{})
+		assert.Equal(t, resultMap["roleId"], "role6")
+	})
+
+	t.Run("returns error on invalid query", func(t *testing.T) {
+		result, err := mongoClient.FindManyPaginated(context.Background(), "roles", map[string]interface{}{
+			"$UNKWNONW": "role9999",
+		}, 0, 10)
+		assert.ErrorContains(t, err, "unknown top level operator")
+		assert.Equal(t, len(result), 0)
+	})
+}
+
+func TestMongoCountDocuments(t *testing.T) {
+	mongoHost := os.Getenv("MONGO_HOST_CI")
+	if mongoHost == "" {
+		mongoHost = testutils.LocalhostMongoDB
+		t.Logf("Connection to localhost MongoDB, on CI env this is a problem!")
+	}
+
+	env := config.EnvironmentVariables{
+		MongoDBUrl:             fmt.Sprintf("mongodb://%s/test", mongoHost),
+		RolesCollectionName:    "roles",
+		BindingsCollectionName: "bindings",
+	}
+	log, _ := test.NewNullLogger()
+	mongoClient, err := NewMongoClient(env, log)
+	defer mongoClient.Disconnect()
+	assert.Assert(t, err == nil, "setup mongo returns error")
+
+	client, dbName, rolesCollection, bindingsCollection := testutils.GetAndDisposeTestClientsAndCollections(t)
+	mongoClient.client = client
+	mongoClient.databaseName = dbName
+	mongoClient.roles = rolesCollection
+	mongoClient.bindings = bindingsCollection
+
+	ctx := context.Background()
+
+	testutils.PopulateDBForTesting(t, ctx, rolesCollection, bindingsCollection)
+
+	t.Run("counts multiple documents", func(t *testing.T) {
+		result, err := mongoClient.CountDocuments(context.Background(), "roles", map[string]interface{}{
+			"$or": []map[string]interface{}{
+				{"roleId": "role3"},
+				{"roleId": "role9999"},
+				{"roleId": "role6"},
+			},
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, result, int64(2))
+	})
+
+	t.Run("does not count any document", func(t *testing.T) {
+		result, err := mongoClient.CountDocuments(context.Background(), "roles", map[string]interface{}{
+			"roleId": "role9999",
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, result, int64(0))
+	})
+
+	t.Run("returns error on invalid query", func(t *testing.T) {
+		result, err := mongoClient.CountDocuments(context.Background(), "roles", map[string]interface{}{
+			"$UNKWNONW": "role9999",
+		})
+		assert.ErrorContains(t, err, "unknown top level operator")
+		assert.Equal(t, result, int64(0))
+	})
+}
+
 func TestRolesIDSFromBindings(t *testing.T) {
 	result := RolesIDsFromBindings([]types.Binding{
 		{Roles: []string{"a", "b"}},
@@ -461,6 +769,43 @@ func TestRolesIDSFromBindings(t *testing.T) {
 	})
 
 	assert.DeepEqual(t, result, []string{"a", "b", "c", "d", "e"})
+
+	t.Run("overlapping roles keep the first seen order", func(t *testing.T) {
+		result := RolesIDsFromBindings([]types.Binding{
+			{Roles: []string{"editor", "viewer"}},
+			{Roles: []string{"admin", "editor"}},
+			{Roles: []string{"viewer", "viewer", "owner"}},
+			{Roles: []string{"admin"}},
+		})
+
+		assert.DeepEqual(t, result, []string{"editor", "viewer", "admin", "owner"})
+	})
+
+	t.Run("empty slice without roles", func(t *testing.T) {
+		result := RolesIDsFromBindings([]types.Binding{{Subjects: []string{"user"}}, {Groups: []string{"group"}}})
+		assert.DeepEqual(t, result, []string{})
+	})
+}
+
+func TestActiveBindings(t *testing.T) {
+	now := time.Date(2023, 1, 15, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	bindings := []types.Binding{
+		{BindingID: "unbounded"},
+		{BindingID: "active", ValidFrom: &past, ValidUntil: &future},
+		{BindingID: "expired", ValidUntil: &past},
+		{BindingID: "future", ValidFrom: &future},
+		{BindingID: "starting now", ValidFrom: &now},
+		{BindingID: "ending now", ValidUntil: &now},
+	}
+
+	activeBindingIDs := []string{}
+	for _, binding := range ActiveBindings(bindings, now) {
+		activeBindingIDs = append(activeBindingIDs, binding.BindingID)
+	}
+	assert.DeepEqual(t, activeBindingIDs, []string{"unbounded", "active", "starting now"})
 }
 
 func TestRetrieveUserBindingsAndRoles(t *testing.T) {
@@ -491,6 +836,22 @@ func TestRetrieveUserBindingsAndRoles(t *testing.T) {
 		})
 	})
 
+	t.Run("extract user groups with custom delimiter", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			UserGroupsHeader:    "thegroupsheader",
+			UserIdHeader:        "theuserheader",
+			UserGroupsDelimiter: ";",
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("thegroupsheader", "group1; group2")
+
+		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), req, env)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, user, types.User{
+			UserGroups: []string{"group1", "group2"},
+		})
+	})
+
 	t.Run("extract user with no id in headers does not perform queries", func(t *testing.T) {
 		mock := mocks.MongoClientMock{
 			UserBindingsError: fmt.Errorf("some error"),
@@ -564,4 +925,158 @@ func TestRetrieveUserBindingsAndRoles(t *testing.T) {
 			},
 		})
 	})
+
+	t.Run("returns cached bindings and roles", func(t *testing.T) {
+		bindingsCache := NewBindingsCache(10, time.Minute)
+		mock := mocks.MongoClientMock{
+			UserBindings: []types.Binding{{Roles: []string{"r1"}}},
+			UserRoles:    []types.Role{{RoleID: "r1", Permissions: []string{"p1"}}},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), mock), bindingsCache))
+		req.Header.Set("thegroupsheader", "group1,group2")
+		req.Header.Set("theuserheader", "userId")
+
+		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logrus.New()), req, env)
+		assert.NilError(t, err)
+
+		failingMock := mocks.MongoClientMock{
+			UserBindingsError: fmt.Errorf("some error"),
+		}
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), failingMock), bindingsCache))
+		req.Header.Set("thegroupsheader", "group2,group1")
+		req.Header.Set("theuserheader", "userId")
+
+		cachedUser, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logrus.New()), req, env)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, cachedUser, user)
+	})
+
+	t.Run("filters out the cached bindings expired after retrieval", func(t *testing.T) {
+		bindingsCache := NewBindingsCache(10, time.Minute)
+		past := time.Now().Add(-time.Minute)
+		bindingsCache.Set(types.User{
+			UserID:       "userId",
+			UserGroups:   []string{"group1"},
+			UserBindings: []types.Binding{{BindingID: "expired", ValidUntil: &past}, {BindingID: "active"}},
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), mocks.MongoClientMock{}), bindingsCache))
+		req.Header.Set("thegroupsheader", "group1")
+		req.Header.Set("theuserheader", "userId")
+
+		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logrus.New()), req, env)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, user.UserBindings, []types.Binding{{BindingID: "active"}})
+	})
+
+	t.Run("filters the bindings and roles by validity at each request", func(t *testing.T) {
+		bindingsCache := NewBindingsCache(10, time.Minute)
+		validFrom := time.Now().Add(100 * time.Millisecond)
+		validUntil := validFrom
+		mock := mocks.MongoClientMock{
+			UserBindings: []types.Binding{
+				{BindingID: "starting", Roles: []string{"r1"}, ValidFrom: &validFrom},
+				{BindingID: "ending", Roles: []string{"r2"}, ValidUntil: &validUntil},
+			},
+			UserRoles: []types.Role{{RoleID: "r1"}, {RoleID: "r2"}},
+		}
+		newRequest := func(mongoClient types.IMongoClient) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), mongoClient), bindingsCache))
+			req.Header.Set("thegroupsheader", "group1")
+			req.Header.Set("theuserheader", "userId")
+			return req
+		}
+
+		user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest(mock), env)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, user.UserBindings, mock.UserBindings[1:])
+		assert.DeepEqual(t, user.UserRoles, []types.Role{{RoleID: "r2"}})
+
+		time.Sleep(time.Until(validFrom))
+		failingMock := mocks.MongoClientMock{UserBindingsError: fmt.Errorf("some error")}
+		cachedUser, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest(failingMock), env)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, cachedUser.UserBindings, mock.UserBindings[:1])
+		assert.DeepEqual(t, cachedUser.UserRoles, []types.Role{{RoleID: "r1"}})
+	})
+
+	t.Run("tenant header", func(t *testing.T) {
+		tenantEnv := env
+		tenantEnv.TenantHeaderKey = "x-tenant"
+		mock := tenantMongoClientMock{
+			bindings: map[string][]types.Binding{
+				"tenant1": {{BindingID: "b1", Roles: []string{"r1"}}},
+				"tenant2": {{BindingID: "b2", Roles: []string{"r2"}}},
+			},
+			roles: map[string][]types.Role{
+				"tenant1": {{RoleID: "r1", Permissions: []string{"p1"}}},
+				"tenant2": {{RoleID: "r2", Permissions: []string{"p2"}}},
+			},
+		}
+		bindingsCache := NewBindingsCache(10, time.Minute)
+		newRequest := func(tenant string) *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(WithBindingsCache(WithMongoClient(req.Context(), mock), bindingsCache))
+			req.Header.Set("theuserheader", "userId")
+			if tenant != "" {
+				req.Header.Set("x-tenant", tenant)
+			}
+			return req
+		}
+
+		t.Run("resolves bindings and roles of each tenant", func(t *testing.T) {
+			user, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest("tenant1"), tenantEnv)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, user, types.User{
+				UserID:       "userId",
+				UserGroups:   []string{},
+				Tenant:       "tenant1",
+				UserBindings: []types.Binding{{BindingID: "b1", Roles: []string{"r1"}}},
+				UserRoles:    []types.Role{{RoleID: "r1", Permissions: []string{"p1"}}},
+			})
+
+			user, err = RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest("tenant2"), tenantEnv)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, user, types.User{
+				UserID:       "userId",
+				UserGroups:   []string{},
+				Tenant:       "tenant2",
+				UserBindings: []types.Binding{{BindingID: "b2", Roles: []string{"r2"}}},
+				UserRoles:    []types.Role{{RoleID: "r2", Permissions: []string{"p2"}}},
+			})
+		})
+
+		t.Run("fails if tenant header is missing", func(t *testing.T) {
+			_, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest(""), tenantEnv)
+			assert.Assert(t, errors.Is(err, ErrInvalidTenant))
+		})
+
+		t.Run("fails if tenant header is not valid", func(t *testing.T) {
+			_, err := RetrieveUserBindingsAndRoles(logrus.NewEntry(logger), newRequest("tenant/1"), tenantEnv)
+			assert.Assert(t, errors.Is(err, ErrInvalidTenant))
+		})
+	})
+}
+
+type tenantMongoClientMock struct {
+	mocks.MongoClientMock
+	bindings map[string][]types.Binding
+	roles    map[string][]types.Role
+}
+
+func (mock tenantMongoClientMock) RetrieveUserBindings(ctx context.Context, user *types.User) ([]types.Binding, error) {
+	return mock.bindings[GetTenantFromContext(ctx)], nil
+}
+
+func (mock tenantMongoClientMock) RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]types.Role, error) {
+	return mock.roles[GetTenantFromContext(ctx)], nil
+}
+
+func TestTenantCollectionName(t *testing.T) {
+	assert.Equal(t, TenantCollectionName("", "bindings", "acme"), "bindings_acme")
+	assert.Equal(t, TenantCollectionName("{tenant}-{collection}", "roles", "acme"), "acme-roles")
+	assert.Equal(t, TenantCollectionName("shared", "roles", "acme"), "shared")
 }
@@ -85,3 +85,69 @@ func HandleGreaterThanEquals(pipeline *[]bson.M, fieldName string, fieldValue in
 	filter := bson.M{fieldName: bson.M{"$gte": fieldValue}}
 	*pipeline = append(*pipeline, filter)
 }
+
+// singleFieldFilter returns field name and value of filters in the form {field: {operator: value}}.
+func singleFieldFilter(filter bson.M, operator string) (string, interface{}, bool) {
+	if len(filter) != 1 {
+		return "", nil, false
+	}
+	for fieldName, condition := range filter {
+		conditionMap, ok := condition.(bson.M)
+		if !ok || len(conditionMap) != 1 {
+			return "", nil, false
+		}
+		value, ok := conditionMap[operator]
+		return fieldName, value, ok
+	}
+	return "", nil, false
+}
+
+// CompactNotEquals merges the $ne filters of a conjunction applied to the same
+// field into a single $nin filter, placed where the first of them was.
+func CompactNotEquals(pipeline []bson.M) []bson.M {
+	notEqualsValues := map[string][]interface{}{}
+	for _, filter := range pipeline {
+		if fieldName, value, ok := singleFieldFilter(filter, "$ne"); ok {
+			notEqualsValues[fieldName] = append(notEqualsValues[fieldName], value)
+		}
+	}
+
+	compacted := make([]bson.M, 0, len(pipeline))
+	compactedFields := map[string]bool{}
+	for _, filter := range pipeline {
+		fieldName, _, ok := singleFieldFilter(filter, "$ne")
+		if !ok || len(notEqualsValues[fieldName]) < 2 {
+			compacted = append(compacted, filter)
+			continue
+		}
+		if compactedFields[fieldName] {
+			continue
+		}
+		compacted = append(compacted, bson.M{fieldName: bson.M{"$nin": notEqualsValues[fieldName]}})
+		compactedFields[fieldName] = true
+	}
+	return compacted
+}
+
+// CompactEqualsDisjunction returns a single $in filter when every conjunction
+// is made of one $eq filter on the same field.
+func CompactEqualsDisjunction(pipelines [][]bson.M) (bson.M, bool) {
+	if len(pipelines) < 2 {
+		return nil, false
+	}
+
+	var compactedFieldName string
+	values := make([]interface{}, 0, len(pipelines))
+	for _, pipeline := range pipelines {
+		if len(pipeline) != 1 {
+			return nil, false
+		}
+		fieldName, value, ok := singleFieldFilter(pipeline[0], "$eq")
+		if !ok || (compactedFieldName != "" && fieldName != compactedFieldName) {
+			return nil, false
+		}
+		compactedFieldName = fieldName
+		values = append(values, value)
+	}
+	return bson.M{compactedFieldName: bson.M{"$in": values}}, true
+}
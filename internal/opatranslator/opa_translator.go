@@ -31,54 +31,110 @@ func extractQueryPipeline(query Queries, _ int) bson.M {
 
 var ErrEmptyQuery = errors.New("empty query")
 
+// ErrQueryTooComplex is returned when the generated query exceeds the maximum number of clauses.
+var ErrQueryTooComplex = errors.New("query too complex")
+
 const minimumResultLength = 3
 
-type OPAClient struct{}
+type OPAClient struct {
+	// MaxClauses bounds the conditions of the generated query, when positive.
+	MaxClauses int
+}
+
+// checkClauses fails with ErrQueryTooComplex when the clauses exceed MaxClauses.
+func (c *OPAClient) checkClauses(clauses int) error {
+	if c.MaxClauses > 0 && clauses > c.MaxClauses {
+		return fmt.Errorf("%w: more than %d clauses", ErrQueryTooComplex, c.MaxClauses)
+	}
+	return nil
+}
+
+const (
+	MongoQueryDialect = "mongo"
+	SQLQueryDialect   = "sql"
+)
+
+type operation struct {
+	operator  string
+	fieldName string
+	value     interface{}
+}
+
+// parseExpression extracts the operation described by a partial query expression;
+// a nil operation is returned when the expression does not reference a resource field.
+func parseExpression(expr *ast.Expr) (*operation, error) {
+	if len(expr.Operands()) != 2 {
+		return nil, fmt.Errorf("invalid expression: too many arguments")
+	}
+
+	var value interface{}
+	var processedTerm []string
+	var err error
+	for _, term := range expr.Operands() {
+		if ast.IsConstant(term.Value) {
+			value, err = ast.JSON(term.Value)
+			if err != nil {
+				return nil, fmt.Errorf("error converting term to JSON: %v", err)
+			}
+		} else if ref, ok := term.Value.(ast.Ref); ok {
+			processedTerm = processRef(ref)
+		} else {
+			processedTerm = processTerm(term.String())
+		}
+	}
+
+	if processedTerm == nil {
+		return nil, nil
+	}
+	return &operation{
+		operator:  expr.Operator().String(),
+		fieldName: processedTerm[1],
+		value:     value,
+	}, nil
+}
 
 func (c *OPAClient) ProcessQuery(pq *rego.PartialQueries) (bson.M, error) {
-	var queries []Queries
+	var pipelines [][]bson.M
+	clauses := 0
 	for i := range pq.Queries {
 		pipeline := &[]bson.M{}
 		for _, expr := range pq.Queries[i] {
 			if !expr.IsCall() {
 				continue
 			}
-
-			if len(expr.Operands()) != 2 {
-				return nil, fmt.Errorf("invalid expression: too many arguments")
+			clauses++
+			if err := c.checkClauses(clauses); err != nil {
+				return nil, err
 			}
 
-			var value interface{}
-			var processedTerm []string
-			var err error
-			for _, term := range expr.Operands() {
-				if ast.IsConstant(term.Value) {
-					value, err = ast.JSON(term.Value)
-					if err != nil {
-						return nil, fmt.Errorf("error converting term to JSON: %v", err)
-					}
-				} else {
-					processedTerm = processTerm(term.String())
-				}
+			op, err := parseExpression(expr)
+			if err != nil {
+				return nil, err
 			}
-
-			if processedTerm == nil {
+			if op == nil {
 				return nil, nil
 			}
-			stringifiedOperator := expr.Operator().String()
-			operationHandled := HandleOperations(stringifiedOperator, pipeline, processedTerm[1], value)
+			operationHandled := HandleOperations(op.operator, pipeline, op.fieldName, op.value)
 			if !operationHandled {
-				return nil, fmt.Errorf("invalid expression: operator not supported: %v", expr.Operator().String())
+				return nil, fmt.Errorf("invalid expression: operator not supported: %v", op.operator)
 			}
 		}
-		k1 := Queries{Pipeline: bson.M{"$and": *pipeline}}
-		queries = append(queries, k1)
+		pipelines = append(pipelines, CompactNotEquals(*pipeline))
 	}
 
-	if len(queries) == 0 {
+	if len(pipelines) == 0 {
 		return nil, fmt.Errorf("%w: RBAC policy evaluation and query generation failed", ErrEmptyQuery)
 	}
 
+	if inQuery, ok := CompactEqualsDisjunction(pipelines); ok {
+		return inQuery, nil
+	}
+
+	var queries []Queries
+	for _, pipeline := range pipelines {
+		queries = append(queries, Queries{Pipeline: bson.M{"$and": pipeline}})
+	}
+
 	mongoQueries := lo.Map(queries, extractQueryPipeline)
 
 	finalQuery := bson.M{"$or": mongoQueries}
@@ -86,6 +142,50 @@ func (c *OPAClient) ProcessQuery(pq *rego.PartialQueries) (bson.M, error) {
 	return finalQuery, nil
 }
 
+// ProcessQueryToSQL translates the partial queries into a parameterized SQL WHERE
+// fragment, using $n placeholders whose values are listed in the returned args.
+func (c *OPAClient) ProcessQueryToSQL(pq *rego.PartialQueries) (*SQLQuery, error) {
+	var conjunctions []string
+	args := []interface{}{}
+	clauses := 0
+	for i := range pq.Queries {
+		conditions := []string{}
+		for _, expr := range pq.Queries[i] {
+			if !expr.IsCall() {
+				continue
+			}
+			clauses++
+			if err := c.checkClauses(clauses); err != nil {
+				return nil, err
+			}
+
+			op, err := parseExpression(expr)
+			if err != nil {
+				return nil, err
+			}
+			if op == nil {
+				return nil, nil
+			}
+			condition, conditionArgs, operationHandled := HandleSQLOperation(op.operator, op.fieldName, op.value, len(args)+1)
+			if !operationHandled {
+				return nil, fmt.Errorf("invalid expression: operator not supported: %v", op.operator)
+			}
+			conditions = append(conditions, condition)
+			args = append(args, conditionArgs...)
+		}
+		conjunctions = append(conjunctions, sqlConjunction(conditions))
+	}
+
+	if len(conjunctions) == 0 {
+		return nil, fmt.Errorf("%w: RBAC policy evaluation and query generation failed", ErrEmptyQuery)
+	}
+
+	return &SQLQuery{
+		Where: strings.Join(conjunctions, " OR "),
+		Args:  args,
+	}, nil
+}
+
 func processTerm(query string) []string {
 	splitQ := strings.Split(query, ".")
 
@@ -103,6 +203,34 @@ func processTerm(query string) []string {
 	return []string{indexName, fieldName}
 }
 
+// processRef returns the collection and the dotted field path referenced by ref,
+// such as data.resources[_].owner.team. Array indexes are kept as path segments,
+// while iteration variables are dropped to match any element of the array.
+func processRef(ref ast.Ref) []string {
+	if len(ref) < minimumResultLength {
+		return nil
+	}
+	indexName, ok := ref[1].Value.(ast.String)
+	if !ok {
+		return nil
+	}
+
+	fieldPath := []string{}
+	for _, term := range ref[2:] {
+		switch value := term.Value.(type) {
+		case ast.String:
+			fieldPath = append(fieldPath, string(value))
+		case ast.Number:
+			fieldPath = append(fieldPath, value.String())
+		}
+	}
+	if len(fieldPath) == 0 {
+		return nil
+	}
+
+	return []string{string(indexName), strings.Join(fieldPath, ".")}
+}
+
 func removeOpenBrace(input string, _ int) string {
 	return strings.Split(input, "[")[0]
 }
@@ -15,11 +15,14 @@
 package opatranslator
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestProcessTerm(t *testing.T) {
@@ -43,9 +46,89 @@ func TestProcessTerm(t *testing.T) {
 	})
 }
 
+func TestProcessRef(t *testing.T) {
+	testCases := []struct {
+		ref      string
+		expected []string
+	}{
+		{ref: "data.resources[_].manager", expected: []string{"resources", "manager"}},
+		{ref: "data.resources[_].owner.team", expected: []string{"resources", "owner.team"}},
+		{ref: "data.resources[_].owner.team.name", expected: []string{"resources", "owner.team.name"}},
+		{ref: `data.resources[_].owner["team-name"]`, expected: []string{"resources", "owner.team-name"}},
+		{ref: "data.resources[_].owners[0].team", expected: []string{"resources", "owners.0.team"}},
+		{ref: "data.resources[_].tags[_]", expected: []string{"resources", "tags"}},
+		{ref: "data.resources[_]", expected: nil},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.ref, func(t *testing.T) {
+			ref, err := ast.ParseRef(testCase.ref)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, processRef(ref))
+		})
+	}
+}
+
 func TestProcessQuery(t *testing.T) {
 	c := OPAClient{}
 
+	partialQueries := func(t *testing.T, policy string) *rego.PartialQueries {
+		t.Helper()
+		pq, err := rego.New(
+			rego.Query("data.policies.allow"),
+			rego.Module("policy.rego", policy),
+			rego.Unknowns([]string{"data.resources"}),
+		).Partial(context.Background())
+		require.NoError(t, err)
+		return pq
+	}
+
+	t.Run("translates two-level nested fields", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	resource := data.resources[_]
+	resource.owner.team == "platform"
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"$or": []bson.M{
+			{"$and": []bson.M{{"owner.team": bson.M{"$eq": "platform"}}}},
+		}}, res)
+	})
+
+	t.Run("translates three-level nested fields", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	owner := data.resources[_].owner
+	owner.team.name == "platform"
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"$or": []bson.M{
+			{"$and": []bson.M{{"owner.team.name": bson.M{"$eq": "platform"}}}},
+		}}, res)
+	})
+
+	t.Run("translates nested fields with brackets and array indexes", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	resource := data.resources[_]
+	resource["owner"]["team-name"] == "platform"
+	resource.reviewers[0].team == "security"
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"$or": []bson.M{
+			{"$and": []bson.M{
+				{"owner.team-name": bson.M{"$eq": "platform"}},
+				{"reviewers.0.team": bson.M{"$eq": "security"}},
+			}},
+		}}, res)
+	})
+
 	t.Run("ignore non callable expressions", func(t *testing.T) {
 		expr := &ast.Expr{}
 
@@ -60,3 +143,174 @@ func TestProcessQuery(t *testing.T) {
 		require.Equal(t, 1, len(res))
 	})
 }
+
+func TestProcessQueryToSQL(t *testing.T) {
+	c := OPAClient{}
+
+	partialQueries := func(t *testing.T, policy string) *rego.PartialQueries {
+		t.Helper()
+		pq, err := rego.New(
+			rego.Query("data.policies.allow"),
+			rego.Module("policy.rego", policy),
+			rego.Unknowns([]string{"data.resources"}),
+		).Partial(context.Background())
+		require.NoError(t, err)
+		return pq
+	}
+
+	t.Run("translates or of and conditions", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	employee := data.resources[_]
+	employee.manager == "bob"
+	employee.salary > 10
+}
+allow {
+	employee := data.resources[_]
+	employee.department.name == "sales"
+}`)
+
+		res, err := c.ProcessQueryToSQL(pq)
+		require.NoError(t, err)
+		require.Equal(t, &SQLQuery{
+			Where: `("manager" = $1 AND "salary" > $2) OR ("department"."name" = $3)`,
+			Args:  []interface{}{"bob", json.Number("10"), "sales"},
+		}, res)
+	})
+
+	t.Run("translates null comparisons", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	employee := data.resources[_]
+	employee.manager == null
+}`)
+
+		res, err := c.ProcessQueryToSQL(pq)
+		require.NoError(t, err)
+		require.Equal(t, &SQLQuery{Where: `("manager" IS NULL)`, Args: []interface{}{}}, res)
+	})
+
+	t.Run("ignore non callable expressions", func(t *testing.T) {
+		pq := &rego.PartialQueries{
+			Queries: []ast.Body{
+				{&ast.Expr{}},
+			},
+		}
+
+		res, err := c.ProcessQueryToSQL(pq)
+		require.NoError(t, err)
+		require.Equal(t, &SQLQuery{Where: "(TRUE)", Args: []interface{}{}}, res)
+	})
+
+	t.Run("fails on empty query", func(t *testing.T) {
+		_, err := c.ProcessQueryToSQL(&rego.PartialQueries{})
+		require.ErrorIs(t, err, ErrEmptyQuery)
+	})
+}
+
+func TestProcessQueryMembershipCompaction(t *testing.T) {
+	c := OPAClient{}
+
+	partialQueries := func(t *testing.T, policy string) *rego.PartialQueries {
+		t.Helper()
+		pq, err := rego.New(
+			rego.Query("data.policies.allow"),
+			rego.Module("policy.rego", policy),
+			rego.Unknowns([]string{"data.resources"}),
+		).Partial(context.Background())
+		require.NoError(t, err)
+		return pq
+	}
+
+	t.Run("membership in list becomes $in", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allowed := ["a", "b", "c"]
+allow {
+	resource := data.resources[_]
+	resource.id == allowed[_]
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"id": bson.M{"$in": []interface{}{"a", "b", "c"}}}, res)
+	})
+
+	t.Run("exclusion of many values becomes $nin", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	resource := data.resources[_]
+	resource.id != "a"
+	resource.id != "b"
+	resource.name == "foo"
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"$or": []bson.M{
+			{"$and": []bson.M{
+				{"id": bson.M{"$nin": []interface{}{"a", "b"}}},
+				{"name": bson.M{"$eq": "foo"}},
+			}},
+		}}, res)
+	})
+
+	t.Run("equalities on different fields keep $or", func(t *testing.T) {
+		pq := partialQueries(t, `package policies
+allow {
+	data.resources[_].id == "a"
+}
+allow {
+	data.resources[_].name == "b"
+}`)
+
+		res, err := c.ProcessQuery(pq)
+		require.NoError(t, err)
+		require.Equal(t, bson.M{"$or": []bson.M{
+			{"$and": []bson.M{{"id": bson.M{"$eq": "a"}}}},
+			{"$and": []bson.M{{"name": bson.M{"$eq": "b"}}}},
+		}}, res)
+	})
+}
+
+func TestProcessQueryMaxClauses(t *testing.T) {
+	// every combination of manager and team is a disjunct of two clauses: 16 disjuncts, 32 clauses
+	pq, err := rego.New(
+		rego.Query("data.policies.allow"),
+		rego.Module("policy.rego", `package policies
+managers := ["m1", "m2", "m3", "m4"]
+teams := ["t1", "t2", "t3", "t4"]
+allow {
+	resource := data.resources[_]
+	resource.manager == managers[_]
+	resource.team == teams[_]
+}`),
+		rego.Unknowns([]string{"data.resources"}),
+	).Partial(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pq.Queries, 16)
+
+	t.Run("translates queries within the limit", func(t *testing.T) {
+		for _, maxClauses := range []int{0, 32} {
+			c := OPAClient{MaxClauses: maxClauses}
+
+			res, err := c.ProcessQuery(pq)
+			require.NoError(t, err)
+			require.Len(t, res["$or"], 16)
+
+			sqlQuery, err := c.ProcessQueryToSQL(pq)
+			require.NoError(t, err)
+			require.Len(t, sqlQuery.Args, 32)
+		}
+	})
+
+	t.Run("fails on queries exceeding the limit", func(t *testing.T) {
+		c := OPAClient{MaxClauses: 31}
+
+		_, err := c.ProcessQuery(pq)
+		require.ErrorIs(t, err, ErrQueryTooComplex)
+		require.EqualError(t, err, "query too complex: more than 31 clauses")
+
+		_, err = c.ProcessQueryToSQL(pq)
+		require.ErrorIs(t, err, ErrQueryTooComplex)
+	})
+}
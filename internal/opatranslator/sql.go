@@ -0,0 +1,73 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opatranslator
+
+import (
+	"fmt"
+	"strings"
+)
+
+type SQLQuery struct {
+	Where string        `json:"where"`
+	Args  []interface{} `json:"args"`
+}
+
+var sqlOperators = map[string]string{
+	LtOp:    "<",
+	LteOp:   "<=",
+	GtOp:    ">",
+	GteOp:   ">=",
+	EqOp:    "=",
+	EqualOp: "=",
+	NeqOp:   "<>",
+}
+
+// HandleSQLOperation builds the SQL condition for the operation, numbering its
+// placeholder starting from placeholderIndex; comparisons with null are
+// translated to IS NULL and IS NOT NULL, which take no argument.
+func HandleSQLOperation(operation string, fieldName string, fieldValue interface{}, placeholderIndex int) (string, []interface{}, bool) {
+	operator, ok := sqlOperators[operation]
+	if !ok {
+		return "", nil, false
+	}
+
+	column := quoteSQLIdentifier(fieldName)
+	if fieldValue == nil {
+		switch operator {
+		case "=":
+			return fmt.Sprintf("%s IS NULL", column), nil, true
+		case "<>":
+			return fmt.Sprintf("%s IS NOT NULL", column), nil, true
+		}
+	}
+	return fmt.Sprintf("%s %s $%d", column, operator, placeholderIndex), []interface{}{fieldValue}, true
+}
+
+func sqlConjunction(conditions []string) string {
+	if len(conditions) == 0 {
+		return "(TRUE)"
+	}
+	return fmt.Sprintf("(%s)", strings.Join(conditions, " AND "))
+}
+
+// quoteSQLIdentifier quotes each dot separated part of the field name, so that
+// nested fields are addressed as "table"."column".
+func quoteSQLIdentifier(fieldName string) string {
+	parts := strings.Split(fieldName, ".")
+	for i, part := range parts {
+		parts[i] = fmt.Sprintf(`"%s"`, strings.ReplaceAll(part, `"`, `""`))
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opatranslator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleSQLOperation(t *testing.T) {
+	testCases := []struct {
+		operation  string
+		fieldName  string
+		fieldValue interface{}
+		condition  string
+		args       []interface{}
+	}{
+		{operation: LtOp, fieldName: "answer", fieldValue: 42, condition: `"answer" < $3`, args: []interface{}{42}},
+		{operation: LteOp, fieldName: "answer", fieldValue: 42, condition: `"answer" <= $3`, args: []interface{}{42}},
+		{operation: GtOp, fieldName: "answer", fieldValue: 42, condition: `"answer" > $3`, args: []interface{}{42}},
+		{operation: GteOp, fieldName: "answer", fieldValue: 42, condition: `"answer" >= $3`, args: []interface{}{42}},
+		{operation: EqOp, fieldName: "answer", fieldValue: 42, condition: `"answer" = $3`, args: []interface{}{42}},
+		{operation: EqualOp, fieldName: "answer", fieldValue: 42, condition: `"answer" = $3`, args: []interface{}{42}},
+		{operation: NeqOp, fieldName: "answer", fieldValue: 1, condition: `"answer" <> $3`, args: []interface{}{1}},
+		{operation: EqOp, fieldName: "answer", fieldValue: nil, condition: `"answer" IS NULL`},
+		{operation: NeqOp, fieldName: "answer", fieldValue: nil, condition: `"answer" IS NOT NULL`},
+		{operation: EqOp, fieldName: "nested.answer", fieldValue: 42, condition: `"nested"."answer" = $3`, args: []interface{}{42}},
+		{operation: EqOp, fieldName: `an"swer`, fieldValue: 42, condition: `"an""swer" = $3`, args: []interface{}{42}},
+	}
+
+	for i, testCase := range testCases {
+		t.Run(
+			fmt.Sprintf(`case #%d: op %s <%s,%+v> => %s`, i+1, testCase.operation, testCase.fieldName, testCase.fieldValue, testCase.condition),
+			func(t *testing.T) {
+				condition, args, ok := HandleSQLOperation(testCase.operation, testCase.fieldName, testCase.fieldValue, 3)
+				require.True(t, ok)
+				require.Equal(t, testCase.condition, condition)
+				require.Equal(t, testCase.args, args)
+			},
+		)
+	}
+
+	t.Run("unsupported operation", func(t *testing.T) {
+		_, _, ok := HandleSQLOperation("unknown", "answer", 42, 1)
+		require.False(t, ok)
+	})
+}
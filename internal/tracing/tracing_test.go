@@ -0,0 +1,86 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestStartSpan(t *testing.T) {
+	t.Run("no-op without tracer provider", func(t *testing.T) {
+		_, span := StartSpan(context.Background(), "span-name")
+		defer EndSpan(span, nil)
+
+		require.False(t, span.SpanContext().IsValid())
+	})
+
+	t.Run("records span with attributes and error", func(t *testing.T) {
+		recorder := setupSpanRecorder(t)
+
+		_, span := StartSpan(context.Background(), "span-name", PolicyNameAttributeKey.String("allow"))
+		EndSpan(span, errors.New("some error"))
+
+		spans := recorder.Ended()
+		require.Len(t, spans, 1)
+		require.Equal(t, "span-name", spans[0].Name())
+		require.Contains(t, spans[0].Attributes(), PolicyNameAttributeKey.String("allow"))
+		require.Equal(t, codes.Error, spans[0].Status().Code)
+		require.Equal(t, "some error", spans[0].Status().Description)
+	})
+}
+
+func TestRequestMiddlewareTraceContext(t *testing.T) {
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previousPropagator)
+
+	middleware := RequestMiddlewareTraceContext()
+	builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spanContext := trace.SpanContextFromContext(r.Context())
+		require.True(t, spanContext.IsRemote())
+		require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	builtHandler.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func setupSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previousProvider) })
+
+	return recorder
+}
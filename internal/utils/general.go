@@ -32,3 +32,18 @@ func SanitizeString(input string) string {
 	sanitized = strings.Replace(sanitized, "\r", "", -1)
 	return sanitized
 }
+
+// SplitHeaderValues splits a header value on delimiter, defaulting to a comma, trimming
+// surrounding whitespaces and discarding empty elements.
+func SplitHeaderValues(headerValue string, delimiter string) []string {
+	if delimiter == "" {
+		delimiter = ","
+	}
+	values := make([]string, 0)
+	for _, value := range strings.Split(headerValue, delimiter) {
+		if trimmed := strings.TrimSpace(value); trimmed != "" {
+			values = append(values, trimmed)
+		}
+	}
+	return values
+}
@@ -16,19 +16,29 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	swagger "github.com/davidebianchi/gswagger"
 	"github.com/davidebianchi/gswagger/apirouter"
 	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/rond-authz/rond/custom_builtins"
 	"github.com/rond-authz/rond/helpers"
+	"github.com/rond-authz/rond/internal/authtoken"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/decisionlog"
+	"github.com/rond-authz/rond/internal/identity"
+	"github.com/rond-authz/rond/internal/metrics"
 	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/tracing"
+	"github.com/rond-authz/rond/internal/utils"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
@@ -38,10 +48,32 @@ import (
 const HTTPScheme = "http"
 
 func main() {
+	checkConfig := flag.Bool("check-config", false, "validate the configuration and exit without starting the server")
+	flag.Parse()
+
+	env := config.GetEnvOrDie()
+	if *checkConfig || env.ValidateOnly {
+		os.Exit(runConfigurationCheck(env, os.Stdout))
+	}
+
 	entrypoint(make(chan os.Signal, 1))
 	os.Exit(0)
 }
 
+// runConfigurationCheck validates the configuration, returning the process exit code.
+func runConfigurationCheck(env config.EnvironmentVariables, w io.Writer) int {
+	log, err := glogger.InitHelper(glogger.InitOptions{Level: env.LogLevel})
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if err := checkConfiguration(env, log, w); err != nil {
+		fmt.Fprintf(w, "Configuration is not valid: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
 func entrypoint(shutdown chan os.Signal) {
 	env := config.GetEnvOrDie()
 
@@ -51,43 +83,97 @@ func entrypoint(shutdown chan os.Signal) {
 		panic(err.Error())
 	}
 
-	if _, err := os.Stat(env.OPAModulesDirectory); err != nil {
+	var opaModuleConfig *OPAModuleConfig
+	var bundleLoader *policiesBundleLoader
+	if env.OPABundleURL != "" {
+		bundleLoader, err = newPoliciesBundleLoader(env)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": logrus.Fields{"message": err.Error()},
+			}).Errorf("failed policies bundle loader setup")
+			return
+		}
+		opaModuleConfig, err = bundleLoader.load(context.Background())
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":     logrus.Fields{"message": err.Error()},
+				"bundleUrl": env.OPABundleURL,
+			}).Errorf("failed policies bundle load")
+			return
+		}
+		log.WithField("bundleUrl", env.OPABundleURL).Trace("policies bundle successfully loaded")
+	} else {
+		if _, err := os.Stat(env.OPAModulesDirectory); err != nil {
+			log.WithFields(logrus.Fields{
+				"error":        logrus.Fields{"message": err.Error()},
+				"opaDirectory": env.OPAModulesDirectory,
+			}).Errorf("load OPA modules failed")
+			return
+		}
+
+		opaModuleConfig, err = loadPoliciesFromDirectory(env.OPAModulesDirectory, env.OPADataFilePath)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error":        logrus.Fields{"message": err.Error()},
+				"opaDirectory": env.OPAModulesDirectory,
+			}).Errorf("failed rego file read")
+			return
+		}
+		log.WithField("opaModuleFileName", opaModuleConfig.Name).Trace("rego module successfully loaded")
+	}
+
+	oas, err := loadOASFromFileOrNetwork(log, env)
+	if err != nil {
 		log.WithFields(logrus.Fields{
 			"error":        logrus.Fields{"message": err.Error()},
-			"opaDirectory": env.OPAModulesDirectory,
-		}).Errorf("load OPA modules failed")
+			"oasFilePath":  env.APIPermissionsFilePath,
+			"oasFilePaths": env.PermissionsFilePaths,
+			"oasApiPath":   env.TargetServiceOASPath,
+		}).Errorf("failed to load oas")
 		return
 	}
+	log.WithFields(logrus.Fields{
+		"oasFilePath":  env.APIPermissionsFilePath,
+		"oasFilePaths": env.PermissionsFilePaths,
+		"oasApiPath":   env.TargetServiceOASPath,
+	}).Trace("OAS successfully loaded")
 
-	opaModuleConfig, err := loadRegoModule(env.OPAModulesDirectory)
-	if err != nil {
+	if err := requireNonEmptyOAS(oas, env); err != nil {
 		log.WithFields(logrus.Fields{
 			"error":        logrus.Fields{"message": err.Error()},
-			"opaDirectory": env.OPAModulesDirectory,
-		}).Errorf("failed rego file read")
+			"oasFilePath":  env.APIPermissionsFilePath,
+			"oasFilePaths": env.PermissionsFilePaths,
+			"oasApiPath":   env.TargetServiceOASPath,
+		}).Errorf("empty oas")
+		return
+	}
+	if err := applySecuritySchemePolicies(oas, env); err != nil {
+		log.WithField("error", logrus.Fields{"message": err.Error()}).Errorf("failed security scheme policies mapping")
 		return
 	}
-	log.WithField("opaModuleFileName", opaModuleConfig.Name).Trace("rego module successfully loaded")
 
-	oas, err := loadOASFromFileOrNetwork(log, env)
+	if err := validatePolicies(oas, opaModuleConfig); err != nil {
+		fields := logrus.Fields{"error": logrus.Fields{"message": err.Error()}}
+		if env.PolicyStrictStartup {
+			log.WithFields(fields).Errorf("policies validation failed")
+			return
+		}
+		log.WithFields(fields).Warn("policies validation failed")
+	}
+
+	mongoClient, err := mongoclient.NewMongoClient(env, log)
 	if err != nil {
 		log.WithFields(logrus.Fields{
-			"error":       logrus.Fields{"message": err.Error()},
-			"oasFilePath": env.APIPermissionsFilePath,
-			"oasApiPath":  env.TargetServiceOASPath,
-		}).Errorf("failed to load oas")
+			"error": logrus.Fields{"message": err.Error()},
+		}).Errorf("MongoDB setup failed")
 		return
 	}
-	log.WithFields(logrus.Fields{
-		"oasFilePath": env.APIPermissionsFilePath,
-		"oasApiPath":  env.TargetServiceOASPath,
-	}).Trace("OAS successfully loaded")
 
-	mongoClient, err := mongoclient.NewMongoClient(env, log)
+	components, err := newRouterComponents(env)
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"error": logrus.Fields{"message": err.Error()},
-		}).Errorf("MongoDB setup failed")
+		}).Errorf("failed router setup")
 		return
 	}
 
@@ -104,9 +190,53 @@ func entrypoint(shutdown chan os.Signal) {
 		return
 	}
 	log.WithField("policiesLength", len(policiesEvaluators)).Debug("policies evaluators partial results computed")
+	if env.DefaultPolicyName != "" {
+		log.WithField("defaultPolicyName", env.DefaultPolicyName).Info("default policy applied to the API without permission")
+	}
+	if env.DisableRowFilter {
+		log.Warn("row filter disabled, query generating policies are evaluated as allow policies")
+	}
+	if env.DebugInputEnabled {
+		log.Warn("debug input enabled, requests can ask for the policy input instead of being proxied")
+	}
+	if env.DebugProfileEnabled {
+		log.Warn("debug profile enabled, requests can ask for the policies profile instead of being proxied")
+	}
+
+	policies := NewPoliciesStore(opaModuleConfig, policiesEvaluators)
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+	// oasMu guards oas, which is replaced when the OAS is refreshed
+	var oasMu sync.Mutex
+	if bundleLoader != nil {
+		updatePolicies := func(opaModuleConfig *OPAModuleConfig) error {
+			oasMu.Lock()
+			defer oasMu.Unlock()
+			return policies.Update(ctx, opaModuleConfig, mongoClient, oas, env)
+		}
+		pollPoliciesBundle(watchCtx, bundleLoader, env.OPABundlePollInterval, updatePolicies)
+	} else if env.PolicyHotReload {
+		reloadPolicies := func() error {
+			oasMu.Lock()
+			defer oasMu.Unlock()
+			return policies.Reload(ctx, env.OPAModulesDirectory, mongoClient, oas, env)
+		}
+		var watchedFiles []string
+		if env.OPADataFilePath != "" {
+			watchedFiles = append(watchedFiles, env.OPADataFilePath)
+		}
+		if err := watchPoliciesDirectory(watchCtx, env.OPAModulesDirectory, reloadPolicies, watchedFiles...); err != nil {
+			log.WithFields(logrus.Fields{
+				"error":        logrus.Fields{"message": err.Error()},
+				"opaDirectory": env.OPAModulesDirectory,
+			}).Errorf("failed policies hot reload setup")
+			return
+		}
+		log.WithField("opaDirectory", env.OPAModulesDirectory).Info("policies hot reload enabled")
+	}
 
 	// Routing
-	router, err := setupRouter(log, env, opaModuleConfig, oas, policiesEvaluators, mongoClient)
+	router, err := buildRouter(log, env, policies, oas, mongoClient, components)
 	if mongoClient != nil {
 		defer mongoClient.Disconnect()
 	}
@@ -118,9 +248,38 @@ func entrypoint(shutdown chan os.Signal) {
 	}
 	log.Trace("router setup completed")
 
+	handler := newSwappableHandler(routerHandler(router, env))
+	if documentationURL := oasDocumentationURL(env); documentationURL != "" && env.OASFetchCacheTTL > 0 {
+		updateOAS := func(refreshedOAS *OpenAPISpec) error {
+			oasMu.Lock()
+			defer oasMu.Unlock()
+			if err := requireNonEmptyOAS(refreshedOAS, env); err != nil {
+				return err
+			}
+			if err := applySecuritySchemePolicies(refreshedOAS, env); err != nil {
+				return err
+			}
+			opaModuleConfig, _ := policies.Get()
+			evaluators, err := setupEvaluators(ctx, mongoClient, refreshedOAS, opaModuleConfig, env)
+			if err != nil {
+				return fmt.Errorf("failed to create evaluators: %s", err.Error())
+			}
+			refreshedRouter, err := buildRouter(log, env, policies, refreshedOAS, mongoClient, components)
+			if err != nil {
+				return fmt.Errorf("failed router setup: %s", err.Error())
+			}
+			policies.Swap(opaModuleConfig, evaluators)
+			handler.Swap(routerHandler(refreshedRouter, env))
+			oas = refreshedOAS
+			return nil
+		}
+		pollOAS(watchCtx, documentationURL, env.OASFetchCacheTTL, oas, updateOAS)
+		log.WithField("oasApiPath", env.TargetServiceOASPath).Info("OAS refresh enabled")
+	}
+
 	srv := &http.Server{
 		Addr:              fmt.Sprintf("0.0.0.0:%s", env.HTTPPort),
-		Handler:           router,
+		Handler:           handler,
 		ReadHeaderTimeout: time.Second,
 	}
 
@@ -138,22 +297,126 @@ func entrypoint(shutdown chan os.Signal) {
 	helpers.GracefulShutdown(srv, shutdown, log, env.DelayShutdownSeconds)
 }
 
+// routerHandler returns the handler serving the requests with the router.
+func routerHandler(router *mux.Router, env config.EnvironmentVariables) http.Handler {
+	if env.CaseInsensitivePaths {
+		return matchLowerCasedPath(router)
+	}
+	return router
+}
+
+// routerComponents are the stateful components used by the router, built once so that
+// they are reused, instead of being leaked or reset, when the router is rebuilt.
+type routerComponents struct {
+	queryMetrics           *metrics.Metrics
+	identityExtractor      identity.Extractor
+	bindingsCache          *mongoclient.BindingsCache
+	decisionCache          *DecisionCache
+	httpResourceFetcher    *custom_builtins.HTTPResourceFetcher
+	targetServiceTransport http.RoundTripper
+	decisionLogger         *decisionlog.Logger
+	verifier               *authtoken.Verifier
+}
+
+func newRouterComponents(env config.EnvironmentVariables) (*routerComponents, error) {
+	identityExtractor, err := identity.NewExtractor(env.IdentityExtractor, env)
+	if err != nil {
+		return nil, err
+	}
+	targetServiceTransport, err := newTargetServiceTransport(env)
+	if err != nil {
+		return nil, err
+	}
+	components := &routerComponents{
+		identityExtractor:      identityExtractor,
+		bindingsCache:          mongoclient.NewBindingsCache(env.BindingsCacheSize, env.BindingsCacheTTL),
+		decisionCache:          NewDecisionCache(defaultDecisionCacheSize),
+		httpResourceFetcher:    newHTTPResourceFetcher(env),
+		targetServiceTransport: targetServiceTransport,
+	}
+	if env.MongoQueryMetrics {
+		components.queryMetrics = metrics.New()
+	}
+	if env.DecisionLogEnabled {
+		components.decisionLogger, err = decisionlog.NewFileLogger(env.DecisionLogFile, utils.SplitHeaderValues(env.RedactedHeaders, ","))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if env.JWKSURL != "" {
+		components.verifier = authtoken.NewVerifier(env.JWKSURL, env.JWTIssuer, env.JWTAudience, env.JWKSRefreshInterval)
+	}
+	return components, nil
+}
+
 func setupRouter(
 	log *logrus.Logger,
 	env config.EnvironmentVariables,
-	opaModuleConfig *OPAModuleConfig,
+	policies *PoliciesStore,
 	oas *OpenAPISpec,
-	policiesEvaluators PartialResultsEvaluators,
 	mongoClient *mongoclient.MongoClient,
+) (*mux.Router, error) {
+	components, err := newRouterComponents(env)
+	if err != nil {
+		return nil, err
+	}
+	return buildRouter(log, env, policies, oas, mongoClient, components)
+}
+
+// buildRouter builds the router serving the OAS routes with the provided components.
+func buildRouter(
+	log *logrus.Logger,
+	env config.EnvironmentVariables,
+	policies *PoliciesStore,
+	oas *OpenAPISpec,
+	mongoClient *mongoclient.MongoClient,
+	components *routerComponents,
 ) (*mux.Router, error) {
 	router := mux.NewRouter().UseEncodedPath()
+	if env.CaseInsensitivePaths {
+		// restores the path lower cased by matchLowerCasedPath before any other middleware
+		router.Use(restoreOriginalPath)
+	}
+	router.Use(UpgradeHijackerMiddleware())
+	router.Use(RequestIDMiddleware(env.RequestIDHeaderKey))
 	router.Use(glogger.RequestMiddlewareLogger(log, []string{"/-/"}))
+	router.Use(RequestIDLoggerMiddleware())
+	router.Use(ErrorResponseFormatMiddleware(env.ErrorResponseFormat))
 	serviceName := "rönd"
-	StatusRoutes(router, serviceName, env.ServiceVersion)
+	statusRouter := router.NewRoute().Subrouter()
+	if mongoClient != nil {
+		statusRouter.Use(mongoclient.MongoClientInjectorMiddleware(mongoClient))
+	}
+	StatusRoutes(statusRouter, serviceName, env.ServiceVersion)
+	if env.ExposePolicies {
+		PoliciesRoute(statusRouter, oas)
+	}
+	if env.DebugEvalEnabled {
+		ValidateRoute(statusRouter, policies)
+	}
+	if components.queryMetrics != nil {
+		MetricsRoute(statusRouter, components.queryMetrics)
+		router.Use(metrics.MetricsInjectorMiddleware(components.queryMetrics))
+	}
 
 	router.Use(config.RequestMiddlewareEnvironments(env))
+	router.Use(identity.ExtractorInjectorMiddleware(components.identityExtractor))
+	router.Use(tracing.RequestMiddlewareTraceContext())
+	if components.bindingsCache != nil {
+		router.Use(mongoclient.BindingsCacheInjectorMiddleware(components.bindingsCache))
+	}
+	router.Use(DecisionCacheInjectorMiddleware(components.decisionCache))
+	router.Use(custom_builtins.HTTPResourceFetcherInjectorMiddleware(components.httpResourceFetcher))
+	if components.targetServiceTransport != nil {
+		router.Use(TargetServiceTransportInjectorMiddleware(components.targetServiceTransport))
+	}
+	if components.decisionLogger != nil {
+		router.Use(decisionlog.LoggerInjectorMiddleware(components.decisionLogger))
+	}
+	if components.verifier != nil {
+		router.Use(authtoken.VerifierInjectorMiddleware(components.verifier))
+	}
 
-	evalRouter := router.NewRoute().Subrouter()
 	if env.Standalone {
 		swaggerRouter, err := swagger.NewRouter(apirouter.NewGorillaMuxRouter(router), swagger.Options{
 			Context: context.Background(),
@@ -169,7 +432,11 @@ func setupRouter(
 		if err != nil {
 			return nil, err
 		}
-		if err := addStandaloneRoutes(swaggerRouter); err != nil {
+		var policyEvaluation http.Handler = policyEvaluationHandler(policies)
+		if mongoClient != nil {
+			policyEvaluation = mongoclient.MongoClientInjectorMiddleware(mongoClient)(policyEvaluation)
+		}
+		if err := addStandaloneRoutes(swaggerRouter, env.PathPrefixStandalone, policyEvaluation); err != nil {
 			return nil, err
 		}
 
@@ -178,7 +445,9 @@ func setupRouter(
 		}
 	}
 
-	evalRouter.Use(OPAMiddleware(opaModuleConfig, oas, &env, policiesEvaluators))
+	// eval routes are registered after the standalone ones, so they do not shadow the policy evaluation route
+	evalRouter := router.NewRoute().Subrouter()
+	evalRouter.Use(OPAMiddleware(policies, oas, &env))
 
 	if mongoClient != nil {
 		evalRouter.Use(mongoclient.MongoClientInjectorMiddleware(mongoClient))
@@ -195,3 +464,13 @@ func setupRouter(
 
 	return router, nil
 }
+
+// newHTTPResourceFetcher returns the fetcher used by the http_get_json builtin, which refuses
+// every host when POLICY_HTTP_ALLOWED_HOSTS is empty.
+func newHTTPResourceFetcher(env config.EnvironmentVariables) *custom_builtins.HTTPResourceFetcher {
+	return custom_builtins.NewHTTPResourceFetcher(
+		utils.SplitHeaderValues(env.PolicyHTTPAllowedHosts, ","),
+		env.PolicyHTTPTimeout,
+		env.PolicyHTTPCacheTTL,
+	)
+}
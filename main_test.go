@@ -23,6 +23,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -190,6 +192,60 @@ func TestEntrypoint(t *testing.T) {
 		unsetEnvs()
 	})
 
+	t.Run("fails for policies bundle not found", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundle.tar.gz").
+			Reply(404)
+
+		unsetEnvs := setEnvs([]env{
+			{name: "HTTP_PORT", value: "3000"},
+			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
+			{name: "TARGET_SERVICE_OAS_PATH", value: "/documentation/json"},
+			{name: "OPA_BUNDLE_URL", value: "http://bundle-server/bundle.tar.gz"},
+			{name: "LOG_LEVEL", value: "fatal"},
+		})
+		shutdown := make(chan os.Signal, 1)
+
+		entrypoint(shutdown)
+		require.True(t, gock.IsDone(), "bundle not requested")
+		unsetEnvs()
+	})
+
+	t.Run("fails for missing policies with strict startup", func(t *testing.T) {
+		unsetEnvs := setEnvs([]env{
+			{name: "HTTP_PORT", value: "3000"},
+			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
+			{name: "API_PERMISSIONS_FILE_PATH", value: "./mocks/simplifiedMock.json"},
+			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "POLICY_STRICT_STARTUP", value: "true"},
+			{name: "LOG_LEVEL", value: "fatal"},
+		})
+		shutdown := make(chan os.Signal, 1)
+
+		entrypoint(shutdown)
+		require.True(t, true, "If we get here the service has not started")
+		unsetEnvs()
+	})
+
+	t.Run("fails for empty OAS when required", func(t *testing.T) {
+		oasPath := filepath.Join(t.TempDir(), "oas.json")
+		require.NoError(t, os.WriteFile(oasPath, []byte(`{"paths":{}}`), 0600))
+		unsetEnvs := setEnvs([]env{
+			{name: "HTTP_PORT", value: "3000"},
+			{name: "TARGET_SERVICE_HOST", value: "localhost:3001"},
+			{name: "API_PERMISSIONS_FILE_PATH", value: oasPath},
+			{name: "OPA_MODULES_DIRECTORY", value: "./mocks/rego-policies"},
+			{name: "REQUIRE_NONEMPTY_OAS", value: "true"},
+			{name: "LOG_LEVEL", value: "fatal"},
+		})
+		shutdown := make(chan os.Signal, 1)
+
+		entrypoint(shutdown)
+		require.True(t, true, "If we get here the service has not started")
+		unsetEnvs()
+	})
+
 	t.Run("opens server on port 3000", func(t *testing.T) {
 		shutdown := make(chan os.Signal, 1)
 		defer gock.Off()
@@ -880,7 +936,7 @@ func TestEntrypoint(t *testing.T) {
 		gock.Flush()
 		gock.New("http://localhost:3033/users/").
 			Get("/users/").
-			MatchHeader("acl_rows", `{"$or":[{"$and":[{"_id":{"$eq":"9876"}}]},{"$and":[{"_id":{"$eq":"12345"}}]},{"$and":[{"_id":{"$eq":"9876"}}]},{"$and":[{"_id":{"$eq":"12345"}}]}]}`).
+			MatchHeader("acl_rows", `{"_id":{"$in":["9876","12345","9876","12345"]}}`).
 			Reply(200)
 		req, err := http.NewRequest("GET", "http://localhost:3034/users/", nil)
 		require.NoError(t, err)
@@ -1674,6 +1730,12 @@ func TestSetupRouterStandaloneMode(t *testing.T) {
 		Name: "policies",
 		Content: `package policies
 test_policy { true }
+
+filter_policy {
+	input.request.method == "GET"
+	employee := data.resources[_]
+	employee.name == input.user.properties.name
+}
 `,
 	}
 	oas := &OpenAPISpec{
@@ -1684,6 +1746,11 @@ test_policy { true }
 						RequestFlow: RequestFlow{PolicyName: "test_policy"},
 					},
 				},
+				"post": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "filter_policy"},
+					},
+				},
 			},
 		},
 	}
@@ -1692,7 +1759,7 @@ test_policy { true }
 	evaluatorsMap, err := setupEvaluators(ctx, mongoClient, oas, opa, env)
 	assert.NilError(t, err, "unexpected error")
 
-	router, err := setupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+	router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
 	assert.NilError(t, err, "unexpected error")
 
 	t.Run("some eval API", func(t *testing.T) {
@@ -1733,6 +1800,50 @@ test_policy { true }
 		assert.Equal(t, requestError.Error, "EOF")
 	})
 
+	t.Run("policy evaluation API", func(t *testing.T) {
+		evaluatePolicy := func(t *testing.T, policyName, body string) (*http.Response, []byte) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/my-prefix/policies/"+policyName, strings.NewReader(body))
+			router.ServeHTTP(w, req)
+			return w.Result(), getResponseBody(t, w)
+		}
+
+		t.Run("allowed policy", func(t *testing.T) {
+			resp, body := evaluatePolicy(t, "test_policy", `{}`)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, JSONContentTypeHeader, resp.Header.Get(ContentTypeHeaderKey))
+			require.JSONEq(t, `{"allowed":true,"query":null}`, string(body))
+		})
+
+		t.Run("allowed policy with query", func(t *testing.T) {
+			resp, body := evaluatePolicy(t, "filter_policy", `{"request":{"method":"GET"},"user":{"properties":{"name":"john"}}}`)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			require.JSONEq(t, `{"allowed":true,"query":{"$or":[{"$and":[{"name":{"$eq":"john"}}]}]}}`, string(body))
+		})
+
+		t.Run("denied policy", func(t *testing.T) {
+			resp, body := evaluatePolicy(t, "filter_policy", `{"request":{"method":"POST"}}`)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			require.JSONEq(t, `{"allowed":false,"query":null}`, string(body))
+		})
+
+		t.Run("unknown policy", func(t *testing.T) {
+			resp, body := evaluatePolicy(t, "not_existing_policy", `{}`)
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			var requestError types.RequestError
+			err := json.Unmarshal(body, &requestError)
+			assert.NilError(t, err, "unexpected error")
+			assert.Equal(t, requestError.Error, "policy not_existing_policy not found")
+		})
+
+		t.Run("malformed input", func(t *testing.T) {
+			resp, _ := evaluatePolicy(t, "test_policy", `{"request":`)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	})
+
 	t.Run("API documentation is correctly exposed - json", func(t *testing.T) {
 		w := httptest.NewRecorder()
 		req := httptest.NewRequest(http.MethodGet, "/openapi/json", nil)
@@ -0,0 +1,3 @@
+package policies
+
+broken {
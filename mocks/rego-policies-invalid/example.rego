@@ -0,0 +1,3 @@
+package policies
+
+todo { true }
@@ -0,0 +1,5 @@
+package policies
+
+is_admin {
+	input.user.groups[_] == "admin"
+}
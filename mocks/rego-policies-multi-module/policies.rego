@@ -0,0 +1,5 @@
+package policies
+
+allow_with_shared_rule {
+	is_admin
+}
@@ -0,0 +1,209 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBundlePollingInterval = time.Minute
+	defaultBundleFetchTimeout    = 30 * time.Second
+	bundleVerificationKeyID      = "default"
+	bundleVerificationAlgorithm  = "RS256"
+	bundleResourcesDataKey       = "resources"
+)
+
+// policiesBundleLoader downloads the OPA bundle holding the policies, keeping track
+// of the last loaded version so that unchanged bundles are not loaded again.
+type policiesBundleLoader struct {
+	url                string
+	verificationConfig *bundle.VerificationConfig
+	// fetchTimeout bounds each bundle download, defaultBundleFetchTimeout if not set,
+	// so that a hung bundle server does not stop the policies updates
+	fetchTimeout time.Duration
+
+	etag   string
+	digest string
+}
+
+// newPoliciesBundleLoader creates the bundle loader for the configured bundle URL.
+// When a public key is provided, bundles are required to be signed with it.
+func newPoliciesBundleLoader(env config.EnvironmentVariables) (*policiesBundleLoader, error) {
+	loader := &policiesBundleLoader{url: env.OPABundleURL}
+	if env.OPABundlePublicKeyFile == "" {
+		return loader, nil
+	}
+
+	publicKey, err := os.ReadFile(env.OPABundlePublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed bundle public key read: %s", err.Error())
+	}
+	loader.verificationConfig = bundle.NewVerificationConfig(
+		map[string]*bundle.KeyConfig{
+			bundleVerificationKeyID: {Key: string(publicKey), Algorithm: bundleVerificationAlgorithm},
+		},
+		bundleVerificationKeyID,
+		"",
+		nil,
+	)
+	return loader, nil
+}
+
+// load downloads the bundle and returns the rego modules and data it contains.
+// A `nil` configuration is returned when the bundle did not change since the last load.
+func (loader *policiesBundleLoader) load(ctx context.Context) (*OPAModuleConfig, error) {
+	fetchTimeout := loader.fetchTimeout
+	if fetchTimeout <= 0 {
+		fetchTimeout = defaultBundleFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, loader.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, err.Error())
+	}
+	if loader.etag != "" {
+		req.Header.Set("If-None-Match", loader.etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: invalid status code %d", ErrRequestFailed, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, err.Error())
+	}
+	etag := resp.Header.Get("ETag")
+	checksum := sha256.Sum256(body)
+	digest := hex.EncodeToString(checksum[:])
+	if digest == loader.digest {
+		loader.etag = etag
+		return nil, nil
+	}
+
+	policiesBundle, err := bundle.NewReader(bytes.NewReader(body)).
+		WithBundleVerificationConfig(loader.verificationConfig).
+		WithSkipBundleVerification(loader.verificationConfig == nil).
+		WithBundleEtag(etag).
+		Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed bundle read: %s", err.Error())
+	}
+	opaModuleConfig, err := opaModuleConfigFromBundle(policiesBundle)
+	if err != nil {
+		return nil, err
+	}
+
+	loader.etag = etag
+	loader.digest = digest
+	return opaModuleConfig, nil
+}
+
+// opaModuleConfigFromBundle builds the module configuration from the bundle modules and data.
+// The `resources` data key is excluded, since it is reserved for the partial evaluation unknowns.
+func opaModuleConfigFromBundle(policiesBundle bundle.Bundle) (*OPAModuleConfig, error) {
+	if len(policiesBundle.Modules) == 0 {
+		return nil, fmt.Errorf("no rego module found in bundle")
+	}
+
+	modules := make([]OPAModule, 0, len(policiesBundle.Modules))
+	for _, module := range policiesBundle.Modules {
+		modules = append(modules, OPAModule{
+			Name:    module.Path,
+			Content: string(module.Raw),
+		})
+	}
+
+	data := make(map[string]interface{}, len(policiesBundle.Data))
+	for key, value := range policiesBundle.Data {
+		if key == bundleResourcesDataKey {
+			continue
+		}
+		data[key] = value
+	}
+
+	return &OPAModuleConfig{
+		Name:              modules[0].Name,
+		Content:           modules[0].Content,
+		AdditionalModules: modules[1:],
+		Data:              data,
+	}, nil
+}
+
+// pollPoliciesBundle periodically loads the bundle, invoking update every time it changes.
+// The polling is stopped when the context is done.
+func pollPoliciesBundle(ctx context.Context, loader *policiesBundleLoader, interval time.Duration, update func(*OPAModuleConfig) error) {
+	if interval <= 0 {
+		interval = defaultBundlePollingInterval
+	}
+	logger := glogger.Get(ctx)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				opaModuleConfig, err := loader.load(ctx)
+				if err != nil {
+					logger.WithFields(logrus.Fields{
+						"error":     logrus.Fields{"message": err.Error()},
+						"bundleUrl": loader.url,
+					}).Error("failed policies bundle load, keeping previous policies")
+					continue
+				}
+				if opaModuleConfig == nil {
+					continue
+				}
+				if err := update(opaModuleConfig); err != nil {
+					logger.WithFields(logrus.Fields{
+						"error":     logrus.Fields{"message": err.Error()},
+						"bundleUrl": loader.url,
+					}).Error("failed policies bundle update, keeping previous policies")
+					continue
+				}
+				logger.WithField("bundleUrl", loader.url).Info("policies bundle successfully reloaded")
+			}
+		}
+	}()
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
+)
+
+const bundleTestURL = "http://bundle-server/bundles/policies.tar.gz"
+
+func buildTestBundle(t *testing.T, modules map[string]string, data map[string]interface{}) []byte {
+	t.Helper()
+	policiesBundle := bundle.Bundle{Data: data}
+	for path, content := range modules {
+		policiesBundle.Modules = append(policiesBundle.Modules, bundle.ModuleFile{
+			Path: path,
+			URL:  path,
+			Raw:  []byte(content),
+		})
+	}
+	var buf bytes.Buffer
+	require.NoError(t, bundle.NewWriter(&buf).Write(policiesBundle))
+	return buf.Bytes()
+}
+
+func TestPoliciesBundleLoader(t *testing.T) {
+	policiesBundle := buildTestBundle(t,
+		map[string]string{"/policies.rego": "package policies\nallow { input.user.groups[_] == data.config.adminGroup }\n"},
+		map[string]interface{}{
+			"config":    map[string]interface{}{"adminGroup": "admin"},
+			"resources": []interface{}{"ignored"},
+		},
+	)
+
+	t.Run("loads modules and data from bundle", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Reply(200).
+			SetHeader("ETag", `"v1"`).
+			Body(bytes.NewReader(policiesBundle))
+
+		loader, err := newPoliciesBundleLoader(config.EnvironmentVariables{OPABundleURL: bundleTestURL})
+		require.NoError(t, err)
+
+		opaModuleConfig, err := loader.load(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "/policies.rego", opaModuleConfig.Name)
+		require.Equal(t, map[string]interface{}{"config": map[string]interface{}{"adminGroup": "admin"}}, opaModuleConfig.Data)
+		require.Equal(t, `"v1"`, loader.etag)
+		require.True(t, gock.IsDone())
+
+		input := []byte(`{"user":{"groups":["admin"]}}`)
+		evaluator, err := NewOPAEvaluator(context.Background(), "allow", opaModuleConfig, input, envs)
+		require.NoError(t, err)
+		result, err := evaluator.PolicyEvaluator.Eval(context.Background())
+		require.NoError(t, err)
+		require.True(t, result.Allowed(), "bundle data not available to the policy")
+	})
+
+	t.Run("returns nil configuration when the server replies not modified", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			MatchHeader("If-None-Match", `"v1"`).
+			Reply(304)
+
+		loader := &policiesBundleLoader{url: bundleTestURL, etag: `"v1"`}
+		opaModuleConfig, err := loader.load(context.Background())
+		require.NoError(t, err)
+		require.Nil(t, opaModuleConfig)
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("returns nil configuration when the bundle content did not change", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Times(2).
+			Reply(200).
+			Body(bytes.NewReader(policiesBundle))
+
+		loader := &policiesBundleLoader{url: bundleTestURL}
+		opaModuleConfig, err := loader.load(context.Background())
+		require.NoError(t, err)
+		require.NotNil(t, opaModuleConfig)
+
+		opaModuleConfig, err = loader.load(context.Background())
+		require.NoError(t, err)
+		require.Nil(t, opaModuleConfig)
+	})
+
+	t.Run("fails on unexpected status code", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Reply(500)
+
+		loader := &policiesBundleLoader{url: bundleTestURL}
+		_, err := loader.load(context.Background())
+		require.ErrorIs(t, err, ErrRequestFailed)
+		require.Contains(t, err.Error(), "invalid status code 500")
+	})
+
+	t.Run("fails on invalid bundle", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Reply(200).
+			BodyString("not a bundle")
+
+		loader := &policiesBundleLoader{url: bundleTestURL}
+		_, err := loader.load(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed bundle read")
+		require.Empty(t, loader.digest, "failed bundle must not be marked as loaded")
+	})
+
+	t.Run("fails on bundle without modules", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Reply(200).
+			Body(bytes.NewReader(buildTestBundle(t, nil, map[string]interface{}{"config": "value"})))
+
+		loader := &policiesBundleLoader{url: bundleTestURL}
+		_, err := loader.load(context.Background())
+		require.EqualError(t, err, "no rego module found in bundle")
+	})
+
+	t.Run("fails when the bundle server does not respond in time", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://bundle-server").
+			Get("/bundles/policies.tar.gz").
+			Reply(200).
+			Delay(200 * time.Millisecond).
+			Body(bytes.NewReader(buildTestBundle(t, map[string]string{"/policies.rego": "package policies\nallow { true }\n"}, map[string]interface{}{})))
+
+		loader := &policiesBundleLoader{url: bundleTestURL, fetchTimeout: 20 * time.Millisecond}
+		_, err := loader.load(context.Background())
+		require.ErrorIs(t, err, ErrRequestFailed)
+		require.ErrorContains(t, err, "context deadline exceeded")
+	})
+
+	t.Run("fails on missing public key file", func(t *testing.T) {
+		_, err := newPoliciesBundleLoader(config.EnvironmentVariables{
+			OPABundleURL:           bundleTestURL,
+			OPABundlePublicKeyFile: "./mocks/not-existing-key.pem",
+		})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed bundle public key read")
+	})
+}
+
+func TestPollPoliciesBundle(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	ctx, cancel := context.WithCancel(glogger.WithLogger(context.Background(), logrus.NewEntry(log)))
+	defer cancel()
+
+	defer gock.Off()
+	gock.New("http://bundle-server").
+		Get("/bundles/policies.tar.gz").
+		Persist().
+		Reply(200).
+		Body(bytes.NewReader(buildTestBundle(t, map[string]string{"/policies.rego": "package policies\nallow { true }\n"}, map[string]interface{}{})))
+
+	var mu sync.Mutex
+	updates := 0
+	update := func(opaModuleConfig *OPAModuleConfig) error {
+		mu.Lock()
+		defer mu.Unlock()
+		updates++
+		return nil
+	}
+
+	pollPoliciesBundle(ctx, &policiesBundleLoader{url: bundleTestURL}, 10*time.Millisecond, update)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return updates == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// unchanged bundles do not trigger further updates
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, updates)
+}
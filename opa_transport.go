@@ -16,12 +16,17 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/mongoclient"
@@ -32,8 +37,6 @@ import (
 
 type OPATransport struct {
 	http.RoundTripper
-	// FIXME: this overlaps with the req.Context used during RoundTrip.
-	context                  context.Context
 	logger                   *logrus.Entry
 	request                  *http.Request
 	permission               *RondConfig
@@ -55,7 +58,18 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 		return resp, nil
 	}
 
-	b, err := io.ReadAll(resp.Body)
+	// only the configured content types are filtered, any other response is proxied untouched
+	if !hasFilterableContentType(resp.Header, t.env) {
+		t.logger.WithField("foundContentType", resp.Header.Get(ContentTypeHeaderKey)).Debug("response content type not filtered")
+		return resp, nil
+	}
+
+	maxBodySize := t.env.ResponseMaxBodySize
+	var bodyReader io.Reader = resp.Body
+	if maxBodySize > 0 {
+		bodyReader = io.LimitReader(resp.Body, maxBodySize+1)
+	}
+	b, err := io.ReadAll(bodyReader)
 	if err != nil {
 		return nil, err
 	}
@@ -63,13 +77,18 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 		return nil, err
 	}
 
+	if maxBodySize > 0 && int64(len(b)) > maxBodySize {
+		t.responseWithError(resp, fmt.Errorf("response body exceeds the maximum size of %d bytes", maxBodySize), http.StatusInternalServerError)
+		return resp, nil
+	}
+
 	if len(b) == 0 {
 		return resp, nil
 	}
 
-	if !hasApplicationJSONContentType(resp.Header) {
-		t.logger.WithField("foundContentType", resp.Header.Get(ContentTypeHeaderKey)).Debug("found content type")
-		t.responseWithError(resp, fmt.Errorf("content-type is not application/json"), http.StatusInternalServerError)
+	b, err = decodeResponseBody(b, resp.Header.Get(ContentEncodingHeaderKey), maxBodySize)
+	if err != nil {
+		t.responseWithError(resp, err, http.StatusInternalServerError)
 		return resp, nil
 	}
 
@@ -84,13 +103,34 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 		return resp, nil
 	}
 
-	input, err := createRegoQueryInput(t.request, t.env, t.permission.Options.EnableResourcePermissionsMapOptimization, userInfo, decodedBody)
+	input, err := createRegoQueryInput(t.request, t.env, t.permission.Options, userInfo, &InputResponse{
+		Body:       decodedBody,
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+	})
 	if err != nil {
 		t.responseWithError(resp, err, http.StatusInternalServerError)
 		return resp, nil
 	}
 
-	evaluator, err := t.partialResultsEvaluators.GetEvaluatorFromPolicy(t.context, t.permission.ResponseFlow.PolicyName, input, t.env)
+	if t.permission.ResponseFlow.FilterItems {
+		if items, withItems, ok := responseItems(decodedBody); ok {
+			allowedItems, err := t.allowedItems(req.Context(), input, items)
+			if err != nil {
+				t.responseWithError(resp, err, http.StatusInternalServerError)
+				return resp, nil
+			}
+			marshalledBody, err := json.Marshal(withItems(allowedItems))
+			if err != nil {
+				t.responseWithError(resp, err, http.StatusInternalServerError)
+				return resp, nil
+			}
+			overwriteResponse(resp, marshalledBody)
+			return resp, nil
+		}
+	}
+
+	evaluator, err := t.partialResultsEvaluators.GetEvaluatorFromPolicy(req.Context(), t.permission.ResponseFlow.PolicyName, input, t.env)
 	if err != nil {
 		t.logger.WithField("error", logrus.Fields{
 			"policyName": t.permission.ResponseFlow.PolicyName,
@@ -102,7 +142,16 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 
 	bodyToProxy, err := evaluator.evaluate(t.logger)
 	if err != nil {
-		t.responseWithError(resp, err, http.StatusForbidden)
+		statusCode := http.StatusForbidden
+		if errors.Is(err, ErrPolicyEvaluationTimeout) {
+			statusCode = http.StatusInternalServerError
+		}
+		t.responseWithError(resp, err, statusCode)
+		return resp, nil
+	}
+	// a policy that does not return a transformed body only gates the response
+	if bodyToProxy == nil {
+		overwriteResponse(resp, b)
 		return resp, nil
 	}
 
@@ -115,6 +164,56 @@ func (t *OPATransport) RoundTrip(req *http.Request) (resp *http.Response, err er
 	return resp, nil
 }
 
+// allowedItems evaluates the response policy for each item, set as the response body of the input,
+// returning the allowed ones.
+func (t *OPATransport) allowedItems(ctx context.Context, input []byte, items []interface{}) ([]interface{}, error) {
+	var itemInput Input
+	if err := json.Unmarshal(input, &itemInput); err != nil {
+		return nil, fmt.Errorf("failed input JSON decode: %s", err.Error())
+	}
+
+	allowedItems := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		itemInput.Response.Body = item
+		itemInputBytes, err := json.Marshal(itemInput)
+		if err != nil {
+			return nil, fmt.Errorf("failed input JSON encode: %s", err.Error())
+		}
+		evaluator, err := t.partialResultsEvaluators.GetEvaluatorFromPolicy(ctx, t.permission.ResponseFlow.PolicyName, itemInputBytes, t.env)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := evaluator.evaluate(t.logger); err != nil {
+			var denyErr *PolicyDenyError
+			if errors.As(err, &denyErr) {
+				continue
+			}
+			return nil, err
+		}
+		allowedItems = append(allowedItems, item)
+	}
+	return allowedItems, nil
+}
+
+// responseItems returns the items of a list response, which is either a top-level array or an
+// object holding them in the data array, and a function to build the response with other items.
+func responseItems(body interface{}) ([]interface{}, func([]interface{}) interface{}, bool) {
+	switch typedBody := body.(type) {
+	case []interface{}:
+		return typedBody, func(items []interface{}) interface{} { return items }, true
+	case map[string]interface{}:
+		items, ok := typedBody["data"].([]interface{})
+		if !ok {
+			return nil, nil, false
+		}
+		return items, func(items []interface{}) interface{} {
+			typedBody["data"] = items
+			return typedBody
+		}, true
+	}
+	return nil, nil, false
+}
+
 func (t *OPATransport) responseWithError(resp *http.Response, err error, statusCode int) {
 	t.logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("error while evaluating column filter query")
 	message := NO_PERMISSIONS_ERROR_MESSAGE
@@ -125,6 +224,7 @@ func (t *OPATransport) responseWithError(resp *http.Response, err error, statusC
 		StatusCode: statusCode,
 		Message:    message,
 		Error:      err.Error(),
+		RequestID:  GetRequestIDFromContext(t.request.Context()),
 	})
 	overwriteResponseWithStatusCode(resp, content, statusCode)
 }
@@ -134,9 +234,49 @@ func overwriteResponseWithStatusCode(originalResponse *http.Response, newBody []
 	originalResponse.StatusCode = statusCode
 }
 
+// overwriteResponse replaces the response body, which is always sent without content encoding.
 func overwriteResponse(originalResponse *http.Response, newBody []byte) {
 	body := io.NopCloser(bytes.NewReader(newBody))
 	originalResponse.Body = body
 	originalResponse.ContentLength = int64(len(newBody))
 	originalResponse.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
+	originalResponse.Header.Del(ContentEncodingHeaderKey)
+}
+
+// decodeResponseBody decompresses the body according to the provided content encoding,
+// supporting gzip and deflate. The maximum body size, if any, applies to the decompressed body.
+func decodeResponseBody(body []byte, contentEncoding string, maxBodySize int64) ([]byte, error) {
+	var decompressor io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		decompressor, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		decompressor, err = zlib.NewReader(bytes.NewReader(body))
+		// some servers send raw deflate data without the zlib wrapper
+		if errors.Is(err, zlib.ErrHeader) {
+			decompressor, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", contentEncoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed response body decompression: %s", err.Error())
+	}
+	defer decompressor.Close()
+
+	var bodyReader io.Reader = decompressor
+	if maxBodySize > 0 {
+		bodyReader = io.LimitReader(decompressor, maxBodySize+1)
+	}
+	decodedBody, err := io.ReadAll(bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed response body decompression: %s", err.Error())
+	}
+	if maxBodySize > 0 && int64(len(decodedBody)) > maxBodySize {
+		return nil, fmt.Errorf("response body exceeds the maximum size of %d bytes", maxBodySize)
+	}
+	return decodedBody, nil
 }
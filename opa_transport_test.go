@@ -16,6 +16,10 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -55,7 +59,6 @@ func TestRoundTripErrors(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "http://example.com/some-api", nil)
 		transport := &OPATransport{
 			http.DefaultTransport,
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -92,7 +95,6 @@ func TestOPATransportResponseWithError(t *testing.T) {
 
 	transport := &OPATransport{
 		http.DefaultTransport,
-		req.Context(),
 		logrus.NewEntry(logger),
 		req,
 		nil,
@@ -158,7 +160,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 	t.Run("returns error on RoundTrip error", func(t *testing.T) {
 		transport := &OPATransport{
 			&MockRoundTrip{Error: fmt.Errorf("some error")},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -179,7 +180,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -201,11 +201,10 @@ func TestOPATransportRoundTrip(t *testing.T) {
 				ReadError: fmt.Errorf("read error"),
 			},
 			ContentLength: 0,
-			Header:        http.Header{},
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -226,11 +225,10 @@ func TestOPATransportRoundTrip(t *testing.T) {
 				CloseError: fmt.Errorf("close error"),
 			},
 			ContentLength: 0,
-			Header:        http.Header{},
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -254,7 +252,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -267,29 +264,56 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		require.Equal(t, []string{"content"}, resp.Header[http.CanonicalHeaderKey("some")])
 	})
 
-	t.Run("failure on non-json response content-type", func(t *testing.T) {
+	t.Run("proxies untouched a non-json response", func(t *testing.T) {
+		csvBody := "id,name\n1,resource\n"
 		resp := &http.Response{
 			StatusCode:    http.StatusOK,
-			Body:          io.NopCloser(bytes.NewReader([]byte("original response"))),
+			Body:          io.NopCloser(bytes.NewReader([]byte(csvBody))),
+			ContentLength: int64(len(csvBody)),
+			Header:        http.Header{"Content-Type": []string{"text/csv"}},
+		}
+		transport := &OPATransport{
+			&MockRoundTrip{Response: resp},
+			logrus.NewEntry(logger),
+			req,
+			&RondConfig{ResponseFlow: ResponseFlow{PolicyName: "response_policy"}},
+			nil,
+			envs,
+		}
+
+		resp, err := transport.RoundTrip(req)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Equal(t, csvBody, string(bodyBytes))
+	})
+
+	t.Run("filters the configured content types only", func(t *testing.T) {
+		env := envs
+		env.ResponseContentTypes = "application/vnd.custom+json"
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Body:          io.NopCloser(bytes.NewReader([]byte(`{"some":"content"}`))),
 			ContentLength: 0,
-			Header:        http.Header{"Content-Type": []string{"text/plain"}},
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
 			nil,
-			envs,
+			env,
 		}
 
 		resp, err := transport.RoundTrip(req)
 		require.Nil(t, err)
-		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
 		bodyBytes, err := io.ReadAll(resp.Body)
 		require.Nil(t, err)
-		require.True(t, strings.Contains(string(bodyBytes), "content-type is not application/json"))
+		require.Equal(t, `{"some":"content"}`, string(bodyBytes))
 	})
 
 	t.Run("failure on non-json response even with json content-type", func(t *testing.T) {
@@ -301,7 +325,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -329,7 +352,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			ctx,
 			logrus.NewEntry(logger),
 			req,
 			nil,
@@ -357,7 +379,6 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		}
 		transport := &OPATransport{
 			&MockRoundTrip{Response: resp},
-			req.Context(),
 			logrus.NewEntry(logger),
 			req,
 			&RondConfig{
@@ -373,6 +394,246 @@ func TestOPATransportRoundTrip(t *testing.T) {
 		require.Nil(t, err)
 		require.True(t, strings.Contains(string(bodyBytes), "user properties header is not valid"))
 	})
+
+	opaModule := &OPAModuleConfig{
+		Name: "response.rego",
+		Content: `package policies
+allow_response {
+	true
+}
+strip_salary [body] {
+	body := [item | employee := input.response.body[_]; item := object.remove(employee, ["salary"])]
+}
+item_of_user_tenant {
+	input.response.body.tenant == input.user.properties.tenant
+}
+allow_ok_json_response {
+	input.response.statusCode == 200
+	input.response.headers["Content-Type"][0] == "application/json"
+}
+deny_response_flag [body] {
+	body := object.union(input.response.body, {"allow": false})
+}
+allow_flag_object = body {
+	body := {"allow": true, "secret": "value"}
+}`,
+	}
+	newResponseTransport := func(t *testing.T, policy string, env config.EnvironmentVariables, responseBody string) *OPATransport {
+		t.Helper()
+		partialEvaluator, err := NewPartialResultEvaluator(context.Background(), policy, opaModule, nil, env)
+		require.NoError(t, err)
+		return &OPATransport{
+			&MockRoundTrip{Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader([]byte(responseBody))),
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+			}},
+			logrus.NewEntry(logger),
+			req,
+			&RondConfig{ResponseFlow: ResponseFlow{PolicyName: policy}},
+			PartialResultsEvaluators{policy: {PartialEvaluator: partialEvaluator}},
+			env,
+		}
+	}
+
+	t.Run("keeps original body when response policy does not transform it", func(t *testing.T) {
+		transport := newResponseTransport(t, "allow_response", envs, `{"hey":"there"}`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hey":"there"}`, string(bodyBytes))
+	})
+
+	t.Run("replaces body with the one returned by response policy", func(t *testing.T) {
+		transport := newResponseTransport(t, "strip_salary", envs, `[{"name":"jane","salary":42},{"name":"john","salary":1}]`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `[{"name":"jane"},{"name":"john"}]`, string(bodyBytes))
+		require.Equal(t, int64(len(bodyBytes)), resp.ContentLength)
+	})
+
+	t.Run("exposes response status code and headers to the response policy", func(t *testing.T) {
+		transport := newResponseTransport(t, "allow_ok_json_response", envs, `{"hey":"there"}`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hey":"there"}`, string(bodyBytes))
+	})
+
+	t.Run("proxies a body returned by response policy with an allow field", func(t *testing.T) {
+		transport := newResponseTransport(t, "deny_response_flag", envs, `{"name":"jane"}`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"name":"jane","allow":false}`, string(bodyBytes))
+	})
+
+	t.Run("does not interpret an object result of response policy as a structured decision", func(t *testing.T) {
+		transport := newResponseTransport(t, "allow_flag_object", envs, `{"name":"jane"}`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NotContains(t, string(bodyBytes), "secret")
+	})
+
+	t.Run("bypasses filtering of non-2xx response", func(t *testing.T) {
+		transport := newResponseTransport(t, "strip_salary", envs, "")
+		responseBody := `{"name":"jane","salary":42}`
+		transport.RoundTripper = &MockRoundTrip{Response: &http.Response{
+			StatusCode: http.StatusForbidden,
+			Body:       io.NopCloser(bytes.NewReader([]byte(responseBody))),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+		}}
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, responseBody, string(bodyBytes))
+	})
+
+	t.Run("filters the items of the response list", func(t *testing.T) {
+		itemsReq := httptest.NewRequest(http.MethodGet, "http://example.com/some-api", nil)
+		itemsReq.Header.Set("userpropertiesheader", `{"tenant":"acme"}`)
+		items := `[{"id":1,"tenant":"acme"},{"id":2,"tenant":"other"},{"id":3}]`
+
+		t.Run("top-level array", func(t *testing.T) {
+			transport := newResponseTransport(t, "item_of_user_tenant", envs, items)
+			transport.request = itemsReq
+			transport.permission.ResponseFlow.FilterItems = true
+			resp, err := transport.RoundTrip(itemsReq)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			bodyBytes, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `[{"id":1,"tenant":"acme"}]`, string(bodyBytes))
+		})
+
+		t.Run("data array keeping pagination fields", func(t *testing.T) {
+			transport := newResponseTransport(t, "item_of_user_tenant", envs, `{"data":`+items+`,"page":1,"total":3}`)
+			transport.request = itemsReq
+			transport.permission.ResponseFlow.FilterItems = true
+			resp, err := transport.RoundTrip(itemsReq)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			bodyBytes, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"data":[{"id":1,"tenant":"acme"}],"page":1,"total":3}`, string(bodyBytes))
+		})
+	})
+
+	t.Run("failure on response body exceeding maximum size", func(t *testing.T) {
+		envsWithMaxBodySize := envs
+		envsWithMaxBodySize.ResponseMaxBodySize = 10
+		transport := newResponseTransport(t, "allow_response", envsWithMaxBodySize, `{"hey":"there, this body is too large"}`)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "response body exceeds the maximum size of 10 bytes")
+	})
+
+	newEncodedResponseTransport := func(t *testing.T, policy string, env config.EnvironmentVariables, contentEncoding string, responseBody []byte) *OPATransport {
+		t.Helper()
+		transport := newResponseTransport(t, policy, env, "")
+		response := transport.RoundTripper.(*MockRoundTrip).Response
+		response.Body = io.NopCloser(bytes.NewReader(responseBody))
+		response.Header.Set(ContentEncodingHeaderKey, contentEncoding)
+		return transport
+	}
+
+	t.Run("filters gzip encoded response body", func(t *testing.T) {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write([]byte(`[{"name":"jane","salary":42},{"name":"john","salary":1}]`))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		transport := newEncodedResponseTransport(t, "strip_salary", envs, "gzip", compressed.Bytes())
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get(ContentEncodingHeaderKey), "filtered body must be sent without encoding")
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `[{"name":"jane"},{"name":"john"}]`, string(bodyBytes))
+		require.Equal(t, int64(len(bodyBytes)), resp.ContentLength)
+	})
+
+	t.Run("decodes deflate encoded response body", func(t *testing.T) {
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		_, err := writer.Write([]byte(`{"hey":"there"}`))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		transport := newEncodedResponseTransport(t, "allow_response", envs, "deflate", compressed.Bytes())
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Empty(t, resp.Header.Get(ContentEncodingHeaderKey))
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hey":"there"}`, string(bodyBytes))
+	})
+
+	t.Run("decodes raw deflate encoded response body", func(t *testing.T) {
+		var compressed bytes.Buffer
+		writer, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte(`{"hey":"there"}`))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		transport := newEncodedResponseTransport(t, "allow_response", envs, "deflate", compressed.Bytes())
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, `{"hey":"there"}`, string(bodyBytes))
+	})
+
+	t.Run("failure on unsupported response content encoding", func(t *testing.T) {
+		transport := newEncodedResponseTransport(t, "allow_response", envs, "br", []byte("compressed"))
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Empty(t, resp.Header.Get(ContentEncodingHeaderKey))
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "unsupported content encoding br")
+	})
+
+	t.Run("failure on decompressed response body exceeding maximum size", func(t *testing.T) {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := writer.Write([]byte(`{"hey":"` + strings.Repeat("a", 1000) + `"}`))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		envsWithMaxBodySize := envs
+		envsWithMaxBodySize.ResponseMaxBodySize = 100
+		transport := newEncodedResponseTransport(t, "allow_response", envsWithMaxBodySize, "gzip", compressed.Bytes())
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		bodyBytes, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(bodyBytes), "response body exceeds the maximum size of 100 bytes")
+	})
 }
 
 type MockRoundTrip struct {
@@ -18,26 +18,36 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/rond-authz/rond/internal/authtoken"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/identity"
+	"github.com/rond-authz/rond/internal/metrics"
 	"github.com/rond-authz/rond/internal/opatranslator"
+	"github.com/rond-authz/rond/internal/tracing"
+	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
 
 	"github.com/rond-authz/rond/custom_builtins"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
 	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/profiler"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/topdown/print"
 	"github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Evaluator interface {
@@ -47,17 +57,114 @@ type Evaluator interface {
 
 var unknowns = []string{"data.resources"}
 
+// setHeadersResultKey is the field of an object policy result holding the headers
+// to be set on the request proxied to the target service.
+const setHeadersResultKey = "setHeaders"
+
+// allowResultKey and reasonResultKey are the fields of a structured policy decision,
+// e.g. {"allow": false, "reason": "tenant_mismatch"}.
+const (
+	allowResultKey  = "allow"
+	reasonResultKey = "reason"
+)
+
+// ErrPolicyEvaluationTimeout is returned when a single policy evaluation exceeds
+// the configured evaluation timeout.
+var ErrPolicyEvaluationTimeout = errors.New("policy evaluation timed out")
+
+// ErrPolicyNotFound is returned when no evaluator has been set up for the requested policy,
+// which denotes a configuration error.
+var ErrPolicyNotFound = errors.New("policy evaluator not found")
+
+// ErrRequestBodyTooLarge is returned when the request body exceeds the configured maximum size.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+var ErrInvalidRequestBody = errors.New("invalid request body")
+
+// PolicyDenyError is returned when the policy does not allow the request, holding the reason
+// of the decision when returned by the policy.
+type PolicyDenyError struct {
+	Reason string
+}
+
+func (e *PolicyDenyError) Error() string {
+	if e.Reason == "" {
+		return "RBAC policy evaluation failed, user is not allowed"
+	}
+	return fmt.Sprintf("RBAC policy evaluation failed, user is not allowed: %s", e.Reason)
+}
+
 type OPAEvaluator struct {
 	PolicyEvaluator Evaluator
 	PolicyName      string
 	Context         context.Context
+	// EvaluationTimeout bounds the duration of a single evaluation, when positive.
+	EvaluationTimeout time.Duration
+	// QueryMaxClauses bounds the clauses of the query generated by partial evaluation, when positive.
+	QueryMaxClauses int
+	// PolicyUndefined reports the policy rule is missing from the rego module.
+	PolicyUndefined bool
 }
 type PartialResultsEvaluatorConfigKey struct{}
 
+type evaluationClockKey struct{}
+
+// WithEvaluationClock returns a context making the evaluators built with it read the current time
+// from the provided clock, allowing to evaluate time-based policies at a fixed time.
+func WithEvaluationClock(ctx context.Context, clock func() time.Time) context.Context {
+	return context.WithValue(ctx, evaluationClockKey{}, clock)
+}
+
+// evaluationTime returns the time policies are evaluated at, defaulting to the current time.
+func evaluationTime(ctx context.Context) time.Time {
+	if clock, ok := ctx.Value(evaluationClockKey{}).(func() time.Time); ok {
+		return clock()
+	}
+	return time.Now()
+}
+
+type evaluationSeedKey struct{}
+
+// WithEvaluationSeed returns a context making the evaluators built with it generate the random
+// values of the builtins, such as rand.intn, from the seed, so that they are repeatable.
+func WithEvaluationSeed(ctx context.Context, seed int64) context.Context {
+	return context.WithValue(ctx, evaluationSeedKey{}, seed)
+}
+
+// WithDeterministicEvaluation returns a context making the evaluators built with it evaluate the
+// policies at the provided time and with random values generated from the seed, meant for tests
+// of time-based or randomized policies.
+func WithDeterministicEvaluation(ctx context.Context, at time.Time, seed int64) context.Context {
+	return WithEvaluationSeed(WithEvaluationClock(ctx, func() time.Time { return at }), seed)
+}
+
+type evaluationProfilerKey struct{}
+
+// WithEvaluationProfiler returns a context making the evaluators built with it trace the
+// evaluation with the provided profiler.
+func WithEvaluationProfiler(ctx context.Context, evaluationProfiler *profiler.Profiler) context.Context {
+	return context.WithValue(ctx, evaluationProfilerKey{}, evaluationProfiler)
+}
+
+// evaluationOptions returns the rego options setting the time, if any, the random seed
+// policies are evaluated with and, if any, the profiler tracing the evaluation.
+func evaluationOptions(ctx context.Context) []func(*rego.Rego) {
+	options := []func(*rego.Rego){rego.Time(evaluationTime(ctx))}
+	if seed, ok := ctx.Value(evaluationSeedKey{}).(int64); ok {
+		//#nosec G404 -- seeded randomness is an explicit opt-in meant for repeatable evaluations
+		options = append(options, rego.Seed(rand.New(rand.NewSource(seed))))
+	}
+	if evaluationProfiler, ok := ctx.Value(evaluationProfilerKey{}).(*profiler.Profiler); ok {
+		options = append(options, rego.QueryTracer(evaluationProfiler))
+	}
+	return options
+}
+
 type PartialResultsEvaluators map[string]PartialEvaluator
 
 type PartialEvaluator struct {
 	PartialEvaluator *rego.PartialResult
+	PolicyUndefined  bool
 }
 
 func createPartialEvaluator(policy string, ctx context.Context, mongoClient types.IMongoClient, oas *OpenAPISpec, opaModuleConfig *OPAModuleConfig, env config.EnvironmentVariables) (*PartialEvaluator, error) {
@@ -69,6 +176,7 @@ func createPartialEvaluator(policy string, ctx context.Context, mongoClient type
 		glogger.Get(ctx).Infof("computed rego query for policy: %s in %s", policy, time.Since(policyEvaluatorTime))
 		return &PartialEvaluator{
 			PartialEvaluator: partialResultEvaluator,
+			PolicyUndefined:  !opaModuleConfig.definesPolicy(policy),
 		}, nil
 	}
 	return nil, err
@@ -82,23 +190,30 @@ func setupEvaluators(ctx context.Context, mongoClient types.IMongoClient, oas *O
 				continue
 			}
 
-			allowPolicy := verbConfig.PermissionV2.RequestFlow.PolicyName
+			requestFlow := verbConfig.PermissionV2.RequestFlow
+			allowPolicies := requestFlow.allowPolicies()
 			responsePolicy := verbConfig.PermissionV2.ResponseFlow.PolicyName
 
-			glogger.Get(ctx).Infof("precomputing rego queries for API: %s %s. Allow policy: %s. Response policy: %s.", verb, path, allowPolicy, responsePolicy)
-			if allowPolicy == "" {
+			glogger.Get(ctx).Infof("precomputing rego queries for API: %s %s. Allow policy: %s. Response policy: %s.", verb, path, strings.Join(allowPolicies, ","), responsePolicy)
+			if len(allowPolicies) == 0 {
 				// allow policy is required, if missing assume the API has no valid x-rond configuration.
 				continue
 			}
 
-			if _, ok := policyEvaluators[allowPolicy]; !ok {
-				evaluator, err := createPartialEvaluator(allowPolicy, ctx, mongoClient, oas, opaModuleConfig, env)
+			if err := validateRequestFlow(requestFlow); err != nil {
+				return nil, fmt.Errorf("invalid request flow for API %s %s: %s", verb, path, err.Error())
+			}
+
+			for _, allowPolicy := range allowPolicies {
+				if _, ok := policyEvaluators[allowPolicy]; !ok {
+					evaluator, err := createPartialEvaluator(allowPolicy, ctx, mongoClient, oas, opaModuleConfig, env)
 
-				if err != nil {
-					return nil, fmt.Errorf("error during evaluator creation: %s", err.Error())
-				}
+					if err != nil {
+						return nil, fmt.Errorf("error during evaluator creation: %s", err.Error())
+					}
 
-				policyEvaluators[allowPolicy] = *evaluator
+					policyEvaluators[allowPolicy] = *evaluator
+				}
 			}
 
 			if responsePolicy != "" {
@@ -114,9 +229,94 @@ func setupEvaluators(ctx context.Context, mongoClient types.IMongoClient, oas *O
 			}
 		}
 	}
+
+	if env.DefaultPolicyName != "" {
+		if _, ok := policyEvaluators[env.DefaultPolicyName]; !ok {
+			evaluator, err := createPartialEvaluator(env.DefaultPolicyName, ctx, mongoClient, oas, opaModuleConfig, env)
+			if err != nil {
+				return nil, fmt.Errorf("error during evaluator creation: %s", err.Error())
+			}
+			policyEvaluators[env.DefaultPolicyName] = *evaluator
+		}
+	}
 	return policyEvaluators, nil
 }
 
+// validateRequestFlow checks the combinator of the allow policies, which cannot
+// be combined with query generation, the target of the generated query and the
+// decision cache TTL.
+func validateRequestFlow(requestFlow RequestFlow) error {
+	switch requestFlow.Combinator {
+	case "", PoliciesCombinatorAll, PoliciesCombinatorAny:
+	default:
+		return fmt.Errorf("unknown policies combinator %s", requestFlow.Combinator)
+	}
+	switch requestFlow.QueryOptions.Target {
+	case "", RowFilterTargetHeader, RowFilterTargetQuery:
+	default:
+		return fmt.Errorf("unknown row filter target %s", requestFlow.QueryOptions.Target)
+	}
+	if requestFlow.GenerateQuery && len(requestFlow.allowPolicies()) > 1 {
+		return fmt.Errorf("query generation is not supported with multiple policies")
+	}
+	ttl, err := requestFlow.cacheTTL()
+	if err != nil {
+		return err
+	}
+	if ttl > 0 && requestFlow.GenerateQuery {
+		return fmt.Errorf("decision caching is not supported with query generation")
+	}
+	return nil
+}
+
+// ErrMissingPolicies is returned by validatePolicies when the OAS references policies not defined in the rego modules.
+var ErrMissingPolicies = errors.New("missing policies")
+
+// validatePolicies checks that every policy referenced by the OAS is defined as a rule
+// of the policies package, returning an error listing all the missing ones.
+func validatePolicies(oas *OpenAPISpec, opaModuleConfig *OPAModuleConfig) error {
+	definedPolicies, err := opaModuleConfig.policyNames()
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(oas.Paths))
+	for path := range oas.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	missingPolicies := []string{}
+	for _, path := range paths {
+		verbs := make([]string, 0, len(oas.Paths[path]))
+		for verb := range oas.Paths[path] {
+			verbs = append(verbs, verb)
+		}
+		sort.Strings(verbs)
+
+		for _, verb := range verbs {
+			permission := oas.Paths[path][verb].PermissionV2
+			if permission == nil {
+				continue
+			}
+			policies := append([]string{}, permission.RequestFlow.allowPolicies()...)
+			for _, policy := range append(policies, permission.ResponseFlow.PolicyName) {
+				if policy == "" {
+					continue
+				}
+				if _, ok := definedPolicies[strings.Replace(policy, ".", "_", -1)]; !ok {
+					missingPolicies = append(missingPolicies, fmt.Sprintf("%s (%s %s)", policy, strings.ToUpper(verb), path))
+				}
+			}
+		}
+	}
+
+	if len(missingPolicies) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingPolicies, strings.Join(missingPolicies, ", "))
+	}
+	return nil
+}
+
 func NewPrintHook(w io.Writer, policy string) print.Hook {
 	return printHook{
 		w:          w,
@@ -151,7 +351,10 @@ func (h printHook) Print(_ print.Context, message string) error {
 	return err
 }
 
-func NewOPAEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, input []byte, env config.EnvironmentVariables) (*OPAEvaluator, error) {
+func NewOPAEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAModuleConfig, input []byte, env config.EnvironmentVariables) (evaluator *OPAEvaluator, err error) {
+	_, span := tracing.StartSpan(ctx, "NewOPAEvaluator", tracing.PolicyNameAttributeKey.String(policy))
+	defer func() { tracing.EndSpan(span, err) }()
+
 	inputTerm, err := ast.ParseTerm(string(input))
 	if err != nil {
 		return nil, fmt.Errorf("failed input parse: %v", err)
@@ -159,23 +362,39 @@ func NewOPAEvaluator(ctx context.Context, policy string, opaModuleConfig *OPAMod
 
 	sanitizedPolicy := strings.Replace(policy, ".", "_", -1)
 	queryString := fmt.Sprintf("data.policies.%s", sanitizedPolicy)
-	query := rego.New(
+	options := []func(*rego.Rego){
 		rego.Query(queryString),
-		rego.Module(opaModuleConfig.Name, opaModuleConfig.Content),
 		rego.ParsedInput(inputTerm.Value),
 		rego.Unknowns(unknowns),
 		rego.Capabilities(ast.CapabilitiesForThisVersion()),
 		rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
 		rego.PrintHook(NewPrintHook(os.Stdout, policy)),
 		custom_builtins.GetHeaderFunction,
+		custom_builtins.GetHeaderAllFunction,
+		custom_builtins.GetQueryFunction,
+		custom_builtins.ParseTimeFunction,
+		custom_builtins.GroupDescendsFromFunction(env.GroupLevelsDelimiter),
+		custom_builtins.SafeRegexMatchFunction,
+		custom_builtins.IPInCIDRFunction,
+		custom_builtins.InAllowedSetFunction(opaModuleConfig.Data),
 		custom_builtins.MongoFindOne,
+		custom_builtins.MongoFindOneWithProjection,
 		custom_builtins.MongoFindMany,
-	)
+		custom_builtins.MongoFindManyWithProjection,
+		custom_builtins.MongoFindManyPaginated,
+		custom_builtins.MongoCount,
+	}
+	options = append(options, evaluationOptions(ctx)...)
+	options = append(options, opaModuleConfig.regoModules()...)
+	query := rego.New(options...)
 
 	return &OPAEvaluator{
-		PolicyEvaluator: query,
-		PolicyName:      policy,
-		Context:         ctx,
+		PolicyEvaluator:   query,
+		PolicyName:        policy,
+		Context:           ctx,
+		EvaluationTimeout: env.PolicyEvalTimeout,
+		QueryMaxClauses:   env.QueryMaxClauses,
+		PolicyUndefined:   !opaModuleConfig.definesPolicy(policy),
 	}, nil
 }
 
@@ -206,15 +425,30 @@ func NewPartialResultEvaluator(ctx context.Context, policy string, opaModuleConf
 
 	options := []func(*rego.Rego){
 		rego.Query(queryString),
-		rego.Module(opaModuleConfig.Name, opaModuleConfig.Content),
 		rego.Unknowns(unknowns),
 		rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
 		rego.PrintHook(NewPrintHook(os.Stdout, policy)),
 		rego.Capabilities(ast.CapabilitiesForThisVersion()),
 		custom_builtins.GetHeaderFunction,
+		custom_builtins.GetHeaderAllFunction,
+		custom_builtins.GetQueryFunction,
+		custom_builtins.ParseTimeFunction,
+		custom_builtins.GroupDescendsFromFunction(env.GroupLevelsDelimiter),
+		custom_builtins.SafeRegexMatchFunction,
+		custom_builtins.IPInCIDRFunction,
+		custom_builtins.InAllowedSetFunction(opaModuleConfig.Data),
 	}
+	options = append(options, opaModuleConfig.regoModules()...)
 	if mongoClient != nil {
-		options = append(options, custom_builtins.MongoFindOne, custom_builtins.MongoFindMany)
+		options = append(
+			options,
+			custom_builtins.MongoFindOne,
+			custom_builtins.MongoFindOneWithProjection,
+			custom_builtins.MongoFindMany,
+			custom_builtins.MongoFindManyWithProjection,
+			custom_builtins.MongoFindManyPaginated,
+			custom_builtins.MongoCount,
+		)
 	}
 	regoInstance := rego.New(options...)
 
@@ -229,32 +463,66 @@ func (partialEvaluators PartialResultsEvaluators) GetEvaluatorFromPolicy(ctx con
 			return nil, fmt.Errorf("failed input parse: %v", err)
 		}
 
-		evaluator := eval.PartialEvaluator.Rego(
+		options := []func(*rego.Rego){
 			rego.ParsedInput(inputTerm.Value),
 			rego.EnablePrintStatements(env.LogLevel == config.TraceLogLevel),
 			rego.PrintHook(NewPrintHook(os.Stdout, policy)),
-		)
+		}
+		evaluator := eval.PartialEvaluator.Rego(append(options, evaluationOptions(ctx)...)...)
 
 		return &OPAEvaluator{
-			PolicyName:      policy,
-			PolicyEvaluator: evaluator,
-			Context:         ctx,
+			PolicyName:        policy,
+			PolicyEvaluator:   evaluator,
+			Context:           ctx,
+			EvaluationTimeout: env.PolicyEvalTimeout,
+			QueryMaxClauses:   env.QueryMaxClauses,
+			PolicyUndefined:   eval.PolicyUndefined,
 		}, nil
 	}
-	return nil, fmt.Errorf("policy evaluator not found")
+	return nil, fmt.Errorf("%w: %s", ErrPolicyNotFound, policy)
+}
+
+// evaluationContext derives from ctx the context of a single evaluation, bounded by
+// the evaluation timeout when configured.
+func (evaluator *OPAEvaluator) evaluationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if evaluator.EvaluationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, evaluator.EvaluationTimeout)
+}
+
+// interruptedEvaluationError tells apart an evaluation stopped by its own timeout from
+// one interrupted by the request context.
+func (evaluator *OPAEvaluator) interruptedEvaluationError(logger *logrus.Entry, ctx, evaluationCtx context.Context) error {
+	if ctx.Err() == nil && errors.Is(evaluationCtx.Err(), context.DeadlineExceeded) {
+		logger.WithFields(logrus.Fields{
+			"policyName": evaluator.PolicyName,
+			"timeout":    evaluator.EvaluationTimeout.String(),
+		}).Error("policy evaluation timed out")
+		return fmt.Errorf("%w: policy %s exceeded %s", ErrPolicyEvaluationTimeout, evaluator.PolicyName, evaluator.EvaluationTimeout)
+	}
+	return fmt.Errorf("policy Evaluation has been interrupted: %w", evaluationCtx.Err())
 }
 
-func (evaluator *OPAEvaluator) partiallyEvaluate(logger *logrus.Entry) (primitive.M, error) {
+func (evaluator *OPAEvaluator) partiallyEvaluate(logger *logrus.Entry, queryOptions QueryOptions) (query interface{}, err error) {
+	ctx, span := tracing.StartSpan(evaluator.Context, "partiallyEvaluate", tracing.PolicyNameAttributeKey.String(evaluator.PolicyName))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	evaluationCtx, cancel := evaluator.evaluationContext(ctx)
+	defer cancel()
+
 	opaEvaluationTime := time.Now()
-	partialResults, err := evaluator.PolicyEvaluator.Partial(evaluator.Context)
+	partialResults, err := evaluator.PolicyEvaluator.Partial(evaluationCtx)
+	if evaluationCtx.Err() != nil {
+		return nil, evaluator.interruptedEvaluationError(logger, ctx, evaluationCtx)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("policy Evaluation has failed when partially evaluating the query: %s", err.Error())
 	}
 	logger.Tracef("OPA partial evaluation in: %+v", time.Since(opaEvaluationTime))
 
-	client := opatranslator.OPAClient{}
-	q, err := client.ProcessQuery(partialResults)
-	if err != nil {
+	q, err := translatePartialQueries(partialResults, queryOptions.Dialect, evaluator.QueryMaxClauses)
+	if err != nil || q == nil {
 		return nil, err
 	}
 
@@ -266,9 +534,53 @@ func (evaluator *OPAEvaluator) partiallyEvaluate(logger *logrus.Entry) (primitiv
 	return q, nil
 }
 
+// translatePartialQueries converts the partial queries to the query dialect configured
+// for the route, returning an untyped nil when no query has to be forwarded.
+func translatePartialQueries(partialResults *rego.PartialQueries, dialect string, maxClauses int) (interface{}, error) {
+	client := opatranslator.OPAClient{MaxClauses: maxClauses}
+	switch dialect {
+	case "", opatranslator.MongoQueryDialect:
+		query, err := client.ProcessQuery(partialResults)
+		if err != nil || query == nil {
+			return nil, err
+		}
+		return query, nil
+	case opatranslator.SQLQueryDialect:
+		query, err := client.ProcessQueryToSQL(partialResults)
+		if err != nil || query == nil {
+			return nil, err
+		}
+		return query, nil
+	default:
+		return nil, fmt.Errorf("unsupported query dialect: %s", dialect)
+	}
+}
+
+// evaluate evaluates the policy, returning the first item of a set or array result.
 func (evaluator *OPAEvaluator) evaluate(logger *logrus.Entry) (interface{}, error) {
+	return evaluator.evaluateResult(logger, false)
+}
+
+// evaluateRequestPolicy evaluates a request flow policy, which may also return
+// a structured decision or the headers to set on the proxied request.
+func (evaluator *OPAEvaluator) evaluateRequestPolicy(logger *logrus.Entry) (interface{}, error) {
+	return evaluator.evaluateResult(logger, true)
+}
+
+func (evaluator *OPAEvaluator) evaluateResult(logger *logrus.Entry, structuredDecision bool) (result interface{}, err error) {
+	ctx, span := tracing.StartSpan(evaluator.Context, "Evaluate", tracing.PolicyNameAttributeKey.String(evaluator.PolicyName))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	evaluationCtx, cancel := evaluator.evaluationContext(ctx)
+	defer cancel()
+
 	opaEvaluationTime := time.Now()
-	results, err := evaluator.PolicyEvaluator.Eval(evaluator.Context)
+	results, err := evaluator.PolicyEvaluator.Eval(evaluationCtx)
+	// builtin failures caused by a cancelled context do not make the evaluation fail,
+	// so the context is checked explicitly to avoid trusting a partial result.
+	if evaluationCtx.Err() != nil {
+		return nil, evaluator.interruptedEvaluationError(logger, ctx, evaluationCtx)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("policy Evaluation has failed when evaluating the query: %s", err.Error())
 	}
@@ -276,6 +588,18 @@ func (evaluator *OPAEvaluator) evaluate(logger *logrus.Entry) (interface{}, erro
 		"policyName": evaluator.PolicyName,
 	}).Tracef("OPA evaluation in: %+v", time.Since(opaEvaluationTime))
 
+	// an undefined result caused by a policy missing from the rego module,
+	// unlike a policy without a default value, is reported apart while still denying.
+	if len(results) == 0 && evaluator.PolicyUndefined {
+		logger.WithFields(logrus.Fields{
+			"policyName": evaluator.PolicyName,
+		}).Warn("policy result is undefined, check the policy is defined in the rego module")
+		if m := metrics.GetMetricsFromContext(ctx); m != nil {
+			m.ObservePolicyUndefined(evaluator.PolicyName)
+		}
+		return nil, &PolicyDenyError{}
+	}
+
 	if results.Allowed() {
 		logger.WithFields(logrus.Fields{
 			"policyName":    evaluator.PolicyName,
@@ -295,79 +619,203 @@ func (evaluator *OPAEvaluator) evaluate(logger *logrus.Entry) (interface{}, erro
 			if value, ok := exprs[0].Value.([]interface{}); ok && value != nil && len(value) != 0 {
 				return value[0], nil
 			}
+			if value, ok := exprs[0].Value.(map[string]interface{}); ok && structuredDecision {
+				// a structured decision allows or denies the request with a reason
+				if allowed, ok := value[allowResultKey].(bool); ok {
+					if allowed {
+						return value, nil
+					}
+					reason, _ := value[reasonResultKey].(string)
+					logger.WithFields(logrus.Fields{
+						"policyName": evaluator.PolicyName,
+						"reason":     reason,
+					}).Error("policy resulted in not allowed")
+					return nil, &PolicyDenyError{Reason: reason}
+				}
+				// an object result holding the headers to set is an allow decision
+				if _, ok := value[setHeadersResultKey]; ok {
+					return value, nil
+				}
+			}
 		}
 	}
 	logger.WithFields(logrus.Fields{
 		"policyName": evaluator.PolicyName,
 	}).Error("policy resulted in not allowed")
-	return nil, fmt.Errorf("RBAC policy evaluation failed, user is not allowed")
+	return nil, &PolicyDenyError{}
 }
 
-func (evaluator *OPAEvaluator) PolicyEvaluation(logger *logrus.Entry, permission *RondConfig) (interface{}, primitive.M, error) {
+func (evaluator *OPAEvaluator) PolicyEvaluation(logger *logrus.Entry, permission *RondConfig) (interface{}, interface{}, error) {
 	if permission.RequestFlow.GenerateQuery {
-		query, err := evaluator.partiallyEvaluate(logger)
+		query, err := evaluator.partiallyEvaluate(logger, permission.RequestFlow.QueryOptions)
 		return nil, query, err
 	}
-	dataFromEvaluation, err := evaluator.evaluate(logger)
+	dataFromEvaluation, err := evaluator.evaluateRequestPolicy(logger)
 	if err != nil {
 		return nil, nil, err
 	}
 	return dataFromEvaluation, nil, nil
 }
 
-func createRegoQueryInput(req *http.Request, env config.EnvironmentVariables, enableResourcePermissionsMapOptimization bool, user types.User, responseBody interface{}) ([]byte, error) {
+// requestClientIP returns the IP address of the client, which is the first X-Forwarded-For
+// entry when the inbound forwarded headers are trusted, otherwise the request remote address.
+func requestClientIP(req *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if forwardedFor := utils.SplitHeaderValues(req.Header.Get(XForwardedForHeaderKey), ","); len(forwardedFor) > 0 {
+			return forwardedFor[0]
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// requestCookies returns the request cookies by name, keeping the first value of repeated cookies.
+func requestCookies(req *http.Request) map[string]string {
+	cookies := req.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	cookiesMap := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		if _, ok := cookiesMap[cookie.Name]; !ok {
+			cookiesMap[cookie.Name] = cookie.Value
+		}
+	}
+	return cookiesMap
+}
+
+// requestPathTemplate returns the OAS path template of the route matched by the request, without the
+// standalone path prefix and the path parameters constraints; the requests matched by no route, or by
+// the fallback one, get their concrete path.
+func requestPathTemplate(req *http.Request, env config.EnvironmentVariables) string {
+	route := mux.CurrentRoute(req)
+	if route == nil || route.GetName() == fallbackRouteName {
+		return req.URL.Path
+	}
+	pathTemplate, err := route.GetPathTemplate()
+	if err != nil {
+		return req.URL.Path
+	}
+	if env.Standalone {
+		pathTemplate = strings.TrimPrefix(pathTemplate, env.PathPrefixStandalone)
+	}
+	return removePathParamsConstraints(pathTemplate)
+}
+
+// readRequestBody reads the whole request body, failing with ErrRequestBodyTooLarge
+// when it exceeds maxBodySize; a non positive maxBodySize disables the limit.
+func readRequestBody(req *http.Request, maxBodySize int64) ([]byte, error) {
+	var bodyReader io.Reader = req.Body
+	if maxBodySize > 0 {
+		if req.ContentLength > maxBodySize {
+			return nil, fmt.Errorf("%w: exceeds the maximum size of %d bytes", ErrRequestBodyTooLarge, maxBodySize)
+		}
+		bodyReader = io.LimitReader(req.Body, maxBodySize+1)
+	}
+	bodyBytes, err := io.ReadAll(bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed request body parse: %s", err.Error())
+	}
+	if maxBodySize > 0 && int64(len(bodyBytes)) > maxBodySize {
+		return nil, fmt.Errorf("%w: exceeds the maximum size of %d bytes", ErrRequestBodyTooLarge, maxBodySize)
+	}
+	return bodyBytes, nil
+}
+
+// validateRequestBody validates the JSON request body against the schema, restoring
+// the body so that it can be read again.
+func validateRequestBody(req *http.Request, maxBodySize int64, schema *openapi3.Schema) error {
+	bodyBytes, err := readRequestBody(req, maxBodySize)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+	var body interface{}
+	if len(bodyBytes) > 0 {
+		if err := json.Unmarshal(bodyBytes, &body); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidRequestBody, err.Error())
+		}
+	}
+	if err := schema.VisitJSON(body, openapi3.MultiErrors()); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRequestBody, err.Error())
+	}
+	return nil
+}
+
+func createRegoQueryInput(req *http.Request, env config.EnvironmentVariables, options PermissionOptions, user types.User, response *InputResponse) ([]byte, error) {
 	requestContext := req.Context()
 	logger := glogger.Get(requestContext)
 	opaInputCreationTime := time.Now()
-	userProperties := make(map[string]interface{})
-	_, err := unmarshalHeader(req.Header, env.UserPropertiesHeader, &userProperties)
+	userIdentity, err := identity.GetExtractorFromContext(requestContext, env).Extract(req)
 	if err != nil {
-		return nil, fmt.Errorf("user properties header is not valid: %s", err.Error())
+		return nil, err
 	}
 
-	userGroup := make([]string, 0)
-	userGroupsNotSplitted := req.Header.Get(env.UserGroupsHeader)
-	if userGroupsNotSplitted != "" {
-		userGroup = strings.Split(userGroupsNotSplitted, ",")
+	var tokenClaims map[string]interface{}
+	if token, ok := authtoken.BearerTokenFromHeader(req.Header); ok {
+		if verifier := authtoken.GetVerifierFromContext(requestContext); verifier != nil {
+			if tokenClaims, err = verifier.Verify(requestContext, token); err != nil {
+				return nil, err
+			}
+		} else if env.ParseBearerToken {
+			if tokenClaims, err = authtoken.ParseUnverifiedClaims(token); err != nil {
+				logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("ignoring malformed bearer token")
+			}
+		}
 	}
 
 	var permissionsMap PermissionsOnResourceMap
-	if enableResourcePermissionsMapOptimization {
+	if options.EnableResourcePermissionsMapOptimization {
 		logger.Info("preparing optimized resourcePermissionMap for OPA evaluator")
 		opaPermissionsMapTime := time.Now()
 		permissionsMap = buildOptimizedResourcePermissionsMap(user)
 		logger.WithField("resourcePermissionMapCreationTime", fmt.Sprintf("%+v", time.Since(opaPermissionsMapTime))).Tracef("resource permission map creation")
 	}
 
+	var resourcePermissions ResourcePermissions
+	if options.ResourcePermission != "" {
+		resourcePermissions = buildResourcePermissions(user, options.ResourcePermission)
+	}
+
 	input := Input{
 		ClientType: req.Header.Get(env.ClientTypeHeader),
 		Request: InputRequest{
-			Method:     req.Method,
-			Path:       req.URL.Path,
-			Headers:    req.Header,
-			Query:      req.URL.Query(),
-			PathParams: mux.Vars(req),
-		},
-		Response: InputResponse{
-			Body: responseBody,
+			Method:       req.Method,
+			Path:         req.URL.Path,
+			PathTemplate: requestPathTemplate(req, env),
+			Headers:      req.Header,
+			Query:        req.URL.Query(),
+			PathParams:   mux.Vars(req),
+			Cookies:      requestCookies(req),
+			ClientIP:     requestClientIP(req, env.TrustInboundForwarded),
 		},
 		User: InputUser{
 			Bindings:               user.UserBindings,
 			Roles:                  user.UserRoles,
-			Properties:             userProperties,
-			Groups:                 userGroup,
+			Properties:             userIdentity.Properties,
+			Groups:                 userIdentity.Groups,
 			ResourcePermissionsMap: permissionsMap,
+			ResourcePermissions:    resourcePermissions,
+			Token:                  tokenClaims,
 		},
 	}
 
+	if response != nil {
+		input.Response = *response
+	}
+
 	shouldParseJSONBody := hasApplicationJSONContentType(req.Header) &&
 		req.ContentLength > 0 &&
-		(req.Method == http.MethodPatch || req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodDelete)
+		hasParsableBodyMethod(req.Method, env.AllowGetBody)
 
 	if shouldParseJSONBody {
-		bodyBytes, err := io.ReadAll(req.Body)
+		bodyBytes, err := readRequestBody(req, env.RequestMaxBodySize)
 		if err != nil {
-			return nil, fmt.Errorf("failed request body parse: %s", err.Error())
+			return nil, err
 		}
 		if err := json.Unmarshal(bodyBytes, &input.Request.Body); err != nil {
 			return nil, fmt.Errorf("failed request body deserialization: %s", err.Error())
@@ -382,6 +830,18 @@ func createRegoQueryInput(req *http.Request, env config.EnvironmentVariables, en
 	return inputBytes, nil
 }
 
+// hasParsableBodyMethod returns whether the body of requests with the given method is added to the input,
+// which happens for GET requests only when explicitly allowed.
+func hasParsableBodyMethod(method string, allowGetBody bool) bool {
+	switch method {
+	case http.MethodPatch, http.MethodPost, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodGet:
+		return allowGetBody
+	}
+	return false
+}
+
 func buildOptimizedResourcePermissionsMap(user types.User) PermissionsOnResourceMap {
 	permissionsOnResourceMap := make(PermissionsOnResourceMap, 0)
 	rolesMap := buildRolesMap(user.UserRoles)
@@ -404,6 +864,37 @@ func buildOptimizedResourcePermissionsMap(user types.User) PermissionsOnResource
 	return permissionsOnResourceMap
 }
 
+// buildResourcePermissions collects the resources of the bindings granting the permission,
+// either directly or through one of their roles, grouped by resource type.
+func buildResourcePermissions(user types.User, permission string) ResourcePermissions {
+	resourcePermissions := make(ResourcePermissions)
+	rolesMap := buildRolesMap(user.UserRoles)
+	for _, binding := range user.UserBindings {
+		if binding.Resource == nil || !bindingGrantsPermission(binding, rolesMap, permission) {
+			continue
+		}
+		resourceIDs, ok := resourcePermissions[binding.Resource.ResourceType]
+		if !ok {
+			resourceIDs = make(map[string]bool)
+			resourcePermissions[binding.Resource.ResourceType] = resourceIDs
+		}
+		resourceIDs[binding.Resource.ResourceID] = true
+	}
+	return resourcePermissions
+}
+
+func bindingGrantsPermission(binding types.Binding, rolesMap map[string][]string, permission string) bool {
+	if utils.Contains(binding.Permissions, permission) {
+		return true
+	}
+	for _, role := range binding.Roles {
+		if utils.Contains(rolesMap[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
 func buildRolesMap(roles []types.Role) map[string][]string {
 	var rolesMap = make(map[string][]string, 0)
 	for _, role := range roles {
@@ -17,22 +17,37 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/identity"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/mocks"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/tracing"
 	"github.com/rond-authz/rond/types"
 
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/topdown/print"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gotest.tools/v3/assert"
 )
 
@@ -52,10 +67,384 @@ func TestNewOPAEvaluator(t *testing.T) {
 	})
 }
 
+func TestEvaluateTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previousProvider)
+
+	log, _ := test.NewNullLogger()
+	evaluator, err := NewOPAEvaluator(context.Background(), "allow", &OPAModuleConfig{Content: "package policies allow {true}"}, []byte("{}"), envs)
+	require.NoError(t, err)
+
+	_, err = evaluator.evaluate(logrus.NewEntry(log))
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	require.Equal(t, "NewOPAEvaluator", spans[0].Name())
+	require.Equal(t, "Evaluate", spans[1].Name())
+	require.Contains(t, spans[1].Attributes(), tracing.PolicyNameAttributeKey.String("allow"))
+}
+
+func TestEvaluateContextCancellation(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow {
+	projects := find_many("projects", {"tenantId": input.tenantId})
+	count(projects) > 0
+}`,
+	}
+	log, _ := test.NewNullLogger()
+
+	t.Run("evaluation is interrupted when request context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mongoMock := mocks.MongoClientMock{
+			FindManyExpectation: func(collectionName string, query interface{}) {
+				cancel()
+			},
+			FindManyResult: []interface{}{map[string]interface{}{"tenantId": "1234"}},
+		}
+		partialResult, err := NewPartialResultEvaluator(context.Background(), "allow", opaModule, mongoMock, envs)
+		require.NoError(t, err)
+		partialEvaluators := PartialResultsEvaluators{"allow": PartialEvaluator{PartialEvaluator: partialResult}}
+
+		evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(mongoclient.WithMongoClient(ctx, mongoMock), "allow", []byte(`{"tenantId":"1234"}`), envs)
+		require.NoError(t, err)
+
+		_, err = evaluator.evaluate(logrus.NewEntry(log))
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("partial evaluation is interrupted when request context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		opaModule := &OPAModuleConfig{Name: "example.rego", Content: `package policies allow { input.tenantId == "1234" }`}
+		evaluator, err := NewOPAEvaluator(ctx, "allow", opaModule, []byte(`{"tenantId":"1234"}`), envs)
+		require.NoError(t, err)
+
+		_, err = evaluator.partiallyEvaluate(logrus.NewEntry(log), QueryOptions{})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestEvaluateMongoQueryInstrumentation(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow {
+	project := find_one("projects", {"projectId": input.projectId})
+	project.tenantId == "1234"
+}`,
+	}
+	mongoMock := mocks.MongoClientMock{
+		FindOneExpectation: func(collectionName string, query interface{}) {},
+		FindOneResult:      map[string]interface{}{"tenantId": "1234"},
+	}
+	partialResult, err := NewPartialResultEvaluator(context.Background(), "allow", opaModule, mongoMock, envs)
+	require.NoError(t, err)
+	partialEvaluators := PartialResultsEvaluators{"allow": PartialEvaluator{PartialEvaluator: partialResult}}
+
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.TraceLevel)
+	queryMetrics := metrics.New()
+	ctx := glogger.WithLogger(mongoclient.WithMongoClient(context.Background(), mongoMock), logrus.NewEntry(log))
+	ctx = metrics.WithMetrics(ctx, queryMetrics)
+
+	evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(ctx, "allow", []byte(`{"projectId":"p1"}`), envs)
+	require.NoError(t, err)
+	_, err = evaluator.evaluate(logrus.NewEntry(log))
+	require.NoError(t, err)
+
+	t.Run("trace logs the query", func(t *testing.T) {
+		var queryEntry *logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "policy MongoDB query completed" {
+				queryEntry = entry
+			}
+		}
+		require.NotNil(t, queryEntry, "missing query log entry")
+		require.Equal(t, logrus.TraceLevel, queryEntry.Level)
+		require.Equal(t, "projects", queryEntry.Data["collection"])
+		require.Equal(t, "find_one", queryEntry.Data["operation"])
+		require.Equal(t, map[string]interface{}{"projectId": "p1"}, queryEntry.Data["query"])
+		require.Equal(t, 1, queryEntry.Data["documents"])
+	})
+
+	t.Run("records the query metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		queryMetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-metrics", nil))
+		require.Contains(t, w.Body.String(), `rond_mongo_query_duration_seconds_count{collection="projects",operation="find_one"} 1`)
+		require.Contains(t, w.Body.String(), `rond_mongo_query_documents_sum{collection="projects",operation="find_one"} 1`)
+	})
+}
+
+func TestEvaluateUndefinedPolicy(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+explicit_false := false
+without_default {
+	input.enabled
+}`,
+	}
+
+	evaluate := func(t *testing.T, policy string) (*test.Hook, *metrics.Metrics, error) {
+		t.Helper()
+		log, hook := test.NewNullLogger()
+		policyMetrics := metrics.New()
+		ctx := metrics.WithMetrics(context.Background(), policyMetrics)
+
+		evaluator, err := NewOPAEvaluator(ctx, policy, opaModule, []byte(`{}`), envs)
+		require.NoError(t, err)
+		_, err = evaluator.evaluate(logrus.NewEntry(log))
+		return hook, policyMetrics, err
+	}
+
+	t.Run("warns and denies when the policy is not defined", func(t *testing.T) {
+		hook, policyMetrics, err := evaluate(t, "not_existing")
+		var denyErr *PolicyDenyError
+		require.ErrorAs(t, err, &denyErr)
+
+		var warning *logrus.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == logrus.WarnLevel {
+				warning = entry
+			}
+		}
+		require.NotNil(t, warning, "missing undefined policy warning")
+		require.Equal(t, "policy result is undefined, check the policy is defined in the rego module", warning.Message)
+		require.Equal(t, "not_existing", warning.Data["policyName"])
+
+		w := httptest.NewRecorder()
+		policyMetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-metrics", nil))
+		require.Contains(t, w.Body.String(), `rond_policy_undefined_results_total{policy="not_existing"} 1`)
+	})
+
+	t.Run("denies without warning when the policy is false", func(t *testing.T) {
+		hook, policyMetrics, err := evaluate(t, "explicit_false")
+		var denyErr *PolicyDenyError
+		require.ErrorAs(t, err, &denyErr)
+
+		for _, entry := range hook.AllEntries() {
+			require.NotEqual(t, logrus.WarnLevel, entry.Level)
+		}
+		w := httptest.NewRecorder()
+		policyMetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-metrics", nil))
+		require.NotContains(t, w.Body.String(), "rond_policy_undefined_results_total")
+	})
+
+	t.Run("flags the partial evaluators of policies not defined", func(t *testing.T) {
+		ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(logrus.New()))
+		for policy, undefined := range map[string]bool{"not_existing": true, "without_default": false} {
+			evaluator, err := createPartialEvaluator(policy, ctx, nil, nil, opaModule, envs)
+			require.NoError(t, err)
+			require.Equal(t, undefined, evaluator.PolicyUndefined, policy)
+		}
+	})
+
+	t.Run("denies without warning when the policy without default is not satisfied", func(t *testing.T) {
+		hook, policyMetrics, err := evaluate(t, "without_default")
+		var denyErr *PolicyDenyError
+		require.ErrorAs(t, err, &denyErr)
+
+		for _, entry := range hook.AllEntries() {
+			require.NotEqual(t, logrus.WarnLevel, entry.Level)
+		}
+		w := httptest.NewRecorder()
+		policyMetrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-metrics", nil))
+		require.NotContains(t, w.Body.String(), "rond_policy_undefined_results_total")
+	})
+}
+
+type blockingEvaluator struct{}
+
+func (blockingEvaluator) Eval(ctx context.Context) (rego.ResultSet, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingEvaluator) Partial(ctx context.Context) (*rego.PartialQueries, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestEvaluatePolicyTimeout(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow {
+	size := input.request.body.size
+	count([1 | numbers.range(1, size)[_]; numbers.range(1, size)[_]]) > 0
+}`,
+	}
+	env := config.EnvironmentVariables{PolicyEvalTimeout: 50 * time.Millisecond}
+	input := []byte(`{"request":{"body":{"size":100000}}}`)
+
+	t.Run("evaluation fails when exceeding the timeout", func(t *testing.T) {
+		log, hook := test.NewNullLogger()
+		partialResult, err := NewPartialResultEvaluator(context.Background(), "allow", opaModule, nil, env)
+		require.NoError(t, err)
+		partialEvaluators := PartialResultsEvaluators{"allow": PartialEvaluator{PartialEvaluator: partialResult}}
+
+		evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(context.Background(), "allow", input, env)
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = evaluator.evaluate(logrus.NewEntry(log))
+		require.ErrorIs(t, err, ErrPolicyEvaluationTimeout)
+		require.NotErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), 5*time.Second)
+
+		entry := hook.LastEntry()
+		require.Equal(t, "policy evaluation timed out", entry.Message)
+		require.Equal(t, "allow", entry.Data["policyName"])
+	})
+
+	t.Run("partial evaluation fails when exceeding the timeout", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		evaluator := &OPAEvaluator{
+			PolicyEvaluator:   blockingEvaluator{},
+			PolicyName:        "allow",
+			Context:           context.Background(),
+			EvaluationTimeout: 10 * time.Millisecond,
+		}
+
+		_, err := evaluator.partiallyEvaluate(logrus.NewEntry(log), QueryOptions{})
+		require.ErrorIs(t, err, ErrPolicyEvaluationTimeout)
+	})
+
+	t.Run("request deadline is not reported as evaluation timeout", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		evaluator := &OPAEvaluator{
+			PolicyEvaluator:   blockingEvaluator{},
+			PolicyName:        "allow",
+			Context:           ctx,
+			EvaluationTimeout: time.Minute,
+		}
+
+		_, err := evaluator.evaluate(logrus.NewEntry(log))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, ErrPolicyEvaluationTimeout)
+	})
+
+	t.Run("request fails with internal server error", func(t *testing.T) {
+		permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow"}}
+		oas := OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"post": VerbConfig{PermissionV2: permission},
+				},
+			},
+		}
+		partialEvaluators, err := setupEvaluators(context.Background(), nil, &oas, opaModule, env)
+		require.NoError(t, err)
+
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://www.example.com:8080/api", bytes.NewReader([]byte(`{"size":100000}`)))
+		require.NoError(t, err)
+		r.Header.Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+		w := httptest.NewRecorder()
+
+		err = EvaluateRequest(r, env, w, partialEvaluators, permission)
+		require.ErrorIs(t, err, ErrPolicyEvaluationTimeout)
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestMongoBuiltinsProjection(t *testing.T) {
+	log, _ := test.NewNullLogger()
+
+	evaluate := func(t *testing.T, policy string, mongoMock mocks.MongoClientMock) error {
+		t.Helper()
+		opaModule := &OPAModuleConfig{Name: "example.rego", Content: policy}
+		ctx := mongoclient.WithMongoClient(context.Background(), mongoMock)
+		evaluator, err := NewOPAEvaluator(ctx, "allow", opaModule, []byte(`{}`), envs)
+		require.NoError(t, err)
+		_, err = evaluator.evaluate(logrus.NewEntry(log))
+		return err
+	}
+
+	t.Run("find_one_with_projection forwards the projection", func(t *testing.T) {
+		var receivedProjection interface{}
+		err := evaluate(t, `package policies
+allow {
+	project := find_one_with_projection("projects", {"projectId": "1234"}, {"tenantId": 1})
+	project.tenantId == "1234"
+	not project.name
+}`, mocks.MongoClientMock{
+			FindOneExpectation:    func(collectionName string, query interface{}) {},
+			ProjectionExpectation: func(projection interface{}) { receivedProjection = projection },
+			FindOneResult:         map[string]interface{}{"tenantId": "1234"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"tenantId": json.Number("1")}, receivedProjection)
+	})
+
+	t.Run("find_one without projection", func(t *testing.T) {
+		var receivedProjection interface{} = "not invoked"
+		err := evaluate(t, `package policies
+allow {
+	project := find_one("projects", {"projectId": "1234"})
+	project.tenantId == "1234"
+}`, mocks.MongoClientMock{
+			FindOneExpectation:    func(collectionName string, query interface{}) {},
+			ProjectionExpectation: func(projection interface{}) { receivedProjection = projection },
+			FindOneResult:         map[string]interface{}{"tenantId": "1234"},
+		})
+		require.NoError(t, err)
+		require.Nil(t, receivedProjection)
+	})
+
+	t.Run("find_many_with_projection forwards the projection", func(t *testing.T) {
+		var receivedProjection interface{}
+		err := evaluate(t, `package policies
+allow {
+	projects := find_many_with_projection("projects", {"tenantId": "1234"}, {"name": 1})
+	count(projects) == 1
+}`, mocks.MongoClientMock{
+			FindManyExpectation:   func(collectionName string, query interface{}) {},
+			ProjectionExpectation: func(projection interface{}) { receivedProjection = projection },
+			FindManyResult:        []interface{}{map[string]interface{}{"name": "project"}},
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"name": json.Number("1")}, receivedProjection)
+	})
+}
+
+type identityExtractorMock struct {
+	identity identity.Identity
+	err      error
+}
+
+func (e identityExtractorMock) Extract(req *http.Request) (identity.Identity, error) {
+	return e.identity, e.err
+}
+
 func TestCreateRegoInput(t *testing.T) {
 	env := config.EnvironmentVariables{}
 	user := types.User{}
-	enableResourcePermissionsMapOptimization := false
+	options := PermissionOptions{}
+
+	t.Run("bindings validity", func(t *testing.T) {
+		validUntil := time.Date(2023, 1, 15, 12, 0, 0, 0, time.UTC)
+		user := types.User{UserBindings: []types.Binding{{BindingID: "b1", ValidUntil: &validUntil}, {BindingID: "b2"}}}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+		require.NoError(t, err)
+
+		var input map[string]interface{}
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		bindings := input["user"].(map[string]interface{})["bindings"].([]interface{})
+		require.Equal(t, "2023-01-15T12:00:00Z", bindings[0].(map[string]interface{})["validUntil"])
+		require.NotContains(t, bindings[1], "validUntil")
+		require.NotContains(t, bindings[1], "validFrom")
+	})
 
 	t.Run("headers", func(t *testing.T) {
 		t.Run("allow empty userproperties header", func(t *testing.T) {
@@ -65,8 +454,114 @@ func TestCreateRegoInput(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/", nil)
 			req.Header.Set("userproperties", "")
 
-			_, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			_, err := createRegoQueryInput(req, env, options, user, nil)
+			require.Nil(t, err, "Unexpected error")
+		})
+
+		t.Run("base64 encoded userproperties header", func(t *testing.T) {
+			env := config.EnvironmentVariables{
+				UserPropertiesHeader: "userproperties",
+				UserPropertiesBase64: true,
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("userproperties", base64.StdEncoding.EncodeToString([]byte(`{"tenant":"acme"}`)))
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Nil(t, err, "Unexpected error")
+
+			var input Input
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, map[string]interface{}{"tenant": "acme"}, input.User.Properties)
+		})
+
+		t.Run("user groups", func(t *testing.T) {
+			testCases := []struct {
+				name           string
+				delimiter      string
+				headerValue    string
+				expectedGroups []string
+			}{
+				{name: "default delimiter", headerValue: "a,b", expectedGroups: []string{"a", "b"}},
+				{name: "trims whitespaces", delimiter: ",", headerValue: "a, b ", expectedGroups: []string{"a", "b"}},
+				{name: "custom delimiter", delimiter: ";", headerValue: "a; b;c", expectedGroups: []string{"a", "b", "c"}},
+				{name: "space delimiter", delimiter: " ", headerValue: "a  b c", expectedGroups: []string{"a", "b", "c"}},
+				{name: "empty header", delimiter: ",", headerValue: "", expectedGroups: nil},
+			}
+
+			for _, testCase := range testCases {
+				t.Run(testCase.name, func(t *testing.T) {
+					env := config.EnvironmentVariables{
+						UserGroupsHeader:    "usergroups",
+						UserGroupsDelimiter: testCase.delimiter,
+					}
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("usergroups", testCase.headerValue)
+
+					inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+					require.NoError(t, err)
+
+					var input Input
+					require.NoError(t, json.Unmarshal(inputBytes, &input))
+					require.Equal(t, testCase.expectedGroups, input.User.Groups)
+				})
+			}
+		})
+
+		t.Run("bearer token claims", func(t *testing.T) {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-id"}).SignedString([]byte("secret"))
+			require.NoError(t, err)
+
+			createInput := func(t *testing.T, env config.EnvironmentVariables, authorization string) Input {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", authorization)
+
+				inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+				require.NoError(t, err)
+
+				var input Input
+				require.NoError(t, json.Unmarshal(inputBytes, &input))
+				return input
+			}
+
+			t.Run("ignored when disabled", func(t *testing.T) {
+				input := createInput(t, config.EnvironmentVariables{}, "Bearer "+token)
+				require.Nil(t, input.User.Token)
+			})
+
+			t.Run("added when enabled", func(t *testing.T) {
+				input := createInput(t, config.EnvironmentVariables{ParseBearerToken: true}, "Bearer "+token)
+				require.Equal(t, map[string]interface{}{"sub": "user-id"}, input.User.Token)
+			})
+
+			t.Run("malformed token is ignored", func(t *testing.T) {
+				input := createInput(t, config.EnvironmentVariables{ParseBearerToken: true}, "Bearer not-a-token")
+				require.Nil(t, input.User.Token)
+			})
+		})
+
+		t.Run("custom identity extractor", func(t *testing.T) {
+			env := config.EnvironmentVariables{UserGroupsHeader: "usergroups"}
+			extractor := identityExtractorMock{identity: identity.Identity{
+				ID:         "CN=client",
+				Groups:     []string{"mtls-clients"},
+				Properties: map[string]interface{}{"issuer": "internal-ca"},
+			}}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("usergroups", "header-group")
+			req = req.WithContext(identity.WithExtractor(req.Context(), extractor))
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+
+			var input Input
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, []string{"mtls-clients"}, input.User.Groups)
+			require.Equal(t, map[string]interface{}{"issuer": "internal-ca"}, input.User.Properties)
+
+			req = req.WithContext(identity.WithExtractor(req.Context(), identityExtractorMock{err: errors.New("missing client certificate")}))
+			_, err = createRegoQueryInput(req, env, options, user, nil)
+			require.EqualError(t, err, "missing client certificate")
 		})
 
 		t.Run("fail on invalid userproperties header value", func(t *testing.T) {
@@ -76,11 +571,128 @@ func TestCreateRegoInput(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/", nil)
 			req.Header.Set("userproperties", "1")
 
-			_, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			_, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Error(t, err)
 		})
 	})
 
+	t.Run("cookies", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc%3D123"})
+		req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+		req.AddCookie(&http.Cookie{Name: "session", Value: "ignored"})
+
+		inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+		require.NoError(t, err)
+
+		input := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(inputBytes, &input))
+		request := input["request"].(map[string]interface{})
+		require.Equal(t, map[string]interface{}{"session": "abc%3D123", "theme": "dark"}, request["cookies"])
+	})
+
+	t.Run("without cookies", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+		require.NoError(t, err)
+		require.NotContains(t, string(inputBytes), `"cookies"`)
+	})
+
+	t.Run("client ip", func(t *testing.T) {
+		clientIP := func(t *testing.T, env config.EnvironmentVariables, remoteAddr, forwardedFor string) string {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = remoteAddr
+			if forwardedFor != "" {
+				req.Header.Set(XForwardedForHeaderKey, forwardedFor)
+			}
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+
+			input := Input{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			return input.Request.ClientIP
+		}
+
+		t.Run("taken from the remote address", func(t *testing.T) {
+			require.Equal(t, "10.0.0.1", clientIP(t, env, "10.0.0.1:5000", ""))
+			require.Equal(t, "2001:db8::1", clientIP(t, env, "[2001:db8::1]:5000", ""))
+		})
+
+		t.Run("ignores untrusted X-Forwarded-For", func(t *testing.T) {
+			require.Equal(t, "10.0.0.1", clientIP(t, env, "10.0.0.1:5000", "192.168.1.1"))
+		})
+
+		t.Run("taken from trusted X-Forwarded-For", func(t *testing.T) {
+			trustedEnv := config.EnvironmentVariables{TrustInboundForwarded: true}
+			require.Equal(t, "192.168.1.1", clientIP(t, trustedEnv, "10.0.0.1:5000", "192.168.1.1, 172.16.0.1"))
+			require.Equal(t, "10.0.0.1", clientIP(t, trustedEnv, "10.0.0.1:5000", ""))
+		})
+	})
+
+	t.Run("path template", func(t *testing.T) {
+		t.Run("taken from the matched route", func(t *testing.T) {
+			var inputBytes []byte
+			router := mux.NewRouter()
+			router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				inputBytes, err = createRegoQueryInput(r, env, options, user, nil)
+				require.NoError(t, err)
+			})
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/42", nil))
+
+			input := Input{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, "/users/42", input.Request.Path)
+			require.Equal(t, "/users/{id}", input.Request.PathTemplate)
+			require.Equal(t, map[string]string{"id": "42"}, input.Request.PathParams)
+		})
+
+		t.Run("strips the standalone prefix and the path parameters constraints", func(t *testing.T) {
+			standaloneEnv := config.EnvironmentVariables{Standalone: true, PathPrefixStandalone: "/eval"}
+			var inputBytes []byte
+			router := mux.NewRouter()
+			router.HandleFunc("/eval/users/{id:[0-9]+}/orders/{orderId}", func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				inputBytes, err = createRegoQueryInput(r, standaloneEnv, options, user, nil)
+				require.NoError(t, err)
+			})
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/eval/users/42/orders/7", nil))
+
+			input := Input{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, "/users/{id}/orders/{orderId}", input.Request.PathTemplate)
+		})
+
+		t.Run("falls back to the concrete path on the fallback route", func(t *testing.T) {
+			var inputBytes []byte
+			router := mux.NewRouter()
+			router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				inputBytes, err = createRegoQueryInput(r, env, options, user, nil)
+				require.NoError(t, err)
+			}).Name(fallbackRouteName)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/not/in/oas", nil))
+
+			input := Input{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, "/not/in/oas", input.Request.PathTemplate)
+		})
+
+		t.Run("falls back to the concrete path without route", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+
+			input := Input{}
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, "/users/42", input.Request.PathTemplate)
+		})
+	})
+
 	t.Run("body integration", func(t *testing.T) {
 		expectedRequestBody := []byte(`{"Key":42}`)
 		reqBody := struct{ Key int }{
@@ -92,16 +704,49 @@ func TestCreateRegoInput(t *testing.T) {
 		t.Run("ignored on method GET", func(t *testing.T) {
 			req := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(reqBodyBytes))
 
-			inputBytes, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Nil(t, err, "Unexpected error")
 			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
 		})
 
+		t.Run("added on method GET when allowed", func(t *testing.T) {
+			env := config.EnvironmentVariables{AllowGetBody: true}
+			req := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(reqBodyBytes))
+			req.Header.Set(ContentTypeHeaderKey, "application/json")
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+			require.Contains(t, string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody))
+
+			restoredBody, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, reqBodyBytes, restoredBody, "request body must be readable after input creation")
+		})
+
+		t.Run("ignored on method GET with application/json when not allowed", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(reqBodyBytes))
+			req.Header.Set(ContentTypeHeaderKey, "application/json")
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+			require.NotContains(t, string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody))
+		})
+
+		t.Run("ignored on method GET when allowed but with another content type", func(t *testing.T) {
+			env := config.EnvironmentVariables{AllowGetBody: true}
+			req := httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(reqBodyBytes))
+			req.Header.Set(ContentTypeHeaderKey, "text/plain")
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+			require.NotContains(t, string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody))
+		})
+
 		t.Run("ignore nil body on method POST", func(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/", nil)
 			req.Header.Set(ContentTypeHeaderKey, "application/json")
 
-			inputBytes, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Nil(t, err, "Unexpected error")
 			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
 		})
@@ -112,26 +757,96 @@ func TestCreateRegoInput(t *testing.T) {
 			for _, method := range acceptedMethods {
 				req := httptest.NewRequest(method, "/", bytes.NewReader(reqBodyBytes))
 				req.Header.Set(ContentTypeHeaderKey, "application/json")
-				inputBytes, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+				inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 				require.Nil(t, err, "Unexpected error")
 
 				require.True(t, strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)), "Unexpected body for method %s", method)
 			}
 		})
 
+		t.Run("size limit", func(t *testing.T) {
+			t.Run("added and restored when within the limit", func(t *testing.T) {
+				env := config.EnvironmentVariables{RequestMaxBodySize: int64(len(reqBodyBytes))}
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBodyBytes))
+				req.Header.Set(ContentTypeHeaderKey, "application/json")
+
+				inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+				require.NoError(t, err)
+				require.Contains(t, string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody))
+
+				restoredBody, err := io.ReadAll(req.Body)
+				require.NoError(t, err)
+				require.Equal(t, reqBodyBytes, restoredBody)
+			})
+
+			t.Run("rejected when exceeded", func(t *testing.T) {
+				env := config.EnvironmentVariables{RequestMaxBodySize: int64(len(reqBodyBytes) - 1)}
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBodyBytes))
+				req.Header.Set(ContentTypeHeaderKey, "application/json")
+
+				_, err := createRegoQueryInput(req, env, options, user, nil)
+				require.ErrorIs(t, err, ErrRequestBodyTooLarge)
+			})
+
+			t.Run("rejected when exceeded with unknown content length", func(t *testing.T) {
+				env := config.EnvironmentVariables{RequestMaxBodySize: int64(len(reqBodyBytes) - 1)}
+				req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(bytes.NewReader(reqBodyBytes)))
+				req.Header.Set(ContentTypeHeaderKey, "application/json")
+				req.ContentLength = 1
+
+				_, err := createRegoQueryInput(req, env, options, user, nil)
+				require.ErrorIs(t, err, ErrRequestBodyTooLarge)
+			})
+		})
+
+		t.Run("added on method DELETE with application/json", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/", bytes.NewReader(reqBodyBytes))
+			req.Header.Set(ContentTypeHeaderKey, "application/json")
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.Nil(t, err, "Unexpected error")
+
+			var input Input
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, map[string]interface{}{"Key": float64(42)}, input.Request.Body)
+
+			restoredBody, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Equal(t, reqBodyBytes, restoredBody, "request body must be readable after input creation")
+		})
+
+		t.Run("ignored on method DELETE without content length", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/", bytes.NewReader(reqBodyBytes))
+			req.Header.Set(ContentTypeHeaderKey, "application/json")
+			req.ContentLength = 0
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.Nil(t, err, "Unexpected error")
+			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
+		})
+
 		t.Run("added with content-type specifying charset", func(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBodyBytes))
 			req.Header.Set(ContentTypeHeaderKey, "application/json;charset=UTF-8")
-			inputBytes, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Nil(t, err, "Unexpected error")
 
 			require.True(t, strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)), "Unexpected body for method %s", http.MethodPost)
 		})
 
+		t.Run("added with structured syntax JSON content-type", func(t *testing.T) {
+			for _, contentType := range []string{"application/vnd.api+json", "application/ld+json;charset=utf-8"} {
+				req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(reqBodyBytes))
+				req.Header.Set(ContentTypeHeaderKey, contentType)
+				inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+				require.Nil(t, err, "Unexpected error")
+
+				require.True(t, strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)), "Unexpected body for content-type %s", contentType)
+			}
+		})
+
 		t.Run("reject on method POST but with invalid body", func(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{notajson}")))
 			req.Header.Set(ContentTypeHeaderKey, "application/json")
-			_, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			_, err := createRegoQueryInput(req, env, options, user, nil)
 			require.True(t, err != nil)
 		})
 
@@ -139,11 +854,60 @@ func TestCreateRegoInput(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("{notajson}")))
 			req.Header.Set(ContentTypeHeaderKey, "multipart/form-data")
 
-			inputBytes, err := createRegoQueryInput(req, env, enableResourcePermissionsMapOptimization, user, nil)
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
 			require.Nil(t, err, "Unexpected error")
 			require.True(t, !strings.Contains(string(inputBytes), fmt.Sprintf(`"body":%s`, expectedRequestBody)))
 		})
 	})
+
+	t.Run("resource permissions", func(t *testing.T) {
+		user := types.User{
+			UserBindings: testmongoMock.UserBindings,
+			UserRoles:    testmongoMock.UserRoles,
+		}
+
+		t.Run("omitted without resource permission option", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			inputBytes, err := createRegoQueryInput(req, env, options, user, nil)
+			require.NoError(t, err)
+			require.NotContains(t, string(inputBytes), `"resourcePermissions"`)
+		})
+
+		t.Run("added for the configured permission", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			inputBytes, err := createRegoQueryInput(req, env, PermissionOptions{ResourcePermission: "console.project.view"}, user, nil)
+			require.NoError(t, err)
+
+			var input Input
+			require.NoError(t, json.Unmarshal(inputBytes, &input))
+			require.Equal(t, ResourcePermissions{
+				"project": {"project123": true},
+				"custom":  {"9876": true, "12345": true},
+			}, input.User.ResourcePermissions)
+		})
+	})
+}
+
+func TestGetEvaluatorFromPolicy(t *testing.T) {
+	opaModule := &OPAModuleConfig{Name: "example.rego", Content: "package policies\ntodo { true }"}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, &OpenAPISpec{
+		Paths: OpenAPIPaths{"/api": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}}}},
+	}, opaModule, envs)
+	require.NoError(t, err)
+
+	t.Run("returns the evaluator of the policy", func(t *testing.T) {
+		evaluator, err := partialEvaluators.GetEvaluatorFromPolicy(context.Background(), "todo", []byte("{}"), envs)
+		require.NoError(t, err)
+		require.Equal(t, "todo", evaluator.PolicyName)
+	})
+
+	t.Run("fails with ErrPolicyNotFound for unknown policies", func(t *testing.T) {
+		_, err := partialEvaluators.GetEvaluatorFromPolicy(context.Background(), "missing_policy", []byte("{}"), envs)
+		require.ErrorIs(t, err, ErrPolicyNotFound)
+		require.EqualError(t, err, "policy evaluator not found: missing_policy")
+	})
 }
 
 func TestCreatePolicyEvaluators(t *testing.T) {
@@ -184,6 +948,145 @@ func TestCreatePolicyEvaluators(t *testing.T) {
 		assert.Assert(t, err == nil, "unexpected error creating evaluators")
 		assert.Equal(t, len(policyEvals), 4, "unexpected length")
 	})
+
+	t.Run("with combined request policies", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "policies.rego",
+			Content: `package policies
+tenant_check { true }
+feature_flag { true }
+`,
+		}
+		oasWithRequestFlow := func(requestFlow RequestFlow) *OpenAPISpec {
+			return &OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: requestFlow}}},
+				},
+			}
+		}
+		policies := []string{"tenant_check", "feature_flag"}
+
+		policyEvals, err := setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{Policies: policies, Combinator: PoliciesCombinatorAny}), opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Len(t, policyEvals, 2)
+		require.Contains(t, policyEvals, "tenant_check")
+		require.Contains(t, policyEvals, "feature_flag")
+
+		_, err = setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{Policies: policies, Combinator: "none"}), opaModuleConfig, config.EnvironmentVariables{})
+		require.EqualError(t, err, "invalid request flow for API get /api: unknown policies combinator none")
+
+		_, err = setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{Policies: policies, GenerateQuery: true}), opaModuleConfig, config.EnvironmentVariables{})
+		require.EqualError(t, err, "invalid request flow for API get /api: query generation is not supported with multiple policies")
+	})
+
+	t.Run("with row filter target", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "policies.rego", Content: "package policies\nallow { true }"}
+		oasWithTarget := func(target string) *OpenAPISpec {
+			return &OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{
+						PolicyName:    "allow",
+						GenerateQuery: true,
+						QueryOptions:  QueryOptions{Target: target},
+					}}}},
+				},
+			}
+		}
+
+		for _, target := range []string{"", RowFilterTargetHeader, RowFilterTargetQuery} {
+			_, err := setupEvaluators(context.Background(), nil, oasWithTarget(target), opaModuleConfig, config.EnvironmentVariables{})
+			require.NoError(t, err, "unexpected error with target %q", target)
+		}
+
+		_, err := setupEvaluators(context.Background(), nil, oasWithTarget("body"), opaModuleConfig, config.EnvironmentVariables{})
+		require.EqualError(t, err, "invalid request flow for API get /api: unknown row filter target body")
+	})
+
+	t.Run("with decision cache TTL", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{Name: "policies.rego", Content: "package policies\nallow { true }"}
+		oasWithRequestFlow := func(requestFlow RequestFlow) *OpenAPISpec {
+			return &OpenAPISpec{
+				Paths: OpenAPIPaths{
+					"/api": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: requestFlow}}},
+				},
+			}
+		}
+
+		_, err := setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{PolicyName: "allow", CacheTTL: "30s"}), opaModuleConfig, config.EnvironmentVariables{})
+		require.NoError(t, err)
+
+		_, err = setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{PolicyName: "allow", CacheTTL: "soon"}), opaModuleConfig, config.EnvironmentVariables{})
+		require.EqualError(t, err, "invalid request flow for API get /api: invalid cache TTL soon: must be a positive duration")
+
+		_, err = setupEvaluators(context.Background(), nil, oasWithRequestFlow(RequestFlow{PolicyName: "allow", CacheTTL: "30s", GenerateQuery: true}), opaModuleConfig, config.EnvironmentVariables{})
+		require.EqualError(t, err, "invalid request flow for API get /api: decision caching is not supported with query generation")
+	})
+}
+
+func TestValidatePolicies(t *testing.T) {
+	opaModuleConfig := &OPAModuleConfig{
+		Name: "policies.rego",
+		Content: `package policies
+allow { true }
+filter_response { true }
+`,
+		AdditionalModules: []OPAModule{
+			{Name: "nested.rego", Content: "package policies\nnested_policy { true }\n"},
+			{Name: "other.rego", Content: "package other\nother_policy { true }\n"},
+		},
+	}
+
+	t.Run("passes when every policy is defined", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "allow"},
+						ResponseFlow: ResponseFlow{PolicyName: "filter_response"},
+					}},
+					"post": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "nested.policy"}}},
+				},
+				"/no-permission": PathVerbs{"get": VerbConfig{}},
+			},
+		}
+
+		require.NoError(t, validatePolicies(oas, opaModuleConfig))
+	})
+
+	t.Run("lists every missing policy with the referencing API", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "allow"},
+						ResponseFlow: ResponseFlow{PolicyName: "notexistingfilter"},
+					}},
+				},
+				"/admin": PathVerbs{
+					"delete": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "notexistingpermission"}}},
+					"get":    VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "other_policy"}}},
+				},
+			},
+		}
+
+		err := validatePolicies(oas, opaModuleConfig)
+		require.ErrorIs(t, err, ErrMissingPolicies)
+		require.EqualError(t, err, "missing policies: notexistingpermission (DELETE /admin), other_policy (GET /admin), notexistingfilter (GET /users)")
+	})
+
+	t.Run("reports policies missing in mocks", func(t *testing.T) {
+		log, _ := test.NewNullLogger()
+		envs := config.EnvironmentVariables{APIPermissionsFilePath: "./mocks/simplifiedMock.json"}
+		openApiSpec, err := loadOASFromFileOrNetwork(log, envs)
+		require.NoError(t, err)
+
+		opaModuleConfig, err := loadRegoModule("./mocks/rego-policies")
+		require.NoError(t, err)
+
+		err = validatePolicies(openApiSpec, opaModuleConfig)
+		require.ErrorIs(t, err, ErrMissingPolicies)
+		require.Contains(t, err.Error(), "notexistingpermission (POST /users/)")
+	})
 }
 
 func TestBuildRolesMap(t *testing.T) {
@@ -260,6 +1163,52 @@ func TestBuildOptimizedResourcePermissionsMap(t *testing.T) {
 	assert.DeepEqual(t, result, expected)
 }
 
+func TestBuildResourcePermissions(t *testing.T) {
+	user := types.User{
+		UserBindings: testmongoMock.UserBindings,
+		UserRoles:    testmongoMock.UserRoles,
+	}
+
+	t.Run("collects resources granting the permission through roles or directly", func(t *testing.T) {
+		require.Equal(t, ResourcePermissions{
+			"project": {"project123": true},
+			"custom":  {"9876": true, "12345": true},
+		}, buildResourcePermissions(user, "console.project.view"))
+
+		require.Equal(t, ResourcePermissions{
+			"project": {"project123": true},
+		}, buildResourcePermissions(user, "permission4"))
+	})
+
+	t.Run("returns an empty map for permissions not granted on any resource", func(t *testing.T) {
+		require.Empty(t, buildResourcePermissions(user, "permission7"))
+		require.Empty(t, buildResourcePermissions(user, "unknown"))
+	})
+
+	t.Run("allows row filtering with a membership check", func(t *testing.T) {
+		opaModuleConfig := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			filter_projects {
+				resource := data.resources[_]
+				input.user.resourcePermissions.project[resource._id]
+			}`,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		input, err := createRegoQueryInput(req, config.EnvironmentVariables{}, PermissionOptions{ResourcePermission: "console.project.view"}, user, nil)
+		require.NoError(t, err)
+
+		evaluator, err := NewOPAEvaluator(context.Background(), "filter_projects", opaModuleConfig, input, config.EnvironmentVariables{})
+		require.NoError(t, err)
+		query, err := evaluator.partiallyEvaluate(logrus.NewEntry(logrus.New()), QueryOptions{})
+		require.NoError(t, err)
+
+		queryBytes, err := json.Marshal(query)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"$or":[{"$and":[{"_id":{"$eq":"project123"}}]}]}`, string(queryBytes))
+	})
+}
+
 func BenchmarkBuildOptimizedResourcePermissionsMap(b *testing.B) {
 	var roles []types.Role
 	for i := 0; i < 20; i++ {
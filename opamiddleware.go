@@ -28,6 +28,10 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/util"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,9 +45,67 @@ type OPAModuleConfigKey struct{}
 type OPAModuleConfig struct {
 	Name    string
 	Content string
+	// AdditionalModules holds the other rego modules found in the modules directory,
+	// compiled together with the main one so that rules can reference each other.
+	AdditionalModules []OPAModule
+	// Data holds the documents made available to the policies under the `data` root.
+	Data map[string]interface{}
 }
 
-func OPAMiddleware(opaModuleConfig *OPAModuleConfig, openAPISpec *OpenAPISpec, envs *config.EnvironmentVariables, policyEvaluators PartialResultsEvaluators) mux.MiddlewareFunc {
+type OPAModule struct {
+	Name    string
+	Content string
+}
+
+// regoModules returns the rego options registering every module of the configuration,
+// together with the store holding its data, if any.
+func (opaModuleConfig *OPAModuleConfig) regoModules() []func(*rego.Rego) {
+	modules := []func(*rego.Rego){rego.Module(opaModuleConfig.Name, opaModuleConfig.Content)}
+	for _, module := range opaModuleConfig.AdditionalModules {
+		modules = append(modules, rego.Module(module.Name, module.Content))
+	}
+	if len(opaModuleConfig.Data) > 0 {
+		modules = append(modules, rego.Store(inmem.NewFromObject(opaModuleConfig.Data)))
+	}
+	return modules
+}
+
+// policyNames returns the names of the rules defined in the policies package of the configuration modules.
+func (opaModuleConfig *OPAModuleConfig) policyNames() (map[string]struct{}, error) {
+	modules := append([]OPAModule{{Name: opaModuleConfig.Name, Content: opaModuleConfig.Content}}, opaModuleConfig.AdditionalModules...)
+	policiesPackage := ast.MustParseRef("data.policies")
+
+	policyNames := map[string]struct{}{}
+	for _, module := range modules {
+		parsedModule, err := ast.ParseModule(module.Name, module.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file parse %s: %s", module.Name, err.Error())
+		}
+		if !parsedModule.Package.Path.Equal(policiesPackage) {
+			continue
+		}
+		for _, rule := range parsedModule.Rules {
+			policyNames[rule.Head.Name.String()] = struct{}{}
+		}
+	}
+	return policyNames, nil
+}
+
+// definesPolicy reports whether the policy rule is defined in the policies package of the configuration modules.
+// Modules failing to parse are assumed to define it, since their evaluation fails anyway.
+func (opaModuleConfig *OPAModuleConfig) definesPolicy(policy string) bool {
+	policyNames, err := opaModuleConfig.policyNames()
+	if err != nil {
+		return true
+	}
+	_, ok := policyNames[strings.Replace(policy, ".", "_", -1)]
+	return ok
+}
+
+func OPAMiddleware(policies *PoliciesStore, openAPISpec *OpenAPISpec, envs *config.EnvironmentVariables) mux.MiddlewareFunc {
+	if envs.CaseInsensitivePaths {
+		openAPISpec = openAPISpec.withLowerCasedPaths()
+	}
 	OASrouter := openAPISpec.PrepareOASRouter()
 
 	return func(next http.Handler) http.Handler {
@@ -52,14 +114,26 @@ func OPAMiddleware(opaModuleConfig *OPAModuleConfig, openAPISpec *OpenAPISpec, e
 				next.ServeHTTP(w, r)
 				return
 			}
+			if route := mux.CurrentRoute(r); route != nil && route.GetName() == publicRouteName {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// methods not allowed are rejected even when they are not declared in the OAS
+			if rejectNotAllowedMethod(w, r, *envs) {
+				return
+			}
 
 			path := r.URL.EscapedPath()
 			if envs.Standalone {
 				path = strings.Replace(r.URL.EscapedPath(), envs.PathPrefixStandalone, "", 1)
 			}
+			if envs.CaseInsensitivePaths {
+				path = strings.ToLower(path)
+			}
 
 			permission, err := openAPISpec.FindPermission(OASrouter, path, r.Method)
-			if r.Method == http.MethodGet && r.URL.Path == envs.TargetServiceOASPath && permission.RequestFlow.PolicyName == "" {
+			if r.Method == http.MethodGet && r.URL.Path == envs.TargetServiceOASPath && len(permission.RequestFlow.allowPolicies()) == 0 {
 				fields := logrus.Fields{}
 				if err != nil {
 					fields["error"] = logrus.Fields{"message": err.Error()}
@@ -69,28 +143,37 @@ func OPAMiddleware(opaModuleConfig *OPAModuleConfig, openAPISpec *OpenAPISpec, e
 				return
 			}
 
-			if err != nil || permission.RequestFlow.PolicyName == "" {
+			// the operations declared without permission are evaluated with the default policy, if any
+			if err == nil && len(permission.RequestFlow.allowPolicies()) == 0 && envs.DefaultPolicyName != "" {
+				permission.RequestFlow.PolicyName = envs.DefaultPolicyName
+			}
+
+			if err != nil || len(permission.RequestFlow.allowPolicies()) == 0 {
 				errorMessage := "User is not allowed to request the API"
 				statusCode := http.StatusForbidden
 				fields := logrus.Fields{
 					"originalRequestPath": utils.SanitizeString(r.URL.Path),
 					"method":              utils.SanitizeString(r.Method),
-					"allowPermission":     utils.SanitizeString(permission.RequestFlow.PolicyName),
+					"allowPermission":     utils.SanitizeString(strings.Join(permission.RequestFlow.allowPolicies(), ",")),
 				}
 				technicalError := ""
 				if err != nil {
 					technicalError = err.Error()
 					fields["error"] = logrus.Fields{"message": err.Error()}
-					errorMessage = "The request doesn't match any known API"
-				}
-				if errors.Is(err, ErrNotFoundOASDefinition) {
-					statusCode = http.StatusNotFound
+					if errors.Is(err, ErrNotFoundOASDefinition) {
+						errorMessage = "The request doesn't match any known API"
+						statusCode = http.StatusNotFound
+					} else {
+						errorMessage = GENERIC_BUSINESS_ERROR_MESSAGE
+						statusCode = http.StatusInternalServerError
+					}
 				}
 				glogger.Get(r.Context()).WithFields(fields).Errorf(errorMessage)
 				failResponseWithCode(w, statusCode, technicalError, errorMessage)
 				return
 			}
 
+			opaModuleConfig, policyEvaluators := policies.Get()
 			ctx := WithXPermission(
 				WithOPAModuleConfig(
 					WithPartialResultsEvaluators(
@@ -107,36 +190,81 @@ func OPAMiddleware(opaModuleConfig *OPAModuleConfig, openAPISpec *OpenAPISpec, e
 }
 
 func loadRegoModule(rootDirectory string) (*OPAModuleConfig, error) {
-	var regoModulePath string
+	var regoModulePaths []string
 	//#nosec G104 -- Produces a false positive
 	filepath.Walk(rootDirectory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if regoModulePath != "" {
-			return nil
-		}
-
 		if filepath.Ext(path) == ".rego" {
-			regoModulePath = path
+			regoModulePaths = append(regoModulePaths, path)
 		}
 		return nil
 	})
 
-	if regoModulePath == "" {
+	if len(regoModulePaths) == 0 {
 		return nil, fmt.Errorf("no rego module found in directory")
 	}
-	fileContent, err := readFile(regoModulePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed rego file read: %s", err.Error())
+
+	modules := make([]OPAModule, 0, len(regoModulePaths))
+	for _, regoModulePath := range regoModulePaths {
+		fileContent, err := readFile(regoModulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file read: %s", err.Error())
+		}
+		if _, err := ast.ParseModule(regoModulePath, string(fileContent)); err != nil {
+			return nil, fmt.Errorf("failed rego file parse %s: %s", regoModulePath, err.Error())
+		}
+		// modules are named by their relative path, since OPA keeps only one of the modules with the same name
+		moduleName, err := filepath.Rel(rootDirectory, regoModulePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed rego file path %s: %s", regoModulePath, err.Error())
+		}
+		modules = append(modules, OPAModule{
+			Name:    filepath.ToSlash(moduleName),
+			Content: string(fileContent),
+		})
 	}
 
 	return &OPAModuleConfig{
-		Name:    filepath.Base(regoModulePath),
-		Content: string(fileContent),
+		Name:              modules[0].Name,
+		Content:           modules[0].Content,
+		AdditionalModules: modules[1:],
 	}, nil
 }
 
+// loadPoliciesFromDirectory loads the rego modules found in rootDirectory and, when
+// dataFilePath is not empty, the data document made available to the policies.
+func loadPoliciesFromDirectory(rootDirectory, dataFilePath string) (*OPAModuleConfig, error) {
+	opaModuleConfig, err := loadRegoModule(rootDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if dataFilePath != "" {
+		if opaModuleConfig.Data, err = loadRegoData(dataFilePath); err != nil {
+			return nil, err
+		}
+	}
+	return opaModuleConfig, nil
+}
+
+// loadRegoData reads the JSON object stored in filePath, to be used as data document.
+// The resources document is reserved to the unknowns used by the row filtering.
+func loadRegoData(filePath string) (map[string]interface{}, error) {
+	fileContent, err := readFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed data file read: %w", err)
+	}
+	var data map[string]interface{}
+	if err := util.UnmarshalJSON(fileContent, &data); err != nil {
+		return nil, fmt.Errorf("failed data file parse %s: %s", filePath, err.Error())
+	}
+	if _, ok := data[bundleResourcesDataKey]; ok {
+		return nil, fmt.Errorf("data file %s must not define the %s document", filePath, bundleResourcesDataKey)
+	}
+	return data, nil
+}
+
 func WithOPAModuleConfig(requestContext context.Context, permission *OPAModuleConfig) context.Context {
 	return context.WithValue(requestContext, OPAModuleConfigKey{}, permission)
 }
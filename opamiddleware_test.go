@@ -17,15 +17,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rond-authz/rond/custom_builtins"
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/types"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/h2non/gock.v1"
 	"gotest.tools/v3/assert"
 )
 
@@ -43,7 +51,7 @@ todo { true }`,
 		var openAPISpec *OpenAPISpec
 		openAPISpecContent, _ := os.ReadFile("./mocks/simplifiedMock.json")
 		_ = json.Unmarshal(openAPISpecContent, &openAPISpec)
-		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+		middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 
 		t.Run(`missing oas paths`, func(t *testing.T) {
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +71,19 @@ todo { true }`,
 			assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader, "Unexpected content type.")
 		})
 
+		t.Run(`method not allowed`, func(t *testing.T) {
+			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Fail()
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodTrace, "http://example.com/users/", nil)
+			builtHandler.ServeHTTP(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusMethodNotAllowed, "Unexpected status code.")
+			assert.Equal(t, w.Result().Header.Get("Allow"), "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		})
+
 		t.Run(`missing method`, func(t *testing.T) {
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				t.Fail()
@@ -94,6 +115,59 @@ todo { true }`,
 		})
 	})
 
+	t.Run(`default policy`, func(t *testing.T) {
+		opaModule := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+todo { true }
+default_policy { input.request.method == "GET" }`,
+		}
+		openAPISpec, err := loadOASFile("./mocks/simplifiedMock.json")
+		assert.NilError(t, err)
+		envs := config.EnvironmentVariables{DefaultPolicyName: "default_policy"}
+		partialEvaluators, err := setupEvaluators(context.Background(), nil, openAPISpec, opaModule, envs)
+		assert.NilError(t, err)
+
+		middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
+		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permission, err := GetXPermission(r.Context())
+			require.NoError(t, err)
+			if err := EvaluateRequest(r, envs, w, partialEvaluators, permission); err != nil {
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		t.Run(`blocks the path without permission`, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/no-permission", nil)
+			builtHandler.ServeHTTP(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusForbidden, "Unexpected status code.")
+			assert.DeepEqual(t, getJSONResponseBody[types.RequestError](t, w), &types.RequestError{
+				Message:    NO_PERMISSIONS_ERROR_MESSAGE,
+				Error:      "RBAC policy evaluation failed",
+				StatusCode: http.StatusForbidden,
+			})
+		})
+
+		t.Run(`allows the path without permission`, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/no-permission", nil)
+			builtHandler.ServeHTTP(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+		})
+
+		t.Run(`keeps the declared permission`, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodHead, "http://example.com/users/", nil)
+			builtHandler.ServeHTTP(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+		})
+	})
+
 	t.Run(`documentation request`, func(t *testing.T) {
 		opaModule := &OPAModuleConfig{
 			Name: "example.rego",
@@ -107,7 +181,7 @@ foobar { true }`,
 			var envs = config.EnvironmentVariables{
 				TargetServiceOASPath: "/documentation/json",
 			}
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
 			}))
@@ -125,7 +199,7 @@ foobar { true }`,
 			var envs = config.EnvironmentVariables{
 				TargetServiceOASPath: "/documentation/json",
 			}
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
 			}))
@@ -143,7 +217,7 @@ foobar { true }`,
 			var envs = config.EnvironmentVariables{
 				TargetServiceOASPath: "/documentation/custom/json",
 			}
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
 			}))
@@ -167,7 +241,7 @@ foobar { true }`,
 todo { true }`,
 			}
 
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				permission, err := GetXPermission(r.Context())
 				require.True(t, err == nil, "Unexpected error")
@@ -189,7 +263,7 @@ todo { true }`,
 foobar { true }`,
 			}
 
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				permission, err := GetXPermission(r.Context())
 				require.True(t, err == nil, "Unexpected error")
@@ -211,7 +285,7 @@ foobar { true }`,
 very_very_composed_permission { true }`,
 			}
 
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				permission, err := GetXPermission(r.Context())
 				require.True(t, err == nil, "Unexpected error")
@@ -238,7 +312,7 @@ very_very_composed_permission_with_eval { true }`,
 				PathPrefixStandalone: "/eval", // default value
 			}
 
-			middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				permission, err := GetXPermission(r.Context())
 				require.True(t, err == nil, "Unexpected error")
@@ -253,6 +327,64 @@ very_very_composed_permission_with_eval { true }`,
 			assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
 		})
 	})
+
+	t.Run("case insensitive paths", func(t *testing.T) {
+		opaModule := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+get_user { true }
+list_projects { true }`,
+		}
+		openAPISpec := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/Users/{userId}": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "get_user"}}}},
+				"/projects/":      PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "list_projects"}}}},
+			},
+		}
+
+		testCases := []struct {
+			path           string
+			expectedPolicy string
+		}{
+			{path: "/users/AbC", expectedPolicy: "get_user"},
+			{path: "/USERS/abc", expectedPolicy: "get_user"},
+			{path: "/Projects/", expectedPolicy: "list_projects"},
+			{path: "/projects/", expectedPolicy: "list_projects"},
+		}
+
+		for _, testCase := range testCases {
+			t.Run(testCase.path, func(t *testing.T) {
+				envs := config.EnvironmentVariables{CaseInsensitivePaths: true}
+				middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
+				builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					permission, err := GetXPermission(r.Context())
+					require.NoError(t, err)
+					require.Equal(t, &RondConfig{RequestFlow: RequestFlow{PolicyName: testCase.expectedPolicy}}, permission)
+					require.Equal(t, testCase.path, r.URL.Path, "request path must not be altered")
+					w.WriteHeader(http.StatusOK)
+				}))
+
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "http://example.com"+testCase.path, nil)
+				builtHandler.ServeHTTP(w, r)
+
+				assert.Equal(t, w.Result().StatusCode, http.StatusOK, "Unexpected status code.")
+			})
+		}
+
+		t.Run("case sensitive by default", func(t *testing.T) {
+			middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &config.EnvironmentVariables{})
+			builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Fail()
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/Projects/", nil)
+			builtHandler.ServeHTTP(w, r)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusNotFound, "Unexpected status code.")
+		})
+	})
 }
 
 func TestOPAMiddlewareStandaloneIntegration(t *testing.T) {
@@ -271,7 +403,7 @@ func TestOPAMiddlewareStandaloneIntegration(t *testing.T) {
 			very_very_composed_permission { true }`,
 		}
 
-		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+		middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			permission, err := GetXPermission(r.Context())
 			require.True(t, err == nil, "Unexpected error")
@@ -293,7 +425,7 @@ func TestOPAMiddlewareStandaloneIntegration(t *testing.T) {
 very_very_composed_permission_with_eval { true }`,
 		}
 
-		middleware := OPAMiddleware(opaModule, openAPISpec, &envs, partialEvaluators)
+		middleware := OPAMiddleware(NewPoliciesStore(opaModule, partialEvaluators), openAPISpec, &envs)
 		builtHandler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			permission, err := GetXPermission(r.Context())
 			require.True(t, err == nil, "Unexpected error")
@@ -362,6 +494,553 @@ func TestGetHeaderFunction(t *testing.T) {
 	})
 }
 
+func TestGetHeaderAllFunction(t *testing.T) {
+	env := config.EnvironmentVariables{}
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { get_header_all("X-FoRwArDeD-FoR", input.headers) == ["10.0.0.1", "10.0.0.2"] }
+		empty { get_header_all("missing", input.headers) == [] }`,
+	}
+
+	evaluate := func(t *testing.T, policy string, headers http.Header) bool {
+		t.Helper()
+		inputBytes, err := json.Marshal(map[string]interface{}{"headers": headers})
+		require.NoError(t, err)
+
+		opaEvaluator, err := NewOPAEvaluator(context.Background(), policy, opaModule, inputBytes, env)
+		require.NoError(t, err, "Unexpected error during creation of opaEvaluator")
+
+		results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err, "Unexpected error during rego validation")
+		return results.Allowed()
+	}
+
+	t.Run("returns all the header values", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Add("x-forwarded-for", "10.0.0.1")
+		headers.Add("X-Forwarded-For", "10.0.0.2")
+		require.True(t, evaluate(t, "todo", headers), "The input is not allowed by rego")
+	})
+
+	t.Run("returns a single header value as array", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Add("X-Forwarded-For", "10.0.0.1")
+		require.False(t, evaluate(t, "todo", headers), "Rego policy allows illegal input")
+	})
+
+	t.Run("returns empty array if header key not exists", func(t *testing.T) {
+		headers := http.Header{}
+		headers.Add("Accept", "application/json")
+		require.True(t, evaluate(t, "empty", headers), "Missing header key does not return an empty array")
+	})
+}
+
+func TestGetQueryFunction(t *testing.T) {
+	env := config.EnvironmentVariables{}
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { get_query("ExAmPlEkEy", input.request.query) == "value" }
+		empty { get_query("missing", input.request.query) == "" }`,
+	}
+
+	evaluate := func(t *testing.T, policy string, query url.Values) bool {
+		t.Helper()
+		inputBytes, err := json.Marshal(Input{Request: InputRequest{Query: query}})
+		require.NoError(t, err)
+
+		opaEvaluator, err := NewOPAEvaluator(context.Background(), policy, opaModule, inputBytes, env)
+		require.NoError(t, err, "Unexpected error during creation of opaEvaluator")
+
+		results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err, "Unexpected error during rego validation")
+		return results.Allowed()
+	}
+
+	t.Run("if query key exists", func(t *testing.T) {
+		require.True(t, evaluate(t, "todo", url.Values{"exampleKey": []string{"value"}}), "The input is not allowed by rego")
+	})
+
+	t.Run("returns the first value of multi-valued query key", func(t *testing.T) {
+		require.True(t, evaluate(t, "todo", url.Values{"EXAMPLEKEY": []string{"value", "other"}}), "The input is not allowed by rego")
+	})
+
+	t.Run("prefers the exact query key", func(t *testing.T) {
+		require.True(t, evaluate(t, "todo", url.Values{"ExAmPlEkEy": []string{"value"}, "examplekey": []string{"other"}}), "The input is not allowed by rego")
+	})
+
+	t.Run("if query key not exists", func(t *testing.T) {
+		require.False(t, evaluate(t, "todo", url.Values{"anotherKey": []string{"value"}}), "Rego policy allows illegal input")
+		require.True(t, evaluate(t, "empty", url.Values{"anotherKey": []string{"value"}}), "Missing query key does not return an empty string")
+	})
+}
+
+func TestTimeFunctions(t *testing.T) {
+	env := config.EnvironmentVariables{}
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { now() < parse_time(input.user.properties.validUntil) }`,
+	}
+	input := []byte(`{"user":{"properties":{"validUntil":"2022-10-01T18:00:00+02:00"}}}`)
+	before := time.Date(2022, time.October, 1, 15, 59, 59, 0, time.UTC)
+	after := time.Date(2022, time.October, 1, 16, 0, 1, 0, time.UTC)
+
+	frozenClock := func(frozenTime time.Time) context.Context {
+		return WithEvaluationClock(context.Background(), func() time.Time { return frozenTime })
+	}
+
+	t.Run("evaluator", func(t *testing.T) {
+		evaluate := func(t *testing.T, ctx context.Context, input []byte) bool {
+			t.Helper()
+			opaEvaluator, err := NewOPAEvaluator(ctx, "todo", opaModule, input, env)
+			require.NoError(t, err, "Unexpected error during creation of opaEvaluator")
+
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err, "Unexpected error during rego validation")
+			return results.Allowed()
+		}
+
+		require.True(t, evaluate(t, frozenClock(before), input), "The input is not allowed before the threshold")
+		require.False(t, evaluate(t, frozenClock(after), input), "Rego policy allows input after the threshold")
+	})
+
+	t.Run("partial evaluator", func(t *testing.T) {
+		partialResult, err := NewPartialResultEvaluator(context.Background(), "todo", opaModule, nil, env)
+		require.NoError(t, err)
+		evaluators := PartialResultsEvaluators{"todo": PartialEvaluator{PartialEvaluator: partialResult}}
+
+		evaluate := func(t *testing.T, ctx context.Context, input []byte) bool {
+			t.Helper()
+			opaEvaluator, err := evaluators.GetEvaluatorFromPolicy(ctx, "todo", input, env)
+			require.NoError(t, err)
+
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err, "Unexpected error during rego validation")
+			return results.Allowed()
+		}
+
+		require.True(t, evaluate(t, frozenClock(before), input), "The input is not allowed before the threshold")
+		require.False(t, evaluate(t, frozenClock(after), input), "Rego policy allows input after the threshold")
+	})
+
+	t.Run("defaults to the current time", func(t *testing.T) {
+		opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, []byte(`{"user":{"properties":{"validUntil":"2100-01-01T00:00:00Z"}}}`), env)
+		require.NoError(t, err)
+
+		results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err)
+		require.True(t, results.Allowed(), "The input is not allowed by rego")
+	})
+
+	t.Run("invalid timestamp is undefined", func(t *testing.T) {
+		opaEvaluator, err := NewOPAEvaluator(frozenClock(before), "todo", opaModule, []byte(`{"user":{"properties":{"validUntil":"tomorrow"}}}`), env)
+		require.NoError(t, err)
+
+		results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err)
+		require.False(t, results.Allowed(), "Rego policy allows invalid timestamp")
+	})
+}
+
+func TestDeterministicEvaluation(t *testing.T) {
+	env := config.EnvironmentVariables{}
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+business_hours {
+	[hour, _, _] := time.clock([now(), "Europe/Rome"])
+	hour >= 9
+	hour < 18
+}
+canary [result] {
+	result := {"bucket": rand.intn("canary", 100), "id": uuid.rfc4122("request")}
+}`,
+	}
+	partialResult, err := NewPartialResultEvaluator(context.Background(), "business_hours", opaModule, nil, env)
+	require.NoError(t, err)
+	evaluators := PartialResultsEvaluators{"business_hours": PartialEvaluator{PartialEvaluator: partialResult}}
+
+	t.Run("time-gated policy", func(t *testing.T) {
+		evaluate := func(t *testing.T, at time.Time) bool {
+			t.Helper()
+			ctx := WithDeterministicEvaluation(context.Background(), at, 1)
+			opaEvaluator, err := evaluators.GetEvaluatorFromPolicy(ctx, "business_hours", []byte(`{}`), env)
+			require.NoError(t, err)
+
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			return results.Allowed()
+		}
+
+		require.True(t, evaluate(t, time.Date(2022, time.October, 3, 8, 30, 0, 0, time.UTC)), "Rego policy denies business hours")
+		require.False(t, evaluate(t, time.Date(2022, time.October, 3, 16, 30, 0, 0, time.UTC)), "Rego policy allows after business hours")
+	})
+
+	t.Run("seeded randomness", func(t *testing.T) {
+		evaluate := func(t *testing.T, seed int64) interface{} {
+			t.Helper()
+			ctx := WithDeterministicEvaluation(context.Background(), time.Now(), seed)
+			opaEvaluator, err := NewOPAEvaluator(ctx, "canary", opaModule, []byte(`{}`), env)
+			require.NoError(t, err)
+
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			return results[0].Expressions[0].Value
+		}
+
+		require.Equal(t, evaluate(t, 42), evaluate(t, 42))
+		require.NotEqual(t, evaluate(t, 42), evaluate(t, 7))
+	})
+}
+
+func TestGroupDescendsFromFunction(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { group_descends_from(input.user.groups[_], "org/team") }`,
+	}
+
+	testCases := []struct {
+		name    string
+		groups  string
+		allowed bool
+	}{
+		{name: "exact match", groups: `["org/team"]`, allowed: true},
+		{name: "descendant", groups: `["other", "org/team/subteam"]`, allowed: true},
+		{name: "parent group", groups: `["org"]`, allowed: false},
+		{name: "sibling with same prefix", groups: `["org/team-a", "org/teamsub"]`, allowed: false},
+		{name: "no groups", groups: `[]`, allowed: false},
+	}
+
+	env := config.EnvironmentVariables{}
+	partialResult, err := NewPartialResultEvaluator(context.Background(), "todo", opaModule, nil, env)
+	require.NoError(t, err)
+	evaluators := PartialResultsEvaluators{"todo": PartialEvaluator{PartialEvaluator: partialResult}}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			input := []byte(fmt.Sprintf(`{"user":{"groups":%s}}`, testCase.groups))
+
+			opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, input, env)
+			require.NoError(t, err)
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			require.Equal(t, testCase.allowed, results.Allowed())
+
+			opaEvaluator, err = evaluators.GetEvaluatorFromPolicy(context.Background(), "todo", input, env)
+			require.NoError(t, err)
+			results, err = opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			require.Equal(t, testCase.allowed, results.Allowed(), "partial evaluator")
+		})
+	}
+
+	t.Run("custom delimiter", func(t *testing.T) {
+		opaModule := &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+			todo { group_descends_from(input.user.groups[_], "org.team") }`,
+		}
+		env := config.EnvironmentVariables{GroupLevelsDelimiter: "."}
+
+		opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, []byte(`{"user":{"groups":["org.team.subteam"]}}`), env)
+		require.NoError(t, err)
+		results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err)
+		require.True(t, results.Allowed())
+
+		opaEvaluator, err = NewOPAEvaluator(context.Background(), "todo", opaModule, []byte(`{"user":{"groups":["org/team/subteam"]}}`), env)
+		require.NoError(t, err)
+		results, err = opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+		require.NoError(t, err)
+		require.False(t, results.Allowed())
+	})
+}
+
+func TestIPInCIDRFunction(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { ip_in_cidr(input.request.clientIp, input.request.query.cidr[0]) }`,
+	}
+
+	testCases := []struct {
+		name    string
+		ip      string
+		cidr    string
+		allowed bool
+	}{
+		{name: "ipv4 in range", ip: "10.1.2.3", cidr: "10.0.0.0/8", allowed: true},
+		{name: "ipv4 out of range", ip: "192.168.1.1", cidr: "10.0.0.0/8", allowed: false},
+		{name: "ipv6 in range", ip: "2001:db8::1", cidr: "2001:db8::/32", allowed: true},
+		{name: "ipv6 out of range", ip: "2001:db9::1", cidr: "2001:db8::/32", allowed: false},
+		{name: "ipv4 mapped ipv6 in ipv4 range", ip: "::ffff:10.1.2.3", cidr: "10.0.0.0/8", allowed: true},
+		{name: "malformed ip", ip: "10.1.2", cidr: "10.0.0.0/8", allowed: false},
+		{name: "malformed cidr", ip: "10.1.2.3", cidr: "10.0.0.0/33", allowed: false},
+		{name: "missing ip", ip: "", cidr: "10.0.0.0/8", allowed: false},
+	}
+
+	env := config.EnvironmentVariables{}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			query := url.Values{"cidr": []string{testCase.cidr}}
+			input, err := json.Marshal(map[string]interface{}{"request": map[string]interface{}{"query": query, "clientIp": testCase.ip}})
+			require.NoError(t, err)
+
+			opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, input, env)
+			require.NoError(t, err)
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			require.Equal(t, testCase.allowed, results.Allowed())
+		})
+	}
+}
+
+func TestInAllowedSetFunction(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { in_allowed_set(input.request.query.value[0], input.request.query.set[0]) }`,
+		Data: map[string]interface{}{
+			"sets": map[string]interface{}{
+				"countries": []interface{}{"it", "fr"},
+				"roles":     map[string]interface{}{"admin": true},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name    string
+		value   string
+		set     string
+		allowed bool
+		err     string
+	}{
+		{name: "array member", value: "it", set: "sets.countries", allowed: true},
+		{name: "array non member", value: "de", set: "sets.countries", allowed: false},
+		{name: "object member", value: "admin", set: "sets.roles", allowed: true},
+		{name: "object non member", value: "guest", set: "sets.roles", allowed: false},
+		{name: "missing set", value: "it", set: "sets.languages", err: "allowed set sets.languages not found in data"},
+		{name: "set is not a collection", value: "it", set: "sets.roles.admin", err: "allowed set sets.roles.admin is neither an array nor an object"},
+	}
+
+	env := config.EnvironmentVariables{}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			query := url.Values{"value": []string{testCase.value}, "set": []string{testCase.set}}
+			input, err := json.Marshal(map[string]interface{}{"request": map[string]interface{}{"query": query}})
+			require.NoError(t, err)
+
+			opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, input, env)
+			require.NoError(t, err)
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			if testCase.err != "" {
+				require.ErrorContains(t, err, testCase.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.allowed, results.Allowed())
+		})
+	}
+}
+
+func TestHTTPGetJSONFunction(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { http_get_json(input.request.query.url[0]).enabled }
+		fallback { not http_get_json(input.request.query.url[0]) }
+		flags_enabled { http_get_json("http://flags.example.com/flags").enabled }`,
+	}
+	env := config.EnvironmentVariables{}
+
+	evaluate := func(t *testing.T, fetcher *custom_builtins.HTTPResourceFetcher, policy, resourceURL string) bool {
+		t.Helper()
+		query := url.Values{"url": []string{resourceURL}}
+		input, err := json.Marshal(map[string]interface{}{"request": map[string]interface{}{"query": query}})
+		require.NoError(t, err)
+
+		ctx := custom_builtins.WithHTTPResourceFetcher(context.Background(), fetcher)
+		opaEvaluator, err := NewOPAEvaluator(ctx, policy, opaModule, input, env)
+		require.NoError(t, err)
+		results, err := opaEvaluator.PolicyEvaluator.Eval(ctx)
+		require.NoError(t, err)
+		return results.Allowed()
+	}
+
+	t.Run("fetches and caches the resource of an allowed host", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Times(1).
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": true})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, time.Second, time.Minute)
+		require.True(t, evaluate(t, fetcher, "todo", "http://flags.example.com/flags"))
+		require.True(t, gock.IsDone())
+		// served from the cache, since the mock has already been consumed
+		require.True(t, evaluate(t, fetcher, "todo", "http://flags.example.com/flags"))
+	})
+
+	t.Run("fetches the resource on each evaluation of the partial results", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Times(1).
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": true})
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": false})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, time.Second, time.Nanosecond)
+		ctx := custom_builtins.WithHTTPResourceFetcher(context.Background(), fetcher)
+		partialEvaluator, err := NewPartialResultEvaluator(ctx, "flags_enabled", opaModule, nil, env)
+		require.NoError(t, err)
+		partialEvaluators := PartialResultsEvaluators{"flags_enabled": {PartialEvaluator: partialEvaluator}}
+
+		for _, enabled := range []bool{true, false} {
+			opaEvaluator, err := partialEvaluators.GetEvaluatorFromPolicy(ctx, "flags_enabled", []byte(`{}`), env)
+			require.NoError(t, err)
+			results, err := opaEvaluator.PolicyEvaluator.Eval(ctx)
+			require.NoError(t, err)
+			require.Equal(t, enabled, results.Allowed())
+		}
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("refuses a host not allowed", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://other.example.com").
+			Get("/flags").
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": true})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, time.Second, time.Minute)
+		require.False(t, evaluate(t, fetcher, "todo", "http://other.example.com/flags"))
+		require.True(t, evaluate(t, fetcher, "fallback", "http://other.example.com/flags"))
+		require.False(t, gock.IsDone())
+
+		_, err := fetcher.Fetch(context.Background(), "http://other.example.com/flags")
+		require.EqualError(t, err, "host other.example.com is not allowed")
+	})
+
+	t.Run("fails when the host does not respond in time", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Times(3).
+			Reply(200).
+			Delay(200 * time.Millisecond).
+			JSON(map[string]interface{}{"enabled": true})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, 50*time.Millisecond, time.Minute)
+		require.False(t, evaluate(t, fetcher, "todo", "http://flags.example.com/flags"))
+		require.True(t, evaluate(t, fetcher, "fallback", "http://flags.example.com/flags"))
+
+		_, err := fetcher.Fetch(context.Background(), "http://flags.example.com/flags")
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		require.True(t, netErr.Timeout(), "unexpected error %s", err)
+	})
+
+	t.Run("refuses a redirect to a host not allowed", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Reply(http.StatusFound).
+			SetHeader("Location", "http://internal.example.com/secrets")
+		gock.New("http://internal.example.com").
+			Get("/secrets").
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": true})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, time.Second, time.Minute)
+		require.False(t, evaluate(t, fetcher, "todo", "http://flags.example.com/flags"))
+		require.False(t, gock.IsDone(), "redirect to a host not allowed must not be followed")
+
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Reply(http.StatusFound).
+			SetHeader("Location", "http://internal.example.com/secrets")
+		_, err := fetcher.Fetch(context.Background(), "http://flags.example.com/flags")
+		require.ErrorContains(t, err, "host internal.example.com is not allowed")
+	})
+
+	t.Run("follows a redirect to an allowed host", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Reply(http.StatusFound).
+			SetHeader("Location", "http://cdn.example.com/flags")
+		gock.New("http://cdn.example.com").
+			Get("/flags").
+			Reply(200).
+			JSON(map[string]interface{}{"enabled": true})
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com", "cdn.example.com"}, time.Second, time.Minute)
+		require.True(t, evaluate(t, fetcher, "todo", "http://flags.example.com/flags"))
+		require.True(t, gock.IsDone())
+	})
+
+	t.Run("refuses a response body too large", func(t *testing.T) {
+		defer gock.Off()
+		gock.New("http://flags.example.com").
+			Get("/flags").
+			Reply(200).
+			BodyString(fmt.Sprintf(`{"enabled": true, "padding": %q}`, strings.Repeat("a", 1<<20)))
+
+		fetcher := custom_builtins.NewHTTPResourceFetcher([]string{"flags.example.com"}, time.Second, time.Minute)
+		_, err := fetcher.Fetch(context.Background(), "http://flags.example.com/flags")
+		require.ErrorContains(t, err, "returned a body larger than")
+	})
+}
+
+func TestSafeRegexMatchFunction(t *testing.T) {
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+		todo { safe_regex_match(input.request.query.pattern[0], input.request.query.value[0]) }`,
+	}
+
+	testCases := []struct {
+		name    string
+		pattern string
+		value   string
+		allowed bool
+	}{
+		{name: "valid match", pattern: "^tenant-[0-9]+$", value: "tenant-42", allowed: true},
+		{name: "non match", pattern: "^tenant-[0-9]+$", value: "tenant-abc", allowed: false},
+		{name: "invalid pattern", pattern: "tenant-(", value: "tenant-(", allowed: false},
+		{name: "pathological nested repetition", pattern: "((a{10}){10}){20}", value: strings.Repeat("a", 2000), allowed: false},
+		{name: "pathological repetition", pattern: "(ab|cd|ef){1000}", value: strings.Repeat("ab", 1000), allowed: false},
+		{name: "too long pattern", pattern: strings.Repeat("a", 2000), value: strings.Repeat("a", 2000), allowed: false},
+	}
+
+	env := config.EnvironmentVariables{}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			query := url.Values{"pattern": []string{testCase.pattern}, "value": []string{testCase.value}}
+			input, err := json.Marshal(map[string]interface{}{"request": map[string]interface{}{"query": query}})
+			require.NoError(t, err)
+
+			opaEvaluator, err := NewOPAEvaluator(context.Background(), "todo", opaModule, input, env)
+			require.NoError(t, err)
+			results, err := opaEvaluator.PolicyEvaluator.Eval(context.TODO())
+			require.NoError(t, err)
+			require.Equal(t, testCase.allowed, results.Allowed())
+		})
+	}
+}
+
 func TestGetOPAModuleConfig(t *testing.T) {
 	t.Run(`GetOPAModuleConfig fails because no key has been passed`, func(t *testing.T) {
 		ctx := context.Background()
@@ -378,6 +1057,134 @@ func TestGetOPAModuleConfig(t *testing.T) {
 	})
 }
 
+func TestLoadRegoModule(t *testing.T) {
+	t.Run("loads every rego module in directory", func(t *testing.T) {
+		opaModuleConfig, err := loadRegoModule("./mocks/rego-policies-multi-module")
+		require.NoError(t, err)
+		require.Equal(t, "common/shared.rego", opaModuleConfig.Name)
+		require.Len(t, opaModuleConfig.AdditionalModules, 1)
+		require.Equal(t, "policies.rego", opaModuleConfig.AdditionalModules[0].Name)
+
+		input := []byte(`{"user":{"groups":["admin"]}}`)
+		evaluator, err := NewOPAEvaluator(context.Background(), "allow_with_shared_rule", opaModuleConfig, input, envs)
+		require.NoError(t, err)
+
+		result, err := evaluator.PolicyEvaluator.Eval(context.Background())
+		require.NoError(t, err)
+		require.True(t, result.Allowed(), "rule defined in another module not resolved")
+	})
+
+	t.Run("loads modules with the same file name in different directories", func(t *testing.T) {
+		directory := t.TempDir()
+		writeModule := func(subdirectory, content string) {
+			require.NoError(t, os.MkdirAll(filepath.Join(directory, subdirectory), 0700))
+			require.NoError(t, os.WriteFile(filepath.Join(directory, subdirectory, "policies.rego"), []byte(content), 0600))
+		}
+		writeModule("users", `package policies
+allow_users { is_billing_admin }
+is_users_admin { input.user.groups[_] == "users-admin" }`)
+		writeModule("billing", `package policies
+allow_billing { is_users_admin }
+is_billing_admin { input.user.groups[_] == "billing-admin" }`)
+
+		opaModuleConfig, err := loadRegoModule(directory)
+		require.NoError(t, err)
+		require.Equal(t, "billing/policies.rego", opaModuleConfig.Name)
+		require.Len(t, opaModuleConfig.AdditionalModules, 1)
+		require.Equal(t, "users/policies.rego", opaModuleConfig.AdditionalModules[0].Name)
+
+		for policy, group := range map[string]string{"allow_users": "billing-admin", "allow_billing": "users-admin"} {
+			input := []byte(fmt.Sprintf(`{"user":{"groups":[%q]}}`, group))
+			evaluator, err := NewOPAEvaluator(context.Background(), policy, opaModuleConfig, input, envs)
+			require.NoError(t, err)
+
+			result, err := evaluator.PolicyEvaluator.Eval(context.Background())
+			require.NoError(t, err)
+			require.True(t, result.Allowed(), "rule of %s not resolved", policy)
+		}
+	})
+
+	t.Run("fails on empty directory", func(t *testing.T) {
+		_, err := loadRegoModule("./mocks/empty-dir")
+		require.EqualError(t, err, "no rego module found in directory")
+	})
+
+	t.Run("fails reporting the module that cannot be parsed", func(t *testing.T) {
+		_, err := loadRegoModule("./mocks/rego-policies-invalid")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed rego file parse mocks/rego-policies-invalid/broken.rego")
+	})
+}
+
+func TestLoadPoliciesFromDirectory(t *testing.T) {
+	directory := t.TempDir()
+	policy := `package policies
+allow {
+	data.roleHierarchy[input.user.groups[_]][_] == "editor"
+}`
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "policies.rego"), []byte(policy), 0600))
+
+	writeDataFile := func(t *testing.T, content string) string {
+		t.Helper()
+		dataFilePath := filepath.Join(t.TempDir(), "data.json")
+		require.NoError(t, os.WriteFile(dataFilePath, []byte(content), 0600))
+		return dataFilePath
+	}
+
+	t.Run("provides data file to the policies", func(t *testing.T) {
+		dataFilePath := writeDataFile(t, `{"roleHierarchy":{"admin":["editor","viewer"],"editor":["viewer"]}}`)
+		opaModuleConfig, err := loadPoliciesFromDirectory(directory, dataFilePath)
+		require.NoError(t, err)
+
+		partialResult, err := NewPartialResultEvaluator(context.Background(), "allow", opaModuleConfig, nil, envs)
+		require.NoError(t, err)
+		evaluators := PartialResultsEvaluators{"allow": PartialEvaluator{PartialEvaluator: partialResult}}
+
+		for _, testCase := range []struct {
+			input    string
+			expected bool
+		}{
+			{input: `{"user":{"groups":["admin"]}}`, expected: true},
+			{input: `{"user":{"groups":["editor"]}}`, expected: false},
+		} {
+			evaluator, err := NewOPAEvaluator(context.Background(), "allow", opaModuleConfig, []byte(testCase.input), envs)
+			require.NoError(t, err)
+			result, err := evaluator.PolicyEvaluator.Eval(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, result.Allowed(), "unexpected evaluator result for %s", testCase.input)
+
+			evaluator, err = evaluators.GetEvaluatorFromPolicy(context.Background(), "allow", []byte(testCase.input), envs)
+			require.NoError(t, err)
+			result, err = evaluator.PolicyEvaluator.Eval(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, result.Allowed(), "unexpected partial evaluator result for %s", testCase.input)
+		}
+	})
+
+	t.Run("loads only rego modules without data file", func(t *testing.T) {
+		opaModuleConfig, err := loadPoliciesFromDirectory(directory, "")
+		require.NoError(t, err)
+		require.Nil(t, opaModuleConfig.Data)
+	})
+
+	t.Run("fails on missing data file", func(t *testing.T) {
+		_, err := loadPoliciesFromDirectory(directory, filepath.Join(t.TempDir(), "missing.json"))
+		require.ErrorIs(t, err, ErrFileLoadFailed)
+	})
+
+	t.Run("fails on invalid data file", func(t *testing.T) {
+		_, err := loadPoliciesFromDirectory(directory, writeDataFile(t, `["not", "an", "object"]`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed data file parse")
+	})
+
+	t.Run("fails on data file defining resources", func(t *testing.T) {
+		dataFilePath := writeDataFile(t, `{"resources":[]}`)
+		_, err := loadPoliciesFromDirectory(directory, dataFilePath)
+		require.EqualError(t, err, fmt.Sprintf("data file %s must not define the resources document", dataFilePath))
+	})
+}
+
 func getResponseBody(t *testing.T, w *httptest.ResponseRecorder) []byte {
 	t.Helper()
 
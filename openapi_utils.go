@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -24,14 +25,21 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
 
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/ghodss/yaml"
+	"github.com/mia-platform/glogger/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/uptrace/bunrouter"
 )
@@ -49,10 +57,19 @@ var OasSupportedHTTPMethods = []string{
 
 var ErrNotFoundOASDefinition = errors.New("not found oas definition")
 
+// ErrEmptyOAS is returned by requireNonEmptyOAS when the loaded OAS declares no path.
+var ErrEmptyOAS = errors.New("OAS declares no path")
+
+// ErrStaleOAS is returned together with the cached OAS when its refresh failed.
+var ErrStaleOAS = errors.New("stale OAS")
+
 type XPermissionKey struct{}
 
 type PermissionOptions struct {
 	EnableResourcePermissionsMapOptimization bool `json:"enableResourcePermissionsMapOptimization"`
+	// ResourcePermission is the permission used to build `input.user.resourcePermissions`,
+	// the map is not provided to the policies when empty.
+	ResourcePermission string `json:"resourcePermission,omitempty"`
 }
 
 // Config v1 //
@@ -63,6 +80,10 @@ type ResourceFilter struct {
 type RowFilterConfiguration struct {
 	HeaderKey string `json:"headerKey"`
 	Enabled   bool   `json:"enabled"`
+	Dialect   string `json:"dialect"`
+	// Target selects where the query is sent to the target service, either header (default) or query.
+	Target         string `json:"target"`
+	QueryParamName string `json:"queryParamName"`
 }
 
 type ResponseFilterConfiguration struct {
@@ -79,18 +100,88 @@ type XPermission struct {
 // END Config v1 //
 
 // Config v2 //
+const (
+	RowFilterTargetHeader = "header"
+	RowFilterTargetQuery  = "query"
+)
+
 type QueryOptions struct {
 	HeaderName string `json:"headerName"`
+	// Dialect selects the generated query language, either mongo (default) or sql.
+	Dialect string `json:"dialect"`
+	// Target selects where the query is sent to the target service: the HeaderName header (default)
+	// or, with query, the QueryParamName query parameter.
+	Target         string `json:"target"`
+	QueryParamName string `json:"queryParamName"`
+}
+
+// OnDenyOptions customizes the response returned when the request policy is not satisfied.
+type OnDenyOptions struct {
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
 }
 
+const (
+	PoliciesCombinatorAll = "all"
+	PoliciesCombinatorAny = "any"
+)
+
 type RequestFlow struct {
-	PolicyName    string       `json:"policyName"`
-	GenerateQuery bool         `json:"generateQuery"`
-	QueryOptions  QueryOptions `json:"queryOptions"`
+	PolicyName    string        `json:"policyName"`
+	GenerateQuery bool          `json:"generateQuery"`
+	QueryOptions  QueryOptions  `json:"queryOptions"`
+	OnDeny        OnDenyOptions `json:"onDeny"`
+	// Policies lists the allow policies to evaluate in place of PolicyName,
+	// combined according to Combinator: all (default) or any of them must allow the request.
+	Policies   []string `json:"policies,omitempty"`
+	Combinator string   `json:"combinator,omitempty"`
+	// BodySchemaRef references the component schema, e.g. #/components/schemas/User, which
+	// JSON request bodies are validated against before the policies evaluation.
+	BodySchemaRef string `json:"bodySchemaRef,omitempty"`
+	// BodySchema is the schema referenced by BodySchemaRef, resolved when the OAS is loaded.
+	BodySchema *openapi3.Schema `json:"-"`
+	// DisablePartialCache evaluates the policies with a fresh evaluator for each request in place
+	// of the one precomputed at startup, where the builtins with constant arguments, such as find_one,
+	// are evaluated once and their results frozen. Each request then pays the policies compilation
+	// and the builtins queries, so it should only be enabled for the policies that need it.
+	DisablePartialCache bool `json:"disablePartialCache,omitempty"`
+	// CacheTTL caches the decision of the allow policies for the given duration, e.g. 30s. Decisions
+	// are keyed by the user identity and the CacheKeys input fields, expressed as dot separated paths,
+	// which are the request method and path by default. Query generating routes cannot be cached.
+	CacheTTL  string   `json:"cacheTTL,omitempty"`
+	CacheKeys []string `json:"cacheKeys,omitempty"`
+}
+
+// allowPolicies returns the allow policies of the request flow, either the Policies list
+// or the single PolicyName; the result is empty when no allow policy is configured.
+func (flow RequestFlow) allowPolicies() []string {
+	if len(flow.Policies) > 0 {
+		return flow.Policies
+	}
+	if flow.PolicyName == "" {
+		return nil
+	}
+	return []string{flow.PolicyName}
+}
+
+// cacheTTL returns the duration the decisions are cached for, zero when caching is disabled.
+func (flow RequestFlow) cacheTTL() (time.Duration, error) {
+	if flow.CacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(flow.CacheTTL)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid cache TTL %s: must be a positive duration", flow.CacheTTL)
+	}
+	return ttl, nil
 }
 
 type ResponseFlow struct {
 	PolicyName string `json:"policyName"`
+	// FilterItems evaluates the policy for each item of the response list, a top-level array or
+	// the data array of an object, with the item as input.response.body: the items the policy does
+	// not allow are removed, while the other fields of the object are kept.
+	FilterItems bool `json:"filterItems,omitempty"`
 }
 
 type RondConfig struct {
@@ -101,9 +192,14 @@ type RondConfig struct {
 
 // END Config v2 //
 
+// VerbConfig holds the permission configuration of an API, read from the x-rond extension or from
+// the legacy x-permission one, which is ignored when both are present.
 type VerbConfig struct {
 	PermissionV1 *XPermission `json:"x-permission"`
 	PermissionV2 *RondConfig  `json:"x-rond"`
+	// Security lists the alternative security requirements of the operation, each one mapping
+	// the names of the required security schemes to their scopes.
+	Security []map[string][]string `json:"security,omitempty"`
 }
 
 type PathVerbs map[string]VerbConfig
@@ -112,6 +208,8 @@ type OpenAPIPaths map[string]PathVerbs
 
 type OpenAPISpec struct {
 	Paths OpenAPIPaths `json:"paths"`
+	// BodySchemas holds the schemas referenced by the request flows, by reference.
+	BodySchemas map[string]*openapi3.Schema `json:"-"`
 }
 
 type Input struct {
@@ -127,10 +225,20 @@ type InputRequest struct {
 	PathParams map[string]string `json:"pathParams,omitempty"`
 	Method     string            `json:"method"`
 	Path       string            `json:"path"`
+	// PathTemplate is the template of the matched route (e.g. /users/{id}),
+	// falling back to the concrete path when no route has been matched.
+	PathTemplate string `json:"pathTemplate"`
+	// Cookies holds the raw request cookie values, which are not URL decoded;
+	// when a cookie is sent more than once, only the first value is kept.
+	Cookies map[string]string `json:"cookies,omitempty"`
+	// ClientIP is the IP address of the client, taken from X-Forwarded-For when trusted.
+	ClientIP string `json:"clientIp,omitempty"`
 }
 
 type InputResponse struct {
-	Body interface{} `json:"body,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+	StatusCode int         `json:"statusCode,omitempty"`
+	Headers    http.Header `json:"headers,omitempty"`
 }
 
 type PermissionOnResourceKey string
@@ -141,12 +249,17 @@ func buildPermissionOnResourceKey(permission string, resourceType string, resour
 	return PermissionOnResourceKey(fmt.Sprintf("%s:%s:%s", permission, resourceType, resourceId))
 }
 
+// ResourcePermissions maps each resource type to the set of resource ids the user is granted a permission on.
+type ResourcePermissions map[string]map[string]bool
+
 type InputUser struct {
 	Properties             map[string]interface{}   `json:"properties,omitempty"`
 	Groups                 []string                 `json:"groups,omitempty"`
 	Bindings               []types.Binding          `json:"bindings,omitempty"`
 	Roles                  []types.Role             `json:"roles,omitempty"`
 	ResourcePermissionsMap PermissionsOnResourceMap `json:"resourcePermissionsMap,omitempty"`
+	ResourcePermissions    ResourcePermissions      `json:"resourcePermissions,omitempty"`
+	Token                  map[string]interface{}   `json:"token,omitempty"`
 }
 
 func cleanWildcard(path string) string {
@@ -157,61 +270,158 @@ func cleanWildcard(path string) string {
 	return path
 }
 
-type RoutesMap map[string]bool
+var matchRouterParams = regexp.MustCompile(`/:\w+`)
+
+// routerPathKey returns the key identifying the router node the path is registered to:
+// paths differing only by the names of their parameters are handled by the same node.
+func routerPathKey(routerPath string) string {
+	return matchRouterParams.ReplaceAllString(routerPath, "/:")
+}
 
-func (oas *OpenAPISpec) createRoutesMap() RoutesMap {
-	routesMap := make(RoutesMap)
-	for OASPath, OASContent := range oas.Paths {
-		for method := range OASContent {
-			route := OASPath + "/" + strings.ToUpper(method)
-			routesMap[route] = true
+// oasRoute is an OAS operation along with the constraints its path parameters must satisfy.
+type oasRoute struct {
+	routerPath  string
+	constraints map[int]*regexp.Regexp
+	handler     http.HandlerFunc
+	allMethods  bool
+}
+
+// precedence returns the rank of the route among the ones sharing the same router node:
+// explicit methods come before the ALL ones, and constrained routes before unconstrained ones.
+func (route oasRoute) precedence() int {
+	rank := 0
+	if route.allMethods {
+		rank += 2
+	}
+	if len(route.constraints) == 0 {
+		rank++
+	}
+	return rank
+}
+
+func (route oasRoute) matches(params []bunrouter.Param) bool {
+	for paramIndex, constraint := range route.constraints {
+		if paramIndex >= len(params) || !constraint.MatchString(params[paramIndex].Value) {
+			return false
 		}
 	}
-	return routesMap
+	return true
 }
 
-func (rMap RoutesMap) contains(path string, method string) bool {
-	route := path + "/" + method
-	_, hasRoute := rMap[route]
-	return hasRoute
+// createOasRoutesHandler handles the request with the first route whose constraints
+// are satisfied, so that non-matching parameters fall through to the following routes.
+func createOasRoutesHandler(routes []oasRoute) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := bunrouter.ParamsFromContext(r.Context()).Slice()
+		for _, route := range routes {
+			if route.matches(params) {
+				route.handler(w, r)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}
 }
 
 func createOasHandler(scopedMethodContent VerbConfig) func(http.ResponseWriter, *http.Request) {
 	permission := scopedMethodContent.PermissionV2
+	if permission == nil {
+		permission = &RondConfig{}
+	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		header := w.Header()
 		header.Set("allow", permission.RequestFlow.PolicyName)
+		header.Set("requestFlow.policies", strings.Join(permission.RequestFlow.Policies, ","))
+		header.Set("requestFlow.combinator", permission.RequestFlow.Combinator)
+		header.Set("requestFlow.bodySchemaRef", permission.RequestFlow.BodySchemaRef)
+		header.Set("requestFlow.disablePartialCache", strconv.FormatBool(permission.RequestFlow.DisablePartialCache))
+		header.Set("requestFlow.cacheTTL", permission.RequestFlow.CacheTTL)
+		header.Set("requestFlow.cacheKeys", strings.Join(permission.RequestFlow.CacheKeys, ","))
 		header.Set("resourceFilter.rowFilter.enabled", strconv.FormatBool(permission.RequestFlow.GenerateQuery))
 		header.Set("resourceFilter.rowFilter.headerKey", permission.RequestFlow.QueryOptions.HeaderName)
+		header.Set("resourceFilter.rowFilter.dialect", permission.RequestFlow.QueryOptions.Dialect)
+		header.Set("resourceFilter.rowFilter.target", permission.RequestFlow.QueryOptions.Target)
+		header.Set("resourceFilter.rowFilter.queryParamName", permission.RequestFlow.QueryOptions.QueryParamName)
+		header.Set("requestFlow.onDeny.statusCode", strconv.Itoa(permission.RequestFlow.OnDeny.StatusCode))
+		header.Set("requestFlow.onDeny.message", permission.RequestFlow.OnDeny.Message)
 		header.Set("responseFilter.policy", permission.ResponseFlow.PolicyName)
+		header.Set("responseFilter.filterItems", strconv.FormatBool(permission.ResponseFlow.FilterItems))
 		header.Set("options.enableResourcePermissionsMapOptimization", strconv.FormatBool(permission.Options.EnableResourcePermissionsMapOptimization))
+		header.Set("options.resourcePermission", permission.Options.ResourcePermission)
+	}
+}
+
+// withLowerCasedPaths returns a copy of the specification with the static segments of the paths
+// lower cased, to find the permission of a lower cased request path.
+func (oas *OpenAPISpec) withLowerCasedPaths() *OpenAPISpec {
+	paths := make(OpenAPIPaths, len(oas.Paths))
+	for path, verbs := range oas.Paths {
+		lowerCasedPath := lowerStaticSegments(path)
+		if paths[lowerCasedPath] == nil {
+			paths[lowerCasedPath] = PathVerbs{}
+		}
+		for verb, verbConfig := range verbs {
+			paths[lowerCasedPath][verb] = verbConfig
+		}
 	}
+	return &OpenAPISpec{Paths: paths, BodySchemas: oas.BodySchemas}
 }
 
 func (oas *OpenAPISpec) PrepareOASRouter() *bunrouter.CompatRouter {
 	OASRouter := bunrouter.New().Compat()
-	routeMap := oas.createRoutesMap()
-	for OASPath, OASContent := range oas.Paths {
 
-		OASPathCleaned := convertPathVariablesToColons(cleanWildcard(OASPath))
-		for method, methodContent := range OASContent {
-			scopedMethod := strings.ToUpper(method)
-
-			handler := createOasHandler(methodContent)
+	OASPaths := make([]string, 0, len(oas.Paths))
+	for OASPath := range oas.Paths {
+		OASPaths = append(OASPaths, OASPath)
+	}
+	sort.Strings(OASPaths)
+
+	// routes sharing the same router node and method are collected and registered with a single
+	// handler, so that the order in which paths and methods are declared does not matter.
+	routeKeys := []string{}
+	routes := map[string][]oasRoute{}
+	addRoute := func(method string, route oasRoute) {
+		routeKey := method + " " + routerPathKey(route.routerPath)
+		if _, ok := routes[routeKey]; !ok {
+			routeKeys = append(routeKeys, routeKey)
+		}
+		routes[routeKey] = append(routes[routeKey], route)
+	}
 
-			if scopedMethod != strings.ToUpper(AllHTTPMethod) {
-				OASRouter.Handle(scopedMethod, OASPathCleaned, handler)
-				continue
+	for _, OASPath := range OASPaths {
+		constraints, err := pathParamsConstraints(OASPath)
+		if err != nil {
+			// constraints are validated when the specification is loaded
+			continue
+		}
+		OASPathCleaned := convertPathVariablesToColons(cleanWildcard(OASPath))
+		for method, methodContent := range oas.Paths[OASPath] {
+			route := oasRoute{
+				routerPath:  OASPathCleaned,
+				constraints: constraints,
+				handler:     createOasHandler(methodContent),
 			}
-
-			for _, method := range OasSupportedHTTPMethods {
-				if !routeMap.contains(OASPath, method) {
-					OASRouter.Handle(method, OASPathCleaned, handler)
+			scopedMethod := strings.ToUpper(method)
+			if scopedMethod == strings.ToUpper(AllHTTPMethod) {
+				route.allMethods = true
+				for _, method := range OasSupportedHTTPMethods {
+					addRoute(method, route)
 				}
+				continue
 			}
+			addRoute(scopedMethod, route)
 		}
 	}
 
+	for _, routeKey := range routeKeys {
+		keyRoutes := routes[routeKey]
+		sort.SliceStable(keyRoutes, func(i, j int) bool {
+			return keyRoutes[i].precedence() < keyRoutes[j].precedence()
+		})
+		method := strings.SplitN(routeKey, " ", 2)[0]
+		OASRouter.Handle(method, keyRoutes[0].routerPath, createOasRoutesHandler(keyRoutes))
+	}
+
 	return OASRouter
 }
 
@@ -229,25 +439,61 @@ func (oas *OpenAPISpec) FindPermission(OASRouter *bunrouter.CompatRouter, path s
 	recorderResult := recorder.Result()
 	rowFilterEnabled, err := strconv.ParseBool(recorderResult.Header.Get("resourceFilter.rowFilter.enabled"))
 	if err != nil {
-		return RondConfig{}, fmt.Errorf("error while parsing rowFilter.enabled: %s", err)
+		return RondConfig{}, fmt.Errorf("error while parsing rowFilter.enabled: %w", err)
 	}
 	enableResourcePermissionsMapOptimization, err := strconv.ParseBool(recorderResult.Header.Get("options.enableResourcePermissionsMapOptimization"))
 	if err != nil {
-		return RondConfig{}, fmt.Errorf("error while parsing rowFilter.enabled: %s", err)
+		return RondConfig{}, fmt.Errorf("error while parsing options.enableResourcePermissionsMapOptimization: %w", err)
+	}
+	disablePartialCache, err := strconv.ParseBool(recorderResult.Header.Get("requestFlow.disablePartialCache"))
+	if err != nil {
+		return RondConfig{}, fmt.Errorf("error while parsing requestFlow.disablePartialCache: %w", err)
+	}
+	filterItems, err := strconv.ParseBool(recorderResult.Header.Get("responseFilter.filterItems"))
+	if err != nil {
+		return RondConfig{}, fmt.Errorf("error while parsing responseFilter.filterItems: %w", err)
+	}
+	onDenyStatusCode, err := strconv.Atoi(recorderResult.Header.Get("requestFlow.onDeny.statusCode"))
+	if err != nil {
+		return RondConfig{}, fmt.Errorf("error while parsing onDeny.statusCode: %w", err)
+	}
+	var policies []string
+	if headerPolicies := recorderResult.Header.Get("requestFlow.policies"); headerPolicies != "" {
+		policies = strings.Split(headerPolicies, ",")
+	}
+	var cacheKeys []string
+	if headerCacheKeys := recorderResult.Header.Get("requestFlow.cacheKeys"); headerCacheKeys != "" {
+		cacheKeys = strings.Split(headerCacheKeys, ",")
 	}
 	return RondConfig{
 		RequestFlow: RequestFlow{
-			PolicyName:    recorderResult.Header.Get("allow"),
-			GenerateQuery: rowFilterEnabled,
+			PolicyName:          recorderResult.Header.Get("allow"),
+			Policies:            policies,
+			Combinator:          recorderResult.Header.Get("requestFlow.combinator"),
+			BodySchemaRef:       recorderResult.Header.Get("requestFlow.bodySchemaRef"),
+			BodySchema:          oas.BodySchemas[recorderResult.Header.Get("requestFlow.bodySchemaRef")],
+			GenerateQuery:       rowFilterEnabled,
+			DisablePartialCache: disablePartialCache,
+			CacheTTL:            recorderResult.Header.Get("requestFlow.cacheTTL"),
+			CacheKeys:           cacheKeys,
 			QueryOptions: QueryOptions{
-				HeaderName: recorderResult.Header.Get("resourceFilter.rowFilter.headerKey"),
+				HeaderName:     recorderResult.Header.Get("resourceFilter.rowFilter.headerKey"),
+				Dialect:        recorderResult.Header.Get("resourceFilter.rowFilter.dialect"),
+				Target:         recorderResult.Header.Get("resourceFilter.rowFilter.target"),
+				QueryParamName: recorderResult.Header.Get("resourceFilter.rowFilter.queryParamName"),
+			},
+			OnDeny: OnDenyOptions{
+				StatusCode: onDenyStatusCode,
+				Message:    recorderResult.Header.Get("requestFlow.onDeny.message"),
 			},
 		},
 		ResponseFlow: ResponseFlow{
-			PolicyName: recorderResult.Header.Get("responseFilter.policy"),
+			PolicyName:  recorderResult.Header.Get("responseFilter.policy"),
+			FilterItems: filterItems,
 		},
 		Options: PermissionOptions{
 			EnableResourcePermissionsMapOptimization: enableResourcePermissionsMapOptimization,
+			ResourcePermission:                       recorderResult.Header.Get("options.resourcePermission"),
 		},
 	}, nil
 }
@@ -258,7 +504,10 @@ func newRondConfigFromPermissionV1(v1Permission *XPermission) *RondConfig {
 			PolicyName:    v1Permission.AllowPermission,
 			GenerateQuery: v1Permission.ResourceFilter.RowFilter.Enabled,
 			QueryOptions: QueryOptions{
-				HeaderName: v1Permission.ResourceFilter.RowFilter.HeaderKey,
+				HeaderName:     v1Permission.ResourceFilter.RowFilter.HeaderKey,
+				Dialect:        v1Permission.ResourceFilter.RowFilter.Dialect,
+				Target:         v1Permission.ResourceFilter.RowFilter.Target,
+				QueryParamName: v1Permission.ResourceFilter.RowFilter.QueryParamName,
 			},
 		},
 		ResponseFlow: ResponseFlow{
@@ -294,12 +543,71 @@ func deserializeSpec(spec []byte, errorWrapper error) (*OpenAPISpec, error) {
 		return nil, fmt.Errorf("%w: unmarshal error: %s", errorWrapper, err.Error())
 	}
 
+	for path := range oas.Paths {
+		if _, err := pathParamsConstraints(path); err != nil {
+			return nil, fmt.Errorf("%w: %s", errorWrapper, err.Error())
+		}
+	}
+
 	adaptOASSpec(&oas)
 
+	if err := resolveBodySchemas(spec, &oas); err != nil {
+		return nil, fmt.Errorf("%w: %s", errorWrapper, err.Error())
+	}
+
 	return &oas, nil
 }
 
+const componentSchemasRefPrefix = "#/components/schemas/"
+
+// resolveBodySchemas resolves the component schemas referenced by the request flows,
+// failing when any of them is not defined in the specification.
+func resolveBodySchemas(spec []byte, oas *OpenAPISpec) error {
+	refs := []string{}
+	for _, verbs := range oas.Paths {
+		for _, verbConfig := range verbs {
+			if verbConfig.PermissionV2 != nil && verbConfig.PermissionV2.RequestFlow.BodySchemaRef != "" {
+				refs = append(refs, verbConfig.PermissionV2.RequestFlow.BodySchemaRef)
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	var components struct {
+		Components struct {
+			Schemas openapi3.Schemas `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &components); err != nil {
+		return fmt.Errorf("invalid component schemas: %s", err.Error())
+	}
+	doc := &openapi3.T{Components: openapi3.Components{Schemas: components.Components.Schemas}}
+	if err := openapi3.NewLoader().ResolveRefsIn(doc, nil); err != nil {
+		return fmt.Errorf("invalid component schemas: %s", err.Error())
+	}
+
+	oas.BodySchemas = map[string]*openapi3.Schema{}
+	for _, ref := range refs {
+		schemaRef, ok := doc.Components.Schemas[strings.TrimPrefix(ref, componentSchemasRefPrefix)]
+		if !strings.HasPrefix(ref, componentSchemasRefPrefix) || !ok || schemaRef.Value == nil {
+			return fmt.Errorf("body schema %s not found", ref)
+		}
+		oas.BodySchemas[ref] = schemaRef.Value
+	}
+	return nil
+}
+
 func fetchOpenAPI(url string) (*OpenAPISpec, error) {
+	content, err := fetchOpenAPIContent(url)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeSpec(content, ErrRequestFailed)
+}
+
+func fetchOpenAPIContent(url string) ([]byte, error) {
 	resp, err := http.DefaultClient.Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", ErrRequestFailed, err)
@@ -311,7 +619,118 @@ func fetchOpenAPI(url string) (*OpenAPISpec, error) {
 	}
 
 	bodyBytes, _ := io.ReadAll(resp.Body)
-	return deserializeSpec(bodyBytes, ErrRequestFailed)
+	return bodyBytes, nil
+}
+
+type cachedOAS struct {
+	spec      *OpenAPISpec
+	content   []byte
+	fetchedAt time.Time
+}
+
+var (
+	oasCacheMutex sync.Mutex
+	oasCache      = map[string]cachedOAS{}
+)
+
+// FetchOpenAPIWithCache fetches the OAS like fetchOpenAPI, but keeps in memory the last
+// successfully parsed spec for the url: the network is hit again only after ttl is expired
+// and, if the new fetch fails, the stale cached spec is returned together with an ErrStaleOAS error.
+// A fetched OAS unchanged from the cached one is returned as the same spec.
+func FetchOpenAPIWithCache(url string, ttl time.Duration) (*OpenAPISpec, error) {
+	oasCacheMutex.Lock()
+	defer oasCacheMutex.Unlock()
+
+	cached, found := oasCache[url]
+	if found && time.Since(cached.fetchedAt) < ttl {
+		return cached.spec, nil
+	}
+
+	content, err := fetchOpenAPIContent(url)
+	if err == nil && found && bytes.Equal(content, cached.content) {
+		cached.fetchedAt = time.Now()
+		oasCache[url] = cached
+		return cached.spec, nil
+	}
+
+	var oas *OpenAPISpec
+	if err == nil {
+		oas, err = deserializeSpec(content, ErrRequestFailed)
+	}
+	if err != nil {
+		if !found {
+			return nil, err
+		}
+		return cached.spec, fmt.Errorf("%w cached at %s: %s", ErrStaleOAS, cached.fetchedAt.Format(time.RFC3339), err.Error())
+	}
+
+	oasCache[url] = cachedOAS{spec: oas, content: content, fetchedAt: time.Now()}
+	return oas, nil
+}
+
+// pollOAS refreshes the OAS fetched from the url every ttl, invoking update when a new spec is
+// fetched; on failed fetches the spec in use is kept. The polling is stopped when the context is done.
+func pollOAS(ctx context.Context, url string, ttl time.Duration, current *OpenAPISpec, update func(*OpenAPISpec) error) {
+	logger := glogger.Get(ctx)
+
+	go func() {
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				oas, err := FetchOpenAPIWithCache(url, ttl)
+				if err != nil {
+					logger.WithFields(logrus.Fields{
+						"oasUrl": url,
+						"error":  logrus.Fields{"message": err.Error()},
+					}).Warn("failed OAS fetch, using stale cached OAS")
+					continue
+				}
+				if oas == current {
+					continue
+				}
+				if err := update(oas); err != nil {
+					logger.WithFields(logrus.Fields{
+						"oasUrl": url,
+						"error":  logrus.Fields{"message": err.Error()},
+					}).Error("failed OAS update, keeping previous OAS")
+					continue
+				}
+				current = oas
+				logger.WithField("oasUrl", url).Info("OAS successfully refreshed")
+			}
+		}
+	}()
+}
+
+// oasDocumentationURL returns the url of the target service documentation when the OAS is
+// fetched from it, that is when no other OAS source is configured.
+func oasDocumentationURL(env config.EnvironmentVariables) string {
+	if env.OASInline != "" || env.APIPermissionsFilePath != "" || env.PermissionsFilePaths != "" || env.TargetServiceOASPath == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s%s", HTTPScheme, env.TargetServiceHost, env.TargetServiceOASPath)
+}
+
+const maxOASFetchBackoff = time.Minute
+
+// oasFetchBackoff returns the time to wait before the next OAS fetch attempt: without a
+// configured backoff it is always 1s, otherwise the backoff is doubled at each attempt.
+func oasFetchBackoff(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 {
+		return time.Second
+	}
+	retryIn := backoff
+	for i := 1; i < attempt && retryIn < maxOASFetchBackoff; i++ {
+		retryIn *= 2
+	}
+	if retryIn > maxOASFetchBackoff {
+		return maxOASFetchBackoff
+	}
+	return retryIn
 }
 
 func readFile(path string) ([]byte, error) {
@@ -323,6 +742,30 @@ func readFile(path string) ([]byte, error) {
 	return fileContentByte, nil
 }
 
+// oasStdinFilePath is the APIPermissionsFilePath value making the OAS read from the standard input.
+const oasStdinFilePath = "-"
+
+// loadOASContent parses an OAS provided as JSON or YAML content.
+func loadOASContent(content []byte) (*OpenAPISpec, error) {
+	if !json.Valid(content) {
+		jsonContent, err := yaml.YAMLToJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unmarshal error: %s", ErrFileLoadFailed, err.Error())
+		}
+		content = jsonContent
+	}
+	return deserializeSpec(content, ErrFileLoadFailed)
+}
+
+// loadOASFromReader reads the whole reader and parses its content as OAS.
+func loadOASFromReader(reader io.Reader) (*OpenAPISpec, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFileLoadFailed, err.Error())
+	}
+	return loadOASContent(content)
+}
+
 func loadOASFile(APIPermissionsFilePath string) (*OpenAPISpec, error) {
 	fileContentByte, err := readFile(APIPermissionsFilePath)
 	if err != nil {
@@ -331,7 +774,19 @@ func loadOASFile(APIPermissionsFilePath string) (*OpenAPISpec, error) {
 	return deserializeSpec(fileContentByte, ErrFileLoadFailed)
 }
 
+// loadOASFromFileOrNetwork loads the OAS from the first configured source among the inline
+// content, the standard input, the file and the target service documentation.
 func loadOASFromFileOrNetwork(log *logrus.Logger, env config.EnvironmentVariables) (*OpenAPISpec, error) {
+	if env.OASInline != "" {
+		log.Debug("Attempt to load inline OAS")
+		return loadOASContent([]byte(env.OASInline))
+	}
+
+	if env.APIPermissionsFilePath == oasStdinFilePath {
+		log.Debug("Attempt to load OAS from standard input")
+		return loadOASFromReader(os.Stdin)
+	}
+
 	if env.APIPermissionsFilePath != "" {
 		log.WithField("oasFilePath", env.APIPermissionsFilePath).Debug("Attempt to load OAS from file")
 		oas, err := loadOASFile(env.APIPermissionsFilePath)
@@ -345,28 +800,137 @@ func loadOASFromFileOrNetwork(log *logrus.Logger, env config.EnvironmentVariable
 		return oas, nil
 	}
 
+	if sources := utils.SplitHeaderValues(env.PermissionsFilePaths, ","); len(sources) > 0 {
+		specs := make([]*OpenAPISpec, 0, len(sources))
+		for _, source := range sources {
+			log.WithField("oasSource", source).Debug("Attempt to load OAS from source")
+			oas, err := loadOASSource(source)
+			if err != nil {
+				log.WithField("oasSource", source).Warn("failed api permissions source read")
+				return nil, err
+			}
+			specs = append(specs, oas)
+		}
+		return mergeOAS(specs, env.OASMergeStrategy)
+	}
+
 	if env.TargetServiceOASPath != "" {
 		log.WithField("oasApiPath", env.TargetServiceOASPath).Debug("Attempt to load OAS from target service")
-		var oas *OpenAPISpec
 		documentationURL := fmt.Sprintf("%s://%s%s", HTTPScheme, env.TargetServiceHost, env.TargetServiceOASPath)
-		for {
-			fetchedOAS, err := fetchOpenAPI(documentationURL)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"targetServiceHost": env.TargetServiceHost,
-					"targetOASPath":     env.TargetServiceOASPath,
-					"error":             logrus.Fields{"message": err.Error()},
-				}).Warn("failed OAS fetch, retry in 1s")
-				time.Sleep(1 * time.Second)
+		for attempt := 1; ; attempt++ {
+			var fetchedOAS *OpenAPISpec
+			var err error
+			if env.OASFetchCacheTTL > 0 {
+				fetchedOAS, err = FetchOpenAPIWithCache(documentationURL, env.OASFetchCacheTTL)
+			} else {
+				fetchedOAS, err = fetchOpenAPI(documentationURL)
+			}
+			if err == nil {
+				return fetchedOAS, nil
+			}
+
+			if env.OASFetchMaxRetries > 0 && attempt > env.OASFetchMaxRetries {
+				return nil, fmt.Errorf("failed OAS fetch after %d attempts: %w", attempt, err)
+			}
+
+			retryIn := oasFetchBackoff(env.OASFetchBackoff, attempt)
+			log.WithFields(logrus.Fields{
+				"targetServiceHost": env.TargetServiceHost,
+				"targetOASPath":     env.TargetServiceOASPath,
+				"attempt":           attempt,
+				"error":             logrus.Fields{"message": err.Error()},
+			}).Warnf("failed OAS fetch, retry in %s", retryIn)
+			time.Sleep(retryIn)
+		}
+	}
+
+	return nil, fmt.Errorf("missing environment variables one of %s, %s, %s or %s is required", config.TargetServiceOASPathEnvKey, config.APIPermissionsFilePathEnvKey, config.PermissionsFilePathsEnvKey, config.OASInlineEnvKey)
+}
+
+// requireNonEmptyOAS fails on an OAS without paths when RequireNonEmptyOAS is set, which would
+// otherwise start a service exposing no permission configuration.
+func requireNonEmptyOAS(oas *OpenAPISpec, env config.EnvironmentVariables) error {
+	if env.RequireNonEmptyOAS && (oas == nil || len(oas.Paths) == 0) {
+		return ErrEmptyOAS
+	}
+	return nil
+}
+
+// applySecuritySchemePolicies configures the operations without permission to evaluate the policy mapped
+// to their security scheme, the first one mapped in the order of the security requirements, sorting the
+// schemes of each requirement by name. The operations without mapped scheme are left untouched.
+func applySecuritySchemePolicies(oas *OpenAPISpec, env config.EnvironmentVariables) error {
+	schemePolicies, err := config.ParseSecuritySchemePolicies(env.SecuritySchemePolicies)
+	if err != nil || len(schemePolicies) == 0 {
+		return err
+	}
+	for _, verbs := range oas.Paths {
+		for verb, verbConfig := range verbs {
+			if verbConfig.PermissionV2 != nil {
 				continue
 			}
-			oas = fetchedOAS
-			break
+			if policyName := securityRequirementsPolicy(verbConfig.Security, schemePolicies); policyName != "" {
+				verbConfig.PermissionV2 = &RondConfig{RequestFlow: RequestFlow{PolicyName: policyName}}
+				verbs[verb] = verbConfig
+			}
 		}
-		return oas, nil
 	}
+	return nil
+}
 
-	return nil, fmt.Errorf("missing environment variables one of %s or %s is required", config.TargetServiceOASPathEnvKey, config.APIPermissionsFilePathEnvKey)
+func securityRequirementsPolicy(requirements []map[string][]string, schemePolicies map[string]string) string {
+	for _, requirement := range requirements {
+		schemes := make([]string, 0, len(requirement))
+		for scheme := range requirement {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		for _, scheme := range schemes {
+			if policyName, ok := schemePolicies[scheme]; ok {
+				return policyName
+			}
+		}
+	}
+	return ""
+}
+
+// loadOASSource loads the OAS from the url, if the source is an HTTP one, or from the file otherwise.
+func loadOASSource(source string) (*OpenAPISpec, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return fetchOpenAPI(source)
+	}
+	return loadOASFile(source)
+}
+
+// mergeOAS combines the paths of the specs, in order. The operations declared by more than
+// one spec make the merge fail, unless the last-wins strategy is used.
+func mergeOAS(specs []*OpenAPISpec, strategy string) (*OpenAPISpec, error) {
+	merged := &OpenAPISpec{Paths: OpenAPIPaths{}}
+	for _, spec := range specs {
+		for path, verbs := range spec.Paths {
+			mergedVerbs, ok := merged.Paths[path]
+			if !ok {
+				mergedVerbs = PathVerbs{}
+				merged.Paths[path] = mergedVerbs
+			}
+			for verb, verbConfig := range verbs {
+				if _, found := mergedVerbs[verb]; found && strategy != config.OASMergeStrategyLastWins {
+					return nil, fmt.Errorf("%w: %s %s declared by more than one source", ErrFileLoadFailed, strings.ToUpper(verb), path)
+				}
+				mergedVerbs[verb] = verbConfig
+			}
+		}
+		for ref, schema := range spec.BodySchemas {
+			if merged.BodySchemas == nil {
+				merged.BodySchemas = map[string]*openapi3.Schema{}
+			}
+			if found, ok := merged.BodySchemas[ref]; ok && !reflect.DeepEqual(found, schema) && strategy != config.OASMergeStrategyLastWins {
+				return nil, fmt.Errorf("%w: body schema %s declared differently by more than one source", ErrFileLoadFailed, ref)
+			}
+			merged.BodySchemas[ref] = schema
+		}
+	}
+	return merged, nil
 }
 
 func WithXPermission(requestContext context.Context, permission *RondConfig) context.Context {
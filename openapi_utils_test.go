@@ -18,9 +18,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mia-platform/glogger/v2"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/h2non/gock.v1"
@@ -132,6 +140,133 @@ func TestFetchOpenAPI(t *testing.T) {
 	})
 }
 
+func TestFetchOpenAPIWithCache(t *testing.T) {
+	t.Run("returns the cached OAS until ttl is expired", func(t *testing.T) {
+		defer gock.Off()
+
+		gock.New("http://localhost:3000").
+			Get("/cached/documentation/json").
+			Times(1).
+			Reply(200).
+			File("./mocks/simplifiedMock.json")
+
+		url := "http://localhost:3000/cached/documentation/json"
+
+		firstSpec, err := FetchOpenAPIWithCache(url, time.Minute)
+		require.NoError(t, err)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+
+		secondSpec, err := FetchOpenAPIWithCache(url, time.Minute)
+		require.NoError(t, err)
+		require.Same(t, firstSpec, secondSpec)
+	})
+
+	t.Run("returns the stale OAS when fetch fails after ttl expiration", func(t *testing.T) {
+		defer gock.Off()
+
+		gock.New("http://localhost:3000").
+			Get("/stale/documentation/json").
+			Reply(200).
+			File("./mocks/simplifiedMock.json")
+		gock.New("http://localhost:3000").
+			Get("/stale/documentation/json").
+			Reply(503).
+			JSON(map[string]string{"error": "ServiceUnavailable"})
+
+		url := "http://localhost:3000/stale/documentation/json"
+
+		firstSpec, err := FetchOpenAPIWithCache(url, time.Nanosecond)
+		require.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+		secondSpec, err := FetchOpenAPIWithCache(url, time.Nanosecond)
+		require.ErrorIs(t, err, ErrStaleOAS)
+		require.ErrorContains(t, err, "invalid status code 503")
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.Same(t, firstSpec, secondSpec)
+	})
+
+	t.Run("returns error when fetch fails and nothing is cached", func(t *testing.T) {
+		defer gock.Off()
+
+		gock.New("http://localhost:3000").
+			Get("/not-cached/documentation/json").
+			Reply(500).
+			JSON(map[string]string{"error": "InternalServerError"})
+
+		spec, err := FetchOpenAPIWithCache("http://localhost:3000/not-cached/documentation/json", time.Minute)
+		require.ErrorIs(t, err, ErrRequestFailed)
+		require.NotErrorIs(t, err, ErrStaleOAS)
+		require.Nil(t, spec)
+	})
+}
+
+func TestPollOAS(t *testing.T) {
+	defer gock.Off()
+	log, hook := test.NewNullLogger()
+	ctx, cancel := context.WithCancel(glogger.WithLogger(context.Background(), logrus.NewEntry(log)))
+	defer cancel()
+
+	url := "http://localhost:3000/polled-oas"
+	ttl := 20 * time.Millisecond
+	gock.New("http://localhost:3000").
+		Get("/polled-oas").
+		Times(1).
+		Reply(200).
+		File("./mocks/simplifiedMock.json")
+	initialSpec, err := FetchOpenAPIWithCache(url, ttl)
+	require.NoError(t, err)
+
+	gock.New("http://localhost:3000").
+		Get("/polled-oas").
+		Times(1).
+		Reply(503).
+		JSON(map[string]string{"error": "ServiceUnavailable"})
+	gock.New("http://localhost:3000").
+		Get("/polled-oas").
+		Persist().
+		Reply(200).
+		File("./mocks/pathsConfig.json")
+
+	var mu sync.Mutex
+	var updatedSpecs []*OpenAPISpec
+	update := func(oas *OpenAPISpec) error {
+		mu.Lock()
+		defer mu.Unlock()
+		updatedSpecs = append(updatedSpecs, oas)
+		return nil
+	}
+
+	pollOAS(ctx, url, ttl, initialSpec, update)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(updatedSpecs) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the failed fetch kept the stale spec in use, without updating it
+	require.Equal(t, "failed OAS fetch, using stale cached OAS", hook.AllEntries()[0].Message)
+	mu.Lock()
+	require.NotSame(t, initialSpec, updatedSpecs[0])
+	require.Contains(t, updatedSpecs[0].Paths, "/users-from-static-file/")
+	mu.Unlock()
+
+	// the refreshed spec is cached, so following polls do not trigger further updates
+	time.Sleep(5 * ttl)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, updatedSpecs, 1)
+}
+
+func TestOASFetchBackoff(t *testing.T) {
+	require.Equal(t, time.Second, oasFetchBackoff(0, 1))
+	require.Equal(t, time.Second, oasFetchBackoff(0, 10))
+	require.Equal(t, 100*time.Millisecond, oasFetchBackoff(100*time.Millisecond, 1))
+	require.Equal(t, 400*time.Millisecond, oasFetchBackoff(100*time.Millisecond, 3))
+	require.Equal(t, maxOASFetchBackoff, oasFetchBackoff(100*time.Millisecond, 100))
+}
+
 func TestLoadOASFile(t *testing.T) {
 	t.Run("get oas config from file", func(t *testing.T) {
 		openAPIFile, err := loadOASFile("./mocks/pathsConfig.json")
@@ -170,6 +305,162 @@ func TestLoadOASFile(t *testing.T) {
 	})
 }
 
+func TestDeserializeSpec(t *testing.T) {
+	t.Run("deserializes paths with constrained parameters", func(t *testing.T) {
+		spec, err := deserializeSpec([]byte(`{"paths":{"/users/{id:[0-9]+}":{"get":{"x-rond":{"requestFlow":{"policyName":"allow"}}}}}}`), ErrFileLoadFailed)
+		assert.NilError(t, err)
+		assert.Equal(t, spec.Paths["/users/{id:[0-9]+}"]["get"].PermissionV2.RequestFlow.PolicyName, "allow")
+	})
+
+	t.Run("x-rond takes precedence over x-permission", func(t *testing.T) {
+		spec, err := deserializeSpec([]byte(`{"paths":{
+			"/both":{"get":{"x-permission":{"allow":"legacy_policy"},"x-rond":{"requestFlow":{"policyName":"rond_policy"}}}},
+			"/legacy":{"get":{"x-permission":{"allow":"legacy_policy"}}}
+		}}`), ErrFileLoadFailed)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, spec.Paths["/both"]["get"], VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "rond_policy"}}})
+		assert.Equal(t, spec.Paths["/legacy"]["get"].PermissionV1, (*XPermission)(nil))
+		assert.Equal(t, spec.Paths["/legacy"]["get"].PermissionV2.RequestFlow.PolicyName, "legacy_policy")
+	})
+
+	t.Run("fails for invalid path parameter constraint", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{"paths":{"/users/{id:[0-9}":{"get":{}}}}`), ErrFileLoadFailed)
+		assert.ErrorIs(t, err, ErrFileLoadFailed)
+		assert.ErrorContains(t, err, "invalid constraint for path parameter id")
+	})
+
+	t.Run("resolves the referenced body schemas", func(t *testing.T) {
+		spec, err := deserializeSpec([]byte(`{
+			"paths":{"/users":{"post":{"x-rond":{"requestFlow":{"policyName":"allow","bodySchemaRef":"#/components/schemas/User"}}}}},
+			"components":{"schemas":{
+				"User":{"type":"object","properties":{"address":{"$ref":"#/components/schemas/Address"}}},
+				"Address":{"type":"object","required":["city"]}
+			}}
+		}`), ErrFileLoadFailed)
+		assert.NilError(t, err)
+		schema := spec.BodySchemas["#/components/schemas/User"]
+		assert.Assert(t, schema != nil)
+		assert.DeepEqual(t, schema.Properties["address"].Value.Required, []string{"city"})
+	})
+
+	t.Run("fails for undefined body schema", func(t *testing.T) {
+		_, err := deserializeSpec([]byte(`{
+			"paths":{"/users":{"post":{"x-rond":{"requestFlow":{"policyName":"allow","bodySchemaRef":"#/components/schemas/Missing"}}}}},
+			"components":{"schemas":{"User":{"type":"object"}}}
+		}`), ErrFileLoadFailed)
+		assert.ErrorIs(t, err, ErrFileLoadFailed)
+		assert.ErrorContains(t, err, "body schema #/components/schemas/Missing not found")
+	})
+}
+
+func TestLoadOASFromMultipleSources(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	dir := t.TempDir()
+	firstFile := filepath.Join(dir, "first.json")
+	require.NoError(t, os.WriteFile(firstFile, []byte(`{"paths":{
+		"/users":{"get":{"x-rond":{"requestFlow":{"policyName":"first_users"}}},"post":{"x-rond":{"requestFlow":{"policyName":"create_users"}}}},
+		"/orders":{"get":{"x-rond":{"requestFlow":{"policyName":"orders"}}}}
+	}}`), 0600))
+	secondFile := filepath.Join(dir, "second.json")
+	require.NoError(t, os.WriteFile(secondFile, []byte(`{"paths":{
+		"/users":{"get":{"x-rond":{"requestFlow":{"policyName":"second_users"}}}},
+		"/products":{"get":{"x-rond":{"requestFlow":{"policyName":"products"}}}}
+	}}`), 0600))
+	disjointFile := filepath.Join(dir, "disjoint.json")
+	require.NoError(t, os.WriteFile(disjointFile, []byte(`{"paths":{
+		"/products":{"get":{"x-rond":{"requestFlow":{"policyName":"products"}}}}
+	}}`), 0600))
+
+	policyName := func(oas *OpenAPISpec, path, verb string) string {
+		return oas.Paths[path][verb].PermissionV2.RequestFlow.PolicyName
+	}
+
+	t.Run("merges disjoint paths", func(t *testing.T) {
+		for _, strategy := range []string{config.OASMergeStrategyError, config.OASMergeStrategyLastWins} {
+			oas, err := loadOASFromFileOrNetwork(log, config.EnvironmentVariables{
+				PermissionsFilePaths: firstFile + "," + disjointFile,
+				OASMergeStrategy:     strategy,
+			})
+			require.NoError(t, err, strategy)
+			require.Len(t, oas.Paths, 3, strategy)
+			require.Equal(t, "first_users", policyName(oas, "/users", "get"))
+			require.Equal(t, "orders", policyName(oas, "/orders", "get"))
+			require.Equal(t, "products", policyName(oas, "/products", "get"))
+		}
+	})
+
+	t.Run("fails on overlapping operations with the error strategy", func(t *testing.T) {
+		_, err := loadOASFromFileOrNetwork(log, config.EnvironmentVariables{
+			PermissionsFilePaths: firstFile + "," + secondFile,
+			OASMergeStrategy:     config.OASMergeStrategyError,
+		})
+		require.ErrorIs(t, err, ErrFileLoadFailed)
+		require.ErrorContains(t, err, "GET /users declared by more than one source")
+	})
+
+	t.Run("keeps the last overlapping operation with the last-wins strategy", func(t *testing.T) {
+		oas, err := loadOASFromFileOrNetwork(log, config.EnvironmentVariables{
+			PermissionsFilePaths: firstFile + "," + secondFile,
+			OASMergeStrategy:     config.OASMergeStrategyLastWins,
+		})
+		require.NoError(t, err)
+		require.Len(t, oas.Paths, 3)
+		require.Equal(t, "second_users", policyName(oas, "/users", "get"))
+		require.Equal(t, "create_users", policyName(oas, "/users", "post"))
+		require.Equal(t, "products", policyName(oas, "/products", "get"))
+	})
+
+	t.Run("fails on source read failure", func(t *testing.T) {
+		_, err := loadOASFromFileOrNetwork(log, config.EnvironmentVariables{
+			PermissionsFilePaths: firstFile + "," + filepath.Join(dir, "missing.json"),
+		})
+		require.ErrorIs(t, err, ErrFileLoadFailed)
+	})
+}
+
+func TestApplySecuritySchemePolicies(t *testing.T) {
+	loadSpec := func(t *testing.T) *OpenAPISpec {
+		t.Helper()
+		oas, err := loadOASContent([]byte(`{"paths":{
+			"/users":{
+				"get":{"security":[{"bearerAuth":["users:read"]}]},
+				"post":{"security":[{"bearerAuth":[]}],"x-rond":{"requestFlow":{"policyName":"create_users"}}},
+				"delete":{"security":[{"basicAuth":[]}]}
+			},
+			"/orders":{"get":{"security":[{"basicAuth":[]},{"apiKey":[],"oauth":[]}]}},
+			"/public":{"get":{}}
+		}}`))
+		require.NoError(t, err)
+		return oas
+	}
+	permission := func(oas *OpenAPISpec, path, verb string) *RondConfig {
+		return oas.Paths[path][verb].PermissionV2
+	}
+
+	t.Run("resolves the policy of the operation security scheme", func(t *testing.T) {
+		oas := loadSpec(t)
+		err := applySecuritySchemePolicies(oas, config.EnvironmentVariables{SecuritySchemePolicies: "bearerAuth=allow_bearer,oauth=allow_oauth,apiKey=allow_api_key"})
+		require.NoError(t, err)
+
+		require.Equal(t, "allow_bearer", permission(oas, "/users", "get").RequestFlow.PolicyName)
+		require.Equal(t, "create_users", permission(oas, "/users", "post").RequestFlow.PolicyName, "explicit permission overridden")
+		require.Nil(t, permission(oas, "/users", "delete"), "unmapped scheme resolved")
+		require.Equal(t, "allow_api_key", permission(oas, "/orders", "get").RequestFlow.PolicyName)
+		require.Nil(t, permission(oas, "/public", "get"), "operation without security resolved")
+
+		found, err := oas.FindPermission(oas.PrepareOASRouter(), "/users", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "allow_bearer", found.RequestFlow.PolicyName)
+	})
+
+	t.Run("keeps the operations untouched without mapping", func(t *testing.T) {
+		oas := loadSpec(t)
+		require.NoError(t, applySecuritySchemePolicies(oas, config.EnvironmentVariables{}))
+		require.Nil(t, permission(oas, "/users", "get"))
+		require.Equal(t, "create_users", permission(oas, "/users", "post").RequestFlow.PolicyName)
+	})
+}
+
 func TestLoadOAS(t *testing.T) {
 	log, _ := test.NewNullLogger()
 
@@ -262,6 +553,49 @@ func TestLoadOAS(t *testing.T) {
 		})
 	})
 
+	t.Run("expect to retry fetching oasApiSpec from API", func(t *testing.T) {
+		envs := config.EnvironmentVariables{
+			TargetServiceHost:    "localhost:3000",
+			TargetServiceOASPath: "/documentation/json",
+			OASFetchMaxRetries:   2,
+			OASFetchBackoff:      time.Millisecond,
+		}
+
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Reply(503)
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Reply(200).
+			File("./mocks/simplifiedMock.json")
+
+		openApiSpec, err := loadOASFromFileOrNetwork(log, envs)
+		require.NoError(t, err)
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+		require.Contains(t, openApiSpec.Paths, "/users/")
+	})
+
+	t.Run("expect to throw if oasApiSpec fetch fails more than max retries", func(t *testing.T) {
+		envs := config.EnvironmentVariables{
+			TargetServiceHost:    "localhost:3000",
+			TargetServiceOASPath: "/documentation/json",
+			OASFetchMaxRetries:   2,
+			OASFetchBackoff:      time.Millisecond,
+		}
+
+		defer gock.Off()
+		gock.New("http://localhost:3000").
+			Get("/documentation/json").
+			Times(3).
+			Reply(500)
+
+		_, err := loadOASFromFileOrNetwork(log, envs)
+		require.ErrorIs(t, err, ErrRequestFailed)
+		require.Contains(t, err.Error(), "failed OAS fetch after 3 attempts")
+		require.True(t, gock.IsDone(), "Mock has not been invoked")
+	})
+
 	t.Run("expect to throw if TargetServiceOASPath or APIPermissionsFilePath is not set", func(t *testing.T) {
 		envs := config.EnvironmentVariables{
 			TargetServiceHost: "localhost:3000",
@@ -269,29 +603,238 @@ func TestLoadOAS(t *testing.T) {
 		_, err := loadOASFromFileOrNetwork(log, envs)
 
 		t.Logf("Expected error occurred: %s", err.Error())
-		assert.Assert(t, err != nil, fmt.Errorf("missing environment variables one of %s or %s is required", config.TargetServiceOASPathEnvKey, config.APIPermissionsFilePathEnvKey))
+		assert.Assert(t, err != nil, fmt.Errorf("missing environment variables one of %s, %s or %s is required", config.TargetServiceOASPathEnvKey, config.APIPermissionsFilePathEnvKey, config.OASInlineEnvKey))
+	})
+
+	inlineExpectedPaths := OpenAPIPaths{
+		"/inline": PathVerbs{
+			"get": VerbConfig{
+				PermissionV2: &RondConfig{
+					RequestFlow: RequestFlow{PolicyName: "inline_policy"},
+				},
+			},
+		},
+	}
+
+	t.Run("inline JSON OAS takes precedence over file", func(t *testing.T) {
+		envs := config.EnvironmentVariables{
+			OASInline:              `{"paths":{"/inline":{"get":{"x-rond":{"requestFlow":{"policyName":"inline_policy"}}}}}}`,
+			APIPermissionsFilePath: "./mocks/pathsConfig.json",
+		}
+		openApiSpec, err := loadOASFromFileOrNetwork(log, envs)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, openApiSpec.Paths, inlineExpectedPaths)
+	})
+
+	t.Run("inline YAML OAS", func(t *testing.T) {
+		envs := config.EnvironmentVariables{
+			OASInline: `paths:
+  /inline:
+    get:
+      x-rond:
+        requestFlow:
+          policyName: inline_policy
+`,
+		}
+		openApiSpec, err := loadOASFromFileOrNetwork(log, envs)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, openApiSpec.Paths, inlineExpectedPaths)
+	})
+
+	t.Run("invalid inline OAS fails with file load error", func(t *testing.T) {
+		envs := config.EnvironmentVariables{OASInline: `{"paths": [`}
+		_, err := loadOASFromFileOrNetwork(log, envs)
+		assert.Assert(t, errors.Is(err, ErrFileLoadFailed), "unexpected error: %v", err)
+	})
+
+	t.Run("OAS from reader used for standard input", func(t *testing.T) {
+		openApiSpec, err := loadOASFromReader(strings.NewReader(`{"paths":{"/inline":{"get":{"x-rond":{"requestFlow":{"policyName":"inline_policy"}}}}}}`))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, openApiSpec.Paths, inlineExpectedPaths)
+
+		_, err = loadOASFromReader(strings.NewReader("paths: [unterminated"))
+		assert.Assert(t, errors.Is(err, ErrFileLoadFailed), "unexpected error: %v", err)
 	})
 }
 
 func TestFindPermission(t *testing.T) {
+	t.Run("explicit methods take precedence over ALL", func(t *testing.T) {
+		verbConfig := func(policyName string) VerbConfig {
+			return VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: policyName}}}
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users/{id}": PathVerbs{
+					"all": verbConfig("users_all"),
+					"get": verbConfig("users_get"),
+				},
+				"/items/{itemId}": PathVerbs{
+					"all": verbConfig("items_all"),
+				},
+				"/items/{id}": PathVerbs{
+					"get": verbConfig("items_get"),
+				},
+			},
+		}
+
+		// map iteration order is random, so the router is built several times
+		for i := 0; i < 20; i++ {
+			OASRouter := oas.PrepareOASRouter()
+
+			found, err := oas.FindPermission(OASRouter, "/users/user1", http.MethodGet)
+			require.NoError(t, err)
+			require.Equal(t, "users_get", found.RequestFlow.PolicyName)
+
+			found, err = oas.FindPermission(OASRouter, "/users/user1", http.MethodPost)
+			require.NoError(t, err)
+			require.Equal(t, "users_all", found.RequestFlow.PolicyName)
+
+			found, err = oas.FindPermission(OASRouter, "/items/item1", http.MethodGet)
+			require.NoError(t, err)
+			require.Equal(t, "items_get", found.RequestFlow.PolicyName)
+
+			found, err = oas.FindPermission(OASRouter, "/items/item1", http.MethodDelete)
+			require.NoError(t, err)
+			require.Equal(t, "items_all", found.RequestFlow.PolicyName)
+		}
+	})
+
+	t.Run("path parameters regex constraints", func(t *testing.T) {
+		verbConfig := func(policyName string) VerbConfig {
+			return VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: policyName}}}
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/users/{id:[0-9]+}": PathVerbs{
+					"get": verbConfig("users_by_id"),
+				},
+				"/users/{name:[a-z]+}": PathVerbs{
+					"get": verbConfig("users_by_name"),
+				},
+				"/users/{userId:[0-9]{3}}/orders/{orderId}": PathVerbs{
+					"all": verbConfig("orders_all"),
+				},
+				"/users/{userId}/orders/{orderId:[a-z]+}": PathVerbs{
+					"all": verbConfig("orders_by_name"),
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/users/123", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "users_by_id", found.RequestFlow.PolicyName)
+
+		found, err = oas.FindPermission(OASRouter, "/users/john", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "users_by_name", found.RequestFlow.PolicyName)
+
+		_, err = oas.FindPermission(OASRouter, "/users/John-1", http.MethodGet)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+
+		found, err = oas.FindPermission(OASRouter, "/users/123/orders/456", http.MethodPost)
+		require.NoError(t, err)
+		require.Equal(t, "orders_all", found.RequestFlow.PolicyName)
+
+		found, err = oas.FindPermission(OASRouter, "/users/1234/orders/abc", http.MethodPost)
+		require.NoError(t, err)
+		require.Equal(t, "orders_by_name", found.RequestFlow.PolicyName)
+
+		_, err = oas.FindPermission(OASRouter, "/users/1234/orders/456", http.MethodPost)
+		require.ErrorIs(t, err, ErrNotFoundOASDefinition)
+	})
+
+	t.Run("unconstrained path parameters match segments not satisfying constraints", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/items/{id:[0-9]+}": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "items_by_id"}}},
+				},
+				"/items/{itemId}": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "items_get"}}},
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/items/42", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "items_by_id", found.RequestFlow.PolicyName)
+
+		found, err = oas.FindPermission(OASRouter, "/items/abc", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "items_get", found.RequestFlow.PolicyName)
+	})
+
+	t.Run("disabled partial cache", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/items": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "items_get", DisablePartialCache: true}}},
+				},
+			},
+		}
+
+		found, err := oas.FindPermission(oas.PrepareOASRouter(), "/items", http.MethodGet)
+		require.NoError(t, err)
+		require.True(t, found.RequestFlow.DisablePartialCache)
+	})
+
+	t.Run("decision cache", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/items": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{
+						PolicyName: "items_get",
+						CacheTTL:   "30s",
+						CacheKeys:  []string{"request.path", "request.query.tenant"},
+					}}},
+				},
+			},
+		}
+
+		found, err := oas.FindPermission(oas.PrepareOASRouter(), "/items", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, "30s", found.RequestFlow.CacheTTL)
+		require.Equal(t, []string{"request.path", "request.query.tenant"}, found.RequestFlow.CacheKeys)
+	})
+
+	t.Run("response items filter", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/items": PathVerbs{
+					"get": VerbConfig{PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "items_get"},
+						ResponseFlow: ResponseFlow{PolicyName: "item_visible", FilterItems: true},
+					}},
+				},
+			},
+		}
+
+		found, err := oas.FindPermission(oas.PrepareOASRouter(), "/items", http.MethodGet)
+		require.NoError(t, err)
+		require.Equal(t, ResponseFlow{PolicyName: "item_visible", FilterItems: true}, found.ResponseFlow)
+	})
+
 	t.Run("nested cases", func(t *testing.T) {
 		oas := prepareOASFromFile(t, "./mocks/nestedPathsConfig.json")
 		OASRouter := oas.PrepareOASRouter()
 
 		found, err := oas.FindPermission(OASRouter, "/not/existing/route", "GET")
-		assert.Equal(t, RondConfig{}, found)
+		assert.DeepEqual(t, RondConfig{}, found)
+		assert.Assert(t, errors.Is(err, ErrNotFoundOASDefinition))
 		assert.Equal(t, err.Error(), fmt.Sprintf("%s: GET /not/existing/route", ErrNotFoundOASDefinition))
 
 		found, err = oas.FindPermission(OASRouter, "/no/method", "PUT")
-		assert.Equal(t, RondConfig{}, found)
+		assert.DeepEqual(t, RondConfig{}, found)
 		assert.Equal(t, err.Error(), fmt.Sprintf("%s: PUT /no/method", ErrNotFoundOASDefinition))
 
 		found, err = oas.FindPermission(OASRouter, "/use/method/that/not/existing/put", "PUT")
-		assert.Equal(t, RondConfig{}, found)
+		assert.DeepEqual(t, RondConfig{}, found)
 		assert.Equal(t, err.Error(), fmt.Sprintf("%s: PUT /use/method/that/not/existing/put", ErrNotFoundOASDefinition))
 
 		found, err = oas.FindPermission(OASRouter, "/foo/bar/barId", "GET")
-		assert.Equal(t, RondConfig{
+		assert.DeepEqual(t, RondConfig{
 			RequestFlow: RequestFlow{
 				PolicyName:    "foo_bar_params",
 				GenerateQuery: true,
@@ -303,7 +846,7 @@ func TestFindPermission(t *testing.T) {
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/foo/bar/barId/another-params-not-configured", "GET")
-		assert.Equal(t, RondConfig{
+		assert.DeepEqual(t, RondConfig{
 			RequestFlow: RequestFlow{
 				PolicyName:    "foo_bar",
 				GenerateQuery: true,
@@ -315,11 +858,11 @@ func TestFindPermission(t *testing.T) {
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/foo/bar/nested/case/really/nested", "GET")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "foo_bar_nested_case"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "foo_bar_nested_case"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/foo/bar/nested", "GET")
-		assert.Equal(t, RondConfig{
+		assert.DeepEqual(t, RondConfig{
 			RequestFlow: RequestFlow{
 				PolicyName:    "foo_bar_nested",
 				GenerateQuery: true,
@@ -331,7 +874,7 @@ func TestFindPermission(t *testing.T) {
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/foo/simble", "PATCH")
-		assert.Equal(t, RondConfig{
+		assert.DeepEqual(t, RondConfig{
 			RequestFlow: RequestFlow{
 				PolicyName:    "foo",
 				GenerateQuery: true,
@@ -343,43 +886,43 @@ func TestFindPermission(t *testing.T) {
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all", "GET")
-		assert.Equal(t, RondConfig{}, found)
+		assert.DeepEqual(t, RondConfig{}, found)
 		assert.Equal(t, err.Error(), fmt.Sprintf("%s: GET /test/all", ErrNotFoundOASDefinition))
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/", "GET")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_get"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_get"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "GET")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_get"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_get"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "POST")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_post"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_post"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "PUT")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "PATCH")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "DELETE")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/test/all/verb", "HEAD")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "permission_for_all"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/projects/", "POST")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "project_all"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "project_all"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/projects/", "GET")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "project_get"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "project_get"}}, found)
 		assert.Equal(t, err, nil)
 	})
 
@@ -388,11 +931,94 @@ func TestFindPermission(t *testing.T) {
 		OASRouter := oas.PrepareOASRouter()
 
 		found, err := oas.FindPermission(OASRouter, "/api/backend/projects/5df2260277baff0011fde823/branches/team-james/files/config-extension%252Fcms-backend%252FcmsProperties.json", "POST")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_commit"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_commit"}}, found)
 		assert.Equal(t, err, nil)
 
 		found, err = oas.FindPermission(OASRouter, "/api/backend/projects/5df2260277baff0011fde823/branches/team-james/files/config-extension%2Fcms-backend%2FcmsProperties.json", "POST")
-		assert.Equal(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_commit"}}, found)
+		assert.DeepEqual(t, RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_commit"}}, found)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("with onDeny options", func(t *testing.T) {
+		onDenyConfig := RondConfig{
+			RequestFlow: RequestFlow{
+				PolicyName: "allow",
+				OnDeny:     OnDenyOptions{StatusCode: http.StatusNotFound, Message: "not found"},
+			},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"get": VerbConfig{PermissionV2: &onDenyConfig},
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/api", "GET")
+		assert.DeepEqual(t, onDenyConfig, found)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("with resource permission option", func(t *testing.T) {
+		resourcePermissionConfig := RondConfig{
+			RequestFlow: RequestFlow{PolicyName: "filter_projects", GenerateQuery: true},
+			Options:     PermissionOptions{ResourcePermission: "console.project.view"},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/projects": PathVerbs{
+					"get": VerbConfig{PermissionV2: &resourcePermissionConfig},
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/projects", "GET")
+		assert.DeepEqual(t, resourcePermissionConfig, found)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("with combined request policies", func(t *testing.T) {
+		combinedPoliciesConfig := RondConfig{
+			RequestFlow: RequestFlow{Policies: []string{"tenant_check", "feature_flag"}, Combinator: PoliciesCombinatorAny},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"get": VerbConfig{PermissionV2: &combinedPoliciesConfig},
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/api", "GET")
+		assert.DeepEqual(t, combinedPoliciesConfig, found)
+		assert.Equal(t, err, nil)
+	})
+
+	t.Run("with row filter sent as query param", func(t *testing.T) {
+		queryParamConfig := RondConfig{
+			RequestFlow: RequestFlow{
+				PolicyName:    "allow",
+				GenerateQuery: true,
+				QueryOptions: QueryOptions{
+					Target:         RowFilterTargetQuery,
+					QueryParamName: "_q",
+				},
+			},
+		}
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/api": PathVerbs{
+					"get": VerbConfig{PermissionV2: &queryParamConfig},
+				},
+			},
+		}
+		OASRouter := oas.PrepareOASRouter()
+
+		found, err := oas.FindPermission(OASRouter, "/api", "GET")
+		assert.DeepEqual(t, queryParamConfig, found)
 		assert.Equal(t, err, nil)
 	})
 }
@@ -0,0 +1,184 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/types"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// policiesReloadDebounce is the time waited after a change in the modules directory
+// before reloading the policies, so that a burst of file events causes a single reload.
+const policiesReloadDebounce = 500 * time.Millisecond
+
+// PoliciesStore holds the rego modules and the evaluators built from them,
+// allowing to swap both of them while requests are being served.
+type PoliciesStore struct {
+	mu              sync.RWMutex
+	opaModuleConfig *OPAModuleConfig
+	evaluators      PartialResultsEvaluators
+}
+
+func NewPoliciesStore(opaModuleConfig *OPAModuleConfig, evaluators PartialResultsEvaluators) *PoliciesStore {
+	return &PoliciesStore{
+		opaModuleConfig: opaModuleConfig,
+		evaluators:      evaluators,
+	}
+}
+
+// Get returns the rego modules and the evaluators currently in use.
+func (store *PoliciesStore) Get() (*OPAModuleConfig, PartialResultsEvaluators) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.opaModuleConfig, store.evaluators
+}
+
+// Swap replaces the rego modules and the evaluators in use.
+func (store *PoliciesStore) Swap(opaModuleConfig *OPAModuleConfig, evaluators PartialResultsEvaluators) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.opaModuleConfig = opaModuleConfig
+	store.evaluators = evaluators
+}
+
+// Reload loads the rego modules from the provided directory, together with the configured
+// data file, and rebuilds the evaluators.
+// On failure the error is returned and the policies in use are left untouched.
+func (store *PoliciesStore) Reload(ctx context.Context, directory string, mongoClient types.IMongoClient, oas *OpenAPISpec, env config.EnvironmentVariables) error {
+	opaModuleConfig, err := loadPoliciesFromDirectory(directory, env.OPADataFilePath)
+	if err != nil {
+		return fmt.Errorf("failed rego file read: %s", err.Error())
+	}
+	return store.Update(ctx, opaModuleConfig, mongoClient, oas, env)
+}
+
+// Update rebuilds the evaluators from the provided rego modules and swaps them with the ones in use.
+// On failure the error is returned and the policies in use are left untouched.
+func (store *PoliciesStore) Update(ctx context.Context, opaModuleConfig *OPAModuleConfig, mongoClient types.IMongoClient, oas *OpenAPISpec, env config.EnvironmentVariables) error {
+	evaluators, err := setupEvaluators(ctx, mongoClient, oas, opaModuleConfig, env)
+	if err != nil {
+		return fmt.Errorf("failed to create evaluators: %s", err.Error())
+	}
+	store.Swap(opaModuleConfig, evaluators)
+	return nil
+}
+
+// watchPoliciesDirectory watches the provided directory, and its subdirectories, invoking
+// reload every time a file changes; the additional files, such as the data file, are watched
+// as well. The watcher is stopped when the context is done.
+func watchPoliciesDirectory(ctx context.Context, directory string, reload func() error, files ...string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed policies watcher creation: %s", err.Error())
+	}
+	if err := addDirectoriesToWatcher(watcher, directory); err != nil {
+		watcher.Close()
+		return err
+	}
+	// files are watched through their parent directory, so that they are still
+	// followed when replaced by a rename, as many editors do
+	watchedFiles := make(map[string]struct{}, len(files))
+	for _, file := range files {
+		watchedFiles[filepath.Clean(file)] = struct{}{}
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed policies file watch %s: %s", file, err.Error())
+		}
+	}
+
+	logger := glogger.Get(ctx)
+	go func() {
+		defer watcher.Close()
+
+		// the timer is created stopped, and it is started on the first file event
+		reloadTimer := time.NewTimer(policiesReloadDebounce)
+		if !reloadTimer.Stop() {
+			<-reloadTimer.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				reloadTimer.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isWatchedPath(directory, watchedFiles, event.Name) {
+					continue
+				}
+				if event.Op&fsnotify.Create == fsnotify.Create {
+					if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+						if err := addDirectoriesToWatcher(watcher, event.Name); err != nil {
+							logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed policies directory watch")
+						}
+					}
+				}
+				reloadTimer.Reset(policiesReloadDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("policies watcher error")
+			case <-reloadTimer.C:
+				if err := reload(); err != nil {
+					logger.WithFields(logrus.Fields{
+						"error":        logrus.Fields{"message": err.Error()},
+						"opaDirectory": directory,
+					}).Error("failed policies reload, keeping previous policies")
+					continue
+				}
+				logger.WithField("opaDirectory", directory).Info("policies successfully reloaded")
+			}
+		}
+	}()
+	return nil
+}
+
+// isWatchedPath reports whether path is inside directory or is one of the watched files.
+func isWatchedPath(directory string, watchedFiles map[string]struct{}, path string) bool {
+	if _, ok := watchedFiles[filepath.Clean(path)]; ok {
+		return true
+	}
+	relativePath, err := filepath.Rel(directory, path)
+	return err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
+func addDirectoriesToWatcher(watcher *fsnotify.Watcher, rootDirectory string) error {
+	return filepath.Walk(rootDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("failed policies directory watch %s: %s", path, err.Error())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoliciesStore(t *testing.T) {
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow: RequestFlow{PolicyName: "allow"},
+					},
+				},
+			},
+		},
+	}
+
+	writePolicy := func(t *testing.T, directory, content string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(directory, "policies.rego"), []byte(content), 0600)
+		require.NoError(t, err)
+	}
+
+	t.Run("Swap replaces modules and evaluators", func(t *testing.T) {
+		store := NewPoliciesStore(&OPAModuleConfig{Name: "old.rego"}, PartialResultsEvaluators{})
+
+		newEvaluators := PartialResultsEvaluators{"allow": PartialEvaluator{}}
+		store.Swap(&OPAModuleConfig{Name: "new.rego"}, newEvaluators)
+
+		opaModuleConfig, evaluators := store.Get()
+		require.Equal(t, "new.rego", opaModuleConfig.Name)
+		require.Equal(t, newEvaluators, evaluators)
+	})
+
+	t.Run("Reload rebuilds evaluators from directory", func(t *testing.T) {
+		directory := t.TempDir()
+		writePolicy(t, directory, "package policies\nallow { true }\n")
+		store := NewPoliciesStore(&OPAModuleConfig{Name: "old.rego"}, PartialResultsEvaluators{})
+
+		err := store.Reload(context.Background(), directory, nil, oas, envs)
+		require.NoError(t, err)
+
+		opaModuleConfig, evaluators := store.Get()
+		require.Equal(t, "policies.rego", opaModuleConfig.Name)
+		require.Contains(t, evaluators, "allow")
+	})
+
+	t.Run("Reload reads the configured data file", func(t *testing.T) {
+		directory := t.TempDir()
+		writePolicy(t, directory, "package policies\nallow { data.enabled }\n")
+		dataFilePath := filepath.Join(t.TempDir(), "data.json")
+		require.NoError(t, os.WriteFile(dataFilePath, []byte(`{"enabled":true}`), 0600))
+		store := NewPoliciesStore(&OPAModuleConfig{Name: "old.rego"}, PartialResultsEvaluators{})
+
+		dataEnv := envs
+		dataEnv.OPADataFilePath = dataFilePath
+		err := store.Reload(context.Background(), directory, nil, oas, dataEnv)
+		require.NoError(t, err)
+
+		opaModuleConfig, _ := store.Get()
+		require.Equal(t, map[string]interface{}{"enabled": true}, opaModuleConfig.Data)
+	})
+
+	t.Run("Reload keeps previous policies on invalid module", func(t *testing.T) {
+		directory := t.TempDir()
+		writePolicy(t, directory, "package policies\nallow { \n")
+		previousEvaluators := PartialResultsEvaluators{"allow": PartialEvaluator{}}
+		store := NewPoliciesStore(&OPAModuleConfig{Name: "old.rego"}, previousEvaluators)
+
+		err := store.Reload(context.Background(), directory, nil, oas, envs)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed rego file read")
+
+		opaModuleConfig, evaluators := store.Get()
+		require.Equal(t, "old.rego", opaModuleConfig.Name)
+		require.Equal(t, previousEvaluators, evaluators)
+	})
+}
+
+func TestWatchPoliciesDirectory(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	ctx, cancel := context.WithCancel(glogger.WithLogger(context.Background(), logrus.NewEntry(log)))
+	defer cancel()
+
+	directory := t.TempDir()
+	policyPath := filepath.Join(directory, "policies.rego")
+	require.NoError(t, os.WriteFile(policyPath, []byte("package policies\nallow { true }\n"), 0600))
+
+	store := NewPoliciesStore(&OPAModuleConfig{Name: "initial.rego"}, PartialResultsEvaluators{})
+	reload := func() error {
+		opaModuleConfig, err := loadRegoModule(directory)
+		if err != nil {
+			return err
+		}
+		store.Swap(opaModuleConfig, PartialResultsEvaluators{})
+		return nil
+	}
+	require.NoError(t, watchPoliciesDirectory(ctx, directory, reload))
+
+	t.Run("reloads policies on file change", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(policyPath, []byte("package policies\nallow { false }\n"), 0600))
+
+		require.Eventually(t, func() bool {
+			opaModuleConfig, _ := store.Get()
+			return opaModuleConfig.Content == "package policies\nallow { false }\n"
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("keeps previous policies and logs on invalid change", func(t *testing.T) {
+		hook.Reset()
+		require.NoError(t, os.WriteFile(policyPath, []byte("package policies\nallow { \n"), 0600))
+
+		require.Eventually(t, func() bool {
+			entry := hook.LastEntry()
+			return entry != nil && entry.Level == logrus.ErrorLevel
+		}, 5*time.Second, 50*time.Millisecond)
+		require.Equal(t, "failed policies reload, keeping previous policies", hook.LastEntry().Message)
+
+		opaModuleConfig, _ := store.Get()
+		require.Equal(t, "package policies\nallow { false }\n", opaModuleConfig.Content)
+	})
+
+	t.Run("fails on missing directory", func(t *testing.T) {
+		err := watchPoliciesDirectory(ctx, filepath.Join(directory, "missing"), reload)
+		require.Error(t, err)
+	})
+
+	t.Run("reloads policies on watched file change", func(t *testing.T) {
+		dataDirectory := t.TempDir()
+		dataFilePath := filepath.Join(dataDirectory, "data.json")
+		require.NoError(t, os.WriteFile(dataFilePath, []byte(`{}`), 0600))
+
+		reloads := make(chan struct{}, 10)
+		countReloads := func() error {
+			reloads <- struct{}{}
+			return nil
+		}
+		require.NoError(t, watchPoliciesDirectory(ctx, t.TempDir(), countReloads, dataFilePath))
+
+		require.NoError(t, os.WriteFile(filepath.Join(dataDirectory, "other.json"), []byte(`{}`), 0600))
+		require.NoError(t, os.WriteFile(dataFilePath, []byte(`{"enabled":true}`), 0600))
+
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "policies not reloaded on data file change")
+		}
+		require.Never(t, func() bool { return len(reloads) > 0 }, 2*policiesReloadDebounce, 50*time.Millisecond)
+	})
+}
+
+func TestIsWatchedPath(t *testing.T) {
+	watchedFiles := map[string]struct{}{"/data/data.json": {}}
+
+	require.True(t, isWatchedPath("/policies", watchedFiles, "/policies/policies.rego"))
+	require.True(t, isWatchedPath("/policies", watchedFiles, "/policies/nested/policies.rego"))
+	require.True(t, isWatchedPath("/policies", watchedFiles, "/data/data.json"))
+	require.False(t, isWatchedPath("/policies", watchedFiles, "/data/other.json"))
+	require.False(t, isWatchedPath("/policies", watchedFiles, "/policies-other/policies.rego"))
+}
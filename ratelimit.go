@@ -0,0 +1,124 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+	"github.com/rond-authz/rond/internal/config"
+)
+
+// rateLimitEvictionInterval is how often the buckets refilled up to the burst are evicted,
+// since they behave as the ones of users never seen before.
+const rateLimitEvictionInterval = time.Minute
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// rateLimiter is a token bucket rate limiter, keeping a bucket for each user.
+type rateLimiter struct {
+	mu           sync.Mutex
+	rate         float64
+	burst        float64
+	buckets      map[string]*tokenBucket
+	lastEviction time.Time
+	now          func() time.Time
+}
+
+// newRateLimiter returns a limiter allowing rps requests per second for each user, with bursts
+// up to burst requests; burst defaults to rps, rounded up, when not positive.
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rps))
+	}
+	return &rateLimiter{
+		rate:    rps,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow consumes a token of the user bucket, reporting whether the request is allowed and,
+// if it is not, how long to wait for the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.evictFullBuckets(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastRefill: now}
+		l.buckets[key] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) evictFullBuckets(now time.Time) {
+	if now.Sub(l.lastEviction) < rateLimitEvictionInterval {
+		return
+	}
+	l.lastEviction = now
+	for key, bucket := range l.buckets {
+		bucket.refill(now, l.rate, l.burst)
+		if bucket.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.lastRefill).Seconds()*rate)
+	b.lastRefill = now
+}
+
+// RateLimitMiddleware responds 429 to the requests exceeding the rate limit of the user,
+// identified by the user id header if trusted, or by the client IP otherwise.
+func RateLimitMiddleware(limiter *rateLimiter, env config.EnvironmentVariables) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := requestClientIP(r, env.TrustInboundForwarded)
+			if userID := r.Header.Get(env.UserIdHeader); userID != "" && isTrustedIdentitySource(r, env) {
+				key = userID
+			}
+
+			allowed, retryAfter := limiter.allow(key)
+			if !allowed {
+				glogger.Get(r.Context()).WithField("retryAfter", retryAfter.String()).Warn("request rate limit exceeded")
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				failResponseWithCode(w, http.StatusTooManyRequests, fmt.Sprintf("rate limit of %g requests per second exceeded", limiter.rate), RATE_LIMIT_ERROR_MESSAGE)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	newLimiter := func(rps float64, burst int) *rateLimiter {
+		limiter := newRateLimiter(rps, burst)
+		limiter.now = func() time.Time { return now }
+		return limiter
+	}
+
+	t.Run("allows bursts up to the configured size", func(t *testing.T) {
+		limiter := newLimiter(1, 2)
+
+		allowed, _ := limiter.allow("user1")
+		require.True(t, allowed)
+		allowed, _ = limiter.allow("user1")
+		require.True(t, allowed)
+		allowed, retryAfter := limiter.allow("user1")
+		require.False(t, allowed)
+		require.Equal(t, time.Second, retryAfter)
+	})
+
+	t.Run("burst defaults to the rate", func(t *testing.T) {
+		limiter := newLimiter(0.5, 0)
+
+		allowed, _ := limiter.allow("user1")
+		require.True(t, allowed)
+		allowed, retryAfter := limiter.allow("user1")
+		require.False(t, allowed)
+		require.Equal(t, 2*time.Second, retryAfter)
+	})
+
+	t.Run("limits each user separately", func(t *testing.T) {
+		limiter := newLimiter(1, 1)
+
+		allowed, _ := limiter.allow("user1")
+		require.True(t, allowed)
+		allowed, _ = limiter.allow("user2")
+		require.True(t, allowed)
+		allowed, _ = limiter.allow("user1")
+		require.False(t, allowed)
+	})
+
+	t.Run("refills tokens over time", func(t *testing.T) {
+		limiter := newLimiter(2, 1)
+
+		allowed, _ := limiter.allow("user1")
+		require.True(t, allowed)
+		allowed, _ = limiter.allow("user1")
+		require.False(t, allowed)
+
+		limiter.now = func() time.Time { return now.Add(500 * time.Millisecond) }
+		allowed, _ = limiter.allow("user1")
+		require.True(t, allowed)
+	})
+
+	t.Run("evicts the idle buckets", func(t *testing.T) {
+		limiter := newLimiter(1, 1)
+
+		limiter.allow("user1")
+		limiter.allow("user2")
+		require.Len(t, limiter.buckets, 2)
+
+		limiter.now = func() time.Time { return now.Add(rateLimitEvictionInterval) }
+		limiter.allow("user2")
+		require.Len(t, limiter.buckets, 1)
+		require.Contains(t, limiter.buckets, "user2")
+	})
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	env := config.EnvironmentVariables{UserIdHeader: "userid"}
+	handler := RateLimitMiddleware(newRateLimiter(1, 2), env)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serveRequest := func(userID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		r.Header.Set("userid", userID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, serveRequest("user1").Code)
+	require.Equal(t, http.StatusOK, serveRequest("user1").Code)
+
+	w := serveRequest("user1")
+	testutils.AssertResponseFullErrorMessages(t, w, http.StatusTooManyRequests, "rate limit of 1 requests per second exceeded", RATE_LIMIT_ERROR_MESSAGE)
+	require.Equal(t, "1", w.Result().Header.Get("Retry-After"))
+
+	require.Equal(t, http.StatusOK, serveRequest("user2").Code, "other users must not be limited")
+}
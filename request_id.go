@@ -0,0 +1,110 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/mia-platform/glogger/v2"
+)
+
+// DefaultRequestIDHeaderKey is the header carrying the request id when no other
+// header is configured.
+const DefaultRequestIDHeaderKey = "X-Request-Id"
+
+const requestIDLogField = "reqId"
+
+type requestIDContextKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// GetRequestIDFromContext returns the request id stored in the context, if any.
+func GetRequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// RequestIDMiddleware reads the request id from the provided header, generating one when
+// missing, and stores it in the request context. The header is set on the request, so that
+// it is forwarded to the target service, and on the response.
+// The middleware must precede the glogger one, which reads the X-Request-Id header.
+func RequestIDMiddleware(headerKey string) mux.MiddlewareFunc {
+	if headerKey == "" {
+		headerKey = DefaultRequestIDHeaderKey
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(headerKey)
+			if requestID == "" {
+				requestID = uuid.New().String()
+				r.Header.Set(headerKey, requestID)
+			}
+			w.Header().Set(headerKey, requestID)
+			next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+		})
+	}
+}
+
+// RequestIDLoggerMiddleware adds the request id to the logger in context and to the error
+// responses. The middleware must follow the glogger one, which replaces the logger in context.
+func RequestIDLoggerMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := GetRequestIDFromContext(r.Context())
+			if requestID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx := glogger.WithLogger(r.Context(), glogger.Get(r.Context()).WithField(requestIDLogField, requestID))
+			next.ServeHTTP(&requestIDResponseWriter{ResponseWriter: w, requestID: requestID}, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestIDResponseWriter makes the request id available to the functions writing
+// error responses, which only receive the response writer.
+type requestIDResponseWriter struct {
+	http.ResponseWriter
+	requestID string
+}
+
+func (w *requestIDResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *requestIDResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseRequestID returns the request id of the response being written, if any.
+func responseRequestID(w http.ResponseWriter) string {
+	for {
+		switch typedWriter := w.(type) {
+		case *requestIDResponseWriter:
+			return typedWriter.requestID
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = typedWriter.Unwrap()
+		default:
+			return ""
+		}
+	}
+}
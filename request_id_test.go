@@ -0,0 +1,155 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/types"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	var proxiedRequestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedRequestID = r.Header.Get("x-correlation-id")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	log, hook := test.NewNullLogger()
+	log.SetLevel(logrus.TraceLevel)
+	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
+
+	env := config.EnvironmentVariables{
+		TargetServiceHost:  strings.TrimPrefix(server.URL, "http://"),
+		RequestIDHeaderKey: "x-correlation-id",
+	}
+	opa := &OPAModuleConfig{
+		Name: "policies",
+		Content: `package policies
+allow_all { true }
+deny_all { false }`,
+	}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/allowed": PathVerbs{
+				"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_all"}}},
+			},
+			"/denied": PathVerbs{
+				"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "deny_all"}}},
+			},
+		},
+	}
+
+	var mongoClient *mongoclient.MongoClient
+	evaluatorsMap, err := setupEvaluators(ctx, mongoClient, oas, opa, env)
+	require.NoError(t, err)
+	router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
+	require.NoError(t, err)
+
+	serve := func(path, requestID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if requestID != "" {
+			req.Header.Set("x-correlation-id", requestID)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	errorRequestID := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var requestError types.RequestError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &requestError))
+		return requestError.RequestID
+	}
+
+	t.Run("same request id is forwarded to the target service and returned on error", func(t *testing.T) {
+		w := serve("/allowed", "my-request-id")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "my-request-id", proxiedRequestID)
+		require.Equal(t, "my-request-id", w.Header().Get("x-correlation-id"))
+
+		hook.Reset()
+		w = serve("/denied", "my-request-id")
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, "my-request-id", w.Header().Get("x-correlation-id"))
+		require.Equal(t, "my-request-id", errorRequestID(t, w))
+
+		checkedEntries := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "incoming request" || entry.Message == "request completed" {
+				// access logs are written by glogger, reading the X-Request-Id header
+				continue
+			}
+			require.Equal(t, "my-request-id", entry.Data[requestIDLogField], "unexpected request id in log %q", entry.Message)
+			checkedEntries++
+		}
+		require.NotZero(t, checkedEntries)
+	})
+
+	t.Run("request id is generated when missing", func(t *testing.T) {
+		proxiedRequestID = ""
+		w := serve("/allowed", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotEmpty(t, proxiedRequestID)
+		require.Equal(t, proxiedRequestID, w.Header().Get("x-correlation-id"))
+
+		w = serve("/denied", "")
+		generatedRequestID := w.Header().Get("x-correlation-id")
+		require.NotEmpty(t, generatedRequestID)
+		require.NotEqual(t, proxiedRequestID, generatedRequestID)
+		require.Equal(t, generatedRequestID, errorRequestID(t, w))
+	})
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var contextRequestID, headerRequestID string
+	handler := RequestIDMiddleware("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contextRequestID = GetRequestIDFromContext(r.Context())
+		headerRequestID = r.Header.Get("X-Request-Id")
+	}))
+
+	t.Run("defaults to X-Request-Id header", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Request-Id", "some-id")
+		handler.ServeHTTP(w, req)
+
+		require.Equal(t, "some-id", contextRequestID)
+		require.Equal(t, "some-id", headerRequestID)
+		require.Equal(t, "some-id", w.Header().Get("X-Request-Id"))
+	})
+
+	t.Run("generates a different id for each request", func(t *testing.T) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		firstRequestID := contextRequestID
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+		require.NotEmpty(t, firstRequestID)
+		require.Equal(t, contextRequestID, headerRequestID)
+		require.NotEqual(t, firstRequestID, contextRequestID)
+	})
+}
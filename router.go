@@ -15,12 +15,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	swagger "github.com/davidebianchi/gswagger"
 	"github.com/rond-authz/rond/internal/config"
@@ -84,7 +88,39 @@ var grantDefinitions = swagger.Definitions{
 	},
 }
 
-func addStandaloneRoutes(router *swagger.Router) error {
+var policyEvaluationDefinitions = swagger.Definitions{
+	RequestBody: &swagger.ContentValue{
+		Content: swagger.Content{
+			"application/json": {
+				Value: map[string]interface{}{},
+			},
+		},
+	},
+	Responses: map[int]swagger.ContentValue{
+		http.StatusOK: {
+			Content: swagger.Content{
+				"application/json": {Value: PolicyEvaluationResponseBody{}},
+			},
+		},
+		http.StatusInternalServerError: {
+			Content: swagger.Content{
+				"application/json": {Value: types.RequestError{}},
+			},
+		},
+		http.StatusBadRequest: {
+			Content: swagger.Content{
+				"application/json": {Value: types.RequestError{}},
+			},
+		},
+		http.StatusNotFound: {
+			Content: swagger.Content{
+				"application/json": {Value: types.RequestError{}},
+			},
+		},
+	},
+}
+
+func addStandaloneRoutes(router *swagger.Router, pathPrefixStandalone string, policyEvaluationHandler http.Handler) error {
 	if _, err := router.AddRoute(http.MethodPost, "/revoke/bindings/resource/{resourceType}", revokeHandler, revokeDefinitions); err != nil {
 		return err
 	}
@@ -97,15 +133,68 @@ func addStandaloneRoutes(router *swagger.Router) error {
 	if _, err := router.AddRoute(http.MethodPost, "/grant/bindings", grantHandler, grantDefinitions); err != nil {
 		return err
 	}
+	if _, err := router.AddRoute(http.MethodPost, path.Join(pathPrefixStandalone, "/policies/{policyName}"), policyEvaluationHandler.ServeHTTP, policyEvaluationDefinitions); err != nil {
+		return err
+	}
 	return nil
 }
 
+// publicRouteName names the route proxying the requests to the PUBLIC_PATHS,
+// which are not subject to policy evaluation.
+const publicRouteName = "public"
+
+// fallbackRouteName names the route evaluating the requests not matching any OAS path.
+const fallbackRouteName = "fallback"
+
+// isPublicPath returns whether the request path matches one of the public path patterns: a pattern
+// ending with its only * matches every path starting with the preceding prefix, the others follow path.Match.
+func isPublicPath(publicPaths []string, requestPath string) bool {
+	for _, publicPath := range publicPaths {
+		if prefix := strings.TrimSuffix(publicPath, "*"); prefix != publicPath && !strings.ContainsAny(prefix, `*?[\`) {
+			if strings.HasPrefix(requestPath, prefix) {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(publicPath, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func setupRoutes(router *mux.Router, oas *OpenAPISpec, env config.EnvironmentVariables) {
+	routePath := func(path string) string {
+		path = convertPathVariablesToBrackets(path)
+		if env.CaseInsensitivePaths {
+			// requests are matched on the lower cased path, see matchLowerCasedPath
+			return lowerStaticSegments(path)
+		}
+		return path
+	}
+
+	if env.RateLimitRPS > 0 {
+		router.Use(RateLimitMiddleware(newRateLimiter(env.RateLimitRPS, env.RateLimitBurst), env))
+	}
+
+	publicPaths := utils.SplitHeaderValues(env.PublicPaths, ",")
+	if env.CaseInsensitivePaths {
+		for i, publicPath := range publicPaths {
+			publicPaths[i] = strings.ToLower(publicPath)
+		}
+	}
+	if len(publicPaths) > 0 {
+		// registered first, so that public paths take precedence over the OAS ones
+		router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return isPublicPath(publicPaths, r.URL.Path)
+		}).HandlerFunc(alwaysProxyHandler).Name(publicRouteName)
+	}
+
 	var documentationPermission string
 	documentationPathInOAS := oas.Paths[env.TargetServiceOASPath]
 	if documentationPathInOAS != nil {
 		if getVerb, ok := documentationPathInOAS[strings.ToLower(http.MethodGet)]; ok && getVerb.PermissionV2 != nil {
-			documentationPermission = getVerb.PermissionV2.RequestFlow.PolicyName
+			documentationPermission = strings.Join(getVerb.PermissionV2.RequestFlow.allowPolicies(), ",")
 		}
 	}
 
@@ -140,17 +229,17 @@ func setupRoutes(router *mux.Router, oas *OpenAPISpec, env config.EnvironmentVar
 		}
 		if strings.Contains(pathToRegister, "*") {
 			pathWithoutAsterisk := strings.ReplaceAll(pathToRegister, "*", "")
-			router.PathPrefix(convertPathVariablesToBrackets(pathWithoutAsterisk)).HandlerFunc(rbacHandler).Methods(methods[path]...)
+			router.PathPrefix(routePath(pathWithoutAsterisk)).HandlerFunc(rbacHandler).Methods(methods[path]...)
 			continue
 		}
 		if path == env.TargetServiceOASPath && documentationPermission == "" {
-			router.HandleFunc(convertPathVariablesToBrackets(pathToRegister), alwaysProxyHandler).Methods(http.MethodGet)
+			router.HandleFunc(routePath(pathToRegister), alwaysProxyHandler).Methods(http.MethodGet)
 			continue
 		}
-		router.HandleFunc(convertPathVariablesToBrackets(pathToRegister), rbacHandler).Methods(methods[path]...)
+		router.HandleFunc(routePath(pathToRegister), rbacHandler).Methods(methods[path]...)
 	}
 	if documentationPathInOAS == nil {
-		router.HandleFunc(convertPathVariablesToBrackets(env.TargetServiceOASPath), alwaysProxyHandler)
+		router.HandleFunc(routePath(env.TargetServiceOASPath), alwaysProxyHandler)
 	}
 	// FIXME: All the routes don't inserted above are anyway handled by rbacHandler.
 	//        Maybe the code above can be cleaned.
@@ -160,7 +249,118 @@ func setupRoutes(router *mux.Router, oas *OpenAPISpec, env config.EnvironmentVar
 	if env.Standalone {
 		fallbackRoute = fmt.Sprintf("%s/", path.Join(env.PathPrefixStandalone, fallbackRoute))
 	}
-	router.PathPrefix(fallbackRoute).HandlerFunc(rbacHandler)
+	router.PathPrefix(fallbackRoute).HandlerFunc(rbacHandler).Name(fallbackRouteName)
+}
+
+// lowerStaticSegments lower cases the path segments, apart from the path variables.
+func lowerStaticSegments(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") && !strings.HasPrefix(segment, ":") {
+			segments[i] = strings.ToLower(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// swappableHandler serves the requests with the handler in use, allowing to replace it
+// while requests are being served, as when the router is rebuilt from a refreshed OAS.
+type swappableHandler struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func newSwappableHandler(handler http.Handler) *swappableHandler {
+	return &swappableHandler{handler: handler}
+}
+
+// Swap replaces the handler serving the next requests.
+func (swappable *swappableHandler) Swap(handler http.Handler) {
+	swappable.mu.Lock()
+	defer swappable.mu.Unlock()
+	swappable.handler = handler
+}
+
+func (swappable *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	swappable.mu.RLock()
+	handler := swappable.handler
+	swappable.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
+
+type originalURLContextKey struct{}
+
+// matchLowerCasedPath lets the router match the request lower casing its path, as the routes
+// are registered with lower cased static segments when CASE_INSENSITIVE_PATHS is enabled.
+// The original path is restored by restoreOriginalPath once a route is matched.
+func matchLowerCasedPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originalURL := r.URL
+		lowerCasedURL := *r.URL
+		lowerCasedURL.Path = strings.ToLower(originalURL.Path)
+		lowerCasedURL.RawPath = strings.ToLower(originalURL.RawPath)
+
+		r = r.WithContext(context.WithValue(r.Context(), originalURLContextKey{}, originalURL))
+		r.URL = &lowerCasedURL
+		next.ServeHTTP(w, r)
+	})
+}
+
+// restoreOriginalPath restores the request path lower cased by matchLowerCasedPath, so that
+// it is forwarded upstream unchanged, taking the path variables values from the original path.
+func restoreOriginalPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originalURL, ok := r.Context().Value(originalURLContextKey{}).(*url.URL)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		vars := mux.Vars(r)
+		if route := mux.CurrentRoute(r); route != nil && len(vars) > 0 {
+			vars = originalPathVars(route, originalURL.EscapedPath(), vars)
+		}
+		r = mux.SetURLVars(r, vars)
+		r.URL = originalURL
+		next.ServeHTTP(w, r)
+	})
+}
+
+var matchPathVariableName = regexp.MustCompile(`{([A-Za-z_]\w*)`)
+
+// originalPathVars matches the route case insensitively on the original path, returning
+// the path variables with their original case.
+func originalPathVars(route *mux.Route, path string, vars map[string]string) map[string]string {
+	pathTemplate, err := route.GetPathTemplate()
+	if err != nil {
+		return vars
+	}
+	pathRegexp, err := route.GetPathRegexp()
+	if err != nil {
+		return vars
+	}
+	matcher, err := regexp.Compile("(?i)" + pathRegexp)
+	if err != nil {
+		return vars
+	}
+	match := matcher.FindStringSubmatch(path)
+	if match == nil {
+		return vars
+	}
+
+	// mux names the path variables groups v0, v1, ... following their order in the template
+	names := matchPathVariableName.FindAllStringSubmatch(pathTemplate, -1)
+	originalVars := make(map[string]string, len(vars))
+	for name, value := range vars {
+		originalVars[name] = value
+	}
+	for i, groupName := range matcher.SubexpNames() {
+		index, err := strconv.Atoi(strings.TrimPrefix(groupName, "v"))
+		if !strings.HasPrefix(groupName, "v") || err != nil || index >= len(names) {
+			continue
+		}
+		originalVars[names[index][1]] = match[i]
+	}
+	return originalVars
 }
 
 var matchColons = regexp.MustCompile(`\/:(\w+)`)
@@ -169,8 +369,41 @@ func convertPathVariablesToBrackets(path string) string {
 	return matchColons.ReplaceAllString(path, "/{$1}")
 }
 
-var matchBrackets = regexp.MustCompile(`\/{(\w+)}`)
+var matchBrackets = regexp.MustCompile(`\/{(\w+)(?::[^/]+)?}`)
 
 func convertPathVariablesToColons(path string) string {
 	return matchBrackets.ReplaceAllString(path, "/:$1")
 }
+
+// removePathParamsConstraints removes the `{name:regex}` constraints from the path parameters.
+func removePathParamsConstraints(path string) string {
+	return matchBrackets.ReplaceAllString(path, "/{$1}")
+}
+
+var matchPathParameter = regexp.MustCompile(`^{(\w+)(?::(.+))?}$`)
+
+// pathParamsConstraints returns the regular expressions declared with the `{name:regex}` syntax,
+// indexed by the position of the constrained parameter among the path parameters.
+func pathParamsConstraints(path string) (map[int]*regexp.Regexp, error) {
+	constraints := map[int]*regexp.Regexp{}
+	paramIndex := 0
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ":") {
+			paramIndex++
+			continue
+		}
+		match := matchPathParameter.FindStringSubmatch(segment)
+		if match == nil {
+			continue
+		}
+		if match[2] != "" {
+			constraint, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", match[2]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid constraint for path parameter %s in %s: %s", match[1], path, err.Error())
+			}
+			constraints[paramIndex] = constraint
+		}
+		paramIndex++
+	}
+	return constraints, nil
+}
@@ -139,6 +139,53 @@ func TestSetupRoutes(t *testing.T) {
 	})
 }
 
+func TestIsPublicPath(t *testing.T) {
+	publicPaths := []string{"/public/*", "/health", "/assets/*.css"}
+
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "/public/", expected: true},
+		{path: "/public/docs/index.html", expected: true},
+		{path: "/health", expected: true},
+		{path: "/assets/main.css", expected: true},
+		{path: "/public", expected: false},
+		{path: "/health/live", expected: false},
+		{path: "/assets/nested/main.css", expected: false},
+		{path: "/users/", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.path, func(t *testing.T) {
+			assert.Equal(t, isPublicPath(publicPaths, testCase.path), testCase.expected)
+		})
+	}
+}
+
+func TestSwappableHandler(t *testing.T) {
+	statusHandler := func(statusCode int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(statusCode)
+		})
+	}
+	handler := newSwappableHandler(statusHandler(http.StatusOK))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	handler.Swap(statusHandler(http.StatusAccepted))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, w.Code, http.StatusAccepted)
+}
+
+func TestLowerStaticSegments(t *testing.T) {
+	assert.Equal(t, lowerStaticSegments("/Users/{userId}/Projects/:projectId"), "/users/{userId}/projects/:projectId")
+	assert.Equal(t, lowerStaticSegments("/API/{id:[A-Z]+}"), "/api/{id:[A-Z]+}")
+}
+
 func TestConvertPathVariables(t *testing.T) {
 	listOfPaths := []struct {
 		Path          string
@@ -176,6 +223,8 @@ func TestConvertPathVariables2(t *testing.T) {
 		{Path: "/endpoint-1/{id1}/{id2}/{id3}", ConvertedPath: "/endpoint-1/:id1/:id2/:id3"},
 		{Path: "/endpoint-1/{id}/upsert", ConvertedPath: "/endpoint-1/:id/upsert"},
 		{Path: "/:another/external-endpoint", ConvertedPath: "/:another/external-endpoint"},
+		{Path: "/users/{id:[0-9]+}", ConvertedPath: "/users/:id"},
+		{Path: "/users/{id:[0-9]{3}}/orders/{orderId:[a-z]+}", ConvertedPath: "/users/:id/orders/:orderId"},
 	}
 
 	t.Run("convert correctly paths", func(t *testing.T) {
@@ -186,6 +235,27 @@ func TestConvertPathVariables2(t *testing.T) {
 	})
 }
 
+func TestPathParamsConstraints(t *testing.T) {
+	t.Run("returns constraints indexed by parameter position", func(t *testing.T) {
+		constraints, err := pathParamsConstraints("/:tenant/users/{id}/orders/{orderId:[0-9]{3}}")
+		assert.NilError(t, err)
+		assert.Equal(t, len(constraints), 1)
+		assert.Assert(t, constraints[2].MatchString("123"))
+		assert.Assert(t, !constraints[2].MatchString("1234"), "constraint must match the whole segment")
+	})
+
+	t.Run("returns no constraints for unconstrained path", func(t *testing.T) {
+		constraints, err := pathParamsConstraints("/users/{id}/*")
+		assert.NilError(t, err)
+		assert.Equal(t, len(constraints), 0)
+	})
+
+	t.Run("fails on invalid constraint", func(t *testing.T) {
+		_, err := pathParamsConstraints("/users/{id:[0-9}")
+		assert.Error(t, err, "invalid constraint for path parameter id in /users/{id:[0-9}: error parsing regexp: missing closing ]: `[0-9)$`")
+	})
+}
+
 func createContext(
 	t *testing.T,
 	originalCtx context.Context,
@@ -310,6 +380,92 @@ func TestSetupRoutesIntegration(t *testing.T) {
 		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
 	})
 
+	t.Run("proxies public paths without policy evaluation", func(t *testing.T) {
+		var mockOPAModule = &OPAModuleConfig{
+			Name: "example.rego",
+			Content: `package policies
+		todo { false }`,
+		}
+		mockPartialEvaluators, _ := setupEvaluators(ctx, nil, oas, mockOPAModule, envs)
+
+		var invokedPaths []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invokedPaths = append(invokedPaths, r.URL.Path)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host, PublicPaths: "/public/*,/users/public"}
+
+		router := mux.NewRouter()
+		router.Use(config.RequestMiddlewareEnvironments(env))
+		router.Use(OPAMiddleware(NewPoliciesStore(mockOPAModule, mockPartialEvaluators), oas, &env))
+		setupRoutes(router, oas, env)
+
+		for _, path := range []string{"/public/docs", "/users/public"} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://crud-service"+path, nil)
+			assert.NilError(t, err)
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, w.Result().StatusCode, http.StatusOK, "unexpected status code for %s", path)
+		}
+		assert.DeepEqual(t, invokedPaths, []string{"/public/docs", "/users/public"})
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://crud-service/users/", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
+		assert.Equal(t, len(invokedPaths), 2, "not public path was proxied")
+	})
+
+	t.Run("matches case insensitive paths forwarding the original path", func(t *testing.T) {
+		oas := &OpenAPISpec{
+			Paths: OpenAPIPaths{
+				"/Users/{userId}/Projects/{projectId}": PathVerbs{"get": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}}},
+			},
+		}
+		mockPartialEvaluators, _ := setupEvaluators(ctx, nil, oas, mockOPAModule, envs)
+
+		var invokedPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invokedPath = r.URL.Path
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		serverURL, _ := url.Parse(server.URL)
+		env := config.EnvironmentVariables{TargetServiceHost: serverURL.Host, CaseInsensitivePaths: true}
+
+		var pathParams map[string]string
+		router := mux.NewRouter().UseEncodedPath()
+		router.Use(restoreOriginalPath)
+		router.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pathParams = mux.Vars(r)
+				next.ServeHTTP(w, r)
+			})
+		})
+		router.Use(config.RequestMiddlewareEnvironments(env))
+		router.Use(OPAMiddleware(NewPoliciesStore(mockOPAModule, mockPartialEvaluators), oas, &env))
+		setupRoutes(router, oas, env)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://crud-service/USERS/AbC/projects/XyZ", nil)
+		assert.NilError(t, err)
+		w := httptest.NewRecorder()
+
+		matchLowerCasedPath(router).ServeHTTP(w, req)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+		assert.Equal(t, invokedPath, "/USERS/AbC/projects/XyZ")
+		assert.DeepEqual(t, pathParams, map[string]string{"userId": "AbC", "projectId": "XyZ"})
+	})
+
 	t.Run("blocks request on not allowed policy evaluation", func(t *testing.T) {
 		var mockOPAModule = &OPAModuleConfig{
 			Name: "example.rego",
@@ -21,6 +21,7 @@ import (
 
 	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/internal/crudclient"
+	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
 
@@ -113,6 +114,8 @@ func revokeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logger.WithField("deletedBindings", deleteCrudResponse).Debug("binding deletion finished")
+		mongoclient.GetBindingsCacheFromContext(r.Context()).Invalidate(reqBody.Subjects, reqBody.Groups)
+		GetDecisionCacheFromContext(r.Context()).Invalidate()
 	}
 
 	if len(bindingsToPatch) > 0 {
@@ -129,6 +132,8 @@ func revokeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		logger.WithField("updatedBindings", patchCrudResponse).Debug("binding updated finished")
+		mongoclient.GetBindingsCacheFromContext(r.Context()).Invalidate(reqBody.Subjects, reqBody.Groups)
+		GetDecisionCacheFromContext(r.Context()).Invalidate()
 	}
 
 	response := RevokeResponseBody{
@@ -213,6 +218,8 @@ func grantHandler(w http.ResponseWriter, r *http.Request) {
 		failResponseWithCode(w, http.StatusInternalServerError, "failed crud request for creating bindings", GENERIC_BUSINESS_ERROR_MESSAGE)
 		return
 	}
+	mongoclient.GetBindingsCacheFromContext(r.Context()).Invalidate(reqBody.Subjects, reqBody.Groups)
+	GetDecisionCacheFromContext(r.Context()).Invalidate()
 	logger.WithFields(logrus.Fields{
 		"createdBindingObjectId": utils.SanitizeString(bindingIDCreated.ObjectID),
 		"createdBindingId":       utils.SanitizeString(bindingToCreate.BindingID),
@@ -237,6 +244,91 @@ func grantHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type PolicyEvaluationResponseBody struct {
+	Allowed bool        `json:"allowed"`
+	Query   interface{} `json:"query" jsonschema:"type=object"`
+}
+
+// policyEvaluationHandler evaluates the policy named in the path against the Input
+// provided as request body; when the policy is not satisfied as is, it is partially
+// evaluated to look for the row filter query that would grant the access.
+func policyEvaluationHandler(policies *PoliciesStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opaModuleConfig, partialResultsEvaluators := policies.Get()
+		logger := glogger.Get(r.Context())
+		env, err := config.GetEnv(r.Context())
+		if err != nil {
+			failResponseWithCode(w, http.StatusInternalServerError, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		policyName := mux.Vars(r)["policyName"]
+		if _, ok := partialResultsEvaluators[policyName]; !ok {
+			failResponseWithCode(w, http.StatusNotFound, fmt.Sprintf("policy %s not found", utils.SanitizeString(policyName)), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		input := Input{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			failResponseWithCode(w, http.StatusBadRequest, fmt.Sprintf("invalid input: %s", err.Error()), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		writePolicyEvaluation(w, r, logger, env, policyName, input, opaModuleConfig, partialResultsEvaluators)
+	}
+}
+
+// writePolicyEvaluation evaluates the policy against the input and writes the result: a policy
+// denying the request is then partially evaluated, since it may allow it with the generated query.
+func writePolicyEvaluation(
+	w http.ResponseWriter,
+	r *http.Request,
+	logger *logrus.Entry,
+	env config.EnvironmentVariables,
+	policyName string,
+	input Input,
+	opaModuleConfig *OPAModuleConfig,
+	partialResultsEvaluators PartialResultsEvaluators,
+) {
+	inputBytes, err := json.Marshal(input)
+	if err != nil {
+		failResponseWithCode(w, http.StatusInternalServerError, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+
+	response := PolicyEvaluationResponseBody{}
+	evaluator, err := partialResultsEvaluators.GetEvaluatorFromPolicy(r.Context(), policyName, inputBytes, env)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed policy evaluator retrieval")
+		failResponseWithCode(w, http.StatusInternalServerError, "failed policy evaluator retrieval", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	if _, err := evaluator.evaluateRequestPolicy(logger); err == nil {
+		response.Allowed = true
+	} else {
+		queryEvaluator, err := NewOPAEvaluator(r.Context(), policyName, opaModuleConfig, inputBytes, env)
+		if err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed policy evaluator creation")
+			failResponseWithCode(w, http.StatusInternalServerError, "failed policy evaluator creation", GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		if query, err := queryEvaluator.partiallyEvaluate(logger, QueryOptions{}); err == nil && query != nil {
+			response.Allowed = true
+			response.Query = query
+		}
+	}
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed response body")
+		failResponseWithCode(w, http.StatusInternalServerError, "failed response body creation", GENERIC_BUSINESS_ERROR_MESSAGE)
+		return
+	}
+	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+	if _, err := w.Write(responseBytes); err != nil {
+		logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+	}
+}
+
 func buildQuery(resourceType string, resourceIDs []string, subjects []string, groups []string) ([]byte, error) {
 	queryPartForSubjectOrGroups := map[string]interface{}{
 		"$or": []map[string]interface{}{},
@@ -23,10 +23,12 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mongoclient"
 	"github.com/rond-authz/rond/types"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/h2non/gock.v1"
@@ -710,6 +712,40 @@ func TestGrantHandler(t *testing.T) {
 		grantHandler(w, req)
 		assert.Equal(t, w.Result().StatusCode, http.StatusInternalServerError)
 	})
+
+	t.Run("invalidates cached bindings of granted subjects and groups", func(t *testing.T) {
+		defer gock.Flush()
+
+		bindingsCache := mongoclient.NewBindingsCache(10, time.Minute)
+		bindingsCache.Set(types.User{UserID: "piero"})
+		bindingsCache.Set(types.User{UserID: "other", UserGroups: []string{"test-group"}})
+		bindingsCache.Set(types.User{UserID: "untouched"})
+
+		reqBody := setupGrantRequestBody(t, GrantRequestBody{
+			Subjects: []string{"piero"},
+			Roles:    []string{"editor"},
+			Groups:   []string{"test-group"},
+		})
+
+		gock.DisableNetworking()
+		gock.New("http://crud-service").
+			Post("/bindings/").
+			Reply(http.StatusOK).
+			JSON(map[string]interface{}{"_id": "newObjectId"})
+
+		req := requestWithParams(t, mongoclient.WithBindingsCache(ctx, bindingsCache), http.MethodPost, "/", bytes.NewBuffer(reqBody), nil)
+		w := httptest.NewRecorder()
+
+		grantHandler(w, req)
+		assert.Equal(t, w.Result().StatusCode, http.StatusOK)
+
+		_, ok := bindingsCache.Get("", "piero", nil)
+		assert.Assert(t, !ok)
+		_, ok = bindingsCache.Get("", "other", []string{"test-group"})
+		assert.Assert(t, !ok)
+		_, ok = bindingsCache.Get("", "untouched", nil)
+		assert.Assert(t, ok)
+	})
 }
 
 func TestBindingsToUpdate(t *testing.T) {
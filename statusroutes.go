@@ -16,10 +16,16 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/gorilla/mux"
 	"github.com/mia-platform/glogger/v2"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/metrics"
+	"github.com/rond-authz/rond/internal/mongoclient"
+	"github.com/rond-authz/rond/internal/utils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -30,10 +36,15 @@ type StatusResponse struct {
 	Version string `json:"version"`
 }
 
-func handleStatusRoutes(w http.ResponseWriter, serviceName, serviceVersion string) (*StatusResponse, []byte) {
+const (
+	statusOK = "OK"
+	statusKO = "KO"
+)
+
+func handleStatusRoutes(w http.ResponseWriter, serviceName, serviceVersion, statusValue string) (*StatusResponse, []byte) {
 	w.Header().Add(ContentTypeHeaderKey, JSONContentTypeHeader)
 	status := StatusResponse{
-		Status:  "OK",
+		Status:  statusValue,
 		Name:    serviceName,
 		Version: serviceVersion,
 	}
@@ -50,7 +61,7 @@ var statusRoutes = []string{"/-/rbac-healthz", "/-/rbac-ready", "/-/rbac-check-u
 
 func handleStatusEndpoint(serviceName, serviceVersion string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		_, body := handleStatusRoutes(w, serviceName, serviceVersion)
+		_, body := handleStatusRoutes(w, serviceName, serviceVersion, statusOK)
 		if _, err := w.Write(body); err != nil {
 			logger := glogger.Get(req.Context())
 			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
@@ -58,12 +69,129 @@ func handleStatusEndpoint(serviceName, serviceVersion string) func(http.Response
 	}
 }
 
+// handleReadinessEndpoint behaves like the status endpoint, but it also verifies the connection
+// to MongoDB when a client is available in the request context.
+func handleReadinessEndpoint(serviceName, serviceVersion string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := glogger.Get(req.Context())
+		statusValue := statusOK
+		statusCode := http.StatusOK
+
+		mongoClient, err := mongoclient.GetMongoClientFromContext(req.Context())
+		if err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("failed MongoDB client retrieval")
+			statusValue, statusCode = statusKO, http.StatusServiceUnavailable
+		} else if mongoClient != nil {
+			if err := mongoClient.HealthCheck(req.Context()); err != nil {
+				logger.WithField("error", logrus.Fields{"message": err.Error()}).Error("MongoDB health check failed")
+				statusValue, statusCode = statusKO, http.StatusServiceUnavailable
+			}
+		}
+
+		_, body := handleStatusRoutes(w, serviceName, serviceVersion, statusValue)
+		w.WriteHeader(statusCode)
+		if _, err := w.Write(body); err != nil {
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}
+}
+
 // StatusRoutes add status routes to router.
 func StatusRoutes(r *mux.Router, serviceName, serviceVersion string) {
 	statusEndpointHandler := handleStatusEndpoint(serviceName, serviceVersion)
 	r.HandleFunc("/-/rbac-healthz", statusEndpointHandler)
 
-	r.HandleFunc("/-/rbac-ready", statusEndpointHandler)
+	r.HandleFunc("/-/rbac-ready", handleReadinessEndpoint(serviceName, serviceVersion))
 
 	r.HandleFunc("/-/rbac-check-up", statusEndpointHandler)
 }
+
+const (
+	policiesRoute = "/-/rbac-policies"
+	metricsRoute  = "/-/rbac-metrics"
+	validateRoute = "/-/rbac-validate"
+)
+
+// PolicyRoute is the rönd configuration resolved for a verb of a path of the OAS.
+type PolicyRoute struct {
+	Path       string      `json:"path"`
+	Verb       string      `json:"verb"`
+	RondConfig *RondConfig `json:"rondConfig"`
+}
+
+// policyRoutes lists the configuration of every path and verb of the OAS, sorted by path and verb.
+func policyRoutes(oas *OpenAPISpec) []PolicyRoute {
+	routes := []PolicyRoute{}
+	if oas == nil {
+		return routes
+	}
+	for path, pathVerbs := range oas.Paths {
+		for verb, verbConfig := range pathVerbs {
+			routes = append(routes, PolicyRoute{Path: path, Verb: verb, RondConfig: verbConfig.PermissionV2})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Verb < routes[j].Verb
+	})
+	return routes
+}
+
+// PoliciesRoute adds the read-only route exposing the route to policy mapping of the loaded OAS.
+func PoliciesRoute(r *mux.Router, oas *OpenAPISpec) {
+	body, err := json.Marshal(policyRoutes(oas))
+	r.HandleFunc(policiesRoute, func(w http.ResponseWriter, req *http.Request) {
+		if err != nil {
+			failResponseWithCode(w, http.StatusInternalServerError, "failed policies serialization", GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		w.Header().Add(ContentTypeHeaderKey, JSONContentTypeHeader)
+		if _, err := w.Write(body); err != nil {
+			logger := glogger.Get(req.Context())
+			logger.WithField("error", logrus.Fields{"message": err.Error()}).Warn("failed response write")
+		}
+	}).Methods(http.MethodGet)
+}
+
+// PolicyValidationRequestBody is the policy, with the input to evaluate it against, posted to the validate route.
+type PolicyValidationRequestBody struct {
+	PolicyName string `json:"policyName"`
+	Input      Input  `json:"input"`
+}
+
+// ValidateRoute adds the debugging route evaluating a policy against the posted input,
+// returning whether it is allowed and the generated query, without proxying any request.
+func ValidateRoute(r *mux.Router, policies *PoliciesStore) {
+	r.HandleFunc(validateRoute, func(w http.ResponseWriter, req *http.Request) {
+		opaModuleConfig, partialResultsEvaluators := policies.Get()
+		logger := glogger.Get(req.Context())
+		env, err := config.GetEnv(req.Context())
+		if err != nil {
+			failResponseWithCode(w, http.StatusInternalServerError, err.Error(), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		body := PolicyValidationRequestBody{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			failResponseWithCode(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		if body.PolicyName == "" {
+			failResponseWithCode(w, http.StatusBadRequest, "invalid request body: missing policyName", GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+		if _, ok := partialResultsEvaluators[body.PolicyName]; !ok {
+			failResponseWithCode(w, http.StatusNotFound, fmt.Sprintf("policy %s not found", utils.SanitizeString(body.PolicyName)), GENERIC_BUSINESS_ERROR_MESSAGE)
+			return
+		}
+
+		writePolicyEvaluation(w, req, logger, env, body.PolicyName, body.Input, opaModuleConfig, partialResultsEvaluators)
+	}).Methods(http.MethodPost)
+}
+
+// MetricsRoute adds the route exposing the collected metrics in the Prometheus format.
+func MetricsRoute(r *mux.Router, m *metrics.Metrics) {
+	r.Handle(metricsRoute, m.Handler()).Methods(http.MethodGet)
+}
@@ -16,14 +16,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/mia-platform/glogger/v2"
 	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/mocks"
 	"github.com/rond-authz/rond/internal/mongoclient"
 
 	"github.com/gorilla/mux"
@@ -88,6 +91,62 @@ func TestStatusRoutes(testCase *testing.T) {
 	})
 }
 
+func TestReadinessRoute(t *testing.T) {
+	serviceName := "my-service-name"
+	serviceVersion := "0.0.0"
+
+	t.Run("ok without MongoDB client", func(t *testing.T) {
+		testRouter := mux.NewRouter()
+		StatusRoutes(testRouter, serviceName, serviceVersion)
+
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("ok with reachable MongoDB", func(t *testing.T) {
+		testRouter := mux.NewRouter()
+		testRouter.Use(mongoclient.MongoClientInjectorMiddleware(mocks.MongoClientMock{}))
+		StatusRoutes(testRouter, serviceName, serviceVersion)
+
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("service unavailable with unreachable MongoDB", func(t *testing.T) {
+		testRouter := mux.NewRouter()
+		testRouter.Use(mongoclient.MongoClientInjectorMiddleware(mocks.MongoClientMock{
+			HealthCheckError: fmt.Errorf("server selection timeout"),
+		}))
+		StatusRoutes(testRouter, serviceName, serviceVersion)
+
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-ready", nil))
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		expectedResponse := fmt.Sprintf("{\"status\":\"KO\",\"name\":\"%s\",\"version\":\"%s\"}", serviceName, serviceVersion)
+		require.Equal(t, expectedResponse, string(body))
+	})
+
+	t.Run("liveness is not affected by MongoDB", func(t *testing.T) {
+		testRouter := mux.NewRouter()
+		testRouter.Use(mongoclient.MongoClientInjectorMiddleware(mocks.MongoClientMock{
+			HealthCheckError: fmt.Errorf("server selection timeout"),
+		}))
+		StatusRoutes(testRouter, serviceName, serviceVersion)
+
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/rbac-healthz", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+}
+
 func TestStatusRoutesIntegration(t *testing.T) {
 	log, _ := test.NewNullLogger()
 	ctx := glogger.WithLogger(context.Background(), logrus.NewEntry(log))
@@ -120,7 +179,7 @@ test_policy { true }
 			TargetServiceHost:    "my-service:4444",
 			PathPrefixStandalone: "/my-prefix",
 		}
-		router, err := setupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
 		assert.NilError(t, err, "unexpected error")
 
 		t.Run("/-/rbac-ready", func(t *testing.T) {
@@ -146,6 +205,42 @@ test_policy { true }
 		})
 	})
 
+	t.Run("non standalone exposing policies", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			Standalone:        false,
+			TargetServiceHost: "my-service:4444",
+			ExposePolicies:    true,
+		}
+		router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
+		assert.NilError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/-/rbac-policies", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var routes []PolicyRoute
+		assert.NilError(t, json.NewDecoder(w.Result().Body).Decode(&routes))
+		assert.Equal(t, len(routes), 1)
+		assert.Equal(t, routes[0].Path, "/evalapi")
+	})
+
+	t.Run("non standalone exposing metrics", func(t *testing.T) {
+		env := config.EnvironmentVariables{
+			Standalone:        false,
+			TargetServiceHost: "my-service:4444",
+			MongoQueryMetrics: true,
+		}
+		router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
+		assert.NilError(t, err, "unexpected error")
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/-/rbac-metrics", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
 	t.Run("standalone", func(t *testing.T) {
 		env := config.EnvironmentVariables{
 			Standalone:           true,
@@ -153,7 +248,7 @@ test_policy { true }
 			PathPrefixStandalone: "/my-prefix",
 			ServiceVersion:       "latest",
 		}
-		router, err := setupRouter(log, env, opa, oas, evaluatorsMap, mongoClient)
+		router, err := setupRouter(log, env, NewPoliciesStore(opa, evaluatorsMap), oas, mongoClient)
 		assert.NilError(t, err, "unexpected error")
 		t.Run("/-/rbac-ready", func(t *testing.T) {
 			w := httptest.NewRecorder()
@@ -178,3 +273,123 @@ test_policy { true }
 		})
 	})
 }
+
+func TestPoliciesRoute(t *testing.T) {
+	oas, err := loadOASFromReader(strings.NewReader(`{"paths":{
+		"/users/{id}":{
+			"get":{"x-rond":{"requestFlow":{"policyName":"allow_user","generateQuery":true},"responseFlow":{"policyName":"filter_user"}}},
+			"delete":{"x-permission":{"allow":"delete_user"}}
+		},
+		"/health":{"get":{}}
+	}}`))
+	require.NoError(t, err)
+
+	testRouter := mux.NewRouter()
+	PoliciesRoute(testRouter, oas)
+
+	t.Run("lists the resolved configuration of every route", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request, requestError := http.NewRequest(http.MethodGet, "/-/rbac-policies", nil)
+		require.NoError(t, requestError)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusOK, responseRecorder.Result().StatusCode)
+		require.Equal(t, JSONContentTypeHeader, responseRecorder.Result().Header.Get(ContentTypeHeaderKey))
+
+		var routes []PolicyRoute
+		require.NoError(t, json.NewDecoder(responseRecorder.Result().Body).Decode(&routes))
+		require.Equal(t, []PolicyRoute{
+			{Path: "/health", Verb: "get"},
+			{Path: "/users/{id}", Verb: "delete", RondConfig: &RondConfig{RequestFlow: RequestFlow{PolicyName: "delete_user"}}},
+			{
+				Path: "/users/{id}",
+				Verb: "get",
+				RondConfig: &RondConfig{
+					RequestFlow:  RequestFlow{PolicyName: "allow_user", GenerateQuery: true},
+					ResponseFlow: ResponseFlow{PolicyName: "filter_user"},
+				},
+			},
+		}, routes)
+	})
+
+	t.Run("is read-only", func(t *testing.T) {
+		responseRecorder := httptest.NewRecorder()
+		request, requestError := http.NewRequest(http.MethodPost, "/-/rbac-policies", nil)
+		require.NoError(t, requestError)
+
+		testRouter.ServeHTTP(responseRecorder, request)
+		require.Equal(t, http.StatusMethodNotAllowed, responseRecorder.Result().StatusCode)
+	})
+
+	t.Run("lists no routes without OAS", func(t *testing.T) {
+		require.Equal(t, []PolicyRoute{}, policyRoutes(nil))
+	})
+}
+
+func TestValidateRoute(t *testing.T) {
+	opaModule := &OPAModuleConfig{Name: "example.rego", Content: `package policies
+allow_get {
+	input.request.method == "GET"
+}
+filter_projects {
+	project := data.resources[_]
+	project.tenant == input.user.properties.tenant
+}`}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get":  VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "allow_get"}}},
+				"post": VerbConfig{PermissionV2: &RondConfig{RequestFlow: RequestFlow{PolicyName: "filter_projects", GenerateQuery: true}}},
+			},
+		},
+	}
+	env := config.EnvironmentVariables{}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, env)
+	require.NoError(t, err)
+
+	testRouter := mux.NewRouter()
+	testRouter.Use(config.RequestMiddlewareEnvironments(env))
+	ValidateRoute(testRouter, NewPoliciesStore(opaModule, partialEvaluators))
+
+	validate := func(t *testing.T, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		responseRecorder := httptest.NewRecorder()
+		request, requestError := http.NewRequest(http.MethodPost, "/-/rbac-validate", strings.NewReader(body))
+		require.NoError(t, requestError)
+		testRouter.ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	t.Run("allows with an allow policy", func(t *testing.T) {
+		responseRecorder := validate(t, `{"policyName":"allow_get","input":{"request":{"method":"GET"}}}`)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		require.JSONEq(t, `{"allowed":true,"query":null}`, responseRecorder.Body.String())
+	})
+
+	t.Run("denies with an allow policy", func(t *testing.T) {
+		responseRecorder := validate(t, `{"policyName":"allow_get","input":{"request":{"method":"DELETE"}}}`)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		require.JSONEq(t, `{"allowed":false,"query":null}`, responseRecorder.Body.String())
+	})
+
+	t.Run("returns the query generated by a row filter policy", func(t *testing.T) {
+		responseRecorder := validate(t, `{"policyName":"filter_projects","input":{"request":{"method":"GET"},"user":{"properties":{"tenant":"acme"}}}}`)
+		require.Equal(t, http.StatusOK, responseRecorder.Code)
+		require.JSONEq(t, `{"allowed":true,"query":{"$or":[{"$and":[{"tenant":{"$eq":"acme"}}]}]}}`, responseRecorder.Body.String())
+	})
+
+	t.Run("responds 400 on invalid body", func(t *testing.T) {
+		responseRecorder := validate(t, `{"policyName":`)
+		require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	})
+
+	t.Run("responds 400 without policy name", func(t *testing.T) {
+		responseRecorder := validate(t, `{"input":{}}`)
+		require.Equal(t, http.StatusBadRequest, responseRecorder.Code)
+	})
+
+	t.Run("responds 404 on unknown policy", func(t *testing.T) {
+		responseRecorder := validate(t, `{"policyName":"missing","input":{}}`)
+		require.Equal(t, http.StatusNotFound, responseRecorder.Code)
+	})
+}
@@ -0,0 +1,269 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/internal/config"
+)
+
+type targetServiceTransportKey struct{}
+
+const (
+	defaultTargetDialTimeout     = 30 * time.Second
+	defaultTargetMaxIdleConns    = 100
+	defaultTargetIdleConnTimeout = 90 * time.Second
+
+	defaultProxyRetryBackoff = 100 * time.Millisecond
+	maxProxyRetryBackoff     = 5 * time.Second
+
+	// unixSocketHostPrefix marks a target service host reached through a unix domain socket.
+	unixSocketHostPrefix = "unix:"
+	// unixSocketURLHost replaces the socket path in the URL of the requests sent over the socket.
+	unixSocketURLHost = "localhost"
+
+	// ProxyRetryHeaderKey opts in to retries for requests with non-idempotent methods.
+	ProxyRetryHeaderKey = "x-rond-retry"
+)
+
+// newTargetServiceTransport returns the transport used to proxy requests to the target service,
+// configured with the connection pool and TLS settings provided by the environment. The function
+// returns a `nil` transport when no custom setting is provided, meaning http.DefaultTransport is used.
+func newTargetServiceTransport(env config.EnvironmentVariables) (http.RoundTripper, error) {
+	hasPoolSettings := env.TargetMaxIdleConns > 0 || env.TargetIdleConnTimeout > 0 || env.TargetDialTimeout > 0
+	hasTLSSettings := env.TargetServiceCACert != "" || env.TargetServiceInsecure
+	_, isUnixSocket := unixSocketPath(env.TargetServiceHost)
+	if !hasPoolSettings && !hasTLSSettings && !isUnixSocket {
+		return nil, nil
+	}
+	transport := newPooledTransport(env)
+	if !hasTLSSettings {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//#nosec G402 -- skipping verification is an explicit opt-in meant for development environments
+		InsecureSkipVerify: env.TargetServiceInsecure,
+	}
+	if env.TargetServiceCACert != "" {
+		caCert, err := os.ReadFile(env.TargetServiceCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed target service CA certificate read: %s", err.Error())
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificate found in %s", env.TargetServiceCACert)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// newPooledTransport returns a transport with the same settings of http.DefaultTransport,
+// overridden by the ones provided by the environment. Since all the requests are sent to
+// the target service, the idle connections limit is applied to the single host as well.
+// When the target service host is a unix socket, every connection is dialed to that socket.
+func newPooledTransport(env config.EnvironmentVariables) *http.Transport {
+	dialTimeout := defaultTargetDialTimeout
+	if env.TargetDialTimeout > 0 {
+		dialTimeout = env.TargetDialTimeout
+	}
+	idleConnTimeout := defaultTargetIdleConnTimeout
+	if env.TargetIdleConnTimeout > 0 {
+		idleConnTimeout = env.TargetIdleConnTimeout
+	}
+	maxIdleConnsPerHost := http.DefaultMaxIdleConnsPerHost
+	maxIdleConns := defaultTargetMaxIdleConns
+	if env.TargetMaxIdleConns > 0 {
+		maxIdleConns = env.TargetMaxIdleConns
+		maxIdleConnsPerHost = env.TargetMaxIdleConns
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	proxy := http.ProxyFromEnvironment
+	dialContext := dialer.DialContext
+	if socketPath, ok := unixSocketPath(env.TargetServiceHost); ok {
+		proxy = nil
+		dialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// unixSocketPath returns the socket path of a target service host in the unix:/path/to.sock form.
+func unixSocketPath(host string) (string, bool) {
+	if !strings.HasPrefix(host, unixSocketHostPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, unixSocketHostPrefix), true
+}
+
+// targetServiceURLHost returns the host to be set in the URL of the requests proxied to the
+// target service, which is a placeholder when the connection is dialed to a unix socket.
+func targetServiceURLHost(host string) string {
+	if _, ok := unixSocketPath(host); ok {
+		return unixSocketURLHost
+	}
+	return host
+}
+
+// TargetServiceTransportInjectorMiddleware will inject into request context the
+// transport used to reach the target service.
+func TargetServiceTransportInjectorMiddleware(transport http.RoundTripper) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), targetServiceTransportKey{}, transport)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// getTargetServiceTransport returns the transport found in context, defaulting to http.DefaultTransport.
+func getTargetServiceTransport(ctx context.Context) http.RoundTripper {
+	if transport, ok := ctx.Value(targetServiceTransportKey{}).(http.RoundTripper); ok {
+		return transport
+	}
+	return http.DefaultTransport
+}
+
+// retryTransport retries the requests with idempotent methods, or opted in with ProxyRetryHeaderKey,
+// when the target service fails with a transient error.
+type retryTransport struct {
+	http.RoundTripper
+	retries int
+	backoff time.Duration
+	optedIn bool
+}
+
+// newRetryTransport returns the transport retrying the proxied requests; optedIn reports whether the
+// inbound request opted in with ProxyRetryHeaderKey, which is not forwarded to the target service.
+func newRetryTransport(transport http.RoundTripper, env config.EnvironmentVariables, optedIn bool) http.RoundTripper {
+	if env.ProxyRetries <= 0 {
+		return transport
+	}
+	return &retryTransport{RoundTripper: transport, retries: env.ProxyRetries, backoff: env.ProxyRetryBackoff, optedIn: optedIn}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetriableRequest(req, t.optedIn) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	// the body is buffered so that it can be sent again on retry
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		if err := req.Body.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if body != nil {
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.RoundTripper.RoundTrip(attemptReq)
+		if attempt > t.retries || !isTransientFailure(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			//#nosec G104 -- the failed response is discarded
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(proxyRetryBackoff(t.backoff, attempt)):
+		}
+	}
+}
+
+// proxyRetryBackoff returns the time to wait before the retry following the given attempt,
+// doubling the backoff at each attempt.
+func proxyRetryBackoff(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 {
+		backoff = defaultProxyRetryBackoff
+	}
+	retryIn := backoff
+	for i := 1; i < attempt && retryIn < maxProxyRetryBackoff; i++ {
+		retryIn *= 2
+	}
+	if retryIn > maxProxyRetryBackoff {
+		return maxProxyRetryBackoff
+	}
+	return retryIn
+}
+
+func isRetriableRequest(req *http.Request, optedIn bool) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return optedIn
+}
+
+// isRetryOptedIn reports whether the inbound request opted in to retries with ProxyRetryHeaderKey.
+func isRetryOptedIn(req *http.Request) bool {
+	return req.Header.Get(ProxyRetryHeaderKey) == "true"
+}
+
+// isTransientFailure returns whether the target service is temporarily unavailable, it refused
+// the connection, as while being restarted, or it reset the connection.
+func isTransientFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
@@ -0,0 +1,395 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTargetServiceTransport(t *testing.T) {
+	t.Run("returns no transport without custom TLS settings", func(t *testing.T) {
+		transport, err := newTargetServiceTransport(config.EnvironmentVariables{})
+		require.NoError(t, err)
+		require.Nil(t, transport)
+	})
+
+	t.Run("returns a pooled transport with default settings", func(t *testing.T) {
+		transport, err := newTargetServiceTransport(config.EnvironmentVariables{TargetDialTimeout: 5 * time.Second})
+		require.NoError(t, err)
+
+		httpTransport := transport.(*http.Transport)
+		require.Equal(t, defaultTargetMaxIdleConns, httpTransport.MaxIdleConns)
+		require.Equal(t, http.DefaultMaxIdleConnsPerHost, httpTransport.MaxIdleConnsPerHost)
+		require.Equal(t, defaultTargetIdleConnTimeout, httpTransport.IdleConnTimeout)
+		require.Nil(t, httpTransport.TLSClientConfig)
+	})
+
+	t.Run("returns a pooled transport with configured settings", func(t *testing.T) {
+		transport, err := newTargetServiceTransport(config.EnvironmentVariables{
+			TargetMaxIdleConns:    500,
+			TargetIdleConnTimeout: 30 * time.Second,
+		})
+		require.NoError(t, err)
+
+		httpTransport := transport.(*http.Transport)
+		require.Equal(t, 500, httpTransport.MaxIdleConns)
+		require.Equal(t, 500, httpTransport.MaxIdleConnsPerHost)
+		require.Equal(t, 30*time.Second, httpTransport.IdleConnTimeout)
+	})
+
+	t.Run("fails to dial after configured timeout", func(t *testing.T) {
+		transport, err := newTargetServiceTransport(config.EnvironmentVariables{TargetDialTimeout: time.Nanosecond})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "http://10.255.255.1/", nil)
+		_, err = transport.RoundTrip(req)
+		require.Error(t, err)
+	})
+
+	t.Run("fails if CA certificate file does not exist", func(t *testing.T) {
+		_, err := newTargetServiceTransport(config.EnvironmentVariables{TargetServiceCACert: "./not-existing.pem"})
+		require.ErrorContains(t, err, "failed target service CA certificate read")
+	})
+
+	t.Run("fails if CA certificate file contains no certificates", func(t *testing.T) {
+		caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(t, os.WriteFile(caCertPath, []byte("not a certificate"), 0600))
+
+		_, err := newTargetServiceTransport(config.EnvironmentVariables{TargetServiceCACert: caCertPath})
+		require.ErrorContains(t, err, "no valid certificate found")
+	})
+
+	t.Run("skips verification when insecure", func(t *testing.T) {
+		transport, err := newTargetServiceTransport(config.EnvironmentVariables{TargetServiceInsecure: true})
+		require.NoError(t, err)
+		require.True(t, transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	})
+}
+
+func TestGetTargetServiceTransport(t *testing.T) {
+	t.Run("defaults to http.DefaultTransport", func(t *testing.T) {
+		require.Equal(t, http.DefaultTransport, getTargetServiceTransport(context.Background()))
+	})
+
+	t.Run("returns transport injected by middleware", func(t *testing.T) {
+		transport := &http.Transport{}
+		invoked := false
+		handler := TargetServiceTransportInjectorMiddleware(transport)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			invoked = true
+			require.Equal(t, transport, getTargetServiceTransport(r.Context()))
+		}))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		require.True(t, invoked)
+	})
+}
+
+func TestProxyToTLSTargetService(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"name":"resource"}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caCertPath, caCert, 0600))
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { true }
+response_policy [body] { body := input.response.body }`,
+	}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "todo"},
+						ResponseFlow: ResponseFlow{PolicyName: "response_policy"},
+					},
+				},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	require.NoError(t, err)
+
+	proxyRequest := func(t *testing.T, env config.EnvironmentVariables, permission *RondConfig) *httptest.ResponseRecorder {
+		t.Helper()
+		transport, err := newTargetServiceTransport(env)
+		require.NoError(t, err)
+
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com:8080/api", nil)
+		if transport != nil {
+			ctx = context.WithValue(ctx, targetServiceTransportKey{}, transport)
+		}
+		req = req.WithContext(ctx)
+
+		w := httptest.NewRecorder()
+		rbacHandler(w, req)
+		return w
+	}
+
+	t.Run("proxies with configured CA certificate", func(t *testing.T) {
+		w := proxyRequest(t, config.EnvironmentVariables{
+			TargetServiceHost:   serverURL.Host,
+			TargetServiceScheme: "https",
+			TargetServiceCACert: caCertPath,
+		}, mockXPermission)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("proxies through response policy with configured CA certificate", func(t *testing.T) {
+		w := proxyRequest(t, config.EnvironmentVariables{
+			TargetServiceHost:   serverURL.Host,
+			TargetServiceScheme: "https",
+			TargetServiceCACert: caCertPath,
+		}, oas.Paths["/api"]["get"].PermissionV2)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.JSONEq(t, `{"name":"resource"}`, w.Body.String())
+	})
+
+	t.Run("proxies skipping verification", func(t *testing.T) {
+		w := proxyRequest(t, config.EnvironmentVariables{
+			TargetServiceHost:     serverURL.Host,
+			TargetServiceScheme:   "https",
+			TargetServiceInsecure: true,
+		}, mockXPermission)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("fails with untrusted certificate", func(t *testing.T) {
+		w := proxyRequest(t, config.EnvironmentVariables{
+			TargetServiceHost:   serverURL.Host,
+			TargetServiceScheme: "https",
+		}, mockXPermission)
+		require.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+	})
+}
+
+func TestProxyToUnixSocketTargetService(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "target.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"name":"resource"}`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+todo { true }
+response_policy [body] { body := input.response.body }`,
+	}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/api": PathVerbs{
+				"get": VerbConfig{
+					PermissionV2: &RondConfig{
+						RequestFlow:  RequestFlow{PolicyName: "todo"},
+						ResponseFlow: ResponseFlow{PolicyName: "response_policy"},
+					},
+				},
+			},
+		},
+	}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	require.NoError(t, err)
+
+	env := config.EnvironmentVariables{TargetServiceHost: "unix:" + socketPath}
+	transport, err := newTargetServiceTransport(env)
+	require.NoError(t, err)
+	require.NotNil(t, transport)
+
+	proxyRequest := func(t *testing.T, permission *RondConfig) *httptest.ResponseRecorder {
+		t.Helper()
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+		ctx = context.WithValue(ctx, targetServiceTransportKey{}, transport)
+		req := httptest.NewRequest(http.MethodGet, "http://www.example.com:8080/api", nil).WithContext(ctx)
+
+		w := httptest.NewRecorder()
+		rbacHandler(w, req)
+		return w
+	}
+
+	t.Run("proxies to the unix socket", func(t *testing.T) {
+		w := proxyRequest(t, mockXPermission)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("proxies through response policy to the unix socket", func(t *testing.T) {
+		w := proxyRequest(t, oas.Paths["/api"]["get"].PermissionV2)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.JSONEq(t, `{"name":"resource"}`, w.Body.String())
+	})
+}
+
+func TestProxyRetries(t *testing.T) {
+	flakyServer := func(t *testing.T, fail func(w http.ResponseWriter), expectedBody string) (*httptest.Server, *int) {
+		t.Helper()
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			require.Equal(t, expectedBody, string(body), "request body not replayed at attempt %d", attempts)
+			require.Empty(t, r.Header.Get(ProxyRetryHeaderKey), "retries opt in must not be proxied")
+			if attempts == 1 {
+				fail(w)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		t.Cleanup(server.Close)
+		return server, &attempts
+	}
+	unavailable := func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }
+	resetConnection := func(w http.ResponseWriter) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	opaModule := &OPAModuleConfig{Name: "example.rego", Content: "package policies\ntodo { true }"}
+	permission := &RondConfig{RequestFlow: RequestFlow{PolicyName: "todo"}}
+	oas := &OpenAPISpec{Paths: OpenAPIPaths{"/api": PathVerbs{"all": VerbConfig{PermissionV2: permission}}}}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, envs)
+	require.NoError(t, err)
+
+	proxyRequest := func(t *testing.T, server *httptest.Server, retries int, req *http.Request) *httptest.ResponseRecorder {
+		t.Helper()
+		serverURL, _ := url.Parse(server.URL)
+		env := config.EnvironmentVariables{
+			TargetServiceHost: serverURL.Host,
+			ProxyRetries:      retries,
+			ProxyRetryBackoff: time.Millisecond,
+		}
+		ctx := createContext(t, context.Background(), env, nil, permission, opaModule, partialEvaluators)
+		ctx = context.WithValue(ctx, targetServiceTransportKey{}, newPooledTransport(env))
+		w := httptest.NewRecorder()
+		rbacHandler(w, req.WithContext(ctx))
+		return w
+	}
+
+	testCases := []struct {
+		name             string
+		method           string
+		body             string
+		headers          map[string]string
+		fail             func(w http.ResponseWriter)
+		retries          int
+		expectedStatus   int
+		expectedAttempts int
+	}{
+		{name: "retries GET on unavailable target service", method: http.MethodGet, fail: unavailable, retries: 2, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "retries GET on connection reset", method: http.MethodGet, fail: resetConnection, retries: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "replays PUT body", method: http.MethodPut, body: `{"name":"resource"}`, fail: unavailable, retries: 1, expectedStatus: http.StatusOK, expectedAttempts: 2},
+		{name: "does not retry without configured retries", method: http.MethodGet, fail: unavailable, expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 1},
+		{
+			name:             "does not proxy the opt in without configured retries",
+			method:           http.MethodPost,
+			headers:          map[string]string{ProxyRetryHeaderKey: "true"},
+			fail:             unavailable,
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+		},
+		{name: "does not retry POST", method: http.MethodPost, body: `{"name":"resource"}`, fail: unavailable, retries: 1, expectedStatus: http.StatusServiceUnavailable, expectedAttempts: 1},
+		{
+			name:             "retries POST opted in with header",
+			method:           http.MethodPost,
+			body:             `{"name":"resource"}`,
+			headers:          map[string]string{ProxyRetryHeaderKey: "true"},
+			fail:             unavailable,
+			retries:          1,
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 2,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server, attempts := flakyServer(t, testCase.fail, testCase.body)
+
+			req := httptest.NewRequest(testCase.method, "http://www.example.com:8080/api", strings.NewReader(testCase.body))
+			for key, value := range testCase.headers {
+				req.Header.Set(key, value)
+			}
+			w := proxyRequest(t, server, testCase.retries, req)
+
+			require.Equal(t, testCase.expectedStatus, w.Result().StatusCode)
+			require.Equal(t, testCase.expectedAttempts, *attempts)
+		})
+	}
+
+	t.Run("surfaces the error after the last retry", func(t *testing.T) {
+		attempts := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+
+		w := proxyRequest(t, server, 2, httptest.NewRequest(http.MethodGet, "http://www.example.com:8080/api", nil))
+
+		require.Equal(t, http.StatusBadGateway, w.Result().StatusCode)
+		require.Equal(t, 3, attempts)
+	})
+}
+
+func TestIsTransientFailure(t *testing.T) {
+	connectionError := func(errno syscall.Errno) error {
+		return &url.Error{Op: "Get", URL: "http://target", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}}
+	}
+
+	require.True(t, isTransientFailure(nil, connectionError(syscall.ECONNREFUSED)))
+	require.True(t, isTransientFailure(nil, connectionError(syscall.ECONNRESET)))
+	require.True(t, isTransientFailure(nil, io.ErrUnexpectedEOF))
+	require.False(t, isTransientFailure(nil, connectionError(syscall.EACCES)))
+	require.True(t, isTransientFailure(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+	require.False(t, isTransientFailure(&http.Response{StatusCode: http.StatusInternalServerError}, nil))
+}
+
+func TestProxyRetryBackoff(t *testing.T) {
+	require.Equal(t, defaultProxyRetryBackoff, proxyRetryBackoff(0, 1))
+	require.Equal(t, 10*time.Millisecond, proxyRetryBackoff(10*time.Millisecond, 1))
+	require.Equal(t, 40*time.Millisecond, proxyRetryBackoff(10*time.Millisecond, 3))
+	require.Equal(t, maxProxyRetryBackoff, proxyRetryBackoff(time.Second, 10))
+}
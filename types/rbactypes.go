@@ -16,6 +16,7 @@ package types
 
 import (
 	"context"
+	"time"
 )
 
 type User struct {
@@ -23,6 +24,7 @@ type User struct {
 	UserGroups   []string
 	UserRoles    []Role
 	UserBindings []Binding
+	Tenant       string
 }
 
 type MongoClientContextKey struct{}
@@ -40,6 +42,9 @@ type Binding struct {
 	Subjects          []string  `bson:"subjects" json:"subjects,omitempty"`
 	Permissions       []string  `bson:"permissions" json:"permissions,omitempty"`
 	Roles             []string  `bson:"roles" json:"roles,omitempty"`
+	// ValidFrom and ValidUntil bound the validity of the binding, which is unbounded when not set.
+	ValidFrom  *time.Time `bson:"validFrom,omitempty" json:"validFrom,omitempty"`
+	ValidUntil *time.Time `bson:"validUntil,omitempty" json:"validUntil,omitempty"`
 }
 
 type BindingFilter struct {
@@ -65,17 +70,23 @@ type Role struct {
 // mongo Collection reference in request contexts.
 type IMongoClient interface {
 	Disconnect() error
+	HealthCheck(ctx context.Context) error
 
 	RetrieveUserBindings(ctx context.Context, user *User) ([]Binding, error)
 	RetrieveRoles(ctx context.Context) ([]Role, error)
 	RetrieveUserRolesByRolesID(ctx context.Context, userRolesId []string) ([]Role, error)
 
-	FindOne(ctx context.Context, collectionName string, query map[string]interface{}) (interface{}, error)
-	FindMany(ctx context.Context, collectionName string, query map[string]interface{}) ([]interface{}, error)
+	FindOne(ctx context.Context, collectionName string, query, projection map[string]interface{}) (interface{}, error)
+	FindMany(ctx context.Context, collectionName string, query, projection map[string]interface{}) ([]interface{}, error)
+	FindManyPaginated(ctx context.Context, collectionName string, query map[string]interface{}, skip, limit int64) ([]interface{}, error)
+	CountDocuments(ctx context.Context, collectionName string, query map[string]interface{}) (int64, error)
 }
 
 type RequestError struct {
 	Error      string `json:"error"`
 	Message    string `json:"message"`
 	StatusCode int    `json:"statusCode"`
+	RequestID  string `json:"requestId,omitempty"`
+	// Reason is the machine-readable reason of a denial, as returned by the allow policy.
+	Reason string `json:"reason,omitempty"`
 }
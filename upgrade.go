@@ -0,0 +1,78 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/internal/utils"
+)
+
+type upgradeHijackerKey struct{}
+
+// UpgradeHijackerMiddleware stores in the request context the hijacker of the client connection
+// of protocol upgrade requests, such as the WebSocket ones. The middleware must precede the ones
+// wrapping the response writer, so that the connection can be switched once the request is allowed.
+func UpgradeHijackerMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hijacker, ok := w.(http.Hijacker); ok && isUpgradeRequest(r) {
+				r = r.WithContext(context.WithValue(r.Context(), upgradeHijackerKey{}, hijacker))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isUpgradeRequest reports whether the request asks to switch protocol, e.g. with the
+// Connection: Upgrade and Upgrade: websocket headers.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range utils.SplitHeaderValues(value, ",") {
+			if strings.EqualFold(token, "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeResponseWriter hijacks the client connection through the hijacker found in context,
+// since the response writers wrapped by the middlewares do not support it.
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+}
+
+func (w *upgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijacker.Hijack()
+}
+
+// upgradableResponseWriter returns a response writer able to switch the protocol of the
+// client connection, if its hijacker is found in the request context.
+func upgradableResponseWriter(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if hijacker, ok := req.Context().Value(upgradeHijackerKey{}).(http.Hijacker); ok {
+		return &upgradeResponseWriter{ResponseWriter: w, hijacker: hijacker}
+	}
+	return w
+}
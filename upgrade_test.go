@@ -0,0 +1,154 @@
+// Copyright 2021 Mia srl
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mia-platform/glogger/v2"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsUpgradeRequest(t *testing.T) {
+	testCases := []struct {
+		name       string
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		{name: "websocket upgrade", connection: "Upgrade", upgrade: "websocket", expected: true},
+		{name: "upgrade among connection tokens", connection: "keep-alive, upgrade", upgrade: "websocket", expected: true},
+		{name: "missing upgrade header", connection: "Upgrade", expected: false},
+		{name: "missing connection upgrade token", connection: "keep-alive", upgrade: "websocket", expected: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			req.Header.Set("Connection", testCase.connection)
+			if testCase.upgrade != "" {
+				req.Header.Set("Upgrade", testCase.upgrade)
+			}
+			require.Equal(t, testCase.expected, isUpgradeRequest(req))
+		})
+	}
+}
+
+func TestProxyUpgradeRequest(t *testing.T) {
+	echoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(bufrw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		bufrw.Flush()
+		buffer := make([]byte, 1024)
+		for {
+			n, err := bufrw.Read(buffer)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buffer[:n]); err != nil {
+				return
+			}
+		}
+	}))
+	defer echoServer.Close()
+	echoServerURL, _ := url.Parse(echoServer.URL)
+
+	opaModule := &OPAModuleConfig{
+		Name: "example.rego",
+		Content: `package policies
+allow { input.request.headers["X-Allowed"][0] == "true" }
+response_policy [body] { body := {"filtered": true} }`,
+	}
+	permission := &RondConfig{
+		RequestFlow:  RequestFlow{PolicyName: "allow"},
+		ResponseFlow: ResponseFlow{PolicyName: "response_policy"},
+	}
+	oas := &OpenAPISpec{
+		Paths: OpenAPIPaths{
+			"/ws": PathVerbs{"get": VerbConfig{PermissionV2: permission}},
+		},
+	}
+	env := config.EnvironmentVariables{TargetServiceHost: echoServerURL.Host}
+	partialEvaluators, err := setupEvaluators(context.Background(), nil, oas, opaModule, env)
+	require.NoError(t, err)
+
+	log, _ := test.NewNullLogger()
+	rondServer := httptest.NewServer(UpgradeHijackerMiddleware()(glogger.RequestMiddlewareLogger(log, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := createContext(t, r.Context(), env, nil, permission, opaModule, partialEvaluators)
+		ctx = context.WithValue(ctx, targetServiceTransportKey{}, newPooledTransport(env))
+		rbacHandler(w, r.WithContext(ctx))
+	}))))
+	defer rondServer.Close()
+
+	upgrade := func(t *testing.T, allowed string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", rondServer.Listener.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		req, err := http.NewRequest(http.MethodGet, rondServer.URL+"/ws", nil)
+		require.NoError(t, err)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("X-Allowed", allowed)
+		require.NoError(t, req.Write(conn))
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		require.NoError(t, err)
+		return conn, reader, resp
+	}
+
+	t.Run("round-trips messages once allowed", func(t *testing.T) {
+		conn, reader, resp := upgrade(t, "true")
+		defer conn.Close()
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		require.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+		for _, message := range []string{"hello", "world"} {
+			_, err := conn.Write([]byte(message))
+			require.NoError(t, err)
+			echoed := make([]byte, len(message))
+			_, err = io.ReadFull(reader, echoed)
+			require.NoError(t, err)
+			require.Equal(t, message, string(echoed))
+		}
+	})
+
+	t.Run("rejects the upgrade when not allowed", func(t *testing.T) {
+		conn, _, resp := upgrade(t, "false")
+		defer conn.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
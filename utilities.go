@@ -17,16 +17,55 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"path"
 	"strings"
 
+	"github.com/gorilla/mux"
+	"github.com/rond-authz/rond/internal/config"
+	"github.com/rond-authz/rond/internal/utils"
 	"github.com/rond-authz/rond/types"
 )
 
 const ContentTypeHeaderKey = "content-type"
+const ContentEncodingHeaderKey = "Content-Encoding"
 const JSONContentTypeHeader = "application/json"
+const TextContentTypeHeader = "text/plain; charset=utf-8"
+const XForwardedForHeaderKey = "X-Forwarded-For"
+const XForwardedHostHeaderKey = "X-Forwarded-Host"
+const XForwardedProtoHeaderKey = "X-Forwarded-Proto"
+const DebugInputHeaderKey = "X-Rond-Debug-Input"
+const DebugProfileHeaderKey = "X-Rond-Profile"
 
+// hasApplicationJSONContentType reports whether the content type is application/json or
+// a structured syntax JSON type, such as application/vnd.api+json, ignoring its parameters.
 func hasApplicationJSONContentType(headers http.Header) bool {
-	return strings.HasPrefix(headers.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
+	mediaType := strings.Split(headers.Get(ContentTypeHeaderKey), ";")[0]
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == JSONContentTypeHeader {
+		return true
+	}
+	return strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
+
+// defaultResponseContentTypes are the content types of the responses filtered by the response policy,
+// unless configured otherwise.
+var defaultResponseContentTypes = []string{JSONContentTypeHeader, "application/*+json"}
+
+// hasFilterableContentType reports whether the response content type, ignoring its parameters, matches
+// one of the configured patterns, meaning the response must be filtered by the response policy.
+func hasFilterableContentType(headers http.Header, env config.EnvironmentVariables) bool {
+	patterns := utils.SplitHeaderValues(env.ResponseContentTypes, ",")
+	if len(patterns) == 0 {
+		patterns = defaultResponseContentTypes
+	}
+	mediaType := strings.Split(headers.Get(ContentTypeHeaderKey), ";")[0]
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+	return false
 }
 
 func failResponse(w http.ResponseWriter, technicalError, businessError string) {
@@ -34,12 +73,27 @@ func failResponse(w http.ResponseWriter, technicalError, businessError string) {
 }
 
 func failResponseWithCode(w http.ResponseWriter, statusCode int, technicalError, businessError string) {
+	failResponseWithReason(w, statusCode, technicalError, businessError, "")
+}
+
+// failResponseWithReason responds like failResponseWithCode, adding the reason of a policy denial.
+func failResponseWithReason(w http.ResponseWriter, statusCode int, technicalError, businessError, reason string) {
+	if responseErrorFormat(w) == config.ErrorResponseFormatText {
+		w.Header().Set(ContentTypeHeaderKey, TextContentTypeHeader)
+		w.WriteHeader(statusCode)
+		//#nosec G104 -- Intended to avoid disruptive code changes
+		w.Write([]byte(businessError))
+		return
+	}
+
 	w.Header().Set(ContentTypeHeaderKey, JSONContentTypeHeader)
 	w.WriteHeader(statusCode)
 	content, err := json.Marshal(types.RequestError{
 		StatusCode: statusCode,
 		Error:      technicalError,
 		Message:    businessError,
+		RequestID:  responseRequestID(w),
+		Reason:     reason,
 	})
 	if err != nil {
 		return
@@ -49,11 +103,45 @@ func failResponseWithCode(w http.ResponseWriter, statusCode int, technicalError,
 	w.Write(content)
 }
 
-func unmarshalHeader(headers http.Header, headerKey string, v interface{}) (bool, error) {
-	headerValueStringified := headers.Get(headerKey)
-	if headerValueStringified != "" {
-		err := json.Unmarshal([]byte(headerValueStringified), &v)
-		return err == nil, err
+// ErrorResponseFormatMiddleware makes the configured format available to the functions writing
+// error responses, which only receive the response writer. The middleware must follow the glogger
+// one, whose response writer cannot be unwrapped.
+func ErrorResponseFormatMiddleware(format string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if format == "" || format == config.ErrorResponseFormatJSON {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&errorFormatResponseWriter{ResponseWriter: w, format: format}, r)
+		})
+	}
+}
+
+type errorFormatResponseWriter struct {
+	http.ResponseWriter
+	format string
+}
+
+func (w *errorFormatResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *errorFormatResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// responseErrorFormat returns the format of the error responses, JSON unless configured otherwise.
+func responseErrorFormat(w http.ResponseWriter) string {
+	for {
+		switch typedWriter := w.(type) {
+		case *errorFormatResponseWriter:
+			return typedWriter.format
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = typedWriter.Unwrap()
+		default:
+			return config.ErrorResponseFormatJSON
+		}
 	}
-	return false, nil
 }
@@ -21,50 +21,63 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/rond-authz/rond/internal/config"
 	"github.com/rond-authz/rond/types"
 
 	"gotest.tools/v3/assert"
 )
 
-func TestUnmarshalHeader(t *testing.T) {
-	userPropertiesHeaderKey := "miauserproperties"
-	mockedUserProperties := map[string]interface{}{
-		"my":  "other",
-		"key": []string{"is", "not"},
+func TestHasApplicationJSONContentType(t *testing.T) {
+	testCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "application/json", expected: true},
+		{contentType: "application/json;charset=UTF-8", expected: true},
+		{contentType: "Application/JSON; charset=utf-8", expected: true},
+		{contentType: "application/vnd.api+json", expected: true},
+		{contentType: "application/ld+json;charset=utf-8", expected: true},
+		{contentType: "application/problem+json", expected: true},
+		{contentType: "text/plain", expected: false},
+		{contentType: "application/xml", expected: false},
+		{contentType: "text/vnd.custom+json", expected: false},
+		{contentType: "application/jsonp", expected: false},
+		{contentType: "", expected: false},
 	}
-	mockedUserPropertiesStringified, err := json.Marshal(mockedUserProperties)
-	assert.NilError(t, err)
-
-	t.Run("header not exists", func(t *testing.T) {
-		headers := http.Header{}
-		var userProperties map[string]interface{}
-
-		ok, err := unmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
-
-		assert.Assert(t, !ok, "Unmarshal not existing header")
-		assert.NilError(t, err, "Unexpected error if doesn't exist header")
-	})
-
-	t.Run("header exists but the unmarshalling fails", func(t *testing.T) {
-		headers := http.Header{}
-		headers.Set(userPropertiesHeaderKey, string(mockedUserPropertiesStringified))
-		var userProperties string
 
-		ok, err := unmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
-
-		assert.Assert(t, !ok, "Unexpected success during unmarshalling")
-		assert.ErrorType(t, err, &json.UnmarshalTypeError{}, "Unexpected error on unmarshalling")
-	})
+	for _, testCase := range testCases {
+		t.Run(testCase.contentType, func(t *testing.T) {
+			headers := http.Header{}
+			headers.Set(ContentTypeHeaderKey, testCase.contentType)
+			assert.Equal(t, hasApplicationJSONContentType(headers), testCase.expected)
+		})
+	}
+}
 
-	t.Run("header exists and unmarshalling finishes correctly", func(t *testing.T) {
-		headers := http.Header{}
-		headers.Set(userPropertiesHeaderKey, string(mockedUserPropertiesStringified))
-		var userProperties map[string]interface{}
+func TestHasFilterableContentType(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		responseContentTypes string
+		contentType          string
+		expected             bool
+	}{
+		{name: "json by default", contentType: "application/json; charset=utf-8", expected: true},
+		{name: "structured json by default", contentType: "application/vnd.api+json", expected: true},
+		{name: "csv not by default", contentType: "text/csv", expected: false},
+		{name: "missing content type", contentType: "", expected: false},
+		{name: "configured content type", responseContentTypes: "application/json, text/csv", contentType: "Text/CSV", expected: true},
+		{name: "configured wildcard", responseContentTypes: "application/*", contentType: "application/xml", expected: true},
+		{name: "json not configured", responseContentTypes: "text/csv", contentType: "application/json", expected: false},
+	}
 
-		ok, err := unmarshalHeader(headers, userPropertiesHeaderKey, &userProperties)
-		assert.Assert(t, ok, "Unexpected failure")
-		assert.NilError(t, err, "Unexpected error")
-	})
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			headers := http.Header{}
+			headers.Set(ContentTypeHeaderKey, testCase.contentType)
+			env := config.EnvironmentVariables{ResponseContentTypes: testCase.responseContentTypes}
+			assert.Equal(t, hasFilterableContentType(headers, env), testCase.expected)
+		})
+	}
 }
 
 func TestFailResponseWithCode(t *testing.T) {
@@ -88,3 +101,77 @@ func TestFailResponseWithCode(t *testing.T) {
 		Message:    "The Message",
 	})
 }
+
+func TestFailResponseWithCodeSendsContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failResponseWithCode(w, http.StatusForbidden, "The Error", "The Message")
+	}))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	assert.Equal(t, resp.Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
+}
+
+func TestErrorResponseFormatMiddleware(t *testing.T) {
+	failingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failResponseWithCode(w, http.StatusForbidden, "The Error", "The Message")
+	})
+
+	t.Run("json format", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(WithRequestID(r.Context(), "the-request-id"))
+
+		handler := RequestIDLoggerMiddleware()(ErrorResponseFormatMiddleware(config.ErrorResponseFormatJSON)(failingHandler))
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), JSONContentTypeHeader)
+
+		var response types.RequestError
+		err := json.NewDecoder(w.Body).Decode(&response)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, response, types.RequestError{
+			StatusCode: http.StatusForbidden,
+			Error:      "The Error",
+			Message:    "The Message",
+			RequestID:  "the-request-id",
+		})
+	})
+
+	t.Run("text format", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(WithRequestID(r.Context(), "the-request-id"))
+
+		handler := ErrorResponseFormatMiddleware(config.ErrorResponseFormatText)(RequestIDLoggerMiddleware()(failingHandler))
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, w.Result().StatusCode, http.StatusForbidden)
+		assert.Equal(t, w.Result().Header.Get(ContentTypeHeaderKey), TextContentTypeHeader)
+
+		bodyBytes, err := io.ReadAll(w.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, string(bodyBytes), "The Message")
+	})
+
+	t.Run("format and request id are found through the wrapped writers", func(t *testing.T) {
+		formatWriter := &errorFormatResponseWriter{
+			ResponseWriter: &requestIDResponseWriter{ResponseWriter: httptest.NewRecorder(), requestID: "the-request-id"},
+			format:         config.ErrorResponseFormatText,
+		}
+		assert.Equal(t, responseRequestID(formatWriter), "the-request-id")
+		assert.Equal(t, responseErrorFormat(formatWriter), config.ErrorResponseFormatText)
+
+		requestIDWriter := &requestIDResponseWriter{
+			ResponseWriter: &errorFormatResponseWriter{ResponseWriter: httptest.NewRecorder(), format: config.ErrorResponseFormatText},
+			requestID:      "the-request-id",
+		}
+		assert.Equal(t, responseRequestID(requestIDWriter), "the-request-id")
+		assert.Equal(t, responseErrorFormat(requestIDWriter), config.ErrorResponseFormatText)
+	})
+}